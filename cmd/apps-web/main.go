@@ -15,12 +15,14 @@ func main() {
 	addr := flag.String("addr", ":8090", "http listen address")
 	socialRPCSock := flag.String("social-rpc-sock", filepath.Join("..", "Assembler", "data", "assembler-p2p.sock"), "assembler local rpc unix socket path")
 	socialPassphrase := flag.String("social-passphrase", os.Getenv("SOCIAL_KEY_PASSPHRASE"), "optional social key passphrase for startup unlock")
+	ethRPC := flag.String("eth-rpc", os.Getenv("SOCIAL_ETH_RPC"), "optional ethereum json-rpc url for registry contact checks")
 	flag.Parse()
 
 	socialManager, err := social.NewManager(social.Config{
 		DataDir:       filepath.Join("data", "social"),
 		RPCSocketPath: *socialRPCSock,
 		Passphrase:    *socialPassphrase,
+		EthRPCURL:     *ethRPC,
 	})
 	if err != nil {
 		log.Fatalf("init social manager failed: %v", err)
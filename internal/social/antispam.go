@@ -0,0 +1,186 @@
+package social
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"math/bits"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSenderRequestsPerHour = 3
+	defaultGlobalRequestsPerHour = 30
+	maxRequestPoWBits            = 24
+	requestLimitWindow           = time.Hour
+	requestStampVersion          = "1"
+	requestStampSkew             = 10 * time.Minute
+)
+
+// RequestPolicy limits inbound friend requests from strangers. PoWBits asks
+// senders that are not registry contacts for a hashcash stamp of that many
+// leading zero bits; zero turns the stamp off.
+type RequestPolicy struct {
+	PerSenderPerHour int `json:"per_sender_per_hour"`
+	GlobalPerHour    int `json:"global_per_hour"`
+	PoWBits          int `json:"pow_bits"`
+}
+
+func normalizeRequestPolicy(p *RequestPolicy) *RequestPolicy {
+	out := RequestPolicy{}
+	if p != nil {
+		out = *p
+	}
+	if out.PerSenderPerHour <= 0 {
+		out.PerSenderPerHour = defaultSenderRequestsPerHour
+	}
+	if out.GlobalPerHour <= 0 {
+		out.GlobalPerHour = defaultGlobalRequestsPerHour
+	}
+	out.PoWBits = min(max(out.PoWBits, 0), maxRequestPoWBits)
+	return &out
+}
+
+// advertisedPoWBits reads the stamp difficulty a peer asks for from the
+// settings in its presence beacon.
+func advertisedPoWBits(body map[string]any) int {
+	s, _ := body["settings"].(map[string]any)
+	p, _ := s["request_policy"].(map[string]any)
+	n, _ := p["pow_bits"].(float64)
+	return min(max(int(n), 0), maxRequestPoWBits)
+}
+
+// RequestDropStats counts inbound friend requests dropped before they
+// reached the request list.
+type RequestDropStats struct {
+	Privacy      int `json:"privacy"`
+	SenderLimit  int `json:"sender_limit"`
+	GlobalLimit  int `json:"global_limit"`
+	ProofOfWork  int `json:"proof_of_work"`
+	InvalidHello int `json:"invalid_hello"`
+}
+
+// requestLimiter keeps sliding one-hour windows of accepted stranger
+// requests, per sender key and in total. It is not persisted.
+type requestLimiter struct {
+	perSender map[string][]time.Time
+	global    []time.Time
+}
+
+func newRequestLimiter() requestLimiter {
+	return requestLimiter{perSender: make(map[string][]time.Time)}
+}
+
+func pruneWindow(ts []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(ts) && !ts[i].After(cutoff) {
+		i++
+	}
+	return ts[i:]
+}
+
+// allow records one request for all senderKeys, or reports which limit
+// would be exceeded without recording anything.
+func (l *requestLimiter) allow(senderKeys []string, p *RequestPolicy, now time.Time) (senderOK, globalOK bool) {
+	cutoff := now.Add(-requestLimitWindow)
+	l.global = pruneWindow(l.global, cutoff)
+	for k, ts := range l.perSender {
+		if ts = pruneWindow(ts, cutoff); len(ts) == 0 {
+			delete(l.perSender, k)
+		} else {
+			l.perSender[k] = ts
+		}
+	}
+	for _, k := range senderKeys {
+		if len(l.perSender[k]) >= p.PerSenderPerHour {
+			return false, true
+		}
+	}
+	if len(l.global) >= p.GlobalPerHour {
+		return true, false
+	}
+	for _, k := range senderKeys {
+		l.perSender[k] = append(l.perSender[k], now)
+	}
+	l.global = append(l.global, now)
+	return true, true
+}
+
+func requestStampResource(toUser, fromUser, requestID string) string {
+	return "social-request/" + toUser + "/" + fromUser + "/" + requestID
+}
+
+func stampZeroBits(stamp string) int {
+	sum := sha256.Sum256([]byte(stamp))
+	n := 0
+	for _, b := range sum {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
+
+// mintRequestStamp finds a hashcash-style stamp
+// "ver:bits:date:resource::rand:counter" whose SHA-256 starts with nbits
+// zero bits.
+func mintRequestStamp(nbits int, resource string, now time.Time) (string, error) {
+	randRaw := make([]byte, 8)
+	if _, err := rand.Read(randRaw); err != nil {
+		return "", err
+	}
+	prefix := strings.Join([]string{requestStampVersion, strconv.Itoa(nbits), now.UTC().Format("060102150405"), resource, "", hex.EncodeToString(randRaw)}, ":") + ":"
+	for counter := uint64(0); ; counter++ {
+		stamp := prefix + strconv.FormatUint(counter, 16)
+		if stampZeroBits(stamp) >= nbits {
+			return stamp, nil
+		}
+	}
+}
+
+// verifyRequestStamp checks a stamp against the resource it has to name,
+// the required work and a freshness window.
+func verifyRequestStamp(stamp, resource string, nbits int, now time.Time) error {
+	parts := strings.Split(stamp, ":")
+	if len(parts) != 7 || parts[0] != requestStampVersion || parts[3] != resource {
+		return errors.New("invalid request stamp")
+	}
+	claimed, err := strconv.Atoi(parts[1])
+	if err != nil || claimed < nbits || stampZeroBits(stamp) < nbits {
+		return errors.New("insufficient request stamp")
+	}
+	minted, err := time.Parse("060102150405", parts[2])
+	if err != nil || minted.After(now.Add(requestStampSkew)) || now.Sub(minted) > outboxTTL {
+		return errors.New("stale request stamp")
+	}
+	return nil
+}
+
+// admitStrangerRequestLocked applies the proof-of-work and rate limits to a
+// friend request from a non-friend, counting what it drops.
+func (m *Manager) admitStrangerRequestLocked(fromUser, wallet, requestID, stamp string, isContact bool) bool {
+	p := normalizeRequestPolicy(m.profile.Settings.RequestPolicy)
+	now := time.Now().UTC()
+	if p.PoWBits > 0 && !isContact {
+		if verifyRequestStamp(stamp, requestStampResource(m.profile.UserID, fromUser, requestID), p.PoWBits, now) != nil {
+			m.requestDrops.ProofOfWork++
+			return false
+		}
+	}
+	keys := []string{"user:" + fromUser}
+	if wallet != "" {
+		keys = append(keys, "wallet:"+strings.ToLower(wallet))
+	}
+	senderOK, globalOK := m.requestLimits.allow(keys, p, now)
+	if !senderOK {
+		m.requestDrops.SenderLimit++
+	}
+	if !globalOK {
+		m.requestDrops.GlobalLimit++
+	}
+	return senderOK && globalOK
+}
@@ -0,0 +1,198 @@
+package social
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+const backupVersion = 1
+
+// identityBackup is the plaintext inside an exported backup. It is sealed
+// with the same argon2id file format as identity.enc.json.
+type identityBackup struct {
+	Version    int                        `json:"version"`
+	Kind       string                     `json:"kind"`
+	Identity   identityPlain              `json:"identity"`
+	Profile    *Profile                   `json:"profile"`
+	Friends    map[string]Friend          `json:"friends"`
+	KnownUsers map[string]KnownUser       `json:"known_users"`
+	DMs        map[string][]DirectMessage `json:"dms,omitempty"`
+	DeviceList *deviceList                `json:"device_list,omitempty"`
+	Rotations  []keyRotation              `json:"key_rotations,omitempty"`
+	Blocked    map[string]BlockedUser     `json:"blocked,omitempty"`
+	CreatedAt  time.Time                  `json:"created_at"`
+}
+
+// ExportBackup seals the identity keys, profile and friend list, plus the
+// message history when includeHistory is set. The local passphrase is
+// required and also protects the backup.
+func (m *Manager) ExportBackup(passphrase string, includeHistory bool) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.profile == nil || m.identity == nil {
+		return nil, errors.New("not initialized")
+	}
+	if !m.isPrimaryDeviceLocked() {
+		return nil, errors.New("backups can only be exported from the primary device")
+	}
+	f, err := readSealedFile(m.identityEncPath())
+	if err != nil {
+		return nil, err
+	}
+	if _, err := openWithPassphrase(f, passphrase); err != nil {
+		return nil, err
+	}
+	friends := make(map[string]Friend, len(m.friends))
+	known := make(map[string]KnownUser, len(m.friends))
+	for id, fr := range m.friends {
+		friends[id] = fr
+		if u, ok := m.knownUsers[id]; ok {
+			known[id] = u
+		}
+	}
+	b := identityBackup{
+		Version:    backupVersion,
+		Kind:       "social_backup",
+		Identity:   identityPlainFor(m.identity),
+		Profile:    m.profile,
+		Friends:    friends,
+		KnownUsers: known,
+		DeviceList: m.deviceList,
+		Rotations:  m.keyRotations,
+		Blocked:    m.blocked,
+		CreatedAt:  time.Now().UTC(),
+	}
+	if includeHistory {
+		b.DMs = m.dms
+	}
+	plain, err := json.Marshal(b)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := sealWithPassphrase(passphrase, plain)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(sealed, "", "  ")
+}
+
+// ImportBackup restores an exported backup into an empty data dir. The
+// backup passphrase becomes the local passphrase. Ratchet sessions are not
+// part of a backup, so every friend is asked for a fresh handshake; a
+// message still sealed to an old session asks again on arrival.
+func (m *Manager) ImportBackup(data []byte, passphrase, walletAddr string, includeHistory bool) (*Profile, error) {
+	walletAddr, err := m.walletNormalized(walletAddr)
+	if err != nil {
+		return nil, err
+	}
+	var f encryptedIdentityFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, errors.New("invalid backup file")
+	}
+	plain, err := openWithPassphrase(f, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	var b identityBackup
+	if err := json.Unmarshal(plain, &b); err != nil || b.Kind != "social_backup" {
+		return nil, errors.New("invalid backup contents")
+	}
+	if b.Version > backupVersion {
+		return nil, errors.New("backup version not supported")
+	}
+	id, err := identityFromBackup(b)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(b.Profile.Username, walletAddr) {
+		return nil, errors.New("wallet address does not match backup profile")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.profile != nil || m.identity != nil || m.lockedLocked() {
+		return nil, errors.New("already initialized")
+	}
+	m.resetStateLocked()
+	m.identity = id
+	m.profile = b.Profile
+	if b.Friends != nil {
+		m.friends = b.Friends
+	}
+	if b.KnownUsers != nil {
+		m.knownUsers = b.KnownUsers
+	}
+	if includeHistory && b.DMs != nil {
+		m.dms = b.DMs
+	}
+	if b.Blocked != nil {
+		m.blocked = b.Blocked
+	}
+	m.keyRotations = b.Rotations
+	for _, r := range b.Rotations {
+		m.revokeKeyLocked(r.UserID, r.OldSignPub, r.Reason)
+		m.revokeKeyLocked(r.UserID, r.OldBoxPub, r.Reason)
+	}
+	if b.DeviceList != nil && verifyDeviceList(b.Profile.SignPublicKey, b.DeviceList) {
+		m.deviceList = b.DeviceList
+	}
+	if err := m.rekeyLocked(passphrase); err != nil {
+		m.identity = nil
+		m.resetStateLocked()
+		return nil, err
+	}
+	if err := m.saveStateLocked(); err != nil {
+		return nil, err
+	}
+	m.startLoopLocked()
+	for id := range m.friends {
+		if u, ok := m.knownUsers[id]; ok && u.BoxPublicKey != "" {
+			m.requestSessionResetLocked(id, u.BoxPublicKey)
+		}
+	}
+	go m.publishPresence()
+	cp := *m.profile
+	return &cp, nil
+}
+
+// identityFromBackup rebuilds the identity and checks that the keys, user ID
+// and profile in the backup all belong together.
+func identityFromBackup(b identityBackup) (*Identity, error) {
+	if b.Profile == nil {
+		return nil, errors.New("backup profile missing")
+	}
+	signPrivRaw, err := base64.RawStdEncoding.DecodeString(b.Identity.SignPrivB64)
+	if err != nil || len(signPrivRaw) != ed25519.PrivateKeySize {
+		return nil, errors.New("invalid sign key")
+	}
+	boxPrivRaw, err := base64.RawStdEncoding.DecodeString(b.Identity.BoxPrivB64)
+	if err != nil || len(boxPrivRaw) != 32 {
+		return nil, errors.New("invalid box key")
+	}
+	signPriv := ed25519.PrivateKey(signPrivRaw)
+	signPub := signPriv.Public().(ed25519.PublicKey)
+	boxPubRaw, err := curve25519.X25519(boxPrivRaw, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	userID := b.Identity.UserID
+	if b.Profile.UserID != userID || !verifyKeyChain(userID, b.Rotations, base64.RawStdEncoding.EncodeToString(signPub)) {
+		return nil, errors.New("backup user id does not match keys")
+	}
+	profileSign, _ := base64.RawStdEncoding.DecodeString(b.Profile.SignPublicKey)
+	profileBox, _ := base64.RawStdEncoding.DecodeString(b.Profile.BoxPublicKey)
+	if !bytes.Equal(profileSign, signPub) || !bytes.Equal(profileBox, boxPubRaw) {
+		return nil, errors.New("backup profile keys do not match identity")
+	}
+	id := &Identity{UserID: userID, SignPublicKey: signPub, SignPrivate: signPriv}
+	copy(id.BoxPrivateKey[:], boxPrivRaw)
+	copy(id.BoxPublicKey[:], boxPubRaw)
+	return id, nil
+}
@@ -0,0 +1,123 @@
+package social
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+)
+
+const (
+	profileBindingDomainName    = "Assembler Social"
+	profileBindingDomainVersion = "1"
+	profileBindingMaxSkew       = 5 * time.Minute
+)
+
+// WalletBinding is an EIP-712 signature by the username wallet over the
+// profile's user ID and identity keys. Peers verify it to tell that the
+// profile really belongs to the advertised wallet.
+type WalletBinding struct {
+	Wallet    string `json:"wallet"`
+	IssuedAt  int64  `json:"issued_at"`
+	Signature string `json:"signature"`
+}
+
+// ProfileBindingTypedData is the EIP-712 payload the wallet signs with
+// eth_signTypedData_v4.
+func ProfileBindingTypedData(wallet, userID, signKey, boxKey string, issuedAt int64) apitypes.TypedData {
+	return apitypes.TypedData{
+		Types: apitypes.Types{
+			"EIP712Domain": {
+				{Name: "name", Type: "string"},
+				{Name: "version", Type: "string"},
+			},
+			"ProfileBinding": {
+				{Name: "wallet", Type: "address"},
+				{Name: "userId", Type: "string"},
+				{Name: "signKey", Type: "string"},
+				{Name: "boxKey", Type: "string"},
+				{Name: "issuedAt", Type: "uint256"},
+			},
+		},
+		PrimaryType: "ProfileBinding",
+		Domain:      apitypes.TypedDataDomain{Name: profileBindingDomainName, Version: profileBindingDomainVersion},
+		Message: apitypes.TypedDataMessage{
+			"wallet":   common.HexToAddress(wallet).Hex(),
+			"userId":   userID,
+			"signKey":  signKey,
+			"boxKey":   boxKey,
+			"issuedAt": strconv.FormatInt(issuedAt, 10),
+		},
+	}
+}
+
+// verifyProfileBinding reports whether b is a valid wallet signature binding
+// username (the wallet address) to the given user ID and keys.
+func verifyProfileBinding(b *WalletBinding, username, userID, signKey, boxKey string) bool {
+	if b == nil || !common.IsHexAddress(b.Wallet) || !strings.EqualFold(b.Wallet, username) {
+		return false
+	}
+	if b.IssuedAt <= 0 || time.Unix(b.IssuedAt, 0).After(time.Now().Add(profileBindingMaxSkew)) {
+		return false
+	}
+	hash, _, err := apitypes.TypedDataAndHash(ProfileBindingTypedData(b.Wallet, userID, signKey, boxKey, b.IssuedAt))
+	if err != nil {
+		return false
+	}
+	return verifyWalletHashSignature(b.Wallet, hash, b.Signature)
+}
+
+func verifyProfileBindingBody(raw any, username, userID, signKey, boxKey string) bool {
+	if raw == nil {
+		return false
+	}
+	var b WalletBinding
+	if remarshal(raw, &b) != nil {
+		return false
+	}
+	return verifyProfileBinding(&b, username, userID, signKey, boxKey)
+}
+
+// ProfileBindingRequest returns the typed data for the current profile, to
+// be signed by the username wallet and passed to BindWallet.
+func (m *Manager) ProfileBindingRequest() (apitypes.TypedData, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.profile == nil || m.identity == nil {
+		return apitypes.TypedData{}, errors.New("not initialized")
+	}
+	if !common.IsHexAddress(m.profile.Username) {
+		return apitypes.TypedData{}, errors.New("profile username is not a wallet address")
+	}
+	p := m.profile
+	return ProfileBindingTypedData(p.Username, p.UserID, p.SignPublicKey, p.BoxPublicKey, time.Now().UTC().Unix()), nil
+}
+
+// BindWallet stores the wallet's EIP-712 signature over the profile keys and
+// advertises it with presence.
+func (m *Manager) BindWallet(issuedAt int64, sigHex string) (*Profile, error) {
+	m.mu.Lock()
+	if m.profile == nil || m.identity == nil {
+		m.mu.Unlock()
+		return nil, errors.New("not initialized")
+	}
+	p := m.profile
+	b := &WalletBinding{Wallet: strings.ToLower(p.Username), IssuedAt: issuedAt, Signature: strings.TrimSpace(sigHex)}
+	if !verifyProfileBinding(b, p.Username, p.UserID, p.SignPublicKey, p.BoxPublicKey) {
+		m.mu.Unlock()
+		return nil, errors.New("invalid wallet binding signature")
+	}
+	p.WalletBinding = b
+	p.LastUpdatedAt = time.Now().UTC()
+	if err := m.saveStateLocked(); err != nil {
+		m.mu.Unlock()
+		return nil, err
+	}
+	cp := *p
+	m.mu.Unlock()
+	go m.publishPresence()
+	return &cp, nil
+}
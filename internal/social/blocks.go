@@ -0,0 +1,156 @@
+package social
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// BlockedUser is a user whose envelopes are dropped. The sign key and wallet
+// seen at block time are kept too, so the same person cannot come back under
+// a fresh user ID.
+type BlockedUser struct {
+	UserID        string    `json:"user_id"`
+	SignPublicKey string    `json:"sign_public_key,omitempty"`
+	WalletAddress string    `json:"wallet_address,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+func (m *Manager) blockedLocked(userID, signPub, wallet string) bool {
+	if _, ok := m.blocked[userID]; ok && userID != "" {
+		return true
+	}
+	for _, b := range m.blocked {
+		if (signPub != "" && b.SignPublicKey == signPub) || (wallet != "" && b.WalletAddress != "" && strings.EqualFold(b.WalletAddress, wallet)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Manager) mutedLocked(userID string) bool {
+	_, ok := m.muted[userID]
+	return ok
+}
+
+// BlockUser drops the friendship and any pending requests from userID
+// without telling them, and ignores everything they send from now on.
+func (m *Manager) BlockUser(userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.profile == nil || m.identity == nil {
+		return errors.New("not initialized")
+	}
+	userID = strings.TrimSpace(userID)
+	if userID == "" || userID == m.profile.UserID {
+		return errors.New("invalid user id")
+	}
+	b := BlockedUser{UserID: userID, CreatedAt: time.Now().UTC()}
+	if u, ok := m.knownUsers[userID]; ok {
+		b.SignPublicKey = u.SignPublicKey
+		if common.IsHexAddress(u.Username) {
+			b.WalletAddress = strings.ToLower(u.Username)
+		}
+	}
+	m.blocked[userID] = b
+	for id, req := range m.requests {
+		if req.FromUserID == userID && req.Status == "pending_in" {
+			delete(m.requests, id)
+		}
+	}
+	if _, ok := m.friends[userID]; ok {
+		m.removeFriendLocked(userID)
+	}
+	m.syncBlocksLocked()
+	return m.saveStateLocked()
+}
+
+func (m *Manager) UnblockUser(userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.blocked[userID]; !ok {
+		return errors.New("user not blocked")
+	}
+	delete(m.blocked, userID)
+	m.syncBlocksLocked()
+	return m.saveStateLocked()
+}
+
+// SetMuted keeps a user's messages coming in but leaves them out of the
+// unread counts.
+func (m *Manager) SetMuted(userID string, muted bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.profile == nil {
+		return errors.New("not initialized")
+	}
+	userID = strings.TrimSpace(userID)
+	if userID == "" || userID == m.profile.UserID {
+		return errors.New("invalid user id")
+	}
+	if muted {
+		m.muted[userID] = time.Now().UTC()
+	} else {
+		delete(m.muted, userID)
+	}
+	m.syncBlocksLocked()
+	return m.saveStateLocked()
+}
+
+// Unfriend removes a friend and sends them an encrypted friend_removed
+// notice on a best-effort basis. The conversation history stays.
+func (m *Manager) Unfriend(userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.profile == nil || m.identity == nil {
+		return errors.New("not initialized")
+	}
+	if _, ok := m.friends[userID]; !ok {
+		return errors.New("target is not a friend")
+	}
+	m.removeFriendLocked(userID)
+	if target, ok := m.knownUsers[userID]; ok {
+		payload := map[string]any{
+			"type":         "friend_removed",
+			"from_user_id": m.profile.UserID,
+			"created_at":   time.Now().UTC().Format(time.RFC3339Nano),
+		}
+		if wire, err := m.buildSecureEnvelopeLocked(inboxTopic(userID), target.BoxPublicKey, payload); err == nil {
+			if err := m.sendDirectWireLocked(userID, wire); err != nil {
+				_ = m.publishSecureBytesLocked(inboxTopic(userID), wire)
+			}
+			m.fanoutLocked(userID, payload)
+		}
+	}
+	return m.saveStateLocked()
+}
+
+func (m *Manager) removeFriendLocked(userID string) {
+	delete(m.friends, userID)
+	m.syncOwnDevicesLocked("friend_removed", map[string]any{"peer_user_id": userID})
+}
+
+func (m *Manager) syncBlocksLocked() {
+	m.syncOwnDevicesLocked("blocks", map[string]any{"blocked": m.blocked, "muted": m.muted})
+}
+
+func (m *Manager) blockedSnapshotLocked() []BlockedUser {
+	out := make([]BlockedUser, 0, len(m.blocked))
+	for _, b := range m.blocked {
+		out = append(out, b)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out
+}
+
+func (m *Manager) mutedSnapshotLocked() []string {
+	out := make([]string, 0, len(m.muted))
+	for id := range m.muted {
+		out = append(out, id)
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,135 @@
+package social
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	maxFriendAliasLen = 64
+	maxFriendNoteLen  = 2000
+	maxFriendTags     = 20
+	maxFriendTagLen   = 32
+)
+
+// FriendPatch changes how a friend is organized locally. Nil fields are left
+// alone; none of it is ever sent to the friend.
+type FriendPatch struct {
+	Alias    *string   `json:"alias,omitempty"`
+	Note     *string   `json:"note,omitempty"`
+	Tags     *[]string `json:"tags,omitempty"`
+	Favorite *bool     `json:"favorite,omitempty"`
+}
+
+// ContactGroup lists the friends carrying one tag.
+type ContactGroup struct {
+	Tag     string   `json:"tag"`
+	UserIDs []string `json:"user_ids"`
+}
+
+// normalizeTags trims tags, drops empty ones and case-insensitive duplicates,
+// and sorts what is left.
+func normalizeTags(tags []string) ([]string, error) {
+	seen := make(map[string]bool, len(tags))
+	out := make([]string, 0, len(tags))
+	for _, t := range tags {
+		t = strings.TrimSpace(t)
+		key := strings.ToLower(t)
+		if t == "" || seen[key] {
+			continue
+		}
+		if utf8.RuneCountInString(t) > maxFriendTagLen || strings.ContainsAny(t, "\r\n") {
+			return nil, errors.New("invalid tag")
+		}
+		seen[key] = true
+		out = append(out, t)
+	}
+	if len(out) > maxFriendTags {
+		return nil, errors.New("too many tags")
+	}
+	sort.Slice(out, func(i, j int) bool { return strings.ToLower(out[i]) < strings.ToLower(out[j]) })
+	return out, nil
+}
+
+// UpdateFriend applies a patch to a friend's alias, note, tags and favorite
+// mark.
+func (m *Manager) UpdateFriend(userID string, p FriendPatch) (*Friend, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.profile == nil {
+		return nil, errors.New("not initialized")
+	}
+	f, ok := m.friends[userID]
+	if !ok {
+		return nil, errors.New("target is not a friend")
+	}
+	if p.Alias != nil {
+		alias := strings.TrimSpace(*p.Alias)
+		if utf8.RuneCountInString(alias) > maxFriendAliasLen {
+			return nil, errors.New("alias too long")
+		}
+		f.Alias = alias
+	}
+	if p.Note != nil {
+		note := strings.TrimSpace(*p.Note)
+		if utf8.RuneCountInString(note) > maxFriendNoteLen {
+			return nil, errors.New("note too long")
+		}
+		f.Note = note
+	}
+	if p.Tags != nil {
+		tags, err := normalizeTags(*p.Tags)
+		if err != nil {
+			return nil, err
+		}
+		f.Tags = tags
+	}
+	if p.Favorite != nil {
+		f.Favorite = *p.Favorite
+	}
+	m.friends[userID] = f
+	if err := m.saveStateLocked(); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// addFriendLocked records a friendship. An existing entry is kept as is, so
+// a re-delivered acceptance does not wipe its alias, notes or verification.
+func (m *Manager) addFriendLocked(userID string, at time.Time) {
+	if _, ok := m.friends[userID]; !ok {
+		m.friends[userID] = Friend{UserID: userID, CreatedAt: at}
+	}
+}
+
+// contactGroupsSnapshotLocked groups friends by tag, tags sorted by name.
+// Tags differing only in case share a group, named as the first friend in
+// ID order spells it.
+func (m *Manager) contactGroupsSnapshotLocked() []ContactGroup {
+	ids := make([]string, 0, len(m.friends))
+	for id := range m.friends {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	byTag := make(map[string]*ContactGroup)
+	for _, id := range ids {
+		for _, t := range m.friends[id].Tags {
+			key := strings.ToLower(t)
+			g, ok := byTag[key]
+			if !ok {
+				g = &ContactGroup{Tag: t}
+				byTag[key] = g
+			}
+			g.UserIDs = append(g.UserIDs, id)
+		}
+	}
+	out := make([]ContactGroup, 0, len(byTag))
+	for _, g := range byTag {
+		out = append(out, *g)
+	}
+	sort.Slice(out, func(i, j int) bool { return strings.ToLower(out[i].Tag) < strings.ToLower(out[j].Tag) })
+	return out
+}
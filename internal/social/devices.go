@@ -0,0 +1,791 @@
+package social
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"Assembler-Apps/internal/localrpcclient"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	deviceLinkTTL   = 10 * time.Minute
+	topicLinkPrefix = "app.social.v1.link."
+
+	deviceJoinWaiting = "waiting"
+	deviceJoinLinked  = "linked"
+	deviceJoinExpired = "expired"
+)
+
+// Device is one installation of an identity. All devices share the ed25519
+// identity key; each has its own box key and signed prekey so peers run a
+// ratchet session with every device separately. The primary device's box
+// key is the account box key, which keeps peers that do not know about
+// devices working.
+type Device struct {
+	DeviceID        string    `json:"device_id"`
+	Name            string    `json:"name,omitempty"`
+	BoxPublicKey    string    `json:"box_public_key"`
+	Primary         bool      `json:"primary,omitempty"`
+	AddedAt         time.Time `json:"added_at"`
+	PeerID          string    `json:"peer_id,omitempty"`
+	LastSeenAt      time.Time `json:"last_seen_at,omitempty"`
+	PrekeyID        string    `json:"prekey_id,omitempty"`
+	PrekeyPublic    string    `json:"prekey_public,omitempty"`
+	PrekeySignature string    `json:"prekey_sig,omitempty"`
+}
+
+// deviceList is signed with the identity key; PeerID, LastSeenAt and the
+// prekey are local observations and not covered by the signature. Prekeys
+// carry their own signature.
+type deviceList struct {
+	Version int      `json:"version"`
+	Devices []Device `json:"devices"`
+	Sig     string   `json:"sig"`
+}
+
+// deviceLink is a pairing offer held by the primary until a new device
+// answers it or it expires.
+type deviceLink struct {
+	Secret    []byte
+	ExpiresAt time.Time
+}
+
+// deviceJoin is the new device's side of a pairing in progress.
+type deviceJoin struct {
+	LinkID     string
+	UserID     string
+	SignPublic ed25519.PublicKey
+	Secret     []byte
+	DevicePriv []byte
+	DevicePub  []byte
+	Name       string
+	ExpiresAt  time.Time
+	State      string
+
+	passphrase string
+	cancel     context.CancelFunc
+}
+
+type deviceBundle struct {
+	UserID     string                     `json:"user_id"`
+	SignPriv   string                     `json:"sign_priv"`
+	Profile    *Profile                   `json:"profile"`
+	Friends    map[string]Friend          `json:"friends"`
+	KnownUsers map[string]KnownUser       `json:"known_users"`
+	DMs        map[string][]DirectMessage `json:"dms"`
+	DeviceList *deviceList                `json:"device_list"`
+	Rotations  []keyRotation              `json:"key_rotations,omitempty"`
+}
+
+func linkTopic(linkID string) string { return topicLinkPrefix + linkID }
+
+func deviceIDFor(boxPub []byte) string {
+	h := sha256.Sum256(append([]byte("social-device:"), boxPub...))
+	return "d_" + hex.EncodeToString(h[:8])
+}
+
+func userIDForSignKey(signPub ed25519.PublicKey) string {
+	h := sha256.Sum256(append([]byte("social-user:"), signPub...))
+	return "u_" + hex.EncodeToString(h[:8])
+}
+
+func (m *Manager) deviceIDLocked() string {
+	if m.identity == nil {
+		return ""
+	}
+	return deviceIDFor(m.identity.BoxPublicKey[:])
+}
+
+func (m *Manager) isPrimaryDeviceLocked() bool {
+	return m.profile != nil && m.identity != nil &&
+		m.profile.BoxPublicKey == base64.RawStdEncoding.EncodeToString(m.identity.BoxPublicKey[:])
+}
+
+func deviceListSigningInput(version int, devices []Device) []byte {
+	type entry struct {
+		ID      string `json:"id"`
+		Box     string `json:"box"`
+		Name    string `json:"name"`
+		Primary bool   `json:"primary"`
+		Added   int64  `json:"added"`
+	}
+	entries := make([]entry, 0, len(devices))
+	for _, d := range devices {
+		entries = append(entries, entry{ID: d.DeviceID, Box: d.BoxPublicKey, Name: d.Name, Primary: d.Primary, Added: d.AddedAt.Unix()})
+	}
+	b, _ := json.Marshal(map[string]any{"domain": "social-device-list-v1", "version": version, "devices": entries})
+	return b
+}
+
+func verifyDeviceList(signPubB64 string, l *deviceList) bool {
+	if l == nil || l.Version <= 0 || len(l.Devices) == 0 {
+		return false
+	}
+	signPub, err := base64.RawStdEncoding.DecodeString(signPubB64)
+	if err != nil || len(signPub) != ed25519.PublicKeySize {
+		return false
+	}
+	sig, err := base64.RawStdEncoding.DecodeString(l.Sig)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(ed25519.PublicKey(signPub), deviceListSigningInput(l.Version, l.Devices), sig)
+}
+
+func (m *Manager) setDeviceListLocked(devices []Device) {
+	version := 1
+	if m.deviceList != nil {
+		version = m.deviceList.Version + 1
+	}
+	sig := ed25519.Sign(m.identity.SignPrivate, deviceListSigningInput(version, devices))
+	m.deviceList = &deviceList{Version: version, Devices: devices, Sig: base64.RawStdEncoding.EncodeToString(sig)}
+}
+
+// ensureDeviceListLocked gives a primary that predates device linking a
+// single-entry list naming itself.
+func (m *Manager) ensureDeviceListLocked() bool {
+	if m.deviceList != nil || !m.isPrimaryDeviceLocked() {
+		return false
+	}
+	m.setDeviceListLocked([]Device{{
+		DeviceID:     m.deviceIDLocked(),
+		Name:         "primary",
+		BoxPublicKey: m.profile.BoxPublicKey,
+		Primary:      true,
+		AddedAt:      m.profile.InitializedAt.UTC(),
+	}})
+	return true
+}
+
+func (m *Manager) ownDevicesLocked() []Device {
+	if m.deviceList == nil {
+		return nil
+	}
+	return m.deviceList.Devices
+}
+
+// CreateDeviceLink returns a pairing token, normally shown as a QR code,
+// that lets a new device join this identity. The token is signed with the
+// identity key and carries a one-time secret that authenticates the reply.
+func (m *Manager) CreateDeviceLink() (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.profile == nil || m.identity == nil {
+		return "", errors.New("not initialized")
+	}
+	if !m.isPrimaryDeviceLocked() {
+		return "", errors.New("devices can only be linked from the primary device")
+	}
+	if m.ensureDeviceListLocked() {
+		_ = m.saveStateLocked()
+	}
+	idRaw := make([]byte, 12)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(idRaw); err != nil {
+		return "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	linkID := hex.EncodeToString(idRaw)
+	expires := time.Now().UTC().Add(deviceLinkTTL)
+	m.deviceLinks[linkID] = deviceLink{Secret: secret, ExpiresAt: expires}
+	m.resubscribeLocked()
+	payload := map[string]any{
+		"v":          1,
+		"kind":       "device_link",
+		"user_id":    m.profile.UserID,
+		"sign_pub":   m.profile.SignPublicKey,
+		"link_id":    linkID,
+		"secret":     base64.RawStdEncoding.EncodeToString(secret),
+		"expires_at": expires.Unix(),
+	}
+	if len(m.keyRotations) > 0 {
+		payload["key_rotations"] = m.keyRotations
+	}
+	body, _ := json.Marshal(payload)
+	sig := ed25519.Sign(m.identity.SignPrivate, body)
+	return base64.RawURLEncoding.EncodeToString(body) + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func deviceLinkMAC(secret []byte, linkID, deviceID, boxPubB64 string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("social-device-link-v1|" + linkID + "|" + deviceID + "|" + boxPubB64))
+	return base64.RawStdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func deviceLinkKey(shared, secret []byte, linkID string) []byte {
+	out := make([]byte, 32)
+	_, _ = io.ReadFull(hkdf.New(sha256.New, shared, secret, []byte("social-device-link-v1|"+linkID)), out)
+	return out
+}
+
+func (m *Manager) handleDeviceLinkRecord(body map[string]any) {
+	if asString(body["type"]) != "device_link_request" {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	reply, err := m.acceptDeviceLinkLocked(body)
+	if err != nil {
+		return
+	}
+	_ = m.publishPlain(linkTopic(asString(reply["link_id"])), reply)
+	_ = m.saveStateLocked()
+	go m.publishPresence()
+}
+
+// acceptDeviceLinkLocked registers the requesting device and returns the
+// reply carrying the identity key and a sync bundle, sealed to the device's
+// box key and the link secret.
+func (m *Manager) acceptDeviceLinkLocked(body map[string]any) (map[string]any, error) {
+	if m.profile == nil || m.identity == nil {
+		return nil, errors.New("not initialized")
+	}
+	linkID := asString(body["link_id"])
+	link, ok := m.deviceLinks[linkID]
+	if !ok {
+		return nil, errors.New("unknown device link")
+	}
+	if time.Now().After(link.ExpiresAt) {
+		delete(m.deviceLinks, linkID)
+		m.resubscribeLocked()
+		return nil, errors.New("device link expired")
+	}
+	boxPubB64 := asString(body["box_public_key"])
+	boxPub, err := decodeKey32(boxPubB64)
+	if err != nil {
+		return nil, err
+	}
+	deviceID := deviceIDFor(boxPub[:])
+	if asString(body["device_id"]) != deviceID {
+		return nil, errors.New("device id mismatch")
+	}
+	if !hmac.Equal([]byte(asString(body["mac"])), []byte(deviceLinkMAC(link.Secret, linkID, deviceID, boxPubB64))) {
+		return nil, errors.New("device link mac invalid")
+	}
+	m.ensureDeviceListLocked()
+	devices := make([]Device, 0, len(m.ownDevicesLocked())+1)
+	for _, d := range m.ownDevicesLocked() {
+		if d.DeviceID != deviceID {
+			devices = append(devices, d)
+		}
+	}
+	devices = append(devices, Device{
+		DeviceID:     deviceID,
+		Name:         strings.TrimSpace(asString(body["name"])),
+		BoxPublicKey: boxPubB64,
+		AddedAt:      time.Now().UTC(),
+	})
+	m.setDeviceListLocked(devices)
+
+	bundle := deviceBundle{
+		UserID:     m.profile.UserID,
+		SignPriv:   base64.RawStdEncoding.EncodeToString(m.identity.SignPrivate),
+		Profile:    m.profile,
+		Friends:    m.friends,
+		KnownUsers: m.knownUsers,
+		DMs:        m.dms,
+		DeviceList: m.deviceList,
+		Rotations:  m.keyRotations,
+	}
+	plain, err := json.Marshal(bundle)
+	if err != nil {
+		return nil, err
+	}
+	ephPriv, ephPub, err := newX25519KeyPair()
+	if err != nil {
+		return nil, err
+	}
+	shared, err := curve25519.X25519(ephPriv, boxPub[:])
+	if err != nil {
+		return nil, err
+	}
+	nonce, ct, err := sealWithKey(deviceLinkKey(shared, link.Secret, linkID), plain, []byte(linkID))
+	if err != nil {
+		return nil, err
+	}
+	delete(m.deviceLinks, linkID)
+	m.resubscribeLocked()
+	m.syncOwnDevicesLocked("device_list", map[string]any{"device_list": m.deviceList})
+	return map[string]any{
+		"type":       "device_link_accept",
+		"link_id":    linkID,
+		"device_id":  deviceID,
+		"ek":         base64.RawStdEncoding.EncodeToString(ephPub),
+		"nonce":      base64.RawStdEncoding.EncodeToString(nonce),
+		"ciphertext": base64.RawStdEncoding.EncodeToString(ct),
+	}, nil
+}
+
+// LinkDevice joins this (empty) data dir to the identity that issued token.
+// The reply is awaited in the background; the snapshot reports progress.
+func (m *Manager) LinkDevice(token, passphrase, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	join, req, err := m.beginDeviceLinkLocked(token, passphrase, name)
+	if err != nil {
+		return err
+	}
+	if err := m.publishPlain(linkTopic(join.LinkID), req); err != nil {
+		m.join = nil
+		return err
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), join.ExpiresAt)
+	join.cancel = cancel
+	go m.joinLoop(ctx, join)
+	m.publishSectionsLocked()
+	return nil
+}
+
+func (m *Manager) beginDeviceLinkLocked(token, passphrase, name string) (*deviceJoin, map[string]any, error) {
+	if m.profile != nil || m.identity != nil || m.lockedLocked() {
+		return nil, nil, errors.New("already initialized")
+	}
+	if m.join != nil && m.join.State == deviceJoinWaiting && time.Now().Before(m.join.ExpiresAt) {
+		return nil, nil, errors.New("device link already in progress")
+	}
+	if strings.TrimSpace(passphrase) == "" {
+		return nil, nil, errors.New("passphrase required")
+	}
+	payload, err := parseInvite(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	if asString(payload["kind"]) != "device_link" {
+		return nil, nil, errors.New("not a device link token")
+	}
+	signPub, _ := base64.RawStdEncoding.DecodeString(asString(payload["sign_pub"]))
+	userID := asString(payload["user_id"])
+	var chain []keyRotation
+	if raw, ok := payload["key_rotations"]; ok && remarshal(raw, &chain) != nil {
+		return nil, nil, errors.New("invalid device link key rotations")
+	}
+	if userID == "" || !verifyKeyChain(userID, chain, asString(payload["sign_pub"])) {
+		return nil, nil, errors.New("device link identity mismatch")
+	}
+	secret, err := base64.RawStdEncoding.DecodeString(asString(payload["secret"]))
+	if err != nil || len(secret) != 32 {
+		return nil, nil, errors.New("invalid device link secret")
+	}
+	linkID := asString(payload["link_id"])
+	if linkID == "" {
+		return nil, nil, errors.New("invalid device link")
+	}
+	priv, pub, err := newX25519KeyPair()
+	if err != nil {
+		return nil, nil, err
+	}
+	expiresF, _ := payload["expires_at"].(float64)
+	join := &deviceJoin{
+		LinkID:     linkID,
+		UserID:     userID,
+		SignPublic: ed25519.PublicKey(signPub),
+		Secret:     secret,
+		DevicePriv: priv,
+		DevicePub:  pub,
+		Name:       strings.TrimSpace(name),
+		ExpiresAt:  time.Unix(int64(expiresF), 0).UTC(),
+		State:      deviceJoinWaiting,
+		passphrase: passphrase,
+	}
+	m.join = join
+	deviceID := deviceIDFor(pub)
+	boxPubB64 := base64.RawStdEncoding.EncodeToString(pub)
+	req := map[string]any{
+		"type":           "device_link_request",
+		"link_id":        linkID,
+		"device_id":      deviceID,
+		"box_public_key": boxPubB64,
+		"name":           join.Name,
+		"mac":            deviceLinkMAC(secret, linkID, deviceID, boxPubB64),
+	}
+	return join, req, nil
+}
+
+func (m *Manager) joinLoop(ctx context.Context, join *deviceJoin) {
+	defer join.cancel()
+	wait := func() bool {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(2 * time.Second):
+			return true
+		}
+	}
+	subID := ""
+	for ctx.Err() == nil {
+		if subID == "" {
+			rep, err := m.rpc.Subscribe(localrpcclient.SubscribeArgs{AppID: AppID, Topics: []string{linkTopic(join.LinkID)}, FromOffset: 0})
+			if err != nil || rep.Error != "" {
+				if !wait() {
+					break
+				}
+				continue
+			}
+			subID = rep.SubscriptionID
+		}
+		rep, err := m.rpc.Pull(localrpcclient.PullArgs{AppID: AppID, SubscriptionID: subID, MaxItems: 20, WaitMillis: 2000})
+		if err != nil || rep.Error != "" {
+			if !wait() {
+				break
+			}
+			continue
+		}
+		for _, rec := range rep.Messages {
+			var generic map[string]any
+			if err := json.Unmarshal(rec.Payload, &generic); err != nil {
+				continue
+			}
+			body, _ := generic["body"].(map[string]any)
+			if asString(body["type"]) != "device_link_accept" || asString(body["link_id"]) != join.LinkID {
+				continue
+			}
+			m.mu.Lock()
+			err := m.completeDeviceLinkLocked(join, body)
+			m.mu.Unlock()
+			if err == nil {
+				return
+			}
+		}
+	}
+	m.mu.Lock()
+	if m.join == join && join.State == deviceJoinWaiting {
+		join.State = deviceJoinExpired
+		join.passphrase = ""
+		m.publishSectionsLocked()
+	}
+	m.mu.Unlock()
+}
+
+// completeDeviceLinkLocked installs the identity and synced state received
+// from the primary and seals them under the passphrase given at join time.
+func (m *Manager) completeDeviceLinkLocked(join *deviceJoin, body map[string]any) error {
+	if m.join != join || join.State != deviceJoinWaiting {
+		return errors.New("device link not pending")
+	}
+	ek, err := decodeKey32(asString(body["ek"]))
+	if err != nil {
+		return err
+	}
+	nonce, err := base64.RawStdEncoding.DecodeString(asString(body["nonce"]))
+	if err != nil {
+		return err
+	}
+	ct, err := base64.RawStdEncoding.DecodeString(asString(body["ciphertext"]))
+	if err != nil {
+		return err
+	}
+	shared, err := curve25519.X25519(join.DevicePriv, ek[:])
+	if err != nil {
+		return err
+	}
+	plain, err := openWithKey(deviceLinkKey(shared, join.Secret, join.LinkID), nonce, ct, []byte(join.LinkID))
+	if err != nil {
+		return errors.New("device link reply invalid")
+	}
+	var bundle deviceBundle
+	if err := json.Unmarshal(plain, &bundle); err != nil {
+		return err
+	}
+	signPriv, err := base64.RawStdEncoding.DecodeString(bundle.SignPriv)
+	if err != nil || len(signPriv) != ed25519.PrivateKeySize {
+		return errors.New("invalid identity key")
+	}
+	signPub := ed25519.PrivateKey(signPriv).Public().(ed25519.PublicKey)
+	if !bytes.Equal(signPub, join.SignPublic) || bundle.UserID != join.UserID {
+		return errors.New("device link identity mismatch")
+	}
+	if bundle.Profile == nil || bundle.Profile.UserID != join.UserID {
+		return errors.New("device link profile missing")
+	}
+	if !verifyDeviceList(bundle.Profile.SignPublicKey, bundle.DeviceList) {
+		return errors.New("device list signature invalid")
+	}
+	if !verifyKeyChain(join.UserID, bundle.Rotations, bundle.Profile.SignPublicKey) {
+		return errors.New("device link key rotations invalid")
+	}
+	deviceID := deviceIDFor(join.DevicePub)
+	listed := false
+	for _, d := range bundle.DeviceList.Devices {
+		listed = listed || d.DeviceID == deviceID
+	}
+	if !listed {
+		return errors.New("device not in device list")
+	}
+
+	id := &Identity{UserID: join.UserID, SignPublicKey: signPub, SignPrivate: ed25519.PrivateKey(signPriv)}
+	copy(id.BoxPrivateKey[:], join.DevicePriv)
+	copy(id.BoxPublicKey[:], join.DevicePub)
+	m.identity = id
+	m.profile = bundle.Profile
+	if bundle.Friends != nil {
+		m.friends = bundle.Friends
+	}
+	if bundle.KnownUsers != nil {
+		m.knownUsers = bundle.KnownUsers
+	}
+	if bundle.DMs != nil {
+		m.dms = bundle.DMs
+	}
+	m.deviceList = bundle.DeviceList
+	m.keyRotations = bundle.Rotations
+	for _, r := range bundle.Rotations {
+		m.revokeKeyLocked(r.UserID, r.OldSignPub, r.Reason)
+		m.revokeKeyLocked(r.UserID, r.OldBoxPub, r.Reason)
+	}
+	if err := m.rekeyLocked(join.passphrase); err != nil {
+		m.identity, m.profile = nil, nil
+		m.resetStateLocked()
+		return err
+	}
+	join.State = deviceJoinLinked
+	join.passphrase = ""
+	_ = m.saveStateLocked()
+	m.startLoopLocked()
+	go m.publishPresence()
+	return nil
+}
+
+// deviceTargetsLocked lists the devices that need their own copy of a
+// message to userID: the peer's linked devices, or for ourselves every other
+// device of this identity.
+func (m *Manager) deviceTargetsLocked(userID string) []Device {
+	out := make([]Device, 0)
+	if m.profile != nil && userID == m.profile.UserID {
+		self := m.deviceIDLocked()
+		for _, d := range m.ownDevicesLocked() {
+			if d.DeviceID != self {
+				out = append(out, d)
+			}
+		}
+		return out
+	}
+	for _, d := range m.knownUsers[userID].Devices {
+		if !d.Primary {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// fanoutLocked sends payload to each extra device of userID, sealed to that
+// device's box key. The primary copy goes through the normal path.
+func (m *Manager) fanoutLocked(userID string, payload map[string]any) {
+	if userID == "" {
+		return
+	}
+	topic := inboxTopic(userID)
+	for _, d := range m.deviceTargetsLocked(userID) {
+		wire, err := m.buildEnvelopeLocked(topic, d.BoxPublicKey, d.DeviceID, payload)
+		if err != nil {
+			continue
+		}
+		_ = m.publishSecureBytesLocked(topic, wire)
+	}
+}
+
+func (m *Manager) syncOwnDevicesLocked(kind string, data map[string]any) {
+	if m.profile == nil {
+		return
+	}
+	payload := map[string]any{
+		"type":         "device_sync",
+		"sync":         kind,
+		"from_user_id": m.profile.UserID,
+		"created_at":   time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	for k, v := range data {
+		payload[k] = v
+	}
+	m.fanoutLocked(m.profile.UserID, payload)
+}
+
+func (m *Manager) syncFriendsLocked() {
+	known := make(map[string]KnownUser, len(m.friends))
+	for id := range m.friends {
+		if u, ok := m.knownUsers[id]; ok {
+			known[id] = u
+		}
+	}
+	m.syncOwnDevicesLocked("friends", map[string]any{"friends": m.friends, "known_users": known})
+}
+
+func (m *Manager) handleDeviceSyncLocked(body map[string]any) {
+	switch asString(body["sync"]) {
+	case "sent_dm":
+		var msg DirectMessage
+		peer := asString(body["peer_user_id"])
+		if err := remarshal(body["message"], &msg); err != nil || peer == "" || msg.MessageID == "" {
+			return
+		}
+		if !m.hasDMLocked(peer, msg.MessageID) {
+			m.attachReplyLocked(peer, &msg, msg.ReplyTo)
+			m.dms[peer] = append(m.dms[peer], msg)
+			m.resolveRepliesLocked(peer, msg)
+		}
+	case "dm_update":
+		var msg DirectMessage
+		peer := asString(body["peer_user_id"])
+		if err := remarshal(body["message"], &msg); err != nil {
+			return
+		}
+		if i := m.dmIndexLocked(peer, msg.MessageID); i >= 0 {
+			m.dms[peer][i] = msg
+			m.msgIndex = nil
+			m.resolveRepliesLocked(peer, msg)
+		}
+	case "friends":
+		var friends map[string]Friend
+		var known map[string]KnownUser
+		if err := remarshal(body["friends"], &friends); err != nil {
+			return
+		}
+		_ = remarshal(body["known_users"], &known)
+		for id, f := range friends {
+			if _, ok := m.friends[id]; !ok {
+				m.friends[id] = f
+			}
+			if u, ok := known[id]; ok {
+				if _, seen := m.knownUsers[id]; !seen {
+					m.knownUsers[id] = u
+				}
+			}
+		}
+	case "friend_removed":
+		delete(m.friends, asString(body["peer_user_id"]))
+	case "retention":
+		m.handleRetentionLocked(asString(body["peer_user_id"]), body)
+	case "blocks":
+		var blocked map[string]BlockedUser
+		var muted map[string]time.Time
+		if remarshal(body["blocked"], &blocked) != nil || remarshal(body["muted"], &muted) != nil {
+			return
+		}
+		m.blocked, m.muted = blocked, muted
+		if m.blocked == nil {
+			m.blocked = make(map[string]BlockedUser)
+		}
+		if m.muted == nil {
+			m.muted = make(map[string]time.Time)
+		}
+	case "device_list":
+		var l deviceList
+		if err := remarshal(body["device_list"], &l); err != nil {
+			return
+		}
+		if !verifyDeviceList(m.profile.SignPublicKey, &l) {
+			return
+		}
+		if m.deviceList == nil || l.Version > m.deviceList.Version {
+			var prev []Device
+			if m.deviceList != nil {
+				prev = m.deviceList.Devices
+			}
+			l.Devices = carryPrekeys(l.Devices, prev)
+			m.deviceList = &l
+		}
+	}
+}
+
+// applyDeviceList merges a verified device list into u, carrying over
+// per-device observations from prev. Older lists are ignored.
+func applyDeviceList(u *KnownUser, prev KnownUser, l *deviceList) {
+	u.Devices, u.DeviceListVersion = prev.Devices, prev.DeviceListVersion
+	if l == nil || l.Version < prev.DeviceListVersion {
+		return
+	}
+	seen := make(map[string]Device, len(prev.Devices))
+	for _, d := range prev.Devices {
+		seen[d.DeviceID] = d
+	}
+	devices := make([]Device, 0, len(l.Devices))
+	for _, d := range l.Devices {
+		if old, ok := seen[d.DeviceID]; ok {
+			d.PeerID, d.LastSeenAt = old.PeerID, old.LastSeenAt
+		}
+		devices = append(devices, d)
+	}
+	u.Devices, u.DeviceListVersion = carryPrekeys(devices, prev.Devices), l.Version
+}
+
+// carryPrekeys keeps the prekeys already seen for devices that stay listed.
+func carryPrekeys(devices, prev []Device) []Device {
+	for i := range devices {
+		for _, old := range prev {
+			if old.DeviceID == devices[i].DeviceID && old.PrekeyID != "" {
+				devices[i].PrekeyID, devices[i].PrekeyPublic, devices[i].PrekeySignature = old.PrekeyID, old.PrekeyPublic, old.PrekeySignature
+			}
+		}
+	}
+	return devices
+}
+
+// withDevicePrekey returns a copy of devices with the prekey a device
+// advertised in its own presence, or false if there is nothing new.
+func withDevicePrekey(devices []Device, deviceID, signPubB64 string, advert any) ([]Device, bool) {
+	pk, _ := advert.(map[string]any)
+	id, pub, sig := asString(pk["id"]), asString(pk["pub"]), asString(pk["sig"])
+	if !verifyPrekey(signPubB64, id, pub, sig) {
+		return nil, false
+	}
+	for i, d := range devices {
+		if d.DeviceID != deviceID || d.PrekeyID == id {
+			continue
+		}
+		out := append([]Device(nil), devices...)
+		out[i].PrekeyID, out[i].PrekeyPublic, out[i].PrekeySignature = id, pub, sig
+		return out, true
+	}
+	return nil, false
+}
+
+func isPrimaryIn(devices []Device, deviceID string) bool {
+	for _, d := range devices {
+		if d.DeviceID == deviceID {
+			return d.Primary
+		}
+	}
+	return true
+}
+
+func markDeviceSeen(u *KnownUser, deviceID, peerID string) {
+	for i := range u.Devices {
+		if u.Devices[i].DeviceID == deviceID {
+			u.Devices[i].PeerID = peerID
+			u.Devices[i].LastSeenAt = time.Now().UTC()
+		}
+	}
+}
+
+func (m *Manager) deviceSnapshotLocked() map[string]any {
+	devices := append([]Device(nil), m.ownDevicesLocked()...)
+	sort.Slice(devices, func(i, j int) bool { return devices[i].AddedAt.Before(devices[j].AddedAt) })
+	out := map[string]any{
+		"device_id": m.deviceIDLocked(),
+		"primary":   m.isPrimaryDeviceLocked(),
+		"devices":   devices,
+	}
+	if m.join != nil {
+		out["link"] = map[string]any{
+			"state":      m.join.State,
+			"user_id":    m.join.UserID,
+			"expires_at": m.join.ExpiresAt,
+		}
+	}
+	return out
+}
@@ -0,0 +1,228 @@
+package social
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// DeletedForMe hides a message on our devices only; DeletedForEveryone
+	// was asked for by its author and applies on both sides.
+	DeletedForMe       = "me"
+	DeletedForEveryone = "everyone"
+
+	maxReactionRunes = 8
+)
+
+// MessageEdit is an earlier version of an edited message.
+type MessageEdit struct {
+	Body     string    `json:"body"`
+	EditedAt time.Time `json:"edited_at"`
+}
+
+func (m *Manager) dmIndexLocked(peerUserID, msgID string) int {
+	return indexOfDM(m.dms[peerUserID], msgID)
+}
+
+// queueDMUpdateLocked sends an edit, deletion or reaction through the outbox
+// so it is retried like the message it refers to, and queued behind it.
+func (m *Manager) queueDMUpdateLocked(toUserID string, payload map[string]any) error {
+	target, ok := m.knownUsers[toUserID]
+	if !ok {
+		return errors.New("target user not discovered")
+	}
+	id := fmt.Sprintf("dmu-%d", time.Now().UnixNano())
+	payload["update_id"] = id
+	payload["from_user_id"] = m.profile.UserID
+	payload["created_at"] = time.Now().UTC().Format(time.RFC3339Nano)
+	wire, err := m.buildSecureEnvelopeLocked(inboxTopic(toUserID), target.BoxPublicKey, payload)
+	if err != nil {
+		return err
+	}
+	m.enqueueOutboxLocked(toUserID, id, wire)
+	m.fanoutLocked(toUserID, payload)
+	return nil
+}
+
+// storeDMUpdateLocked writes back a changed message and tells our other
+// devices about it.
+func (m *Manager) storeDMUpdateLocked(peerUserID string, i int, msg DirectMessage) {
+	m.dms[peerUserID][i] = msg
+	m.msgIndex = nil
+	m.resolveRepliesLocked(peerUserID, msg)
+	m.syncOwnDevicesLocked("dm_update", map[string]any{"peer_user_id": peerUserID, "message": msg})
+}
+
+func applyDMEdit(msg *DirectMessage, body string, at time.Time) bool {
+	if msg.Deleted != "" || !at.After(msg.EditedAt) || body == msg.Body {
+		return false
+	}
+	msg.Edits = append(msg.Edits, MessageEdit{Body: msg.Body, EditedAt: at})
+	msg.Body = body
+	msg.EditedAt = at
+	return true
+}
+
+// tombstoneDM clears a message's content but keeps its ID, so a late
+// re-delivery is still recognized as a duplicate.
+func tombstoneDM(msg *DirectMessage, scope string, at time.Time) {
+	msg.Body, msg.MediaName, msg.MediaMIME, msg.MediaData, msg.MediaDigest, msg.MediaSize = "", "", "", "", "", 0
+	msg.Edits, msg.Reactions = nil, nil
+	msg.Deleted, msg.DeletedAt = scope, at
+}
+
+// EditDirectMessage replaces the text of one of our messages and sends the
+// new text to the peer. Earlier versions are kept in Edits.
+func (m *Manager) EditDirectMessage(peerUserID, msgID, body string) (*DirectMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.profile == nil || m.identity == nil {
+		return nil, errors.New("not initialized")
+	}
+	body = strings.TrimSpace(body)
+	if body == "" {
+		return nil, errors.New("message body is required")
+	}
+	i := m.dmIndexLocked(peerUserID, msgID)
+	if i < 0 {
+		return nil, errors.New("message not found")
+	}
+	msg := m.dms[peerUserID][i]
+	if msg.FromUserID != m.profile.UserID {
+		return nil, errors.New("only your own messages can be edited")
+	}
+	now := time.Now().UTC()
+	if !applyDMEdit(&msg, body, now) {
+		return nil, errors.New("message cannot be edited")
+	}
+	if err := m.queueDMUpdateLocked(peerUserID, map[string]any{
+		"type":       "dm_edit",
+		"message_id": msgID,
+		"body":       body,
+		"edited_at":  now.Format(time.RFC3339Nano),
+	}); err != nil {
+		return nil, err
+	}
+	m.storeDMUpdateLocked(peerUserID, i, msg)
+	if err := m.saveStateLocked(); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// DeleteDirectMessage removes a message from the conversation. Only its
+// author may delete it for everyone; either side may delete it for itself.
+func (m *Manager) DeleteDirectMessage(peerUserID, msgID string, forEveryone bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.profile == nil || m.identity == nil {
+		return errors.New("not initialized")
+	}
+	i := m.dmIndexLocked(peerUserID, msgID)
+	if i < 0 {
+		return errors.New("message not found")
+	}
+	msg := m.dms[peerUserID][i]
+	if msg.Deleted == DeletedForEveryone || (msg.Deleted == DeletedForMe && !forEveryone) {
+		return errors.New("message already deleted")
+	}
+	scope := DeletedForMe
+	now := time.Now().UTC()
+	if forEveryone {
+		if msg.FromUserID != m.profile.UserID {
+			return errors.New("only your own messages can be deleted for everyone")
+		}
+		if err := m.queueDMUpdateLocked(peerUserID, map[string]any{
+			"type":       "dm_delete",
+			"message_id": msgID,
+			"deleted_at": now.Format(time.RFC3339Nano),
+		}); err != nil {
+			return err
+		}
+		scope = DeletedForEveryone
+	}
+	tombstoneDM(&msg, scope, now)
+	m.storeDMUpdateLocked(peerUserID, i, msg)
+	return m.saveStateLocked()
+}
+
+// ReactDirectMessage sets our reaction on a message, replacing any earlier
+// one. An empty emoji removes it.
+func (m *Manager) ReactDirectMessage(peerUserID, msgID, emoji string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.profile == nil || m.identity == nil {
+		return errors.New("not initialized")
+	}
+	emoji = strings.TrimSpace(emoji)
+	if utf8.RuneCountInString(emoji) > maxReactionRunes {
+		return errors.New("invalid reaction")
+	}
+	i := m.dmIndexLocked(peerUserID, msgID)
+	if i < 0 {
+		return errors.New("message not found")
+	}
+	msg := m.dms[peerUserID][i]
+	if msg.Deleted != "" {
+		return errors.New("message deleted")
+	}
+	if err := m.queueDMUpdateLocked(peerUserID, map[string]any{
+		"type":       "dm_reaction",
+		"message_id": msgID,
+		"emoji":      emoji,
+	}); err != nil {
+		return err
+	}
+	setReaction(&msg, m.profile.UserID, emoji)
+	m.storeDMUpdateLocked(peerUserID, i, msg)
+	return m.saveStateLocked()
+}
+
+func setReaction(msg *DirectMessage, userID, emoji string) {
+	if emoji == "" {
+		delete(msg.Reactions, userID)
+		if len(msg.Reactions) == 0 {
+			msg.Reactions = nil
+		}
+		return
+	}
+	if msg.Reactions == nil {
+		msg.Reactions = make(map[string]string)
+	}
+	msg.Reactions[userID] = emoji
+}
+
+// handleDMUpdateLocked applies a peer's dm_edit, dm_delete or dm_reaction to
+// our copy of the conversation. Edits and deletions are only taken for
+// messages the peer wrote.
+func (m *Manager) handleDMUpdateLocked(msgType, fromUser string, body map[string]any) {
+	i := m.dmIndexLocked(fromUser, asString(body["message_id"]))
+	if i < 0 {
+		return
+	}
+	msg := m.dms[fromUser][i]
+	switch msgType {
+	case "dm_edit":
+		text := strings.TrimSpace(asString(body["body"]))
+		if msg.FromUserID != fromUser || text == "" || !applyDMEdit(&msg, text, parseTS(asString(body["edited_at"]))) {
+			return
+		}
+	case "dm_delete":
+		if msg.FromUserID != fromUser || msg.Deleted == DeletedForEveryone {
+			return
+		}
+		tombstoneDM(&msg, DeletedForEveryone, parseTS(asString(body["deleted_at"])))
+	case "dm_reaction":
+		emoji := strings.TrimSpace(asString(body["emoji"]))
+		if msg.Deleted != "" || utf8.RuneCountInString(emoji) > maxReactionRunes {
+			return
+		}
+		setReaction(&msg, fromUser, emoji)
+	}
+	m.dms[fromUser][i] = msg
+	m.msgIndex = nil
+	m.resolveRepliesLocked(fromUser, msg)
+}
@@ -0,0 +1,291 @@
+package social
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Stream event types. Collections that change often are sent item by item;
+// every other snapshot section is resent whole in a state_patch when it
+// changes.
+const (
+	EventUserSeen            = "user_seen"
+	EventUserRemoved         = "user_removed"
+	EventRequestChanged      = "request_changed"
+	EventRequestRemoved      = "request_removed"
+	EventFriendChanged       = "friend_changed"
+	EventFriendRemoved       = "friend_removed"
+	EventMessageAdded        = "message_added"
+	EventMessageChanged      = "message_changed"
+	EventMessageRemoved      = "message_removed"
+	EventGroupMessageAdded   = "group_message_added"
+	EventGroupMessageChanged = "group_message_changed"
+	EventGroupMessageRemoved = "group_message_removed"
+	EventStatePatch          = "state_patch"
+
+	eventBacklog        = 1024
+	eventListenerBuffer = 256
+)
+
+// Event is one change pushed to stream subscribers. Data is encoded when the
+// event is made, so it never aliases state that changes afterwards.
+type Event struct {
+	ID   uint64          `json:"id"`
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// newEventSeq starts event IDs at the clock, so IDs handed out by an earlier
+// run are always older than the backlog of this one.
+func newEventSeq() uint64 {
+	return uint64(time.Now().UnixMicro())
+}
+
+// SubscribeEvents delivers events as they are made. A subscriber that falls
+// behind is dropped and its channel closed; it can pick up again from
+// EventsSince.
+func (m *Manager) SubscribeEvents() (<-chan Event, func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := m.nextListenerID
+	m.nextListenerID++
+	ch := make(chan Event, eventListenerBuffer)
+	m.listeners[id] = ch
+	cancel := func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if c, ok := m.listeners[id]; ok {
+			delete(m.listeners, id)
+			close(c)
+		}
+	}
+	return ch, cancel
+}
+
+// EventsSince returns the events made after lastID. It reports false when
+// some of them are no longer kept and the caller needs a fresh snapshot.
+func (m *Manager) EventsSince(lastID uint64) ([]Event, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if lastID > m.eventSeq {
+		return nil, false
+	}
+	if lastID == m.eventSeq {
+		return []Event{}, true
+	}
+	if len(m.eventLog) == 0 || m.eventLog[0].ID > lastID+1 {
+		return nil, false
+	}
+	i := sort.Search(len(m.eventLog), func(i int) bool { return m.eventLog[i].ID > lastID })
+	return append([]Event(nil), m.eventLog[i:]...), true
+}
+
+// SnapshotAt returns the snapshot along with the ID of the last event it
+// already reflects.
+func (m *Manager) SnapshotAt() (map[string]any, uint64) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.snapshotLocked(), m.eventSeq
+}
+
+func (m *Manager) emitEventLocked(typ string, data any) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	m.emitRawEventLocked(typ, raw)
+}
+
+func (m *Manager) emitRawEventLocked(typ string, data json.RawMessage) {
+	m.eventSeq++
+	ev := Event{ID: m.eventSeq, Type: typ, Data: data}
+	m.eventLog = append(m.eventLog, ev)
+	if len(m.eventLog) > 2*eventBacklog {
+		m.eventLog = append([]Event(nil), m.eventLog[len(m.eventLog)-eventBacklog:]...)
+	}
+	for id, ch := range m.listeners {
+		select {
+		case ch <- ev:
+		default:
+			delete(m.listeners, id)
+			close(ch)
+		}
+	}
+}
+
+// resyncEventsLocked runs whenever state is replaced wholesale, on load and
+// on lock. Subscribers are dropped and the backlog cleared, so every
+// client starts over from a snapshot, and the baseline that later changes
+// are diffed against is rebuilt. The sequence moves on so that no event ID
+// handed out before counts as up to date.
+func (m *Manager) resyncEventsLocked() {
+	for id, ch := range m.listeners {
+		delete(m.listeners, id)
+		close(ch)
+	}
+	m.eventSeq++
+	m.eventLog = nil
+	m.sectionHashes = make(map[string][32]byte)
+	for name, v := range m.sectionsLocked() {
+		if b, err := json.Marshal(v); err == nil {
+			m.sectionHashes[name] = sha256.Sum256(b)
+		}
+	}
+	m.itemHashes = make(map[string]map[string][32]byte)
+	for peer, msgs := range m.dms {
+		m.itemHashes["dms/"+peer] = messageHashes(dmIDs(msgs), msgs)
+	}
+	for gid, msgs := range m.groupMessages {
+		m.itemHashes["group_messages/"+gid] = messageHashes(groupMessageIDs(msgs), msgs)
+	}
+}
+
+func messageHashes[T any](ids []string, msgs []T) map[string][32]byte {
+	out := make(map[string][32]byte, len(ids))
+	for i, id := range ids {
+		if b, err := json.Marshal(msgs[i]); err == nil {
+			out[id] = sha256.Sum256(b)
+		}
+	}
+	return out
+}
+
+func dmIDs(msgs []DirectMessage) []string {
+	out := make([]string, len(msgs))
+	for i, msg := range msgs {
+		out[i] = msg.MessageID
+	}
+	return out
+}
+
+func groupMessageIDs(msgs []GroupMessage) []string {
+	out := make([]string, len(msgs))
+	for i, msg := range msgs {
+		out[i] = msg.MessageID
+	}
+	return out
+}
+
+// publishChangesLocked turns the store entries written by a save into
+// events. Entries are the JSON of the very items the snapshot lists, so
+// they are sent on as they are.
+func (m *Manager) publishChangesLocked(puts map[string][]byte, deletes []string) {
+	if m.itemHashes == nil {
+		m.resyncEventsLocked()
+		return
+	}
+	keys := make([]string, 0, len(puts))
+	for k := range puts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		name, _, _ := strings.Cut(k, "/")
+		switch name {
+		case "known_users":
+			m.emitRawEventLocked(EventUserSeen, puts[k])
+		case "requests":
+			m.emitRawEventLocked(EventRequestChanged, puts[k])
+		case "friends":
+			m.emitRawEventLocked(EventFriendChanged, puts[k])
+		}
+	}
+	for _, k := range deletes {
+		name, sub, _ := strings.Cut(k, "/")
+		switch name {
+		case "known_users":
+			m.emitEventLocked(EventUserRemoved, map[string]string{"user_id": sub})
+		case "requests":
+			m.emitEventLocked(EventRequestRemoved, map[string]string{"request_id": sub})
+		case "friends":
+			m.emitEventLocked(EventFriendRemoved, map[string]string{"user_id": sub})
+		}
+	}
+	m.publishMessagesLocked("dms", "peer_user_id", func(peer string) []string { return dmIDs(m.dms[peer]) },
+		puts, deletes, EventMessageAdded, EventMessageChanged, EventMessageRemoved)
+	m.publishMessagesLocked("group_messages", "group_id", func(gid string) []string { return groupMessageIDs(m.groupMessages[gid]) },
+		puts, deletes, EventGroupMessageAdded, EventGroupMessageChanged, EventGroupMessageRemoved)
+	m.publishSectionsLocked()
+}
+
+// publishMessagesLocked sends the message entries of one stored field,
+// keyed "<field>/<scope>/<message id>", in the order of the conversation.
+// The hashes tell a new message from one that changed.
+func (m *Manager) publishMessagesLocked(field, scopeField string, order func(scope string) []string, puts map[string][]byte, deletes []string, added, changed, removed string) {
+	scopes := make([]string, 0)
+	seen := make(map[string]bool)
+	for k := range puts {
+		name, rest, _ := strings.Cut(k, "/")
+		if scope, _, isItem := strings.Cut(rest, "/"); name == field && isItem && !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+	sort.Strings(scopes)
+	for _, scope := range scopes {
+		key := field + "/" + scope
+		hashes := m.itemHashes[key]
+		if hashes == nil {
+			hashes = make(map[string][32]byte)
+			m.itemHashes[key] = hashes
+		}
+		for _, id := range order(scope) {
+			raw, ok := puts[key+"/"+id]
+			if !ok {
+				continue
+			}
+			h := sha256.Sum256(raw)
+			typ := added
+			if old, ok := hashes[id]; ok {
+				if old == h {
+					continue
+				}
+				typ = changed
+			}
+			hashes[id] = h
+			m.emitEventLocked(typ, map[string]any{scopeField: scope, "message": json.RawMessage(raw)})
+		}
+	}
+	for _, k := range deletes {
+		name, rest, _ := strings.Cut(k, "/")
+		scope, id, isItem := strings.Cut(rest, "/")
+		if name != field || !isItem {
+			continue
+		}
+		key := field + "/" + scope
+		delete(m.itemHashes[key], id)
+		if len(m.itemHashes[key]) == 0 {
+			delete(m.itemHashes, key)
+		}
+		m.emitEventLocked(removed, map[string]string{scopeField: scope, "message_id": id})
+	}
+}
+
+// publishSectionsLocked sends the snapshot sections that changed since they
+// were last sent. Sections also change without a save, for example while a
+// device link is in progress.
+func (m *Manager) publishSectionsLocked() {
+	if m.sectionHashes == nil {
+		m.resyncEventsLocked()
+		return
+	}
+	patch := make(map[string]json.RawMessage)
+	for name, v := range m.sectionsLocked() {
+		b, err := json.Marshal(v)
+		if err != nil {
+			continue
+		}
+		h := sha256.Sum256(b)
+		if old, ok := m.sectionHashes[name]; ok && old == h {
+			continue
+		}
+		m.sectionHashes[name] = h
+		patch[name] = b
+	}
+	if len(patch) > 0 {
+		m.emitEventLocked(EventStatePatch, patch)
+	}
+}
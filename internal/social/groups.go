@@ -0,0 +1,843 @@
+package social
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"Assembler-Apps/internal/localrpcclient"
+)
+
+const (
+	maxGroupMembers    = 64
+	maxGroupKeyEpochs  = 4
+	maxGroupNameLength = 80
+	// groupRenameMaxSkew bounds how far ahead a rename may be stamped; a
+	// later one would outrank every rename made after it.
+	groupRenameMaxSkew = 2 * time.Minute
+)
+
+type Group struct {
+	GroupID     string    `json:"group_id"`
+	Name        string    `json:"name"`
+	OwnerUserID string    `json:"owner_user_id"`
+	Members     []string  `json:"members"`
+	Epoch       int64     `json:"epoch"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+
+	// NameSetAt and NameSetBy stamp the rename that set Name, so renames
+	// that cross in flight settle on the same name for every member.
+	NameSetAt time.Time `json:"name_set_at,omitempty"`
+	NameSetBy string    `json:"name_set_by,omitempty"`
+}
+
+// rename applies a name if its stamp orders after the current one: the later
+// time wins, and the higher user ID breaks ties.
+func (g *Group) rename(name string, at time.Time, by string) bool {
+	if at.Before(g.NameSetAt) || (at.Equal(g.NameSetAt) && by <= g.NameSetBy) {
+		return false
+	}
+	g.Name, g.NameSetAt, g.NameSetBy = name, at, by
+	return true
+}
+
+type GroupMessage struct {
+	MessageID  string    `json:"message_id"`
+	GroupID    string    `json:"group_id"`
+	FromUserID string    `json:"from_user_id"`
+	Body       string    `json:"body"`
+	Epoch      int64     `json:"epoch"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// groupSenderKey is the symmetric key one member uses to encrypt its group
+// messages during a single membership epoch.
+type groupSenderKey struct {
+	Epoch int64  `json:"epoch"`
+	Key   string `json:"key"`
+}
+
+func (g Group) hasMember(userID string) bool {
+	for _, id := range g.Members {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
+
+func groupTopic(groupID string) string {
+	return "app.social.v1.group." + groupID
+}
+
+func (m *Manager) CreateGroup(name string, memberIDs []string) (*Group, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.profile == nil || m.identity == nil {
+		return nil, errors.New("not initialized")
+	}
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, errors.New("group name required")
+	}
+	if len(name) > maxGroupNameLength {
+		return nil, errors.New("group name too long")
+	}
+	members, err := m.validateGroupInviteesLocked(nil, memberIDs)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	g := Group{
+		GroupID:     fmt.Sprintf("g-%d", now.UnixNano()),
+		Name:        name,
+		OwnerUserID: m.profile.UserID,
+		Members:     append([]string{m.profile.UserID}, members...),
+		Epoch:       1,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	sort.Strings(g.Members)
+	m.groups[g.GroupID] = g
+	if err := m.rotateOwnGroupKeyLocked(g); err != nil {
+		return nil, err
+	}
+	if err := m.broadcastGroupUpdateLocked(g, nil); err != nil {
+		return nil, err
+	}
+	if err := m.distributeGroupKeyLocked(g); err != nil {
+		return nil, err
+	}
+	m.resubscribeLocked()
+	if err := m.saveStateLocked(); err != nil {
+		return nil, err
+	}
+	cp := g
+	return &cp, nil
+}
+
+func (m *Manager) InviteToGroup(groupID string, userIDs []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	g, err := m.ownedGroupLocked(groupID)
+	if err != nil {
+		return err
+	}
+	members, err := m.validateGroupInviteesLocked(&g, userIDs)
+	if err != nil {
+		return err
+	}
+	g.Members = append(g.Members, members...)
+	sort.Strings(g.Members)
+	return m.commitGroupMembershipLocked(g, nil)
+}
+
+func (m *Manager) RemoveFromGroup(groupID, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	g, err := m.ownedGroupLocked(groupID)
+	if err != nil {
+		return err
+	}
+	if userID == m.profile.UserID {
+		return errors.New("owner must leave the group instead")
+	}
+	if !g.hasMember(userID) {
+		return errors.New("user is not a group member")
+	}
+	g.Members = removeString(g.Members, userID)
+	return m.commitGroupMembershipLocked(g, []string{userID})
+}
+
+// RotateGroupKey starts a new epoch without changing membership, forcing every
+// member to issue a fresh sender key.
+func (m *Manager) RotateGroupKey(groupID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	g, err := m.ownedGroupLocked(groupID)
+	if err != nil {
+		return err
+	}
+	return m.commitGroupMembershipLocked(g, nil)
+}
+
+func (m *Manager) RenameGroup(groupID, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.profile == nil || m.identity == nil {
+		return errors.New("not initialized")
+	}
+	g, ok := m.groups[groupID]
+	if !ok {
+		return errors.New("group not found")
+	}
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return errors.New("group name required")
+	}
+	if len(name) > maxGroupNameLength {
+		return errors.New("group name too long")
+	}
+	g.UpdatedAt = time.Now().UTC()
+	g.Name, g.NameSetAt, g.NameSetBy = name, g.UpdatedAt, m.profile.UserID
+	m.groups[groupID] = g
+	payload := map[string]any{
+		"type":         "group_rename",
+		"group_id":     groupID,
+		"name":         name,
+		"from_user_id": m.profile.UserID,
+		"created_at":   g.UpdatedAt.Format(time.RFC3339Nano),
+	}
+	if err := m.sendToGroupMembersLocked(g, payload); err != nil {
+		return err
+	}
+	return m.saveStateLocked()
+}
+
+func (m *Manager) LeaveGroup(groupID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.profile == nil || m.identity == nil {
+		return errors.New("not initialized")
+	}
+	g, ok := m.groups[groupID]
+	if !ok {
+		return errors.New("group not found")
+	}
+	payload := map[string]any{
+		"type":         "group_leave",
+		"group_id":     groupID,
+		"from_user_id": m.profile.UserID,
+		"created_at":   time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	// The group is left either way; copies that could not be built are lost.
+	_ = m.sendToGroupMembersLocked(g, payload)
+	m.dropGroupLocked(groupID)
+	return m.saveStateLocked()
+}
+
+func (m *Manager) SendGroupMessage(groupID, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.profile == nil || m.identity == nil {
+		return errors.New("not initialized")
+	}
+	g, ok := m.groups[groupID]
+	if !ok {
+		return errors.New("group not found")
+	}
+	body = strings.TrimSpace(body)
+	if body == "" {
+		return errors.New("message body is required")
+	}
+	key, ok := m.groupKeyLocked(groupID, m.profile.UserID, g.Epoch)
+	if !ok {
+		return errors.New("group sender key missing")
+	}
+	msg := GroupMessage{
+		MessageID:  fmt.Sprintf("gm-%d", time.Now().UnixNano()),
+		GroupID:    groupID,
+		FromUserID: m.profile.UserID,
+		Body:       body,
+		Epoch:      g.Epoch,
+		CreatedAt:  time.Now().UTC(),
+	}
+	plain, _ := json.Marshal(map[string]any{
+		"type":       "group_message",
+		"message_id": msg.MessageID,
+		"body":       msg.Body,
+		"created_at": msg.CreatedAt.Format(time.RFC3339Nano),
+	})
+	wire, err := m.buildGroupEnvelopeLocked(g, key, plain)
+	if err != nil {
+		return err
+	}
+	rep, err := m.rpc.Publish(localrpcclient.PublishArgs{AppID: AppID, Topic: groupTopic(groupID), Payload: wire})
+	if err != nil {
+		return err
+	}
+	if rep.Error != "" {
+		return errors.New(rep.Error)
+	}
+	m.appendGroupMessageLocked(msg)
+	return m.saveStateLocked()
+}
+
+func (m *Manager) GroupConversation(groupID string) []GroupMessage {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]GroupMessage(nil), m.groupMessages[groupID]...)
+}
+
+func (m *Manager) ownedGroupLocked(groupID string) (Group, error) {
+	if m.profile == nil || m.identity == nil {
+		return Group{}, errors.New("not initialized")
+	}
+	g, ok := m.groups[groupID]
+	if !ok {
+		return Group{}, errors.New("group not found")
+	}
+	if g.OwnerUserID != m.profile.UserID {
+		return Group{}, errors.New("only the group owner can change membership")
+	}
+	return g, nil
+}
+
+func (m *Manager) validateGroupInviteesLocked(g *Group, userIDs []string) ([]string, error) {
+	seen := make(map[string]struct{})
+	out := make([]string, 0, len(userIDs))
+	for _, id := range userIDs {
+		id = strings.TrimSpace(id)
+		if id == "" || id == m.profile.UserID {
+			continue
+		}
+		if _, dup := seen[id]; dup {
+			continue
+		}
+		seen[id] = struct{}{}
+		if g != nil && g.hasMember(id) {
+			continue
+		}
+		if _, ok := m.friends[id]; !ok {
+			return nil, fmt.Errorf("user %s is not a friend", id)
+		}
+		if _, ok := m.knownUsers[id]; !ok {
+			return nil, fmt.Errorf("user %s not discovered", id)
+		}
+		out = append(out, id)
+	}
+	total := len(out) + 1
+	if g != nil {
+		total = len(out) + len(g.Members)
+	}
+	if total > maxGroupMembers {
+		return nil, errors.New("too many group members")
+	}
+	return out, nil
+}
+
+// commitGroupMembershipLocked bumps the epoch, announces the new membership
+// and rotates the local sender key. Removed members get a final update so
+// they can drop the group.
+func (m *Manager) commitGroupMembershipLocked(g Group, removed []string) error {
+	g.Epoch++
+	g.UpdatedAt = time.Now().UTC()
+	m.groups[g.GroupID] = g
+	if err := m.rotateOwnGroupKeyLocked(g); err != nil {
+		return err
+	}
+	if err := m.broadcastGroupUpdateLocked(g, removed); err != nil {
+		return err
+	}
+	if err := m.distributeGroupKeyLocked(g); err != nil {
+		return err
+	}
+	return m.saveStateLocked()
+}
+
+func (m *Manager) broadcastGroupUpdateLocked(g Group, removed []string) error {
+	memberKeys := make(map[string]any, len(g.Members))
+	for _, id := range g.Members {
+		if id == m.profile.UserID {
+			memberKeys[id] = map[string]any{
+				"username":        m.profile.Username,
+				"sign_public_key": m.profile.SignPublicKey,
+				"box_public_key":  m.profile.BoxPublicKey,
+			}
+			continue
+		}
+		if u, ok := m.knownUsers[id]; ok {
+			memberKeys[id] = map[string]any{
+				"username":        u.Username,
+				"peer_id":         u.PeerID,
+				"sign_public_key": u.SignPublicKey,
+				"box_public_key":  u.BoxPublicKey,
+			}
+		}
+	}
+	payload := map[string]any{
+		"type":          "group_update",
+		"group_id":      g.GroupID,
+		"name":          g.Name,
+		"name_set_at":   g.NameSetAt.Format(time.RFC3339Nano),
+		"name_set_by":   g.NameSetBy,
+		"owner_user_id": g.OwnerUserID,
+		"members":       g.Members,
+		"member_keys":   memberKeys,
+		"epoch":         g.Epoch,
+		"from_user_id":  m.profile.UserID,
+		"created_at":    g.UpdatedAt.Format(time.RFC3339Nano),
+	}
+	if err := m.sendToGroupMembersLocked(g, payload); err != nil {
+		return err
+	}
+	for _, id := range removed {
+		if _, ok := m.knownUsers[id]; !ok {
+			continue
+		}
+		if err := m.queueGroupControlLocked(id, payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Manager) distributeGroupKeyLocked(g Group) error {
+	key, ok := m.groupKeyLocked(g.GroupID, m.profile.UserID, g.Epoch)
+	if !ok {
+		return errors.New("group sender key missing")
+	}
+	payload := map[string]any{
+		"type":         "group_sender_key",
+		"group_id":     g.GroupID,
+		"epoch":        g.Epoch,
+		"key":          key,
+		"from_user_id": m.profile.UserID,
+		"created_at":   time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	return m.sendToGroupMembersLocked(g, payload)
+}
+
+// sendToGroupMembersLocked delivers a control payload to every other member
+// whose keys are known. Copies go through the outbox, so a member that is
+// unreachable now gets it on a later retry; the first copy that could not
+// be sealed is reported after the rest have been queued.
+func (m *Manager) sendToGroupMembersLocked(g Group, payload map[string]any) error {
+	var firstErr error
+	for _, id := range g.Members {
+		if _, ok := m.knownUsers[id]; !ok || id == m.profile.UserID {
+			continue
+		}
+		if err := m.queueGroupControlLocked(id, payload); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (m *Manager) queueGroupControlLocked(toUserID string, payload map[string]any) error {
+	wire, err := m.buildSecureEnvelopeLocked(inboxTopic(toUserID), m.knownUsers[toUserID].BoxPublicKey, payload)
+	if err != nil {
+		return err
+	}
+	m.enqueueOutboxLocked(toUserID, fmt.Sprintf("grp-%d-%s", time.Now().UnixNano(), toUserID), wire)
+	m.fanoutLocked(toUserID, payload)
+	return nil
+}
+
+func (m *Manager) rotateOwnGroupKeyLocked(g Group) error {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return err
+	}
+	m.storeGroupKeyLocked(g.GroupID, m.profile.UserID, groupSenderKey{Epoch: g.Epoch, Key: base64.RawStdEncoding.EncodeToString(raw)})
+	return nil
+}
+
+func (m *Manager) storeGroupKeyLocked(groupID, userID string, k groupSenderKey) {
+	byUser, ok := m.groupKeys[groupID]
+	if !ok {
+		byUser = make(map[string][]groupSenderKey)
+		m.groupKeys[groupID] = byUser
+	}
+	keys := byUser[userID][:0:0]
+	for _, existing := range byUser[userID] {
+		if existing.Epoch != k.Epoch {
+			keys = append(keys, existing)
+		}
+	}
+	keys = append(keys, k)
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Epoch < keys[j].Epoch })
+	if len(keys) > maxGroupKeyEpochs {
+		keys = keys[len(keys)-maxGroupKeyEpochs:]
+	}
+	byUser[userID] = keys
+}
+
+func (m *Manager) groupKeyLocked(groupID, userID string, epoch int64) (string, bool) {
+	for _, k := range m.groupKeys[groupID][userID] {
+		if k.Epoch == epoch {
+			return k.Key, true
+		}
+	}
+	return "", false
+}
+
+func (m *Manager) dropGroupLocked(groupID string) {
+	delete(m.groups, groupID)
+	delete(m.groupKeys, groupID)
+	delete(m.groupMessages, groupID)
+	delete(m.cursors, groupTopic(groupID))
+	m.resubscribeLocked()
+}
+
+func (m *Manager) appendGroupMessageLocked(msg GroupMessage) {
+	for _, existing := range m.groupMessages[msg.GroupID] {
+		if existing.MessageID == msg.MessageID && existing.FromUserID == msg.FromUserID {
+			return
+		}
+	}
+	m.groupMessages[msg.GroupID] = append(m.groupMessages[msg.GroupID], msg)
+}
+
+// resubscribeLocked drops the current subscription so the receive loop picks
+// up a topic set that includes every joined group.
+func (m *Manager) resubscribeLocked() {
+	m.subscriptionID = ""
+}
+
+func (m *Manager) subscriptionTopicsLocked() []string {
+	topics := []string{topicPresence, inboxTopic(m.profile.UserID)}
+	ids := make([]string, 0, len(m.groups))
+	for id := range m.groups {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		topics = append(topics, groupTopic(id))
+	}
+	links := make([]string, 0, len(m.deviceLinks))
+	for id := range m.deviceLinks {
+		links = append(links, linkTopic(id))
+	}
+	sort.Strings(links)
+	return append(topics, links...)
+}
+
+func (m *Manager) buildGroupEnvelopeLocked(g Group, keyB64 string, plain []byte) ([]byte, error) {
+	key, err := base64.RawStdEncoding.DecodeString(keyB64)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("invalid group key")
+	}
+	cipherText, nonce, err := sealGroupPayload(key, g.GroupID, plain)
+	if err != nil {
+		return nil, err
+	}
+	env := map[string]any{
+		"version":         1,
+		"kind":            "group",
+		"msg_id":          fmt.Sprintf("gs-%d", time.Now().UnixNano()),
+		"group_id":        g.GroupID,
+		"epoch":           g.Epoch,
+		"from_user_id":    m.profile.UserID,
+		"sender_sign_pub": m.profile.SignPublicKey,
+		"nonce":           base64.RawStdEncoding.EncodeToString(nonce),
+		"ciphertext":      base64.RawStdEncoding.EncodeToString(cipherText),
+		"ts":              time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	canon, _ := json.Marshal(env)
+	env["sig"] = base64.RawStdEncoding.EncodeToString(ed25519.Sign(m.identity.SignPrivate, canon))
+	return json.Marshal(env)
+}
+
+func sealGroupPayload(key []byte, groupID string, plain []byte) ([]byte, []byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	return aead.Seal(nil, nonce, plain, []byte(groupID)), nonce, nil
+}
+
+func openGroupPayload(key []byte, groupID string, nonce, cipherText []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, nonce, cipherText, []byte(groupID))
+}
+
+func (m *Manager) handleGroupEnvelope(raw map[string]any) {
+	groupID := asString(raw["group_id"])
+	fromUser := asString(raw["from_user_id"])
+	msgID := asString(raw["msg_id"])
+	if groupID == "" || fromUser == "" || msgID == "" {
+		return
+	}
+	signPubRaw, err := base64.RawStdEncoding.DecodeString(asString(raw["sender_sign_pub"]))
+	if err != nil || len(signPubRaw) != ed25519.PublicKeySize {
+		return
+	}
+	sig, err := base64.RawStdEncoding.DecodeString(asString(raw["sig"]))
+	if err != nil {
+		return
+	}
+	canonMap := make(map[string]any, len(raw))
+	for k, v := range raw {
+		if k != "sig" {
+			canonMap[k] = v
+		}
+	}
+	canon, _ := json.Marshal(canonMap)
+	if !ed25519.Verify(ed25519.PublicKey(signPubRaw), canon, sig) {
+		return
+	}
+	nonce, err := base64.RawStdEncoding.DecodeString(asString(raw["nonce"]))
+	if err != nil {
+		return
+	}
+	cipherText, err := base64.RawStdEncoding.DecodeString(asString(raw["ciphertext"]))
+	if err != nil {
+		return
+	}
+	epochF, _ := raw["epoch"].(float64)
+	epoch := int64(epochF)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.profile == nil || fromUser == m.profile.UserID {
+		return
+	}
+	g, ok := m.groups[groupID]
+	if !ok || !g.hasMember(fromUser) {
+		return
+	}
+	if u, ok := m.knownUsers[fromUser]; ok && u.SignPublicKey != asString(raw["sender_sign_pub"]) {
+		return
+	}
+	if m.keyRevokedLocked(asString(raw["sender_sign_pub"])) || m.blockedLocked(fromUser, asString(raw["sender_sign_pub"]), "") {
+		return
+	}
+	seenKey := groupID + "/" + msgID
+	if _, seen := m.seenMessageIDs[seenKey]; seen {
+		return
+	}
+	keyB64, ok := m.groupKeyLocked(groupID, fromUser, epoch)
+	if !ok {
+		return
+	}
+	key, err := base64.RawStdEncoding.DecodeString(keyB64)
+	if err != nil {
+		return
+	}
+	plain, err := openGroupPayload(key, groupID, nonce, cipherText)
+	if err != nil {
+		return
+	}
+	var body map[string]any
+	if err := json.Unmarshal(plain, &body); err != nil {
+		return
+	}
+	m.markSeenLocked(seenKey, time.Now())
+	if asString(body["type"]) != "group_message" {
+		return
+	}
+	msg := GroupMessage{
+		MessageID:  asString(body["message_id"]),
+		GroupID:    groupID,
+		FromUserID: fromUser,
+		Body:       asString(body["body"]),
+		Epoch:      epoch,
+		CreatedAt:  parseTS(asString(body["created_at"])),
+	}
+	if msg.MessageID == "" {
+		msg.MessageID = msgID
+	}
+	m.appendGroupMessageLocked(msg)
+	_ = m.saveStateLocked()
+}
+
+// handleGroupControlLocked applies a decrypted group control message received
+// over a 1:1 secure envelope.
+func (m *Manager) handleGroupControlLocked(msgType, fromUser string, body map[string]any) {
+	groupID := asString(body["group_id"])
+	if groupID == "" || m.profile == nil {
+		return
+	}
+	myUser := m.profile.UserID
+	switch msgType {
+	case "group_update":
+		g, known := m.groups[groupID]
+		if known && fromUser != g.OwnerUserID {
+			return
+		}
+		if !known {
+			if _, ok := m.friends[fromUser]; !ok {
+				return
+			}
+		}
+		epochF, _ := body["epoch"].(float64)
+		epoch := int64(epochF)
+		if known && epoch < g.Epoch {
+			return
+		}
+		members := asStringSlice(body["members"])
+		owner := asString(body["owner_user_id"])
+		if owner != fromUser {
+			return
+		}
+		if !containsString(members, myUser) {
+			if known {
+				m.dropGroupLocked(groupID)
+			}
+			return
+		}
+		if keys, ok := body["member_keys"].(map[string]any); ok {
+			for id, v := range keys {
+				entry, _ := v.(map[string]any)
+				if id == myUser || entry == nil || !containsString(members, id) {
+					continue
+				}
+				if _, exists := m.knownUsers[id]; exists {
+					continue
+				}
+				// The owner can vouch for neither key, so the sign key must be
+				// the one the user ID derives from, and both stay hints until
+				// the member's own presence arrives.
+				signPub := asString(entry["sign_public_key"])
+				if !verifyKeyChain(id, nil, signPub) || m.keyRevokedLocked(signPub) || m.keyRevokedLocked(asString(entry["box_public_key"])) {
+					continue
+				}
+				m.knownUsers[id] = KnownUser{
+					UserID:        id,
+					PeerID:        asString(entry["peer_id"]),
+					Username:      asString(entry["username"]),
+					SignPublicKey: signPub,
+					BoxPublicKey:  asString(entry["box_public_key"]),
+					LastSeenAt:    time.Now().UTC(),
+					FromGroup:     true,
+				}
+			}
+		}
+		now := time.Now().UTC()
+		if !known {
+			g = Group{GroupID: groupID, CreatedAt: parseTS(asString(body["created_at"]))}
+			m.resubscribeLocked()
+		}
+		rotated := !known || epoch > g.Epoch
+		at, _ := time.Parse(time.RFC3339Nano, asString(body["name_set_at"]))
+		if !known {
+			g.Name = asString(body["name"])
+		}
+		if !at.After(now.Add(groupRenameMaxSkew)) {
+			g.rename(asString(body["name"]), at, asString(body["name_set_by"]))
+		}
+		g.OwnerUserID = owner
+		g.Members = members
+		g.Epoch = epoch
+		g.UpdatedAt = now
+		m.groups[groupID] = g
+		if rotated {
+			if err := m.rotateOwnGroupKeyLocked(g); err == nil {
+				_ = m.distributeGroupKeyLocked(g)
+			}
+		}
+	case "group_sender_key":
+		// Membership is enforced when a group envelope is opened, so keys from
+		// members whose join announcement has not arrived yet are kept.
+		if _, ok := m.groups[groupID]; !ok {
+			return
+		}
+		epochF, _ := body["epoch"].(float64)
+		key := asString(body["key"])
+		raw, err := base64.RawStdEncoding.DecodeString(key)
+		if err != nil || len(raw) != 32 {
+			return
+		}
+		m.storeGroupKeyLocked(groupID, fromUser, groupSenderKey{Epoch: int64(epochF), Key: key})
+	case "group_rename":
+		g, ok := m.groups[groupID]
+		if !ok || !g.hasMember(fromUser) {
+			return
+		}
+		name := strings.TrimSpace(asString(body["name"]))
+		if name == "" || len(name) > maxGroupNameLength {
+			return
+		}
+		at, err := time.Parse(time.RFC3339Nano, asString(body["created_at"]))
+		if err != nil || at.After(time.Now().Add(groupRenameMaxSkew)) || !g.rename(name, at, fromUser) {
+			return
+		}
+		g.UpdatedAt = time.Now().UTC()
+		m.groups[groupID] = g
+	case "group_leave":
+		g, ok := m.groups[groupID]
+		if !ok || !g.hasMember(fromUser) {
+			return
+		}
+		g.Members = removeString(g.Members, fromUser)
+		if g.OwnerUserID == fromUser && len(g.Members) > 0 {
+			// Ownership passes deterministically so every member agrees on who
+			// drives the next rotation.
+			g.OwnerUserID = g.Members[0]
+		}
+		delete(m.groupKeys[groupID], fromUser)
+		m.groups[groupID] = g
+		if g.OwnerUserID == myUser {
+			_ = m.commitGroupMembershipLocked(g, nil)
+		}
+	}
+}
+
+func (m *Manager) groupsSnapshotLocked() []Group {
+	out := make([]Group, 0, len(m.groups))
+	for _, g := range m.groups {
+		g.Members = append([]string(nil), g.Members...)
+		out = append(out, g)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].UpdatedAt.After(out[j].UpdatedAt) })
+	return out
+}
+
+// groupConversationsSnapshotLocked holds the newest page of each group;
+// older messages are fetched with GroupConversationPage.
+func (m *Manager) groupConversationsSnapshotLocked() map[string][]GroupMessage {
+	out := make(map[string][]GroupMessage, len(m.groupMessages))
+	for id, msgs := range m.groupMessages {
+		if len(msgs) > defaultHistoryPage {
+			msgs = msgs[len(msgs)-defaultHistoryPage:]
+		}
+		out[id] = append([]GroupMessage(nil), msgs...)
+	}
+	return out
+}
+
+func asStringSlice(v any) []string {
+	items, _ := v.([]any)
+	out := make([]string, 0, len(items))
+	for _, it := range items {
+		if s, ok := it.(string); ok && s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func removeString(list []string, s string) []string {
+	out := make([]string, 0, len(list))
+	for _, v := range list {
+		if v != s {
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -0,0 +1,251 @@
+package social
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	defaultHistoryPage = 200
+	maxHistoryPage     = 500
+	defaultSearchHits  = 50
+	maxSearchHits      = 200
+)
+
+// HistoryQuery selects a page of one conversation. Before and After are
+// message IDs and exclude the message they name; the timestamp bounds are
+// exclusive too. Without bounds the newest messages are returned.
+type HistoryQuery struct {
+	Before   string
+	After    string
+	BeforeTS time.Time
+	AfterTS  time.Time
+	Limit    int
+}
+
+// HistoryPage is a slice of a conversation in the order it was stored,
+// oldest first.
+type HistoryPage struct {
+	Messages      []DirectMessage `json:"messages"`
+	HasMoreBefore bool            `json:"has_more_before"`
+	HasMoreAfter  bool            `json:"has_more_after"`
+}
+
+// GroupHistoryPage is a HistoryPage of a group conversation.
+type GroupHistoryPage struct {
+	Messages      []GroupMessage `json:"messages"`
+	HasMoreBefore bool           `json:"has_more_before"`
+	HasMoreAfter  bool           `json:"has_more_after"`
+}
+
+// ConversationPage returns messages exchanged with peerUserID between the
+// query bounds, at most Limit of them. With only an After bound the page
+// starts right after it; otherwise it ends at the newest match.
+func (m *Manager) ConversationPage(peerUserID string, q HistoryQuery) (*HistoryPage, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	msgs := m.dms[peerUserID]
+	match, err := pageRange(len(msgs), func(id string) int { return indexOfDM(msgs, id) },
+		func(i int) time.Time { return msgs[i].CreatedAt }, q)
+	if err != nil {
+		return nil, err
+	}
+	page := &HistoryPage{Messages: []DirectMessage{}}
+	if len(match) > 0 {
+		page.HasMoreBefore = match[0] > 0
+		page.HasMoreAfter = match[len(match)-1] < len(msgs)-1
+	}
+	for _, i := range match {
+		page.Messages = append(page.Messages, msgs[i])
+	}
+	return page, nil
+}
+
+// GroupConversationPage pages through a group conversation the way
+// ConversationPage does for direct messages.
+func (m *Manager) GroupConversationPage(groupID string, q HistoryQuery) (*GroupHistoryPage, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	msgs := m.groupMessages[groupID]
+	indexOf := func(id string) int {
+		for i := len(msgs) - 1; i >= 0; i-- {
+			if msgs[i].MessageID == id {
+				return i
+			}
+		}
+		return -1
+	}
+	match, err := pageRange(len(msgs), indexOf, func(i int) time.Time { return msgs[i].CreatedAt }, q)
+	if err != nil {
+		return nil, err
+	}
+	page := &GroupHistoryPage{Messages: []GroupMessage{}}
+	if len(match) > 0 {
+		page.HasMoreBefore = match[0] > 0
+		page.HasMoreAfter = match[len(match)-1] < len(msgs)-1
+	}
+	for _, i := range match {
+		page.Messages = append(page.Messages, msgs[i])
+	}
+	return page, nil
+}
+
+// pageRange picks the positions of a conversation of n messages that make
+// up the page q asks for.
+func pageRange(n int, indexOf func(string) int, createdAt func(int) time.Time, q HistoryQuery) ([]int, error) {
+	lo, hi := 0, n
+	if q.After != "" {
+		i := indexOf(q.After)
+		if i < 0 {
+			return nil, errors.New("unknown after cursor")
+		}
+		lo = i + 1
+	}
+	if q.Before != "" {
+		i := indexOf(q.Before)
+		if i < 0 {
+			return nil, errors.New("unknown before cursor")
+		}
+		hi = i
+	}
+	var match []int
+	for i := lo; i < hi; i++ {
+		at := createdAt(i)
+		if (!q.AfterTS.IsZero() && !at.After(q.AfterTS)) || (!q.BeforeTS.IsZero() && !at.Before(q.BeforeTS)) {
+			continue
+		}
+		match = append(match, i)
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultHistoryPage
+	}
+	limit = min(limit, maxHistoryPage)
+	if len(match) > limit {
+		if (q.After != "" || !q.AfterTS.IsZero()) && q.Before == "" && q.BeforeTS.IsZero() {
+			match = match[:limit]
+		} else {
+			match = match[len(match)-limit:]
+		}
+	}
+	return match, nil
+}
+
+func indexOfDM(msgs []DirectMessage, msgID string) int {
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if msgs[i].MessageID == msgID {
+			return i
+		}
+	}
+	return -1
+}
+
+// MessageHit is one search result.
+type MessageHit struct {
+	PeerUserID string        `json:"peer_user_id"`
+	Message    DirectMessage `json:"message"`
+}
+
+type dmRef struct {
+	peer string
+	pos  int
+}
+
+// messageIndex is an inverted index over decrypted direct messages. It only
+// lives in memory, so plaintext never reaches disk outside the vault, and is
+// filled lazily: conversations are append-only, and anything that rewrites
+// one drops the whole index.
+type messageIndex struct {
+	terms   map[string]map[dmRef]struct{}
+	indexed map[string]int
+}
+
+func newMessageIndex() *messageIndex {
+	return &messageIndex{terms: make(map[string]map[dmRef]struct{}), indexed: make(map[string]int)}
+}
+
+// searchTerms lowercases text and splits it on anything that is not a
+// letter or digit.
+func searchTerms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+func (ix *messageIndex) catchUp(dms map[string][]DirectMessage) {
+	for peer, msgs := range dms {
+		for pos := ix.indexed[peer]; pos < len(msgs); pos++ {
+			ref := dmRef{peer: peer, pos: pos}
+			for _, t := range searchTerms(msgs[pos].Body + " " + msgs[pos].MediaName) {
+				set, ok := ix.terms[t]
+				if !ok {
+					set = make(map[dmRef]struct{})
+					ix.terms[t] = set
+				}
+				set[ref] = struct{}{}
+			}
+		}
+		ix.indexed[peer] = len(msgs)
+	}
+}
+
+// lookup returns the messages containing every query term, each matched as
+// a word prefix.
+func (ix *messageIndex) lookup(query []string) map[dmRef]struct{} {
+	var hits map[dmRef]struct{}
+	for _, q := range query {
+		found := make(map[dmRef]struct{})
+		for term, refs := range ix.terms {
+			if !strings.HasPrefix(term, q) {
+				continue
+			}
+			for ref := range refs {
+				if _, ok := hits[ref]; hits == nil || ok {
+					found[ref] = struct{}{}
+				}
+			}
+		}
+		hits = found
+		if len(hits) == 0 {
+			break
+		}
+	}
+	return hits
+}
+
+// SearchMessages finds direct messages whose text contains every word of
+// query, newest first. An empty peerUserID searches all conversations.
+func (m *Manager) SearchMessages(query, peerUserID string, limit int) ([]MessageHit, error) {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return nil, errors.New("query required")
+	}
+	if limit <= 0 {
+		limit = defaultSearchHits
+	}
+	limit = min(limit, maxSearchHits)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.profile == nil {
+		return nil, errors.New("not initialized")
+	}
+	if m.msgIndex == nil {
+		m.msgIndex = newMessageIndex()
+	}
+	m.msgIndex.catchUp(m.dms)
+	out := make([]MessageHit, 0)
+	for ref := range m.msgIndex.lookup(terms) {
+		if peerUserID != "" && ref.peer != peerUserID {
+			continue
+		}
+		out = append(out, MessageHit{PeerUserID: ref.peer, Message: m.dms[ref.peer][ref.pos]})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Message.CreatedAt.After(out[j].Message.CreatedAt) })
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
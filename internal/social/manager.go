@@ -1,6 +1,7 @@
 package social
 
 import (
+	"bytes"
 	"context"
 	"crypto/aes"
 	"crypto/cipher"
@@ -24,7 +25,6 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/crypto"
-	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/curve25519"
 )
 
@@ -33,14 +33,23 @@ const (
 	topicPresence        = "app.social.v1.global.presence"
 	defaultInviteTTL     = 24 * time.Hour
 	defaultPresenceEvery = 30 * time.Second
-	walletChallenge      = "Hello"
+	// seenMessageTTL is how long a message ID is remembered. Envelopes sent
+	// longer ago are refused, so a replay is caught even after a restart.
+	seenMessageTTL = outboxTTL + 24*time.Hour
 )
 
 type Settings struct {
+	Privacy               string `json:"privacy,omitempty"`
 	Discoverable          bool   `json:"discoverable"`
 	AllowStrangerRequests bool   `json:"allow_stranger_requests"`
 	IsAdmin               bool   `json:"is_admin"`
 	ContractAddress       string `json:"contract_address,omitempty"`
+
+	RequestPolicy *RequestPolicy `json:"request_policy,omitempty"`
+
+	// flagsSent records that decoded JSON carried either legacy flag, so an
+	// explicit false is told apart from a field the client left out.
+	flagsSent bool
 }
 
 type Profile struct {
@@ -54,6 +63,8 @@ type Profile struct {
 	InitializedAt  time.Time `json:"initialized_at"`
 	LastUpdatedAt  time.Time `json:"last_updated_at"`
 	PresenceSentAt time.Time `json:"presence_sent_at,omitempty"`
+
+	WalletBinding *WalletBinding `json:"wallet_binding,omitempty"`
 }
 
 type KnownUser struct {
@@ -65,6 +76,33 @@ type KnownUser struct {
 	SignPublicKey string    `json:"sign_public_key"`
 	BoxPublicKey  string    `json:"box_public_key"`
 	LastSeenAt    time.Time `json:"last_seen_at"`
+
+	PrekeyID        string `json:"prekey_id,omitempty"`
+	PrekeyPublic    string `json:"prekey_public,omitempty"`
+	PrekeySignature string `json:"prekey_sig,omitempty"`
+
+	Devices           []Device `json:"devices,omitempty"`
+	DeviceListVersion int      `json:"device_list_version,omitempty"`
+
+	KeyVersion        int       `json:"key_version,omitempty"`
+	KeyRotatedAt      time.Time `json:"key_rotated_at,omitempty"`
+	KeyWalletVerified bool      `json:"key_wallet_verified,omitempty"`
+
+	// PresenceAt is the signed timestamp of the newest primary presence;
+	// older beacons are ignored.
+	PresenceAt time.Time `json:"presence_at,omitempty"`
+
+	// Verified is set when presence carried a valid EIP-712 wallet binding
+	// for the current keys.
+	Verified bool `json:"verified"`
+
+	// RequestPoWBits is the friend request stamp difficulty the user asks for.
+	RequestPoWBits int `json:"request_pow_bits,omitempty"`
+
+	// FromGroup is set while the keys are only a group owner's hint; the
+	// user's own signed presence replaces them instead of being checked
+	// against them.
+	FromGroup bool `json:"from_group,omitempty"`
 }
 
 type FriendRequest struct {
@@ -73,6 +111,8 @@ type FriendRequest struct {
 	ToUserID          string    `json:"to_user_id"`
 	FromName          string    `json:"from_name,omitempty"`
 	WalletAddress     string    `json:"wallet_address,omitempty"`
+	ProfileVerified   bool      `json:"profile_verified,omitempty"`
+	HelloMessage      string    `json:"hello_message,omitempty"`
 	HelloSignature    string    `json:"hello_sig,omitempty"`
 	SignatureVerified bool      `json:"signature_verified"`
 	Message           string    `json:"message,omitempty"`
@@ -80,23 +120,56 @@ type FriendRequest struct {
 	Status            string    `json:"status"`
 	CreatedAt         time.Time `json:"created_at"`
 	UpdatedAt         time.Time `json:"updated_at"`
+	ExpiresAt         time.Time `json:"expires_at,omitempty"`
 }
 
 type Friend struct {
-	UserID    string    `json:"user_id"`
-	Alias     string    `json:"alias,omitempty"`
-	CreatedAt time.Time `json:"created_at"`
+	UserID          string    `json:"user_id"`
+	Alias           string    `json:"alias,omitempty"`
+	Note            string    `json:"note,omitempty"`
+	Tags            []string  `json:"tags,omitempty"`
+	Favorite        bool      `json:"favorite,omitempty"`
+	Verified        bool      `json:"verified,omitempty"`
+	VerifiedAt      time.Time `json:"verified_at,omitempty"`
+	VerifiedSignKey string    `json:"verified_sign_public_key,omitempty"`
+	VerifiedBoxKey  string    `json:"verified_box_public_key,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+
+	// RetentionSeconds is the disappearing-message timer agreed with this
+	// friend; zero keeps messages.
+	RetentionSeconds int64     `json:"retention_seconds,omitempty"`
+	RetentionSetAt   time.Time `json:"retention_set_at,omitempty"`
 }
 
 type DirectMessage struct {
-	MessageID  string    `json:"message_id"`
-	FromUserID string    `json:"from_user_id"`
-	ToUserID   string    `json:"to_user_id"`
-	Body       string    `json:"body"`
-	MediaName  string    `json:"media_name,omitempty"`
-	MediaMIME  string    `json:"media_mime,omitempty"`
-	MediaData  string    `json:"media_data,omitempty"`
-	CreatedAt  time.Time `json:"created_at"`
+	MessageID   string    `json:"message_id"`
+	FromUserID  string    `json:"from_user_id"`
+	ToUserID    string    `json:"to_user_id"`
+	Body        string    `json:"body"`
+	MediaName   string    `json:"media_name,omitempty"`
+	MediaMIME   string    `json:"media_mime,omitempty"`
+	MediaData   string    `json:"media_data,omitempty"`
+	MediaDigest string    `json:"media_digest,omitempty"`
+	MediaSize   int64     `json:"media_size,omitempty"`
+	Status      string    `json:"status,omitempty"`
+	DeliveredAt time.Time `json:"delivered_at,omitempty"`
+	ReadAt      time.Time `json:"read_at,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+
+	// ReplyTo names the message this one answers and ThreadRoot the first
+	// message of its thread. ReplyPending is set while the parent has not
+	// reached this device.
+	ReplyTo      string `json:"reply_to,omitempty"`
+	ThreadRoot   string `json:"thread_root,omitempty"`
+	ReplyQuote   string `json:"reply_quote,omitempty"`
+	ReplyPending bool   `json:"reply_pending,omitempty"`
+
+	EditedAt  time.Time         `json:"edited_at,omitempty"`
+	Edits     []MessageEdit     `json:"edits,omitempty"`
+	Deleted   string            `json:"deleted,omitempty"`
+	DeletedAt time.Time         `json:"deleted_at,omitempty"`
+	Reactions map[string]string `json:"reactions,omitempty"`
+	ExpiresAt time.Time         `json:"expires_at,omitempty"`
 }
 
 type Identity struct {
@@ -111,25 +184,64 @@ type Config struct {
 	DataDir       string
 	RPCSocketPath string
 	Passphrase    string
+	// EthRPCURL is used to read the AssemblerRegistry contact list when
+	// Registry is not set.
+	EthRPCURL string
+	Registry  ContactRegistry
 }
 
 type Manager struct {
 	mu sync.RWMutex
 
-	cfg Config
-	rpc *localrpcclient.Client
-
-	profile         *Profile
-	identity        *Identity
-	knownUsers      map[string]KnownUser
-	requests        map[string]FriendRequest
-	friends         map[string]Friend
-	dms             map[string][]DirectMessage
-	usedInviteNonce map[string]time.Time
-	cursors         map[string]int64
-	seenMessageIDs  map[string]struct{}
-	listeners       map[int]chan string
+	cfg      Config
+	rpc      *localrpcclient.Client
+	registry ContactRegistry
+
+	profile          *Profile
+	identity         *Identity
+	knownUsers       map[string]KnownUser
+	requests         map[string]FriendRequest
+	friends          map[string]Friend
+	dms              map[string][]DirectMessage
+	groups           map[string]Group
+	groupMessages    map[string][]GroupMessage
+	groupKeys        map[string]map[string][]groupSenderKey
+	usedInviteNonce  map[string]time.Time
+	walletChallenges map[string]walletChallenge
+	usedWalletNonces map[string]time.Time
+	cursors          map[string]int64
+	prekeys          []signedPrekey
+	sessions         map[string]*ratchetSession
+	outbox           map[string]outboxEntry
+	media            map[string]mediaBlob
+	deviceList       *deviceList
+	deviceLinks      map[string]deviceLink
+	join             *deviceJoin
+	keyRotations     []keyRotation
+	revokedKeys      map[string]revokedKey
+	securityAlerts   map[string]SecurityAlert
+	blocked          map[string]BlockedUser
+	muted            map[string]time.Time
+	purgeLog         []PurgeRecord
+
+	pendingRotation *pendingRotation
+	contactCache    map[string]contactCacheEntry
+	requestLimits   requestLimiter
+	requestDrops    RequestDropStats
+	reconciledAt    map[string]time.Time
+	sessionResets   map[string]time.Time
+	msgIndex        *messageIndex
+	rawStore        Store
+	store           Store
+	storeHashes     map[string][32]byte
+	seenMessageIDs  map[string]time.Time
+	listeners       map[int]chan Event
+	signalListeners map[int]chan Signal
 	nextListenerID  int
+	eventSeq        uint64
+	eventLog        []Event
+	sectionHashes   map[string][32]byte
+	itemHashes      map[string]map[string][32]byte
 	nodePeerID      string
 
 	subscriptionID string
@@ -143,25 +255,30 @@ func NewManager(cfg Config) (*Manager, error) {
 	m := &Manager{
 		cfg:             cfg,
 		rpc:             localrpcclient.New(cfg.RPCSocketPath),
-		knownUsers:      make(map[string]KnownUser),
-		requests:        make(map[string]FriendRequest),
-		friends:         make(map[string]Friend),
-		dms:             make(map[string][]DirectMessage),
-		usedInviteNonce: make(map[string]time.Time),
-		cursors:         make(map[string]int64),
-		seenMessageIDs:  make(map[string]struct{}),
-		listeners:       make(map[int]chan string),
+		listeners:       make(map[int]chan Event),
+		signalListeners: make(map[int]chan Signal),
+		registry:        cfg.Registry,
+		eventSeq:        newEventSeq(),
 	}
+	if m.registry == nil && cfg.EthRPCURL != "" {
+		m.registry = NewEthContactRegistry(cfg.EthRPCURL)
+	}
+	m.resetStateLocked()
+	m.resyncEventsLocked()
 	if err := os.MkdirAll(cfg.DataDir, 0o755); err != nil {
 		return nil, err
 	}
-	_ = m.loadState()
-	m.mu.Lock()
-	_ = m.loadIdentityPlainLocked()
-	m.mu.Unlock()
+	if err := m.openStore(); err != nil {
+		return nil, err
+	}
+	if !m.vaultExists() {
+		_ = m.loadState()
+	}
 	m.refreshNodeStatus()
 	if cfg.Passphrase != "" {
-		_ = m.unlock(cfg.Passphrase)
+		m.mu.Lock()
+		_ = m.unlockStateLocked(cfg.Passphrase)
+		m.mu.Unlock()
 	}
 	if m.profile != nil && m.identity != nil {
 		m.startLoop()
@@ -169,6 +286,42 @@ func NewManager(cfg Config) (*Manager, error) {
 	return m, nil
 }
 
+// resetStateLocked clears all decrypted state; used at startup and on Lock.
+func (m *Manager) resetStateLocked() {
+	m.profile = nil
+	m.knownUsers = make(map[string]KnownUser)
+	m.requests = make(map[string]FriendRequest)
+	m.friends = make(map[string]Friend)
+	m.dms = make(map[string][]DirectMessage)
+	m.groups = make(map[string]Group)
+	m.groupMessages = make(map[string][]GroupMessage)
+	m.groupKeys = make(map[string]map[string][]groupSenderKey)
+	m.usedInviteNonce = make(map[string]time.Time)
+	m.walletChallenges = make(map[string]walletChallenge)
+	m.usedWalletNonces = make(map[string]time.Time)
+	m.cursors = make(map[string]int64)
+	m.prekeys = nil
+	m.sessions = make(map[string]*ratchetSession)
+	m.outbox = make(map[string]outboxEntry)
+	m.media = make(map[string]mediaBlob)
+	m.deviceList = nil
+	m.deviceLinks = make(map[string]deviceLink)
+	m.keyRotations = nil
+	m.revokedKeys = make(map[string]revokedKey)
+	m.securityAlerts = make(map[string]SecurityAlert)
+	m.blocked = make(map[string]BlockedUser)
+	m.muted = make(map[string]time.Time)
+	m.purgeLog = nil
+	m.pendingRotation = nil
+	m.contactCache = make(map[string]contactCacheEntry)
+	m.requestLimits = newRequestLimiter()
+	m.requestDrops = RequestDropStats{}
+	m.reconciledAt = make(map[string]time.Time)
+	m.sessionResets = make(map[string]time.Time)
+	m.msgIndex = nil
+	m.seenMessageIDs = make(map[string]time.Time)
+}
+
 func (m *Manager) Initialized() bool {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
@@ -178,7 +331,7 @@ func (m *Manager) Initialized() bool {
 func (m *Manager) Unlock(passphrase string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	if err := m.unlock(passphrase); err != nil {
+	if err := m.unlockStateLocked(passphrase); err != nil {
 		return err
 	}
 	if m.cancel == nil {
@@ -190,7 +343,7 @@ func (m *Manager) Unlock(passphrase string) error {
 func (m *Manager) Init(username, bio, avatarData, passphrase string, settings Settings) (*Profile, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	if m.profile != nil {
+	if m.profile != nil || m.lockedLocked() {
 		return nil, errors.New("already initialized")
 	}
 	if strings.TrimSpace(username) == "" {
@@ -205,6 +358,10 @@ func (m *Manager) Init(username, bio, avatarData, passphrase string, settings Se
 	if strings.TrimSpace(passphrase) == "" {
 		return nil, errors.New("passphrase required")
 	}
+	settings, err := mergeSettings(Settings{}, settings)
+	if err != nil {
+		return nil, err
+	}
 
 	id, err := generateIdentity()
 	if err != nil {
@@ -218,14 +375,14 @@ func (m *Manager) Init(username, bio, avatarData, passphrase string, settings Se
 		AvatarData:    avatarData,
 		SignPublicKey: base64.RawStdEncoding.EncodeToString(id.SignPublicKey),
 		BoxPublicKey:  base64.RawStdEncoding.EncodeToString(id.BoxPublicKey[:]),
-		Settings:      normalizeSettings(settings),
+		Settings:      settings,
 		InitializedAt: now,
 		LastUpdatedAt: now,
 	}
 	m.profile = p
 	m.identity = id
-	m.cfg.Passphrase = passphrase
-	if err := m.saveIdentity(passphrase); err != nil {
+	if err := m.rekeyLocked(passphrase); err != nil {
+		m.profile, m.identity = nil, nil
 		return nil, err
 	}
 	if err := m.saveStateLocked(); err != nil {
@@ -243,6 +400,10 @@ func (m *Manager) UpdateProfile(username, bio, avatarData string, settings Setti
 	if m.profile == nil {
 		return nil, errors.New("not initialized")
 	}
+	merged, err := mergeSettings(m.profile.Settings, settings)
+	if err != nil {
+		return nil, err
+	}
 	if strings.TrimSpace(username) != "" {
 		if !common.IsHexAddress(strings.TrimSpace(username)) {
 			return nil, errors.New("username must be an EVM wallet address")
@@ -256,7 +417,7 @@ func (m *Manager) UpdateProfile(username, bio, avatarData string, settings Setti
 		}
 		m.profile.AvatarData = avatarData
 	}
-	m.profile.Settings = normalizeSettings(settings)
+	m.profile.Settings = merged
 	m.profile.LastUpdatedAt = time.Now().UTC()
 	if err := m.saveStateLocked(); err != nil {
 		return nil, err
@@ -267,16 +428,47 @@ func (m *Manager) UpdateProfile(username, bio, avatarData string, settings Setti
 }
 
 func normalizeSettings(s Settings) Settings {
-	// Keep social discovery usable by default in wallet-login flow.
-	s.Discoverable = true
-	s.AllowStrangerRequests = true
+	s.Privacy = strings.ToLower(strings.TrimSpace(s.Privacy))
+	if !validPrivacy(s.Privacy) {
+		s.Privacy = privacyFromFlags(s)
+	}
+	if s.Privacy == "" {
+		s.Privacy = PrivacyPublic
+	}
+	// The flags mirror the mode for peers and clients that predate it.
+	s.Discoverable = s.Privacy == PrivacyContacts || s.Privacy == PrivacyPublic
+	s.AllowStrangerRequests = s.Privacy == PrivacyPublic
 	s.ContractAddress = strings.TrimSpace(s.ContractAddress)
+	s.RequestPolicy = normalizeRequestPolicy(s.RequestPolicy)
 	return s
 }
 
+// mergeSettings keeps the current privacy mode and request policy when a
+// client sends settings without them.
+func mergeSettings(prev, incoming Settings) (Settings, error) {
+	mode := strings.ToLower(strings.TrimSpace(incoming.Privacy))
+	if mode != "" && !validPrivacy(mode) {
+		return incoming, errors.New("invalid privacy mode")
+	}
+	if mode == "" {
+		incoming.Privacy = privacyFromFlags(incoming)
+		if incoming.Privacy == "" {
+			incoming.Privacy = prev.Privacy
+		}
+	}
+	if incoming.RequestPolicy == nil {
+		incoming.RequestPolicy = prev.RequestPolicy
+	}
+	return normalizeSettings(incoming), nil
+}
+
 func (m *Manager) Snapshot() map[string]any {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
+	return m.snapshotLocked()
+}
+
+func (m *Manager) snapshotLocked() map[string]any {
 	known := make([]KnownUser, 0, len(m.knownUsers))
 	for _, u := range m.knownUsers {
 		known = append(known, u)
@@ -293,8 +485,25 @@ func (m *Manager) Snapshot() map[string]any {
 	for _, f := range m.friends {
 		friends = append(friends, f)
 	}
-	sort.Slice(friends, func(i, j int) bool { return friends[i].CreatedAt.After(friends[j].CreatedAt) })
+	sort.Slice(friends, func(i, j int) bool {
+		if friends[i].Favorite != friends[j].Favorite {
+			return friends[i].Favorite
+		}
+		return friends[i].CreatedAt.After(friends[j].CreatedAt)
+	})
 
+	out := m.sectionsLocked()
+	out["discovery"] = known
+	out["requests"] = reqs
+	out["friends"] = friends
+	out["conversations"] = m.conversationsSnapshotLocked()
+	out["group_conversations"] = m.groupConversationsSnapshotLocked()
+	return out
+}
+
+// sectionsLocked is the part of the snapshot that streams as state_patch
+// events; users, requests, friends and messages stream item by item.
+func (m *Manager) sectionsLocked() map[string]any {
 	me := (*Profile)(nil)
 	if m.profile != nil {
 		cp := *m.profile
@@ -302,36 +511,32 @@ func (m *Manager) Snapshot() map[string]any {
 	}
 
 	return map[string]any{
-		"initialized":   m.profile != nil && m.identity != nil,
-		"has_profile":   m.profile != nil,
-		"unlocked":      m.profile != nil && m.identity != nil,
-		"me":            me,
-		"discovery":     known,
-		"requests":      reqs,
-		"friends":       friends,
-		"conversations": m.conversationsSnapshotLocked(),
+		"initialized":     m.profile != nil && m.identity != nil,
+		"has_profile":     m.profile != nil || m.lockedLocked(),
+		"locked":          m.lockedLocked(),
+		"key_version":     len(m.keyRotations),
+		"security_alerts": m.securityAlertsSnapshotLocked(),
+		"blocked":         m.blockedSnapshotLocked(),
+		"muted":           m.mutedSnapshotLocked(),
+		"request_drops":   m.requestDrops,
+		"purge_audit":     m.purgeLogSnapshotLocked(),
+		"unlocked":        m.profile != nil && m.identity != nil,
+		"me":              me,
+		"contact_groups":  m.contactGroupsSnapshotLocked(),
+		"groups":          m.groupsSnapshotLocked(),
+		"outbox":          m.outboxSnapshotLocked(),
+		"unread":          m.unreadCountsLocked(),
+		"media_transfers": m.mediaTransfersLocked(),
+		"devices":         m.deviceSnapshotLocked(),
 	}
 }
 
-func (m *Manager) SubscribeEvents() (<-chan string, func()) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	id := m.nextListenerID
-	m.nextListenerID++
-	ch := make(chan string, 64)
-	m.listeners[id] = ch
-	cancel := func() {
-		m.mu.Lock()
-		defer m.mu.Unlock()
-		if c, ok := m.listeners[id]; ok {
-			delete(m.listeners, id)
-			close(c)
-		}
+func (m *Manager) SendFriendRequest(targetUserID, message, method, walletAddr, helloMsg, helloSig string) error {
+	reqID := fmt.Sprintf("fr-%d", time.Now().UnixNano())
+	stamp, err := m.requestStampFor(targetUserID, reqID)
+	if err != nil {
+		return err
 	}
-	return ch, cancel
-}
-
-func (m *Manager) SendFriendRequest(targetUserID, message, method, walletAddr, helloSig string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	if m.profile == nil || m.identity == nil {
@@ -345,20 +550,23 @@ func (m *Manager) SendFriendRequest(targetUserID, message, method, walletAddr, h
 	if !strings.EqualFold(walletAddr, m.profile.Username) {
 		return errors.New("wallet address must match profile username")
 	}
-	if !verifyWalletChallenge(walletAddr, helloSig) {
-		return errors.New("invalid wallet signature")
+	if m.blockedLocked(targetUserID, "", "") {
+		return errors.New("user is blocked")
 	}
 	target, ok := m.knownUsers[targetUserID]
 	if !ok {
 		return errors.New("target user not found in discovery")
 	}
-	reqID := fmt.Sprintf("fr-%d", time.Now().UnixNano())
+	if err := m.consumeWalletChallengeLocked(walletAddr, helloMsg, helloSig); err != nil {
+		return err
+	}
 	req := FriendRequest{
 		RequestID:         reqID,
 		FromUserID:        m.profile.UserID,
 		ToUserID:          targetUserID,
 		FromName:          m.profile.Username,
 		WalletAddress:     strings.ToLower(walletAddr),
+		HelloMessage:      helloMsg,
 		HelloSignature:    helloSig,
 		SignatureVerified: true,
 		Message:           message,
@@ -367,19 +575,9 @@ func (m *Manager) SendFriendRequest(targetUserID, message, method, walletAddr, h
 		CreatedAt:         time.Now().UTC(),
 		UpdatedAt:         time.Now().UTC(),
 	}
+	req.ExpiresAt = req.CreatedAt.Add(friendRequestTTL)
 	m.requests[reqID] = req
-	payload := map[string]any{
-		"type":           "friend_request",
-		"request_id":     reqID,
-		"from_user_id":   m.profile.UserID,
-		"from_name":      m.profile.Username,
-		"wallet_address": strings.ToLower(walletAddr),
-		"hello_sig":      helloSig,
-		"message":        message,
-		"method":         method,
-		"created_at":     req.CreatedAt.Format(time.RFC3339Nano),
-	}
-	if err := m.publishSecureLocked(inboxTopic(targetUserID), target.BoxPublicKey, payload); err != nil {
+	if err := m.publishSecureLocked(inboxTopic(targetUserID), target.BoxPublicKey, m.friendRequestPayloadLocked(req, stamp)); err != nil {
 		return err
 	}
 	return m.saveStateLocked()
@@ -398,10 +596,14 @@ func (m *Manager) RespondFriendRequest(requestID string, accept bool) error {
 	if req.Status != "pending_in" {
 		return errors.New("request already handled")
 	}
+	if time.Now().After(requestExpiry(req)) {
+		return errors.New("request expired")
+	}
 	status := "rejected"
 	if accept {
 		status = "accepted"
-		m.friends[req.FromUserID] = Friend{UserID: req.FromUserID, CreatedAt: time.Now().UTC()}
+		m.addFriendLocked(req.FromUserID, time.Now().UTC())
+		m.syncFriendsLocked()
 	}
 	req.Status = status
 	req.UpdatedAt = time.Now().UTC()
@@ -424,11 +626,20 @@ func (m *Manager) RespondFriendRequest(requestID string, accept bool) error {
 }
 
 func (m *Manager) SendDirectMessage(toUserID, body, mediaName, mediaMIME, mediaData string) error {
+	return m.SendReply(toUserID, "", body, mediaName, mediaMIME, mediaData)
+}
+
+// SendReply sends a direct message answering replyTo, an earlier message of
+// the same conversation. An empty replyTo sends a plain message.
+func (m *Manager) SendReply(toUserID, replyTo, body, mediaName, mediaMIME, mediaData string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	if _, ok := m.friends[toUserID]; !ok {
 		return errors.New("target is not a friend")
 	}
+	if replyTo != "" && m.dmIndexLocked(toUserID, replyTo) < 0 {
+		return errors.New("reply target not found")
+	}
 	target, ok := m.knownUsers[toUserID]
 	if !ok {
 		return errors.New("target user not discovered")
@@ -444,13 +655,8 @@ func (m *Manager) SendDirectMessage(toUserID, body, mediaName, mediaMIME, mediaD
 		Body:       strings.TrimSpace(body),
 		MediaName:  strings.TrimSpace(mediaName),
 		MediaMIME:  strings.TrimSpace(mediaMIME),
-		MediaData:  strings.TrimSpace(mediaData),
 		CreatedAt:  time.Now().UTC(),
 	}
-	if len(msg.MediaData) > 5*1024*1024 {
-		return errors.New("media too large")
-	}
-	m.dms[toUserID] = append(m.dms[toUserID], msg)
 	payload := map[string]any{
 		"type":         "dm_message",
 		"message_id":   msgID,
@@ -458,31 +664,43 @@ func (m *Manager) SendDirectMessage(toUserID, body, mediaName, mediaMIME, mediaD
 		"body":         msg.Body,
 		"media_name":   msg.MediaName,
 		"media_mime":   msg.MediaMIME,
-		"media_data":   msg.MediaData,
 		"created_at":   msg.CreatedAt.Format(time.RFC3339Nano),
 	}
-	wire, err := m.buildSecureEnvelopeLocked(inboxTopic(toUserID), target.BoxPublicKey, payload)
-	if err != nil {
-		return err
-	}
-	if strings.TrimSpace(target.PeerID) == "" {
-		return errors.New("target peer is offline or peer_id unknown")
+	if secs := m.friends[toUserID].RetentionSeconds; secs > 0 {
+		msg.ExpiresAt = m.messageExpiryLocked(toUserID, msg.CreatedAt, 0)
+		payload["expires_in"] = secs
 	}
-	rep, derr := m.rpc.SendDirect(localrpcclient.SendDirectArgs{
-		AppID:   AppID,
-		PeerID:  target.PeerID,
-		Topic:   inboxTopic(toUserID),
-		Payload: wire,
-	})
-	if derr != nil {
-		return derr
+	if replyTo != "" {
+		m.attachReplyLocked(toUserID, &msg, replyTo)
+		payload["reply_to"] = replyTo
 	}
-	if rep.Error != "" || !rep.Sent {
-		if rep.Error != "" {
-			return errors.New(rep.Error)
+	if mediaData = strings.TrimSpace(mediaData); mediaData != "" {
+		raw, mime, err := decodeMediaData(mediaData)
+		if err != nil {
+			return err
+		}
+		if msg.MediaMIME == "" {
+			msg.MediaMIME = mime
 		}
-		return errors.New("direct stream send failed")
+		ref, err := m.storeMediaLocked(raw, msg.MediaName, msg.MediaMIME)
+		if err != nil {
+			return err
+		}
+		m.shareMediaLocked(ref.Digest, toUserID)
+		msg.MediaDigest = ref.Digest
+		msg.MediaSize = ref.Size
+		payload["media_mime"] = msg.MediaMIME
+		payload["media"] = ref
 	}
+	wire, err := m.buildSecureEnvelopeLocked(inboxTopic(toUserID), target.BoxPublicKey, payload)
+	if err != nil {
+		return err
+	}
+	msg.Status = DeliveryQueued
+	m.dms[toUserID] = append(m.dms[toUserID], msg)
+	m.enqueueOutboxLocked(toUserID, msgID, wire)
+	m.fanoutLocked(toUserID, payload)
+	m.syncOwnDevicesLocked("sent_dm", map[string]any{"peer_user_id": toUserID, "message": msg})
 	return m.saveStateLocked()
 }
 
@@ -496,6 +714,15 @@ func (m *Manager) Conversation(peerUserID string) []DirectMessage {
 	return out
 }
 
+func (m *Manager) hasDMLocked(peerUserID, msgID string) bool {
+	for _, msg := range m.dms[peerUserID] {
+		if msg.MessageID == msgID {
+			return true
+		}
+	}
+	return false
+}
+
 func (m *Manager) CreateInviteLink() (string, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -516,13 +743,19 @@ func (m *Manager) CreateInviteLink() (string, error) {
 		"nonce":      nonce,
 		"expires_at": time.Now().UTC().Add(defaultInviteTTL).Unix(),
 	}
+	if len(m.keyRotations) > 0 {
+		payload["key_rotations"] = m.keyRotations
+	}
+	if p := normalizeRequestPolicy(m.profile.Settings.RequestPolicy); p.PoWBits > 0 {
+		payload["pow_bits"] = p.PoWBits
+	}
 	body, _ := json.Marshal(payload)
 	sig := ed25519.Sign(m.identity.SignPrivate, body)
 	token := base64.RawURLEncoding.EncodeToString(body) + "." + base64.RawURLEncoding.EncodeToString(sig)
 	return token, nil
 }
 
-func (m *Manager) SendFriendRequestByInvite(token, message, walletAddr, helloSig string) error {
+func (m *Manager) SendFriendRequestByInvite(token, message, walletAddr, helloMsg, helloSig string) error {
 	payload, err := parseInvite(token)
 	if err != nil {
 		return err
@@ -533,6 +766,10 @@ func (m *Manager) SendFriendRequestByInvite(token, message, walletAddr, helloSig
 	if userID == "" || boxPub == "" {
 		return errors.New("invalid invite payload")
 	}
+	var chain []keyRotation
+	if raw, ok := payload["key_rotations"]; ok && remarshal(raw, &chain) != nil {
+		return errors.New("invalid invite payload")
+	}
 	m.mu.Lock()
 	if m.profile == nil || m.identity == nil {
 		m.mu.Unlock()
@@ -543,12 +780,28 @@ func (m *Manager) SendFriendRequestByInvite(token, message, walletAddr, helloSig
 			m.mu.Unlock()
 			return errors.New("invite already used")
 		}
+	}
+	powBits, _ := payload["pow_bits"].(float64)
+	u := KnownUser{UserID: userID, PeerID: asString(payload["peer_id"]), Username: asString(payload["username"]), SignPublicKey: asString(payload["sign_pub"]), BoxPublicKey: boxPub, LastSeenAt: time.Now().UTC()}
+	u.RequestPoWBits = min(max(int(powBits), 0), maxRequestPoWBits)
+	prev, known := m.knownUsers[userID]
+	if !m.acceptPresenceKeysLocked(&u, prev, known, chain) {
+		m.mu.Unlock()
+		return errors.New("invite keys do not match the keys known for this user")
+	}
+	if known {
+		prev.SignPublicKey, prev.BoxPublicKey = u.SignPublicKey, u.BoxPublicKey
+		prev.KeyVersion, prev.KeyRotatedAt, prev.KeyWalletVerified = u.KeyVersion, u.KeyRotatedAt, u.KeyWalletVerified
+		prev.RequestPoWBits = max(prev.RequestPoWBits, u.RequestPoWBits)
+		u = prev
+	}
+	if nonce != "" {
 		m.usedInviteNonce[nonce] = time.Now().UTC()
 	}
-	m.knownUsers[userID] = KnownUser{UserID: userID, PeerID: asString(payload["peer_id"]), Username: asString(payload["username"]), SignPublicKey: asString(payload["sign_pub"]), BoxPublicKey: boxPub, LastSeenAt: time.Now().UTC()}
+	m.knownUsers[userID] = u
 	_ = m.saveStateLocked()
 	m.mu.Unlock()
-	return m.SendFriendRequest(userID, message, "invite", walletAddr, helloSig)
+	return m.SendFriendRequest(userID, message, "invite", walletAddr, helloMsg, helloSig)
 }
 
 func parseInvite(token string) (map[string]any, error) {
@@ -589,9 +842,24 @@ func (m *Manager) publishPresence() {
 	profile := m.profile
 	peerID := m.nodePeerID
 	m.mu.RUnlock()
-	if profile == nil || !profile.Settings.Discoverable {
+	if profile == nil || profile.Settings.Privacy == PrivacyHidden {
 		return
 	}
+	m.mu.Lock()
+	var prekey map[string]any
+	var devices *deviceList
+	deviceID := m.deviceIDLocked()
+	rotated, err := m.ensurePrekeyLocked()
+	if m.ensureDeviceListLocked() || (err == nil && rotated) {
+		_ = m.saveStateLocked()
+	}
+	prekey = m.prekeyAdvertLocked()
+	if m.deviceList != nil {
+		cp := *m.deviceList
+		devices = &cp
+	}
+	rotations := append([]keyRotation(nil), m.keyRotations...)
+	m.mu.Unlock()
 	body := map[string]any{
 		"user_id":         profile.UserID,
 		"peer_id":         peerID,
@@ -603,7 +871,56 @@ func (m *Manager) publishPresence() {
 		"settings":        profile.Settings,
 		"ts":              time.Now().UTC().Format(time.RFC3339Nano),
 	}
-	_ = m.publishPlain(topicPresence, body)
+	if prekey != nil {
+		body["prekey"] = prekey
+	}
+	if deviceID != "" {
+		body["device_id"] = deviceID
+	}
+	if devices != nil {
+		body["device_list"] = devices
+	}
+	if len(rotations) > 0 {
+		body["key_rotations"] = rotations
+	}
+	if profile.WalletBinding != nil {
+		body["wallet_binding"] = profile.WalletBinding
+	}
+	if profile.Settings.Privacy == PrivacyFriends {
+		m.mu.Lock()
+		m.publishFriendsPresenceLocked(body)
+		m.mu.Unlock()
+		return
+	}
+	m.mu.RLock()
+	signed, err := m.signPlainBodyLocked(body)
+	m.mu.RUnlock()
+	if err != nil {
+		return
+	}
+	_ = m.publishPlain(topicPresence, signed)
+}
+
+// publishFriendsPresenceLocked seals the signed beacon to each friend
+// instead of broadcasting it.
+func (m *Manager) publishFriendsPresenceLocked(body map[string]any) {
+	signed, err := m.signPlainBodyLocked(body)
+	if err != nil || m.profile == nil {
+		return
+	}
+	for id := range m.friends {
+		u, ok := m.knownUsers[id]
+		if !ok {
+			continue
+		}
+		payload := map[string]any{
+			"type":         "presence",
+			"from_user_id": m.profile.UserID,
+			"presence":     signed,
+		}
+		_ = m.publishSecureLocked(inboxTopic(id), u.BoxPublicKey, payload)
+	}
+	_ = m.saveStateLocked()
 }
 
 func (m *Manager) refreshNodeStatus() {
@@ -638,10 +955,22 @@ func (m *Manager) publishSecureLocked(topic, recipientBoxPubB64 string, body map
 	if err != nil {
 		return err
 	}
-	return m.publishSecureBytesLocked(topic, wire)
+	if err := m.publishSecureBytesLocked(topic, wire); err != nil {
+		return err
+	}
+	m.fanoutLocked(userIDFromInboxTopic(topic), body)
+	return nil
 }
 
 func (m *Manager) buildSecureEnvelopeLocked(topic, recipientBoxPubB64 string, body map[string]any) ([]byte, error) {
+	return m.buildEnvelopeLocked(topic, recipientBoxPubB64, "", body)
+}
+
+// buildEnvelopeLocked seals body for one recipient device. An empty toDevice
+// addresses the recipient's primary device. Each pair of devices runs its
+// own ratchet session; the static scheme is only used for devices that do
+// not advertise a prekey.
+func (m *Manager) buildEnvelopeLocked(topic, recipientBoxPubB64, toDevice string, body map[string]any) ([]byte, error) {
 	if m.identity == nil || m.profile == nil {
 		return nil, errors.New("identity not ready")
 	}
@@ -653,10 +982,7 @@ func (m *Manager) buildSecureEnvelopeLocked(topic, recipientBoxPubB64 string, bo
 	copy(peerPub[:], peerPubRaw)
 
 	plain, _ := json.Marshal(body)
-	cipherText, nonce, err := encryptForPeer(m.identity.BoxPrivateKey, peerPub, plain)
-	if err != nil {
-		return nil, err
-	}
+	toUser := userIDFromInboxTopic(topic)
 	msgID := fmt.Sprintf("s-%d", time.Now().UnixNano())
 	secure := map[string]any{
 		"version":         1,
@@ -664,12 +990,39 @@ func (m *Manager) buildSecureEnvelopeLocked(topic, recipientBoxPubB64 string, bo
 		"msg_id":          msgID,
 		"from_user_id":    m.profile.UserID,
 		"sender_sign_pub": m.profile.SignPublicKey,
-		"sender_box_pub":  m.profile.BoxPublicKey,
-		"to_user_id":      userIDFromInboxTopic(topic),
-		"nonce":           base64.RawStdEncoding.EncodeToString(nonce),
-		"ciphertext":      base64.RawStdEncoding.EncodeToString(cipherText),
+		"sender_box_pub":  base64.RawStdEncoding.EncodeToString(m.identity.BoxPublicKey[:]),
+		"to_user_id":      toUser,
 		"ts":              time.Now().UTC().Format(time.RFC3339Nano),
 	}
+	if toDevice != "" {
+		secure["to_device_id"] = toDevice
+	}
+	sess, err := m.sendSessionLocked(toUser, recipientBoxPubB64)
+	if err != nil {
+		return nil, err
+	}
+	if sess != nil {
+		hdr, nonce, cipherText, err := sess.encrypt(plain, sessionAD(m.profile.UserID, toUser))
+		if err != nil {
+			return nil, err
+		}
+		secure["scheme"] = ratchetScheme
+		secure["header"] = map[string]any{"dh": hdr.DH, "pn": hdr.PN, "n": hdr.N}
+		if init := sess.PendingX3DH; init != nil {
+			secure["x3dh"] = map[string]any{"ek": init.Ephemeral, "spk_id": init.PrekeyID, "ts": init.CreatedAt}
+		}
+		secure["nonce"] = base64.RawStdEncoding.EncodeToString(nonce)
+		secure["ciphertext"] = base64.RawStdEncoding.EncodeToString(cipherText)
+	} else {
+		// Devices that do not advertise a signed prekey only understand the
+		// static per-pair key.
+		cipherText, nonce, err := encryptForPeer(m.identity.BoxPrivateKey, peerPub, plain)
+		if err != nil {
+			return nil, err
+		}
+		secure["nonce"] = base64.RawStdEncoding.EncodeToString(nonce)
+		secure["ciphertext"] = base64.RawStdEncoding.EncodeToString(cipherText)
+	}
 	canon, _ := json.Marshal(secure)
 	sig := ed25519.Sign(m.identity.SignPrivate, canon)
 	secure["sig"] = base64.RawStdEncoding.EncodeToString(sig)
@@ -742,8 +1095,7 @@ func generateIdentity() (*Identity, error) {
 	}
 	var boxPub [32]byte
 	copy(boxPub[:], boxPubRaw)
-	h := sha256.Sum256(append([]byte("social-user:"), signPub...))
-	userID := "u_" + hex.EncodeToString(h[:8])
+	userID := userIDForSignKey(signPub)
 	return &Identity{UserID: userID, SignPublicKey: signPub, SignPrivate: signPriv, BoxPublicKey: boxPub, BoxPrivateKey: boxPriv}, nil
 }
 
@@ -776,22 +1128,40 @@ func (m *Manager) walletNormalized(addr string) (string, error) {
 	return addr, nil
 }
 
-func (m *Manager) LoginWithWallet(walletAddr string, settings Settings) (*Profile, error) {
+func (m *Manager) LoginWithWallet(walletAddr, passphrase string, settings Settings) (*Profile, error) {
 	walletAddr, err := m.walletNormalized(walletAddr)
 	if err != nil {
 		return nil, err
 	}
+	if strings.TrimSpace(passphrase) == "" {
+		return nil, errors.New("passphrase required")
+	}
 
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	if m.identity == nil {
-		if err := m.loadIdentityPlainLocked(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		if _, err := os.Stat(m.identityEncPath()); err == nil {
+			if err := m.unlockStateLocked(passphrase); err != nil {
+				return nil, err
+			}
+		} else if err := m.loadIdentityPlainLocked(); err == nil {
+			// Older wallet logins kept identity.json in plaintext; seal it and
+			// the state under the passphrase now.
+			if err := m.rekeyLocked(passphrase); err != nil {
+				m.identity = nil
+				return nil, err
+			}
+		} else if !errors.Is(err, os.ErrNotExist) {
 			return nil, err
 		}
 	}
 
 	if m.profile == nil {
+		settings, err := mergeSettings(Settings{}, settings)
+		if err != nil {
+			return nil, err
+		}
 		id, err := generateIdentity()
 		if err != nil {
 			return nil, err
@@ -804,12 +1174,13 @@ func (m *Manager) LoginWithWallet(walletAddr string, settings Settings) (*Profil
 			AvatarData:    "",
 			SignPublicKey: base64.RawStdEncoding.EncodeToString(id.SignPublicKey),
 			BoxPublicKey:  base64.RawStdEncoding.EncodeToString(id.BoxPublicKey[:]),
-			Settings:      normalizeSettings(settings),
+			Settings:      settings,
 			InitializedAt: now,
 			LastUpdatedAt: now,
 		}
 		m.identity = id
-		if err := m.saveIdentityPlainLocked(); err != nil {
+		if err := m.rekeyLocked(passphrase); err != nil {
+			m.profile, m.identity = nil, nil
 			return nil, err
 		}
 		if err := m.saveStateLocked(); err != nil {
@@ -827,7 +1198,10 @@ func (m *Manager) LoginWithWallet(walletAddr string, settings Settings) (*Profil
 	if m.identity == nil {
 		return nil, errors.New("local identity missing")
 	}
-	incoming := normalizeSettings(settings)
+	incoming, err := mergeSettings(m.profile.Settings, settings)
+	if err != nil {
+		return nil, err
+	}
 	if incoming.ContractAddress == "" {
 		incoming.ContractAddress = m.profile.Settings.ContractAddress
 	}
@@ -842,19 +1216,6 @@ func (m *Manager) LoginWithWallet(walletAddr string, settings Settings) (*Profil
 	return &cp, nil
 }
 
-func (m *Manager) saveIdentityPlainLocked() error {
-	if m.identity == nil {
-		return errors.New("identity missing")
-	}
-	plain := identityPlain{
-		UserID:      m.identity.UserID,
-		SignPrivB64: base64.RawStdEncoding.EncodeToString(m.identity.SignPrivate),
-		BoxPrivB64:  base64.RawStdEncoding.EncodeToString(m.identity.BoxPrivateKey[:]),
-	}
-	b, _ := json.MarshalIndent(plain, "", "  ")
-	return os.WriteFile(m.identityPlainPath(), b, 0o600)
-}
-
 func (m *Manager) loadIdentityPlainLocked() error {
 	if m.identity != nil {
 		return nil
@@ -893,75 +1254,25 @@ func (m *Manager) saveIdentity(passphrase string) error {
 	if m.identity == nil {
 		return errors.New("identity missing")
 	}
-	plain := identityPlain{
-		UserID:      m.identity.UserID,
-		SignPrivB64: base64.RawStdEncoding.EncodeToString(m.identity.SignPrivate),
-		BoxPrivB64:  base64.RawStdEncoding.EncodeToString(m.identity.BoxPrivateKey[:]),
-	}
-	payload, _ := json.Marshal(plain)
-	salt := make([]byte, 16)
-	if _, err := rand.Read(salt); err != nil {
-		return err
-	}
-	iter := uint32(2)
-	mem := uint32(64 * 1024)
-	par := uint8(1)
-	key := argon2.IDKey([]byte(passphrase), salt, iter, mem, par, 32)
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return err
-	}
-	aead, err := cipher.NewGCM(block)
+	f, err := sealWithPassphrase(passphrase, identityPlainJSON(m.identity))
 	if err != nil {
 		return err
 	}
-	nonce := make([]byte, aead.NonceSize())
-	if _, err := rand.Read(nonce); err != nil {
-		return err
-	}
-	ct := aead.Seal(nil, nonce, payload, nil)
-	f := encryptedIdentityFile{Version: 1, KDF: "argon2id", Salt: base64.RawStdEncoding.EncodeToString(salt), MemoryKiB: mem, Iterations: iter, Parallel: par, Nonce: base64.RawStdEncoding.EncodeToString(nonce), Ciphertext: base64.RawStdEncoding.EncodeToString(ct)}
-	b, _ := json.MarshalIndent(f, "", "  ")
-	return os.WriteFile(filepath.Join(m.cfg.DataDir, "identity.enc.json"), b, 0o600)
+	return writeSealedFile(m.identityEncPath(), f)
 }
 
 func (m *Manager) unlock(passphrase string) error {
 	if m.identity != nil {
 		return nil
 	}
-	b, err := os.ReadFile(filepath.Join(m.cfg.DataDir, "identity.enc.json"))
-	if err != nil {
-		return err
-	}
-	var f encryptedIdentityFile
-	if err := json.Unmarshal(b, &f); err != nil {
-		return err
-	}
-	salt, err := base64.RawStdEncoding.DecodeString(f.Salt)
-	if err != nil {
-		return err
-	}
-	nonce, err := base64.RawStdEncoding.DecodeString(f.Nonce)
+	f, err := readSealedFile(m.identityEncPath())
 	if err != nil {
 		return err
 	}
-	ct, err := base64.RawStdEncoding.DecodeString(f.Ciphertext)
+	plainRaw, err := openWithPassphrase(f, passphrase)
 	if err != nil {
 		return err
 	}
-	key := argon2.IDKey([]byte(passphrase), salt, f.Iterations, f.MemoryKiB, f.Parallel, 32)
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return err
-	}
-	aead, err := cipher.NewGCM(block)
-	if err != nil {
-		return err
-	}
-	plainRaw, err := aead.Open(nil, nonce, ct, nil)
-	if err != nil {
-		return errors.New("invalid passphrase")
-	}
 	var plain identityPlain
 	if err := json.Unmarshal(plainRaw, &plain); err != nil {
 		return err
@@ -999,10 +1310,15 @@ func (m *Manager) startLoopLocked() {
 	if m.cancel != nil || m.profile == nil || m.identity == nil {
 		return
 	}
+	rotated, err := m.ensurePrekeyLocked()
+	if m.ensureDeviceListLocked() || (err == nil && rotated) {
+		_ = m.saveStateLocked()
+	}
 	ctx, cancel := context.WithCancel(context.Background())
 	m.cancel = cancel
 	go m.loop(ctx)
 	go m.presenceTicker(ctx)
+	go m.retentionSweeper(ctx)
 }
 
 func (m *Manager) loop(ctx context.Context) {
@@ -1033,11 +1349,14 @@ func (m *Manager) loop(ctx context.Context) {
 			continue
 		}
 		for _, msg := range rep.Messages {
+			if ctx.Err() != nil {
+				return
+			}
 			if !m.shouldProcess(msg.Topic, msg.Offset) {
 				continue
 			}
-			m.processRecord(msg)
-			m.commitCursor(msg.Topic, msg.Offset)
+			persist := m.processRecord(msg)
+			m.commitCursor(msg.Topic, msg.Offset, persist)
 		}
 		select {
 		case <-ctx.Done():
@@ -1068,7 +1387,7 @@ func (m *Manager) ensureSubscribed() error {
 			from = 0
 		}
 	}
-	topics := []string{topicPresence, inboxTopic(m.profile.UserID)}
+	topics := m.subscriptionTopicsLocked()
 	rep, err := m.rpc.Subscribe(localrpcclient.SubscribeArgs{AppID: AppID, Topics: topics, FromOffset: from})
 	if err != nil {
 		return err
@@ -1086,7 +1405,9 @@ func (m *Manager) shouldProcess(topic string, offset int64) bool {
 	return offset > m.cursors[topic]
 }
 
-func (m *Manager) commitCursor(topic string, offset int64) {
+// commitCursor acks a record. The cursor is only saved with persist set;
+// otherwise it is written out by the next save.
+func (m *Manager) commitCursor(topic string, offset int64, persist bool) {
 	m.mu.Lock()
 	m.cursors[topic] = offset
 	subID := m.subscriptionID
@@ -1094,17 +1415,21 @@ func (m *Manager) commitCursor(topic string, offset int64) {
 	if m.profile != nil {
 		appUser = m.profile.UserID
 	}
-	_ = m.saveStateLocked()
+	if persist {
+		_ = m.saveStateLocked()
+	}
 	m.mu.Unlock()
 	if subID != "" && appUser != "" {
 		_, _ = m.rpc.Ack(localrpcclient.AckArgs{AppID: AppID, SubscriptionID: subID, Topic: topic, Offset: offset})
 	}
 }
 
-func (m *Manager) processRecord(rec localrpcclient.MessageRecord) {
+// processRecord handles one record and reports whether it may have changed
+// persisted state. Ephemeral signals do not.
+func (m *Manager) processRecord(rec localrpcclient.MessageRecord) bool {
 	var generic map[string]any
 	if err := json.Unmarshal(rec.Payload, &generic); err != nil {
-		return
+		return true
 	}
 	kind, _ := generic["kind"].(string)
 	switch kind {
@@ -1112,24 +1437,68 @@ func (m *Manager) processRecord(rec localrpcclient.MessageRecord) {
 		body, _ := generic["body"].(map[string]any)
 		if rec.Topic == topicPresence {
 			m.handlePresence(body)
-			return
+			return true
+		}
+		if strings.HasPrefix(rec.Topic, topicLinkPrefix) {
+			m.handleDeviceLinkRecord(body)
+			return true
 		}
 	case "secure":
 		m.handleSecure(generic)
+	case "group":
+		m.handleGroupEnvelope(generic)
+	case "media_chunk":
+		m.handleMediaChunk(generic)
+	case "signal":
+		m.handleSignal(generic)
+		return false
+	case "session_reset":
+		m.handleSessionReset(generic)
 	}
+	return true
 }
 
 func (m *Manager) handlePresence(body map[string]any) {
-	uid := asString(body["user_id"])
-	if uid == "" {
+	uid, ts, ok := checkPresence(body)
+	if !ok {
 		return
 	}
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	m.applyPresenceLocked(body, uid, ts)
+}
+
+// checkPresence verifies the beacon signature and freshness.
+func checkPresence(body map[string]any) (string, time.Time, bool) {
+	uid := asString(body["user_id"])
+	if uid == "" || !verifyPlainBody(body, asString(body["sign_public_key"])) {
+		return "", time.Time{}, false
+	}
+	ts, _ := time.Parse(time.RFC3339Nano, asString(body["ts"]))
+	if !presenceFresh(ts, time.Now()) {
+		return "", time.Time{}, false
+	}
+	return uid, ts, true
+}
+
+func (m *Manager) applyPresenceLocked(body map[string]any, uid string, ts time.Time) {
 	if m.profile != nil && uid == m.profile.UserID {
+		// Our other devices advertise the prekeys that device sync is
+		// sealed to.
+		if m.deviceList != nil && asString(body["sign_public_key"]) == m.profile.SignPublicKey {
+			if devices, ok := withDevicePrekey(m.deviceList.Devices, asString(body["device_id"]), m.profile.SignPublicKey, body["prekey"]); ok {
+				cp := *m.deviceList
+				cp.Devices = devices
+				m.deviceList = &cp
+				_ = m.saveStateLocked()
+			}
+		}
 		return
 	}
-	m.knownUsers[uid] = KnownUser{
+	if m.blockedLocked(uid, asString(body["sign_public_key"]), asString(body["username"])) {
+		return
+	}
+	u := KnownUser{
 		UserID:        uid,
 		PeerID:        asString(body["peer_id"]),
 		Username:      asString(body["username"]),
@@ -1138,6 +1507,65 @@ func (m *Manager) handlePresence(body map[string]any) {
 		SignPublicKey: asString(body["sign_public_key"]),
 		BoxPublicKey:  asString(body["box_public_key"]),
 		LastSeenAt:    time.Now().UTC(),
+
+		RequestPoWBits: advertisedPoWBits(body),
+	}
+	prev, known := m.knownUsers[uid]
+	var chain []keyRotation
+	if raw, ok := body["key_rotations"].([]any); ok && remarshal(raw, &chain) != nil {
+		return
+	}
+	if !m.acceptPresenceKeysLocked(&u, prev, known, chain) {
+		return
+	}
+	u.Verified = verifyProfileBindingBody(body["wallet_binding"], u.Username, u.UserID, u.SignPublicKey, u.BoxPublicKey)
+	if pk, ok := body["prekey"].(map[string]any); ok {
+		id, pub, sig := asString(pk["id"]), asString(pk["pub"]), asString(pk["sig"])
+		if verifyPrekey(u.SignPublicKey, id, pub, sig) {
+			u.PrekeyID, u.PrekeyPublic, u.PrekeySignature = id, pub, sig
+		}
+	}
+	var list *deviceList
+	if raw, ok := body["device_list"].(map[string]any); ok {
+		var l deviceList
+		if remarshal(raw, &l) == nil && verifyDeviceList(u.SignPublicKey, &l) {
+			list = &l
+		}
+	}
+	deviceID := asString(body["device_id"])
+	if list != nil && !isPrimaryIn(list.Devices, deviceID) {
+		// A linked device only refreshes its own entry; the account-level
+		// peer and prekey fields belong to the primary.
+		if !known {
+			prev = u
+			prev.PeerID, prev.PrekeyID, prev.PrekeyPublic, prev.PrekeySignature = "", "", "", ""
+			prev.PresenceAt = time.Time{}
+		}
+		if prev.SignPublicKey != u.SignPublicKey || prev.BoxPublicKey != u.BoxPublicKey {
+			prev.Verified = false
+		}
+		prev.Verified = prev.Verified || u.Verified
+		prev.SignPublicKey, prev.BoxPublicKey, prev.FromGroup = u.SignPublicKey, u.BoxPublicKey, false
+		prev.KeyVersion, prev.KeyRotatedAt, prev.KeyWalletVerified = u.KeyVersion, u.KeyRotatedAt, u.KeyWalletVerified
+		applyDeviceList(&prev, prev, list)
+		markDeviceSeen(&prev, deviceID, u.PeerID)
+		if devices, ok := withDevicePrekey(prev.Devices, deviceID, u.SignPublicKey, body["prekey"]); ok {
+			prev.Devices = devices
+		}
+		m.knownUsers[uid] = prev
+		_ = m.saveStateLocked()
+		return
+	}
+	if known && !ts.After(prev.PresenceAt) {
+		return
+	}
+	u.PresenceAt = ts
+	applyDeviceList(&u, prev, list)
+	markDeviceSeen(&u, deviceID, u.PeerID)
+	m.knownUsers[uid] = u
+	if u.PeerID != "" {
+		m.flushOutboxLocked(uid, true)
+		m.resumeMediaDownloadsLocked(uid)
 	}
 	_ = m.saveStateLocked()
 }
@@ -1162,7 +1590,8 @@ func (m *Manager) handleSecure(raw map[string]any) {
 	nonceB64 := asString(raw["nonce"])
 	cipherB64 := asString(raw["ciphertext"])
 	msgID := asString(raw["msg_id"])
-	if msgID == "" {
+	sentAt, err := time.Parse(time.RFC3339Nano, asString(raw["ts"]))
+	if msgID == "" || err != nil || time.Since(sentAt) > seenMessageTTL {
 		return
 	}
 	m.mu.RLock()
@@ -1184,22 +1613,43 @@ func (m *Manager) handleSecure(raw map[string]any) {
 	if err != nil {
 		return
 	}
-	canonMap := map[string]any{
-		"version":         raw["version"],
-		"kind":            raw["kind"],
-		"msg_id":          raw["msg_id"],
-		"from_user_id":    raw["from_user_id"],
-		"sender_sign_pub": raw["sender_sign_pub"],
-		"sender_box_pub":  raw["sender_box_pub"],
-		"to_user_id":      raw["to_user_id"],
-		"nonce":           raw["nonce"],
-		"ciphertext":      raw["ciphertext"],
-		"ts":              raw["ts"],
+	canonMap := make(map[string]any, len(raw))
+	for k, v := range raw {
+		if k != "sig" {
+			canonMap[k] = v
+		}
 	}
 	canon, _ := json.Marshal(canonMap)
 	if !ed25519.Verify(ed25519.PublicKey(senderSignPubRaw), canon, sig) {
 		return
 	}
+	// Each device only opens the copy sealed to its own box key.
+	m.mu.RLock()
+	if m.keyRevokedLocked(senderSignPubB64) || m.keyRevokedLocked(senderPubB64) {
+		m.mu.RUnlock()
+		return
+	}
+	// Senders are held to the key pinned for them; an unknown sender's user
+	// ID has to derive from the key it signs with.
+	if from := asString(raw["from_user_id"]); from != myUser {
+		pinned := m.knownUsers[from].SignPublicKey
+		if (pinned != "" && pinned != senderSignPubB64) || (pinned == "" && !verifyKeyChain(from, nil, senderSignPubB64)) {
+			m.mu.RUnlock()
+			return
+		}
+		if m.blockedLocked(from, senderSignPubB64, m.knownUsers[from].Username) {
+			m.mu.RUnlock()
+			return
+		}
+	}
+	forUs := m.isPrimaryDeviceLocked()
+	if toDevice := asString(raw["to_device_id"]); toDevice != "" {
+		forUs = toDevice == m.deviceIDLocked()
+	}
+	m.mu.RUnlock()
+	if !forUs {
+		return
+	}
 	nonce, err := base64.RawStdEncoding.DecodeString(nonceB64)
 	if err != nil {
 		return
@@ -1210,7 +1660,21 @@ func (m *Manager) handleSecure(raw map[string]any) {
 	}
 	var senderPub [32]byte
 	copy(senderPub[:], senderPubRaw)
-	plain, err := decryptFromPeer(id.BoxPrivateKey, senderPub, nonce, cipherText)
+	var plain []byte
+	if asString(raw["scheme"]) == ratchetScheme {
+		fromOuter := asString(raw["from_user_id"])
+		m.mu.Lock()
+		plain, err = m.openRatchetLocked(fromOuter, senderPub, raw, sessionAD(fromOuter, myUser))
+		if err == nil {
+			m.markSeenLocked(msgID, sentAt)
+			_ = m.saveStateLocked()
+		} else if m.sessionResetWantedLocked(fromOuter, senderPubB64, raw) {
+			m.requestSessionResetLocked(fromOuter, senderPubB64)
+		}
+		m.mu.Unlock()
+	} else {
+		plain, err = decryptFromPeer(id.BoxPrivateKey, senderPub, nonce, cipherText)
+	}
 	if err != nil {
 		return
 	}
@@ -1220,19 +1684,63 @@ func (m *Manager) handleSecure(raw map[string]any) {
 	}
 	msgType := asString(body["type"])
 	fromUser := asString(body["from_user_id"])
+	// The signed envelope names the sender; a body claiming someone else
+	// would let one friend act on another's conversation.
+	if fromUser != asString(raw["from_user_id"]) {
+		return
+	}
+	// A request's wallet is only looked up once its hello proves it.
+	isContact := false
+	hello, helloOK := walletChallenge{}, false
+	if msgType == "friend_request" {
+		hello, helloOK = helloSigned(strings.ToLower(strings.TrimSpace(asString(body["wallet_address"]))), fromUser, senderPubB64,
+			asString(body["hello_message"]), strings.TrimSpace(asString(body["hello_sig"])))
+	}
+	if helloOK || msgType == "dm_message" {
+		isContact = m.senderIsContact(fromUser, body)
+	}
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.seenMessageIDs[msgID] = struct{}{}
+	m.markSeenLocked(msgID, sentAt)
+	if asString(raw["from_user_id"]) == myUser {
+		// Only our own devices may write as us, and only to sync state.
+		if msgType == "device_sync" && bytes.Equal(senderSignPubRaw, id.SignPublicKey) {
+			m.handleDeviceSyncLocked(body)
+			_ = m.saveStateLocked()
+		}
+		return
+	}
+	_, friend := m.friends[fromUser]
+	if !friend && (msgType == "friend_request" || msgType == "dm_message") && !m.strangerAllowedLocked(isContact) {
+		if msgType == "friend_request" {
+			m.requestDrops.Privacy++
+		}
+		return
+	}
 	switch msgType {
-	case "friend_request":
-		if m.profile != nil && !m.profile.Settings.AllowStrangerRequests {
-			if _, ok := m.friends[fromUser]; !ok {
-				return
-			}
+	case "presence":
+		p, _ := body["presence"].(map[string]any)
+		if !friend || p == nil {
+			return
 		}
+		if uid, ts, ok := checkPresence(p); ok && uid == fromUser {
+			m.applyPresenceLocked(p, uid, ts)
+		}
+	case "friend_request":
 		walletAddr := strings.ToLower(strings.TrimSpace(asString(body["wallet_address"])))
-		helloSig := strings.TrimSpace(asString(body["hello_sig"]))
-		if !verifyWalletChallenge(walletAddr, helloSig) {
+		if m.blockedLocked(fromUser, senderSignPubB64, walletAddr) {
+			return
+		}
+		if req, exists := m.requests[asString(body["request_id"])]; exists {
+			m.handleRequestResendLocked(fromUser, req, body)
+			return
+		}
+		created := parseTS(asString(body["created_at"]))
+		if !helloOK || !m.acceptHelloLocked(hello, created) {
+			m.requestDrops.InvalidHello++
+			return
+		}
+		if !friend && !m.admitStrangerRequestLocked(fromUser, walletAddr, asString(body["request_id"]), asString(body["pow_stamp"]), isContact) {
 			return
 		}
 		fromName := strings.TrimSpace(asString(body["from_name"]))
@@ -1246,36 +1754,49 @@ func (m *Manager) handleSecure(raw map[string]any) {
 		if reqID == "" {
 			return
 		}
-		if _, exists := m.requests[reqID]; exists {
-			return
+		boxKey := senderPubB64
+		if u, ok := m.knownUsers[fromUser]; ok && u.BoxPublicKey != "" {
+			boxKey = u.BoxPublicKey
 		}
-		created := parseTS(asString(body["created_at"]))
 		m.requests[reqID] = FriendRequest{
 			RequestID:         reqID,
 			FromUserID:        fromUser,
 			ToUserID:          myUser,
 			FromName:          walletAddr,
 			WalletAddress:     walletAddr,
-			HelloSignature:    helloSig,
+			ProfileVerified:   verifyProfileBindingBody(body["wallet_binding"], walletAddr, fromUser, senderSignPubB64, boxKey),
+			HelloMessage:      asString(body["hello_message"]),
+			HelloSignature:    strings.TrimSpace(asString(body["hello_sig"])),
 			SignatureVerified: true,
 			Message:           asString(body["message"]),
 			Method:            asString(body["method"]),
 			Status:            "pending_in",
 			CreatedAt:         created,
 			UpdatedAt:         created,
+			ExpiresAt:         incomingRequestExpiry(created, asString(body["expires_at"])),
 		}
 	case "friend_response":
 		reqID := asString(body["request_id"])
 		status := asString(body["status"])
+		// Only an answer to a request we sent this user counts; anything else
+		// would let a stranger make themselves a friend.
 		req, ok := m.requests[reqID]
-		if ok {
-			req.Status = status
-			req.UpdatedAt = time.Now().UTC()
-			m.requests[reqID] = req
+		if !ok || req.Status != "pending_out" || req.ToUserID != fromUser || (status != "accepted" && status != "rejected") {
+			return
 		}
+		req.Status = status
+		req.UpdatedAt = time.Now().UTC()
+		m.requests[reqID] = req
 		if status == "accepted" {
-			m.friends[fromUser] = Friend{UserID: fromUser, CreatedAt: time.Now().UTC()}
+			m.addFriendLocked(fromUser, time.Now().UTC())
+			m.syncFriendsLocked()
 		}
+	case "friend_request_cancel":
+		m.handleRequestCancelLocked(fromUser, body)
+	case "friend_reconcile":
+		m.handleFriendReconcileLocked(fromUser, body)
+	case "friend_removed":
+		delete(m.friends, fromUser)
 	case "dm_message":
 		msg := DirectMessage{
 			MessageID:  asString(body["message_id"]),
@@ -1290,14 +1811,63 @@ func (m *Manager) handleSecure(raw map[string]any) {
 		if msg.MessageID == "" {
 			msg.MessageID = fmt.Sprintf("dm-in-%d", time.Now().UnixNano())
 		}
+		m.attachReplyLocked(fromUser, &msg, asString(body["reply_to"]))
 		if msg.CreatedAt.IsZero() {
 			msg.CreatedAt = time.Now().UTC()
 		}
-		m.dms[fromUser] = append(m.dms[fromUser], msg)
+		expiresIn, _ := body["expires_in"].(float64)
+		msg.ExpiresAt = m.messageExpiryLocked(fromUser, msg.CreatedAt, int64(expiresIn))
+		// A message that expired in transit, or is re-sent after it was
+		// purged, is acknowledged but not stored.
+		if !m.hasDMLocked(fromUser, msg.MessageID) && !expired(msg, time.Now()) {
+			if ref, ok := mediaRefFromBody(body["media"]); ok {
+				msg.MediaDigest, msg.MediaSize = ref.Digest, ref.Size
+				m.trackMediaDownloadLocked(fromUser, ref)
+			} else if msg.MediaData != "" {
+				// Older peers still inline media; keep it out of the state file.
+				if raw, mime, err := decodeMediaData(msg.MediaData); err == nil {
+					if msg.MediaMIME == "" {
+						msg.MediaMIME = mime
+					}
+					if ref, err := m.storeMediaLocked(raw, msg.MediaName, msg.MediaMIME); err == nil {
+						msg.MediaDigest, msg.MediaSize, msg.MediaData = ref.Digest, ref.Size, ""
+					}
+				}
+			}
+			m.dms[fromUser] = append(m.dms[fromUser], msg)
+			m.resolveRepliesLocked(fromUser, msg)
+		}
+		// Acknowledge duplicates too so a retrying sender stops resending.
+		m.sendReceiptLocked(fromUser, receiptDelivered, []string{msg.MessageID})
+	case "dm_receipt":
+		m.handleReceiptLocked(fromUser, body)
+	case "dm_edit", "dm_delete", "dm_reaction":
+		m.handleDMUpdateLocked(msgType, fromUser, body)
+	case "dm_retention":
+		m.handleRetentionLocked(fromUser, body)
+	case "media_request":
+		m.handleMediaRequestLocked(fromUser, body)
+	case "group_update", "group_sender_key", "group_rename", "group_leave":
+		m.handleGroupControlLocked(msgType, fromUser, body)
 	}
 	_ = m.saveStateLocked()
 }
 
+// markSeenLocked remembers a message ID until an envelope sent at the same
+// time would be refused as too old.
+func (m *Manager) markSeenLocked(id string, sentAt time.Time) {
+	now := time.Now()
+	for k, exp := range m.seenMessageIDs {
+		if now.After(exp) {
+			delete(m.seenMessageIDs, k)
+		}
+	}
+	if sentAt.After(now) {
+		sentAt = now
+	}
+	m.seenMessageIDs[id] = sentAt.Add(seenMessageTTL).UTC()
+}
+
 func (m *Manager) presenceTicker(ctx context.Context) {
 	ticker := time.NewTicker(defaultPresenceEvery)
 	defer ticker.Stop()
@@ -1307,6 +1877,9 @@ func (m *Manager) presenceTicker(ctx context.Context) {
 			return
 		case <-ticker.C:
 			m.publishPresence()
+			m.retryOutbox()
+			m.resumeMediaDownloads()
+			m.maintainFriendRequests()
 		}
 	}
 }
@@ -1336,7 +1909,15 @@ func parseTS(raw string) time.Time {
 	return t
 }
 
-func verifyWalletChallenge(walletAddr, sigHex string) bool {
+// verifyWalletSignature checks an EIP-191 personal_sign signature of message
+// by walletAddr.
+func verifyWalletSignature(walletAddr, message, sigHex string) bool {
+	return verifyWalletHashSignature(walletAddr, accounts.TextHash([]byte(message)), sigHex)
+}
+
+// verifyWalletHashSignature checks a 65-byte secp256k1 signature of hash by
+// walletAddr.
+func verifyWalletHashSignature(walletAddr string, hash []byte, sigHex string) bool {
 	walletAddr = strings.TrimSpace(walletAddr)
 	sigHex = strings.TrimSpace(sigHex)
 	if !common.IsHexAddress(walletAddr) || sigHex == "" {
@@ -1352,7 +1933,6 @@ func verifyWalletChallenge(walletAddr, sigHex string) bool {
 	if sig[64] > 1 {
 		return false
 	}
-	hash := accounts.TextHash([]byte(walletChallenge))
 	pub, err := crypto.SigToPub(hash, sig)
 	if err != nil {
 		return false
@@ -1362,26 +1942,63 @@ func verifyWalletChallenge(walletAddr, sigHex string) bool {
 }
 
 type persistedState struct {
-	Profile         *Profile                   `json:"profile"`
-	KnownUsers      map[string]KnownUser       `json:"known_users"`
-	Requests        map[string]FriendRequest   `json:"requests"`
-	Friends         map[string]Friend          `json:"friends"`
-	DMs             map[string][]DirectMessage `json:"dms"`
-	UsedInviteNonce map[string]time.Time       `json:"used_invite_nonce"`
-	Cursors         map[string]int64           `json:"cursors"`
+	Profile          *Profile                               `json:"profile"`
+	KnownUsers       map[string]KnownUser                   `json:"known_users"`
+	Requests         map[string]FriendRequest               `json:"requests"`
+	Friends          map[string]Friend                      `json:"friends"`
+	DMs              map[string][]DirectMessage             `json:"dms"`
+	Groups           map[string]Group                       `json:"groups,omitempty"`
+	GroupMessages    map[string][]GroupMessage              `json:"group_messages,omitempty"`
+	GroupKeys        map[string]map[string][]groupSenderKey `json:"group_keys,omitempty"`
+	UsedInviteNonce  map[string]time.Time                   `json:"used_invite_nonce"`
+	UsedWalletNonces map[string]time.Time                   `json:"used_wallet_nonces,omitempty"`
+	Cursors          map[string]int64                       `json:"cursors"`
+	Prekeys          []signedPrekey                         `json:"prekeys,omitempty"`
+	Sessions         map[string]*ratchetSession             `json:"sessions,omitempty"`
+	Outbox           map[string]outboxEntry                 `json:"outbox,omitempty"`
+	Media            map[string]mediaBlob                   `json:"media,omitempty"`
+	DeviceList       *deviceList                            `json:"device_list,omitempty"`
+	KeyRotations     []keyRotation                          `json:"key_rotations,omitempty"`
+	RevokedKeys      map[string]revokedKey                  `json:"revoked_keys,omitempty"`
+	SecurityAlerts   map[string]SecurityAlert               `json:"security_alerts,omitempty"`
+	Blocked          map[string]BlockedUser                 `json:"blocked,omitempty"`
+	Muted            map[string]time.Time                   `json:"muted,omitempty"`
+	PurgeLog         []PurgeRecord                          `json:"purge_log,omitempty"`
+	SeenMessages     map[string]time.Time                   `json:"seen_messages,omitempty"`
 }
 
-func (m *Manager) stateFile() string { return filepath.Join(m.cfg.DataDir, "state.json") }
+func (m *Manager) openStore() error {
+	store, err := OpenLogStore(m.cfg.DataDir)
+	if err != nil {
+		return err
+	}
+	if err := migrateLegacyState(m.cfg.DataDir, store); err != nil {
+		store.Close()
+		return err
+	}
+	m.rawStore = store
+	return nil
+}
 
+// loadState reads the sealed store once unlocked. Before that it can only
+// read a raw store that predates encryption at rest.
 func (m *Manager) loadState() error {
-	b, err := os.ReadFile(m.stateFile())
+	store := m.store
+	if store == nil {
+		store = m.rawStore
+	}
+	if store == nil {
+		return errors.New("store not open")
+	}
+	entries, err := store.Load()
 	if err != nil {
 		return err
 	}
-	var ps persistedState
-	if err := json.Unmarshal(b, &ps); err != nil {
+	ps, err := stateFromEntries(entries)
+	if err != nil {
 		return err
 	}
+	m.storeHashes = hashEntries(entries)
 	m.profile = ps.Profile
 	if ps.KnownUsers != nil {
 		m.knownUsers = ps.KnownUsers
@@ -1395,33 +2012,99 @@ func (m *Manager) loadState() error {
 	if ps.DMs != nil {
 		m.dms = ps.DMs
 	}
+	if ps.Groups != nil {
+		m.groups = ps.Groups
+	}
+	if ps.GroupMessages != nil {
+		m.groupMessages = ps.GroupMessages
+	}
+	if ps.GroupKeys != nil {
+		m.groupKeys = ps.GroupKeys
+	}
 	if ps.UsedInviteNonce != nil {
 		m.usedInviteNonce = ps.UsedInviteNonce
 	}
+	if ps.UsedWalletNonces != nil {
+		m.usedWalletNonces = ps.UsedWalletNonces
+	}
 	if ps.Cursors != nil {
 		m.cursors = ps.Cursors
 	}
+	m.prekeys = ps.Prekeys
+	if ps.Sessions != nil {
+		m.sessions = ps.Sessions
+	}
+	if ps.Outbox != nil {
+		m.outbox = ps.Outbox
+	}
+	if ps.Media != nil {
+		m.media = ps.Media
+	}
+	m.deviceList = ps.DeviceList
+	m.keyRotations = ps.KeyRotations
+	if ps.RevokedKeys != nil {
+		m.revokedKeys = ps.RevokedKeys
+	}
+	if ps.SecurityAlerts != nil {
+		m.securityAlerts = ps.SecurityAlerts
+	}
+	if ps.Blocked != nil {
+		m.blocked = ps.Blocked
+	}
+	if ps.SeenMessages != nil {
+		m.seenMessageIDs = ps.SeenMessages
+	}
+	if ps.Muted != nil {
+		m.muted = ps.Muted
+	}
+	m.purgeLog = ps.PurgeLog
+	m.resyncEventsLocked()
 	return nil
 }
 
+func (m *Manager) persistedStateLocked() persistedState {
+	return persistedState{
+		Profile:          m.profile,
+		KnownUsers:       m.knownUsers,
+		Requests:         m.requests,
+		Friends:          m.friends,
+		DMs:              m.dms,
+		Groups:           m.groups,
+		GroupMessages:    m.groupMessages,
+		GroupKeys:        m.groupKeys,
+		UsedInviteNonce:  m.usedInviteNonce,
+		UsedWalletNonces: m.usedWalletNonces,
+		Cursors:          m.cursors,
+		Prekeys:          m.prekeys,
+		Sessions:         m.sessions,
+		Outbox:           m.outbox,
+		Media:            m.media,
+		DeviceList:       m.deviceList,
+		KeyRotations:     m.keyRotations,
+		RevokedKeys:      m.revokedKeys,
+		SecurityAlerts:   m.securityAlerts,
+		Blocked:          m.blocked,
+		Muted:            m.muted,
+		PurgeLog:         m.purgeLog,
+		SeenMessages:     m.seenMessageIDs,
+	}
+}
+
 func (m *Manager) saveStateLocked() error {
-	ps := persistedState{
-		Profile:         m.profile,
-		KnownUsers:      m.knownUsers,
-		Requests:        m.requests,
-		Friends:         m.friends,
-		DMs:             m.dms,
-		UsedInviteNonce: m.usedInviteNonce,
-		Cursors:         m.cursors,
-	}
-	b, err := json.MarshalIndent(ps, "", "  ")
+	if m.store == nil {
+		return errors.New("state is locked")
+	}
+	ps := m.persistedStateLocked()
+	entries, err := stateEntries(&ps)
 	if err != nil {
 		return err
 	}
-	if err := os.WriteFile(m.stateFile(), b, 0o600); err != nil {
+	puts, deletes, hashes := diffEntries(m.storeHashes, entries)
+	if err := m.store.Apply(puts, deletes); err != nil {
 		return err
 	}
-	m.emitEventLocked("state")
+	m.storeHashes = hashes
+	m.publishChangesLocked(puts, deletes)
 	return nil
 }
 
@@ -1436,12 +2119,3 @@ func (m *Manager) conversationsSnapshotLocked() map[string][]DirectMessage {
 	}
 	return out
 }
-
-func (m *Manager) emitEventLocked(event string) {
-	for _, ch := range m.listeners {
-		select {
-		case ch <- event:
-		default:
-		}
-	}
-}
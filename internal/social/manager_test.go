@@ -1,13 +1,22 @@
 package social
 
 import (
+	"context"
+	"crypto/ecdsa"
 	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"Assembler-Apps/internal/localrpcclient"
 	"github.com/ethereum/go-ethereum/accounts"
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
 	"golang.org/x/crypto/curve25519"
 )
 
@@ -114,8 +123,34 @@ func TestNormalizeSettingsDefaults(t *testing.T) {
 	t.Parallel()
 	in := Settings{Discoverable: false, AllowStrangerRequests: false, IsAdmin: true, ContractAddress: " 0xabc "}
 	out := normalizeSettings(in)
-	if !out.Discoverable || !out.AllowStrangerRequests {
-		t.Fatalf("discovery defaults should stay enabled")
+	if out.Privacy != PrivacyPublic || !out.Discoverable || !out.AllowStrangerRequests {
+		t.Fatalf("unset privacy should default to public, got %+v", out)
+	}
+	if s := normalizeSettings(Settings{Privacy: "Hidden"}); s.Privacy != PrivacyHidden || s.Discoverable || s.AllowStrangerRequests {
+		t.Fatalf("hidden mode must not be discoverable: %+v", s)
+	}
+	if s := normalizeSettings(Settings{Discoverable: true}); s.Privacy != PrivacyContacts || s.AllowStrangerRequests {
+		t.Fatalf("discoverable without stranger requests maps to contacts: %+v", s)
+	}
+	if s, _ := mergeSettings(Settings{Privacy: PrivacyFriends}, Settings{IsAdmin: true}); s.Privacy != PrivacyFriends {
+		t.Fatalf("settings without a mode should keep the current one, got %q", s.Privacy)
+	}
+	// Legacy clients choose through the flags; an explicit false counts.
+	for raw, want := range map[string]string{
+		`{"discoverable":false,"allow_stranger_requests":false}`: PrivacyFriends,
+		`{"discoverable":false,"allow_stranger_requests":true}`:  PrivacyPublic,
+		`{"is_admin":true}`: PrivacyPublic,
+	} {
+		var in Settings
+		if err := json.Unmarshal([]byte(raw), &in); err != nil {
+			t.Fatalf("decode %s: %v", raw, err)
+		}
+		if s, _ := mergeSettings(Settings{}, in); s.Privacy != want {
+			t.Fatalf("settings %s should map to %q, got %q", raw, want, s.Privacy)
+		}
+	}
+	if _, err := mergeSettings(Settings{}, Settings{Privacy: "secret"}); err == nil {
+		t.Fatalf("unknown privacy mode should be rejected")
 	}
 	if !out.IsAdmin {
 		t.Fatalf("is_admin should be preserved")
@@ -140,7 +175,7 @@ func TestIdentityHasValidCurve25519PublicKey(t *testing.T) {
 	}
 }
 
-func TestVerifyWalletChallenge(t *testing.T) {
+func TestVerifyWalletSignature(t *testing.T) {
 	t.Parallel()
 
 	key, err := crypto.GenerateKey()
@@ -148,24 +183,91 @@ func TestVerifyWalletChallenge(t *testing.T) {
 		t.Fatalf("generate key: %v", err)
 	}
 	addr := crypto.PubkeyToAddress(key.PublicKey).Hex()
-	hash := accounts.TextHash([]byte(walletChallenge))
+	hash := accounts.TextHash([]byte("Hello"))
 	sig, err := crypto.Sign(hash, key)
 	if err != nil {
 		t.Fatalf("sign: %v", err)
 	}
 	sigHex := hexutil.Encode(sig)
 
-	if !verifyWalletChallenge(addr, sigHex) {
+	if !verifyWalletSignature(addr, "Hello", sigHex) {
 		t.Fatalf("expected signature verification to pass")
 	}
+	if verifyWalletSignature(addr, "Hello!", sigHex) {
+		t.Fatalf("expected signature over a different message to fail")
+	}
 
 	tampered := append([]byte(nil), sig...)
 	tampered[5] ^= 0x01
-	if verifyWalletChallenge(addr, hexutil.Encode(tampered)) {
+	if verifyWalletSignature(addr, "Hello", hexutil.Encode(tampered)) {
 		t.Fatalf("expected tampered signature to fail")
 	}
 }
 
+func signWalletMessage(t *testing.T, key *ecdsa.PrivateKey, msg string) string {
+	t.Helper()
+	sig, err := crypto.Sign(accounts.TextHash([]byte(msg)), key)
+	if err != nil {
+		t.Fatalf("wallet sign: %v", err)
+	}
+	return hexutil.Encode(sig)
+}
+
+func TestWalletChallengeIsSingleUseAndBound(t *testing.T) {
+	t.Parallel()
+	alice, aliceKey := newTestWalletManagerWithKey(t)
+	bob := newTestWalletManager(t)
+	carol := newTestWalletManager(t)
+	advertisePresence(t, alice, bob)
+	advertisePresence(t, bob, alice)
+	advertisePresence(t, carol, bob)
+	advertisePresence(t, bob, carol)
+	bob.mu.Lock()
+	bob.profile.Settings = normalizeSettings(Settings{Privacy: PrivacyPublic})
+	bob.mu.Unlock()
+	wallet := alice.profile.Username
+	aliceID := alice.profile.UserID
+
+	if _, _, err := alice.IssueWalletChallenge("social.example", "0x1111111111111111111111111111111111111111"); err == nil {
+		t.Fatalf("challenge for another wallet should be refused")
+	}
+	msg, _, err := alice.IssueWalletChallenge("social.example", wallet)
+	if err != nil {
+		t.Fatalf("issue challenge: %v", err)
+	}
+	c, err := parseWalletChallenge(msg)
+	if err != nil || c.UserID != aliceID || c.Domain != "social.example" || c.String() != msg {
+		t.Fatalf("challenge does not round-trip: %v %+v", err, c)
+	}
+	sig := signWalletMessage(t, aliceKey, msg)
+	alice.mu.Lock()
+	errWrong := alice.consumeWalletChallengeLocked(wallet, msg, signWalletMessage(t, aliceKey, "Hello"))
+	errFirst := alice.consumeWalletChallengeLocked(wallet, msg, sig)
+	errReuse := alice.consumeWalletChallengeLocked(wallet, msg, sig)
+	alice.mu.Unlock()
+	if errWrong == nil || errFirst != nil || errReuse == nil {
+		t.Fatalf("challenge must verify once: wrong=%v first=%v reuse=%v", errWrong, errFirst, errReuse)
+	}
+
+	request := func(from *Manager, reqID string) map[string]any {
+		return map[string]any{
+			"type": "friend_request", "request_id": reqID, "from_user_id": from.profile.UserID, "from_name": wallet,
+			"wallet_address": wallet, "hello_message": msg, "hello_sig": sig, "created_at": time.Now().UTC().Format(time.RFC3339Nano),
+		}
+	}
+	deliverSecure(t, carol, bob, request(carol, "fr-stolen"))
+	deliverSecure(t, alice, bob, request(alice, "fr-1"))
+	deliverSecure(t, alice, bob, request(alice, "fr-replay"))
+	bob.mu.RLock()
+	_, stolen := bob.requests["fr-stolen"]
+	_, first := bob.requests["fr-1"]
+	_, replayed := bob.requests["fr-replay"]
+	bob.mu.RUnlock()
+	if stolen || !first || replayed {
+		t.Fatalf("hello must be bound to the sender and single use: stolen=%v first=%v replayed=%v", stolen, first, replayed)
+	}
+}
+
 func TestWalletLoginAutoInitAndRelogin(t *testing.T) {
 	t.Parallel()
 
@@ -180,7 +282,7 @@ func TestWalletLoginAutoInitAndRelogin(t *testing.T) {
 	if err != nil {
 		t.Fatalf("new manager: %v", err)
 	}
-	p, err := m.LoginWithWallet(addr, Settings{Discoverable: true, AllowStrangerRequests: true})
+	p, err := m.LoginWithWallet(addr, "pw", Settings{Discoverable: true, AllowStrangerRequests: true})
 	if err != nil {
 		t.Fatalf("wallet login init: %v", err)
 	}
@@ -192,7 +294,7 @@ func TestWalletLoginAutoInitAndRelogin(t *testing.T) {
 	if err != nil {
 		t.Fatalf("new manager #2: %v", err)
 	}
-	p2, err := m2.LoginWithWallet(addr, Settings{})
+	p2, err := m2.LoginWithWallet(addr, "pw", Settings{})
 	if err != nil {
 		t.Fatalf("wallet relogin: %v", err)
 	}
@@ -200,3 +302,1988 @@ func TestWalletLoginAutoInitAndRelogin(t *testing.T) {
 		t.Fatalf("expected persistent user id")
 	}
 }
+
+func newTestWalletManager(t *testing.T) *Manager {
+	t.Helper()
+	m, _ := newTestWalletManagerWithKey(t)
+	return m
+}
+
+func newTestWalletManagerWithKey(t *testing.T) (*Manager, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatalf("generate wallet key: %v", err)
+	}
+	m, err := NewManager(Config{DataDir: t.TempDir(), RPCSocketPath: "/tmp/does-not-exist.sock"})
+	if err != nil {
+		t.Fatalf("new manager: %v", err)
+	}
+	if _, err := m.LoginWithWallet(crypto.PubkeyToAddress(key.PublicKey).Hex(), "pw", Settings{}); err != nil {
+		t.Fatalf("wallet login: %v", err)
+	}
+	return m, key
+}
+
+func TestGroupUpdateAndSenderKeyDecrypt(t *testing.T) {
+	t.Parallel()
+	alice := newTestWalletManager(t)
+	bob := newTestWalletManager(t)
+	aliceID := alice.profile.UserID
+	bobID := bob.profile.UserID
+
+	bob.mu.Lock()
+	bob.friends[aliceID] = Friend{UserID: aliceID, CreatedAt: time.Now().UTC()}
+	bob.knownUsers[aliceID] = KnownUser{UserID: aliceID, SignPublicKey: alice.profile.SignPublicKey, BoxPublicKey: alice.profile.BoxPublicKey}
+	bob.mu.Unlock()
+
+	alice.mu.Lock()
+	g := Group{GroupID: "g-1", Name: "team", OwnerUserID: aliceID, Members: []string{aliceID, bobID}, Epoch: 1}
+	alice.groups[g.GroupID] = g
+	if err := alice.rotateOwnGroupKeyLocked(g); err != nil {
+		t.Fatalf("rotate key: %v", err)
+	}
+	key, _ := alice.groupKeyLocked(g.GroupID, aliceID, 1)
+	plain, _ := json.Marshal(map[string]any{"type": "group_message", "message_id": "gm-1", "body": "hi team"})
+	wire, err := alice.buildGroupEnvelopeLocked(g, key, plain)
+	alice.mu.Unlock()
+	if err != nil {
+		t.Fatalf("build envelope: %v", err)
+	}
+
+	bob.mu.Lock()
+	bob.handleGroupControlLocked("group_update", aliceID, map[string]any{
+		"group_id":      g.GroupID,
+		"name":          g.Name,
+		"owner_user_id": aliceID,
+		"members":       []any{aliceID, bobID},
+		"epoch":         float64(1),
+	})
+	bob.handleGroupControlLocked("group_sender_key", aliceID, map[string]any{"group_id": g.GroupID, "epoch": float64(1), "key": key})
+	_, hasOwnKey := bob.groupKeyLocked(g.GroupID, bobID, 1)
+	queued := bob.outboxSnapshotLocked()[aliceID]
+	bob.mu.Unlock()
+	if !hasOwnKey {
+		t.Fatalf("bob should issue his own sender key on join")
+	}
+	if queued != 1 {
+		t.Fatalf("a sender key that could not be published should wait in the outbox, got %d", queued)
+	}
+
+	var raw map[string]any
+	if err := json.Unmarshal(wire, &raw); err != nil {
+		t.Fatalf("decode envelope: %v", err)
+	}
+	bob.handleGroupEnvelope(raw)
+	msgs := bob.GroupConversation(g.GroupID)
+	if len(msgs) != 1 || msgs[0].Body != "hi team" {
+		t.Fatalf("unexpected group messages: %+v", msgs)
+	}
+
+	// Renames that crossed in flight settle on the later one whatever the
+	// order they arrive in.
+	later := time.Now().UTC()
+	bob.mu.Lock()
+	bob.handleGroupControlLocked("group_rename", aliceID, map[string]any{"group_id": g.GroupID, "name": "later", "created_at": later.Format(time.RFC3339Nano)})
+	bob.handleGroupControlLocked("group_rename", aliceID, map[string]any{"group_id": g.GroupID, "name": "earlier", "created_at": later.Add(-time.Second).Format(time.RFC3339Nano)})
+	bob.handleGroupControlLocked("group_rename", aliceID, map[string]any{"group_id": g.GroupID, "name": "future", "created_at": later.Add(time.Hour).Format(time.RFC3339Nano)})
+	bob.handleGroupControlLocked("group_update", aliceID, map[string]any{
+		"group_id":      g.GroupID,
+		"name":          g.Name,
+		"owner_user_id": aliceID,
+		"members":       []any{aliceID, bobID},
+		"epoch":         float64(1),
+	})
+	renamed := bob.groups[g.GroupID].Name
+	bob.mu.Unlock()
+	if renamed != "later" {
+		t.Fatalf("the latest rename should win, got %q", renamed)
+	}
+
+	bob.mu.Lock()
+	bob.handleGroupControlLocked("group_update", aliceID, map[string]any{
+		"group_id":      g.GroupID,
+		"owner_user_id": aliceID,
+		"members":       []any{aliceID},
+		"epoch":         float64(2),
+	})
+	_, stillMember := bob.groups[g.GroupID]
+	bob.mu.Unlock()
+	if stillMember {
+		t.Fatalf("removed member should drop the group")
+	}
+}
+
+func TestGroupMemberKeysAreOnlyHints(t *testing.T) {
+	t.Parallel()
+	alice := newTestWalletManager(t)
+	bob := newTestWalletManager(t)
+	carol := newTestWalletManager(t)
+	mallory := newTestWalletManager(t)
+	aliceID, bobID, carolID := alice.profile.UserID, bob.profile.UserID, carol.profile.UserID
+
+	bob.mu.Lock()
+	bob.friends[aliceID] = Friend{UserID: aliceID, CreatedAt: time.Now().UTC()}
+	bob.knownUsers[aliceID] = KnownUser{UserID: aliceID, SignPublicKey: alice.profile.SignPublicKey, BoxPublicKey: alice.profile.BoxPublicKey}
+	bob.handleGroupControlLocked("group_update", aliceID, map[string]any{
+		"group_id":      "g-1",
+		"owner_user_id": aliceID,
+		"members":       []any{aliceID, bobID, carolID, "u_dave"},
+		"epoch":         float64(1),
+		"member_keys": map[string]any{
+			carolID:  map[string]any{"sign_public_key": carol.profile.SignPublicKey, "box_public_key": mallory.profile.BoxPublicKey},
+			"u_dave": map[string]any{"sign_public_key": mallory.profile.SignPublicKey, "box_public_key": mallory.profile.BoxPublicKey},
+		},
+	})
+	_, daveKnown := bob.knownUsers["u_dave"]
+	hinted := bob.knownUsers[carolID]
+	bob.mu.Unlock()
+	if daveKnown {
+		t.Fatalf("a sign key the user ID does not derive from must not be stored")
+	}
+	if !hinted.FromGroup || hinted.SignPublicKey != carol.profile.SignPublicKey {
+		t.Fatalf("derived keys should be kept as a group hint: %+v", hinted)
+	}
+
+	advertisePresence(t, carol, bob)
+	bob.mu.Lock()
+	got := bob.knownUsers[carolID]
+	alerts := len(bob.securityAlerts)
+	bob.mu.Unlock()
+	if got.FromGroup || got.BoxPublicKey != carol.profile.BoxPublicKey || alerts != 0 {
+		t.Fatalf("carol's own presence should replace the hinted keys: %+v alerts=%d", got, alerts)
+	}
+}
+
+func TestGroupHistoryIsPagedNotTrimmed(t *testing.T) {
+	t.Parallel()
+	m := newTestWalletManager(t)
+	start := time.Now().UTC().Add(-time.Hour)
+	m.mu.Lock()
+	for i := range defaultHistoryPage + 50 {
+		m.appendGroupMessageLocked(GroupMessage{MessageID: "g" + strconv.Itoa(1000+i), GroupID: "g-1", FromUserID: "u_member", CreatedAt: start.Add(time.Duration(i) * time.Second)})
+	}
+	m.mu.Unlock()
+	if got := len(m.GroupConversation("g-1")); got != defaultHistoryPage+50 {
+		t.Fatalf("group history should be kept whole, got %d", got)
+	}
+	if got := len(m.Snapshot()["group_conversations"].(map[string][]GroupMessage)["g-1"]); got != defaultHistoryPage {
+		t.Fatalf("snapshot should hold the newest page, got %d", got)
+	}
+	newest, err := m.GroupConversationPage("g-1", HistoryQuery{})
+	if err != nil || len(newest.Messages) != defaultHistoryPage || !newest.HasMoreBefore {
+		t.Fatalf("newest page: %v %+v", err, newest)
+	}
+	older, err := m.GroupConversationPage("g-1", HistoryQuery{Before: newest.Messages[0].MessageID})
+	if err != nil || len(older.Messages) != 50 || older.HasMoreBefore || older.Messages[0].MessageID != "g1000" {
+		t.Fatalf("older page: %v %+v", err, older)
+	}
+}
+
+func advertisePresence(t *testing.T, from, to *Manager) {
+	t.Helper()
+	from.mu.Lock()
+	if _, err := from.ensurePrekeyLocked(); err != nil {
+		from.mu.Unlock()
+		t.Fatalf("ensure prekey: %v", err)
+	}
+	body := map[string]any{
+		"user_id":         from.profile.UserID,
+		"username":        from.profile.Username,
+		"sign_public_key": from.profile.SignPublicKey,
+		"box_public_key":  from.profile.BoxPublicKey,
+		"prekey":          from.prekeyAdvertLocked(),
+		"ts":              time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	if len(from.keyRotations) > 0 {
+		body["key_rotations"] = from.keyRotations
+	}
+	if from.profile.WalletBinding != nil {
+		body["wallet_binding"] = from.profile.WalletBinding
+	}
+	signed, err := from.signPlainBodyLocked(body)
+	from.mu.Unlock()
+	if err != nil {
+		t.Fatalf("sign presence: %v", err)
+	}
+	to.handlePresence(signed)
+}
+
+func deliverSecure(t *testing.T, from, to *Manager, body map[string]any) {
+	t.Helper()
+	from.mu.Lock()
+	target := from.knownUsers[to.profile.UserID]
+	wire, err := from.buildSecureEnvelopeLocked(inboxTopic(to.profile.UserID), target.BoxPublicKey, body)
+	from.mu.Unlock()
+	if err != nil {
+		t.Fatalf("build envelope: %v", err)
+	}
+	var raw map[string]any
+	if err := json.Unmarshal(wire, &raw); err != nil {
+		t.Fatalf("decode envelope: %v", err)
+	}
+	to.handleSecure(raw)
+}
+
+func TestRatchetSessionRoundTripAndFallback(t *testing.T) {
+	t.Parallel()
+	alice := newTestWalletManager(t)
+	bob := newTestWalletManager(t)
+	carol := newTestWalletManager(t)
+	advertisePresence(t, alice, bob)
+	advertisePresence(t, bob, alice)
+
+	dm := func(from *Manager, id, text string) map[string]any {
+		return map[string]any{"type": "dm_message", "message_id": id, "from_user_id": from.profile.UserID, "body": text}
+	}
+	deliverSecure(t, alice, bob, dm(alice, "m1", "one"))
+	deliverSecure(t, alice, bob, dm(alice, "m2", "two"))
+	deliverSecure(t, bob, alice, dm(bob, "m3", "three"))
+	deliverSecure(t, alice, bob, dm(alice, "m4", "four"))
+
+	if got := len(bob.Conversation(alice.profile.UserID)); got != 3 {
+		t.Fatalf("bob should have 3 messages, got %d", got)
+	}
+	if got := len(alice.Conversation(bob.profile.UserID)); got != 1 {
+		t.Fatalf("alice should have 1 message, got %d", got)
+	}
+	alice.mu.RLock()
+	sess := alice.sessions[bob.profile.UserID]
+	alice.mu.RUnlock()
+	if sess == nil || sess.PendingX3DH != nil {
+		t.Fatalf("alice session should be established after bob's reply")
+	}
+
+	// carol never advertised a prekey, so both directions use the static scheme.
+	carol.mu.Lock()
+	carol.knownUsers[alice.profile.UserID] = KnownUser{UserID: alice.profile.UserID, BoxPublicKey: alice.profile.BoxPublicKey, SignPublicKey: alice.profile.SignPublicKey}
+	carol.mu.Unlock()
+	alice.mu.Lock()
+	alice.knownUsers[carol.profile.UserID] = KnownUser{UserID: carol.profile.UserID, BoxPublicKey: carol.profile.BoxPublicKey, SignPublicKey: carol.profile.SignPublicKey}
+	alice.mu.Unlock()
+	deliverSecure(t, alice, carol, dm(alice, "m5", "legacy"))
+	if got := len(carol.Conversation(alice.profile.UserID)); got != 1 {
+		t.Fatalf("carol should receive legacy message, got %d", got)
+	}
+}
+
+func TestRatchetSessionResetAfterLostState(t *testing.T) {
+	t.Parallel()
+	alice := newTestWalletManager(t)
+	bob := newTestWalletManager(t)
+	advertisePresence(t, alice, bob)
+	advertisePresence(t, bob, alice)
+	aliceID, bobID := alice.profile.UserID, bob.profile.UserID
+	dm := func(from *Manager, id string) map[string]any {
+		return map[string]any{"type": "dm_message", "message_id": id, "from_user_id": from.profile.UserID, "body": id}
+	}
+	deliverSecure(t, alice, bob, dm(alice, "m1"))
+	deliverSecure(t, bob, alice, dm(bob, "m2"))
+
+	bob.mu.Lock()
+	bob.sessions = make(map[string]*ratchetSession)
+	bob.mu.Unlock()
+	deliverSecure(t, alice, bob, dm(alice, "m3"))
+	bob.mu.RLock()
+	_, asked := bob.sessionResets[aliceID]
+	bob.mu.RUnlock()
+	if got := len(bob.Conversation(aliceID)); got != 1 || !asked {
+		t.Fatalf("a message without a session should ask for a reset, got %d messages", got)
+	}
+
+	reset := func(at time.Time) {
+		bob.mu.RLock()
+		wire, err := bob.buildSessionResetLocked(aliceID, alice.profile.BoxPublicKey, at)
+		bob.mu.RUnlock()
+		if err != nil {
+			t.Fatalf("build reset: %v", err)
+		}
+		alice.processRecord(localrpcclient.MessageRecord{Topic: inboxTopic(aliceID), Payload: wire})
+	}
+	reset(time.Now().UTC())
+	alice.mu.RLock()
+	_, kept := alice.sessions[bobID]
+	alice.mu.RUnlock()
+	if kept {
+		t.Fatalf("reset should drop the sender's session")
+	}
+	deliverSecure(t, alice, bob, dm(alice, "m4"))
+	deliverSecure(t, bob, alice, dm(bob, "m5"))
+	if got := len(bob.Conversation(aliceID)); got != 2 {
+		t.Fatalf("fresh handshake should deliver again, got %d messages", got)
+	}
+
+	reset(time.Now().UTC().Add(-time.Minute))
+	alice.mu.RLock()
+	_, kept = alice.sessions[bobID]
+	alice.mu.RUnlock()
+	if !kept {
+		t.Fatalf("a replayed reset must not drop a newer session")
+	}
+
+	// A replayed message fails to open like a lost one would, but must not
+	// cost bob the live session, even once its ID is forgotten.
+	alice.mu.Lock()
+	wire, err := alice.buildSecureEnvelopeLocked(inboxTopic(bobID), bob.profile.BoxPublicKey, dm(alice, "m6"))
+	alice.mu.Unlock()
+	if err != nil {
+		t.Fatalf("build envelope: %v", err)
+	}
+	var raw map[string]any
+	_ = json.Unmarshal(wire, &raw)
+	bob.handleSecure(raw)
+	bob.mu.Lock()
+	_, persisted := bob.persistedStateLocked().SeenMessages[asString(raw["msg_id"])]
+	delete(bob.seenMessageIDs, asString(raw["msg_id"]))
+	bob.sessionResets = make(map[string]time.Time)
+	live := bob.sessions[aliceID]
+	bob.mu.Unlock()
+	if !persisted {
+		t.Fatalf("seen message IDs should be persisted")
+	}
+	bob.handleSecure(raw)
+	bob.mu.RLock()
+	_, asked = bob.sessionResets[aliceID]
+	same := bob.sessions[aliceID] == live
+	bob.mu.RUnlock()
+	if asked || !same {
+		t.Fatalf("a replay must neither drop the session nor ask for a reset")
+	}
+}
+
+func TestRatchetSimultaneousInitiation(t *testing.T) {
+	t.Parallel()
+	alice := newTestWalletManager(t)
+	bob := newTestWalletManager(t)
+	advertisePresence(t, alice, bob)
+	advertisePresence(t, bob, alice)
+
+	build := func(from, to *Manager, id string) map[string]any {
+		from.mu.Lock()
+		defer from.mu.Unlock()
+		target := from.knownUsers[to.profile.UserID]
+		wire, err := from.buildSecureEnvelopeLocked(inboxTopic(to.profile.UserID), target.BoxPublicKey, map[string]any{"type": "dm_message", "message_id": id, "from_user_id": from.profile.UserID, "body": id})
+		if err != nil {
+			t.Fatalf("build envelope: %v", err)
+		}
+		var raw map[string]any
+		_ = json.Unmarshal(wire, &raw)
+		return raw
+	}
+	fromAlice := build(alice, bob, "a1")
+	fromBob := build(bob, alice, "b1")
+	bob.handleSecure(fromAlice)
+	alice.handleSecure(fromBob)
+	alice.handleSecure(build(bob, alice, "b2"))
+	bob.handleSecure(build(alice, bob, "a2"))
+
+	if got := len(bob.Conversation(alice.profile.UserID)); got != 2 {
+		t.Fatalf("bob should have 2 messages, got %d", got)
+	}
+	if got := len(alice.Conversation(bob.profile.UserID)); got != 2 {
+		t.Fatalf("alice should have 2 messages, got %d", got)
+	}
+}
+
+func TestSendDirectMessageQueuesWhenPeerUnreachable(t *testing.T) {
+	t.Parallel()
+	alice := newTestWalletManager(t)
+	bob := newTestWalletManager(t)
+	bobID := bob.profile.UserID
+
+	alice.mu.Lock()
+	alice.friends[bobID] = Friend{UserID: bobID, CreatedAt: time.Now().UTC()}
+	alice.knownUsers[bobID] = KnownUser{UserID: bobID, BoxPublicKey: bob.profile.BoxPublicKey, SignPublicKey: bob.profile.SignPublicKey}
+	alice.mu.Unlock()
+
+	if err := alice.SendDirectMessage(bobID, "hello later", "", "", ""); err != nil {
+		t.Fatalf("send should queue instead of failing: %v", err)
+	}
+	msgs := alice.Conversation(bobID)
+	if len(msgs) != 1 || msgs[0].Status != DeliveryQueued {
+		t.Fatalf("expected queued message, got %+v", msgs)
+	}
+	alice.mu.RLock()
+	entry, ok := alice.outbox[msgs[0].MessageID]
+	alice.mu.RUnlock()
+	if !ok {
+		t.Fatalf("message should stay in outbox")
+	}
+	if entry.Attempts != 1 || !entry.NextAttemptAt.After(entry.CreatedAt) {
+		t.Fatalf("expected one attempt with backoff, got %+v", entry)
+	}
+}
+
+func TestReceiptsUpdateStatusAndUnread(t *testing.T) {
+	t.Parallel()
+	alice := newTestWalletManager(t)
+	bob := newTestWalletManager(t)
+	advertisePresence(t, alice, bob)
+	advertisePresence(t, bob, alice)
+	aliceID, bobID := alice.profile.UserID, bob.profile.UserID
+
+	alice.mu.Lock()
+	alice.dms[bobID] = append(alice.dms[bobID], DirectMessage{MessageID: "m1", FromUserID: aliceID, ToUserID: bobID, Body: "hi", Status: DeliverySent})
+	alice.mu.Unlock()
+	deliverSecure(t, alice, bob, map[string]any{"type": "dm_message", "message_id": "m1", "from_user_id": aliceID, "body": "hi"})
+
+	if got := bob.Snapshot()["unread"].(map[string]int)[aliceID]; got != 1 {
+		t.Fatalf("expected 1 unread, got %d", got)
+	}
+	deliverSecure(t, bob, alice, map[string]any{"type": "dm_receipt", "receipt": "delivered", "message_ids": []string{"m1"}, "from_user_id": bobID})
+	if got := alice.Conversation(bobID)[0].Status; got != DeliveryDelivered {
+		t.Fatalf("expected delivered, got %q", got)
+	}
+
+	if err := bob.MarkConversationRead(aliceID); err != nil {
+		t.Fatalf("mark read: %v", err)
+	}
+	if got := bob.Snapshot()["unread"].(map[string]int)[aliceID]; got != 0 {
+		t.Fatalf("expected no unread, got %d", got)
+	}
+	deliverSecure(t, bob, alice, map[string]any{"type": "dm_receipt", "receipt": "read", "message_ids": []string{"m1"}, "from_user_id": bobID})
+	deliverSecure(t, bob, alice, map[string]any{"type": "dm_receipt", "receipt": "delivered", "message_ids": []string{"m1"}, "from_user_id": bobID})
+	if got := alice.Conversation(bobID)[0].Status; got != DeliveryRead {
+		t.Fatalf("status should not regress from read, got %q", got)
+	}
+}
+
+func TestMediaChunkTransferAndVerification(t *testing.T) {
+	t.Parallel()
+	alice := newTestWalletManager(t)
+	bob := newTestWalletManager(t)
+	aliceID, bobID := alice.profile.UserID, bob.profile.UserID
+
+	plain := make([]byte, 2*mediaChunkSize+1234)
+	for i := range plain {
+		plain[i] = byte(i * 7)
+	}
+	alice.mu.Lock()
+	ref, err := alice.storeMediaLocked(plain, "pic.png", "image/png")
+	alice.mu.Unlock()
+	if err != nil {
+		t.Fatalf("store media: %v", err)
+	}
+	if len(ref.ChunkHashes) != 3 {
+		t.Fatalf("expected 3 chunks, got %d", len(ref.ChunkHashes))
+	}
+	enc, err := os.ReadFile(alice.mediaPath(ref.Digest, true))
+	if err != nil {
+		t.Fatalf("read blob: %v", err)
+	}
+
+	// A first sender that names the digest but never serves it must not
+	// hold the content hostage.
+	bogus := ref
+	bogus.Key = base64.RawStdEncoding.EncodeToString(make([]byte, 32))
+	bogus.ChunkHashes = []string{strings.Repeat("0", 64), strings.Repeat("1", 64), strings.Repeat("2", 64)}
+	bob.mu.Lock()
+	bob.trackMediaDownloadLocked("u_mallory", bogus)
+	bob.trackMediaDownloadLocked(aliceID, ref)
+	source := bob.media[ref.Digest].SourceUser
+	b := bob.media[ref.Digest]
+	b.UpdatedAt = time.Now().Add(-mediaStallAfter - time.Second)
+	bob.media[ref.Digest] = b
+	switched := bob.resumeMediaDownloadsLocked("")
+	b = bob.media[ref.Digest]
+	bob.mu.Unlock()
+	if source != "u_mallory" || !switched || b.SourceUser != aliceID || b.Key != ref.Key || len(b.Alternates) != 0 {
+		t.Fatalf("stalled transfer should move on to the next sender: %+v", b)
+	}
+
+	encChunk := ref.ChunkSize + mediaChunkOverhead
+	chunk := func(i int) []byte { return enc[i*encChunk : min((i+1)*encChunk, len(enc))] }
+	deliver := func(i int, data []byte) {
+		bob.handleMediaChunk(map[string]any{
+			"to_user_id": bobID,
+			"digest":     ref.Digest,
+			"index":      float64(i),
+			"data":       base64.RawStdEncoding.EncodeToString(data),
+		})
+	}
+	tampered := append([]byte(nil), chunk(1)...)
+	tampered[20] ^= 0xff
+	deliver(1, tampered)
+	deliver(2, chunk(2))
+	deliver(0, chunk(0))
+	if _, _, err := bob.OpenMedia(ref.Digest); err == nil {
+		t.Fatalf("media should be incomplete after a tampered chunk")
+	}
+	deliver(1, chunk(1))
+	got, gotRef, err := bob.OpenMedia(ref.Digest)
+	if err != nil {
+		t.Fatalf("open media: %v", err)
+	}
+	if string(got) != string(plain) || gotRef.MIME != "image/png" {
+		t.Fatalf("downloaded media mismatch")
+	}
+}
+
+func TestDecodeMediaDataURL(t *testing.T) {
+	t.Parallel()
+	raw, mime, err := decodeMediaData("data:image/png;base64," + base64.StdEncoding.EncodeToString([]byte("png")))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if string(raw) != "png" || mime != "image/png" {
+		t.Fatalf("unexpected decode result %q %q", raw, mime)
+	}
+}
+
+func TestLogStoreRecoversTornTail(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	s, err := OpenLogStore(dir)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if err := s.Apply(map[string][]byte{"a": []byte("1"), "b": []byte("2")}, nil); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if err := s.Apply(map[string][]byte{"a": []byte("3")}, []string{"b"}); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	s.Close()
+
+	f, err := os.OpenFile(filepath.Join(dir, storeLogName), os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatalf("open log: %v", err)
+	}
+	f.Write([]byte{0, 0, 0, 40, 1, 2, 3, 4, '{'})
+	f.Close()
+
+	s, err = OpenLogStore(dir)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer s.Close()
+	got, _ := s.Load()
+	if len(got) != 1 || string(got["a"]) != "3" {
+		t.Fatalf("unexpected state after recovery: %v", got)
+	}
+	if err := s.Apply(map[string][]byte{"c": []byte("4")}, nil); err != nil {
+		t.Fatalf("apply after recovery: %v", err)
+	}
+}
+
+func TestLogStoreAppendsAfterCompaction(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	s, err := OpenLogStore(dir)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if err := s.Apply(map[string][]byte{"a": []byte("1")}, nil); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if err := s.Compact(); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	if err := s.Apply(map[string][]byte{"b": []byte("2")}, nil); err != nil {
+		t.Fatalf("apply after compaction: %v", err)
+	}
+	s.Close()
+	if _, err := os.Stat(filepath.Join(dir, storeLogName+".tmp")); !os.IsNotExist(err) {
+		t.Fatalf("temp file should be gone after the swap: %v", err)
+	}
+	s, err = OpenLogStore(dir)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer s.Close()
+	got, _ := s.Load()
+	if len(got) != 2 || string(got["b"]) != "2" {
+		t.Fatalf("append after compaction was lost: %v", got)
+	}
+}
+
+func TestStateEntriesKeyMessagesIndividually(t *testing.T) {
+	t.Parallel()
+	msgs := []DirectMessage{{MessageID: "m1", Body: "one"}, {MessageID: "m2", Body: "two"}}
+	ps := persistedState{DMs: map[string][]DirectMessage{"u_peer": msgs}}
+	before, err := stateEntries(&ps)
+	if err != nil {
+		t.Fatalf("entries: %v", err)
+	}
+	ps.DMs["u_peer"] = append(msgs, DirectMessage{MessageID: "m3", Body: "three"})
+	after, err := stateEntries(&ps)
+	if err != nil {
+		t.Fatalf("entries: %v", err)
+	}
+	puts, deletes, _ := diffEntries(hashEntries(before), after)
+	if len(puts) != 2 || puts["dms/u_peer/m3"] == nil || puts["dms/u_peer"] == nil || len(deletes) != 0 {
+		t.Fatalf("a new message should only write itself and the order, got %v", puts)
+	}
+	back, err := stateFromEntries(after)
+	if err != nil || len(back.DMs["u_peer"]) != 3 || back.DMs["u_peer"][2].Body != "three" {
+		t.Fatalf("messages should load back in order: %v %+v", err, back)
+	}
+
+	legacy, _ := json.Marshal(msgs)
+	old, err := stateFromEntries(map[string][]byte{"dms/u_peer": legacy})
+	if err != nil || len(old.DMs["u_peer"]) != 2 || old.DMs["u_peer"][1].Body != "two" {
+		t.Fatalf("a conversation stored whole should still load: %v %+v", err, old)
+	}
+}
+
+func TestLegacyStateJSONMigrates(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	legacy := persistedState{
+		Friends: map[string]Friend{"u_legacyfriend": {UserID: "u_legacyfriend"}},
+		DMs:     map[string][]DirectMessage{"u_legacyfriend": {{MessageID: "m1", FromUserID: "u_legacyfriend", Body: "legacy-secret-body"}}},
+		Cursors: map[string]int64{"topic": 7},
+	}
+	b, _ := json.Marshal(legacy)
+	if err := os.WriteFile(filepath.Join(dir, legacyStateName), b, 0o600); err != nil {
+		t.Fatalf("write legacy: %v", err)
+	}
+	m, err := NewManager(Config{DataDir: dir, RPCSocketPath: "/tmp/does-not-exist.sock"})
+	if err != nil {
+		t.Fatalf("new manager: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, legacyStateName+".migrated")); err != nil {
+		t.Fatalf("legacy file not renamed: %v", err)
+	}
+	if m.cursors["topic"] != 7 || len(m.dms["u_legacyfriend"]) != 1 || m.dms["u_legacyfriend"][0].Body != "legacy-secret-body" {
+		t.Fatalf("state not migrated")
+	}
+	id, err := generateIdentity()
+	if err != nil {
+		t.Fatalf("generate identity: %v", err)
+	}
+	m.mu.Lock()
+	m.identity = id
+	if err := m.rekeyLocked("pw"); err != nil {
+		t.Fatalf("seal legacy state: %v", err)
+	}
+	delete(m.friends, "u_legacyfriend")
+	m.cursors["topic"] = 9
+	if err := m.saveStateLocked(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	m.mu.Unlock()
+	m.rawStore.Close()
+
+	raw, _ := os.ReadFile(filepath.Join(dir, storeLogName))
+	if strings.Contains(string(raw), "u_legacyfriend") || strings.Contains(string(raw), "legacy-secret-body") {
+		t.Fatalf("plaintext state left in store")
+	}
+
+	locked, err := NewManager(Config{DataDir: dir, RPCSocketPath: "/tmp/does-not-exist.sock"})
+	if err != nil {
+		t.Fatalf("reopen locked manager: %v", err)
+	}
+	if len(locked.cursors) != 0 || !locked.lockedLocked() {
+		t.Fatalf("state should stay sealed until unlock")
+	}
+	locked.rawStore.Close()
+
+	again, err := NewManager(Config{DataDir: dir, RPCSocketPath: "/tmp/does-not-exist.sock", Passphrase: "pw"})
+	if err != nil {
+		t.Fatalf("reopen manager: %v", err)
+	}
+	if _, ok := again.friends["u_legacyfriend"]; ok || again.cursors["topic"] != 9 {
+		t.Fatalf("incremental save not persisted: friends=%v cursors=%v", again.friends, again.cursors)
+	}
+}
+
+func TestLockUnlockAndChangePassphrase(t *testing.T) {
+	t.Parallel()
+	m := newTestWalletManager(t)
+	m.mu.Lock()
+	userID := m.profile.UserID
+	m.friends["u_peer"] = Friend{UserID: "u_peer", CreatedAt: time.Now().UTC()}
+	if err := m.saveStateLocked(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	m.mu.Unlock()
+
+	if err := m.Lock(); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+	snap := m.Snapshot()
+	if snap["locked"] != true || snap["unlocked"] != false || snap["has_profile"] != true {
+		t.Fatalf("unexpected locked snapshot: locked=%v unlocked=%v has_profile=%v", snap["locked"], snap["unlocked"], snap["has_profile"])
+	}
+	if _, err := m.Init("0x1111111111111111111111111111111111111111", "", "", "other", Settings{}); err == nil {
+		t.Fatalf("init must not overwrite a locked profile")
+	}
+	if err := m.Unlock("wrong"); err == nil {
+		t.Fatalf("expected wrong passphrase to fail")
+	}
+	if err := m.Unlock("pw"); err != nil {
+		t.Fatalf("unlock: %v", err)
+	}
+	if m.profile == nil || m.profile.UserID != userID || m.friends["u_peer"].UserID == "" {
+		t.Fatalf("state not restored after unlock")
+	}
+
+	if err := m.ChangePassphrase("wrong", "pw2"); err == nil {
+		t.Fatalf("expected change with wrong passphrase to fail")
+	}
+	if err := m.ChangePassphrase("pw", "pw2"); err != nil {
+		t.Fatalf("change passphrase: %v", err)
+	}
+	if err := m.Lock(); err != nil {
+		t.Fatalf("relock: %v", err)
+	}
+	if err := m.Unlock("pw"); err == nil {
+		t.Fatalf("old passphrase should no longer unlock")
+	}
+	if err := m.Unlock("pw2"); err != nil {
+		t.Fatalf("unlock with new passphrase: %v", err)
+	}
+	if m.friends["u_peer"].UserID == "" {
+		t.Fatalf("state lost across re-encryption")
+	}
+	if _, err := os.Stat(m.vaultPath() + stagedKeySuffix); !os.IsNotExist(err) {
+		t.Fatalf("staged key files should be promoted")
+	}
+}
+
+func TestDeviceLinkFanoutAndSync(t *testing.T) {
+	t.Parallel()
+	alice := newTestWalletManager(t)
+	bob := newTestWalletManager(t)
+	phone, err := NewManager(Config{DataDir: t.TempDir(), RPCSocketPath: "/tmp/does-not-exist.sock"})
+	if err != nil {
+		t.Fatalf("new manager: %v", err)
+	}
+
+	token, err := alice.CreateDeviceLink()
+	if err != nil {
+		t.Fatalf("create device link: %v", err)
+	}
+	phone.mu.Lock()
+	join, req, err := phone.beginDeviceLinkLocked(token, "pw", "phone")
+	phone.mu.Unlock()
+	if err != nil {
+		t.Fatalf("begin device link: %v", err)
+	}
+	forged := map[string]any{}
+	for k, v := range req {
+		forged[k] = v
+	}
+	forged["mac"] = "AAAA"
+	alice.mu.Lock()
+	if _, err := alice.acceptDeviceLinkLocked(forged); err == nil {
+		alice.mu.Unlock()
+		t.Fatalf("expected bad mac to be rejected")
+	}
+	reply, err := alice.acceptDeviceLinkLocked(req)
+	alice.mu.Unlock()
+	if err != nil {
+		t.Fatalf("accept device link: %v", err)
+	}
+	phone.mu.Lock()
+	err = phone.completeDeviceLinkLocked(join, reply)
+	phone.mu.Unlock()
+	if err != nil {
+		t.Fatalf("complete device link: %v", err)
+	}
+	defer phone.Lock()
+	if phone.profile.UserID != alice.profile.UserID || phone.isPrimaryDeviceLocked() {
+		t.Fatalf("linked device should share the user id but not be primary")
+	}
+	if len(phone.deviceList.Devices) != 2 || alice.deviceList.Version != phone.deviceList.Version {
+		t.Fatalf("device lists not in sync")
+	}
+
+	phone.mu.Lock()
+	if _, err := phone.ensurePrekeyLocked(); err != nil {
+		phone.mu.Unlock()
+		t.Fatalf("ensure prekey: %v", err)
+	}
+	phonePrekey := phone.prekeyAdvertLocked()
+	phone.mu.Unlock()
+	alice.mu.Lock()
+	presence := map[string]any{
+		"user_id":         alice.profile.UserID,
+		"peer_id":         "peer-phone",
+		"prekey":          phonePrekey,
+		"username":        alice.profile.Username,
+		"sign_public_key": alice.profile.SignPublicKey,
+		"box_public_key":  alice.profile.BoxPublicKey,
+		"device_id":       phone.deviceIDLocked(),
+		"device_list":     alice.deviceList,
+		"ts":              time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	alice.mu.Unlock()
+	phone.mu.Lock()
+	signed, err := phone.signPlainBodyLocked(presence)
+	phone.mu.Unlock()
+	if err != nil {
+		t.Fatalf("sign presence: %v", err)
+	}
+	bob.handlePresence(signed)
+	alice.handlePresence(signed)
+	bob.mu.Lock()
+	known := bob.knownUsers[alice.profile.UserID]
+	targets := bob.deviceTargetsLocked(alice.profile.UserID)
+	bob.mu.Unlock()
+	if known.PeerID != "" || len(targets) != 1 || targets[0].PeerID != "peer-phone" || targets[0].PrekeyID == "" {
+		t.Fatalf("linked device presence should only update its device entry: %+v", known)
+	}
+
+	deliver := func(from *Manager, to []*Manager, boxPub, deviceID string, body map[string]any) {
+		from.mu.Lock()
+		wire, err := from.buildEnvelopeLocked(inboxTopic(alice.profile.UserID), boxPub, deviceID, body)
+		from.mu.Unlock()
+		if err != nil {
+			t.Fatalf("build envelope: %v", err)
+		}
+		for _, m := range to {
+			var env map[string]any
+			_ = json.Unmarshal(wire, &env)
+			if env["scheme"] != ratchetScheme {
+				t.Fatalf("a device with a prekey must get a ratchet envelope")
+			}
+			m.handleSecure(env)
+		}
+	}
+	deliver(bob, []*Manager{alice, phone}, targets[0].BoxPublicKey, targets[0].DeviceID, map[string]any{
+		"type": "dm_message", "message_id": "m-fanout", "from_user_id": bob.profile.UserID, "body": "hello phone",
+	})
+	if len(phone.Conversation(bob.profile.UserID)) != 1 || len(alice.Conversation(bob.profile.UserID)) != 0 {
+		t.Fatalf("device copy should only be opened by the addressed device")
+	}
+	bob.mu.RLock()
+	_, perDevice := bob.sessions[sessionKey(alice.profile.UserID, targets[0].DeviceID)]
+	_, primary := bob.sessions[alice.profile.UserID]
+	bob.mu.RUnlock()
+	if !perDevice || primary {
+		t.Fatalf("the linked device should have a session of its own")
+	}
+
+	sent := DirectMessage{MessageID: "m-sent", FromUserID: alice.profile.UserID, ToUserID: bob.profile.UserID, Body: "from laptop", CreatedAt: time.Now().UTC()}
+	deliver(alice, []*Manager{phone}, targets[0].BoxPublicKey, targets[0].DeviceID, map[string]any{
+		"type": "device_sync", "sync": "sent_dm", "from_user_id": alice.profile.UserID, "peer_user_id": bob.profile.UserID, "message": sent,
+	})
+	deliver(bob, []*Manager{phone}, targets[0].BoxPublicKey, targets[0].DeviceID, map[string]any{
+		"type": "device_sync", "sync": "sent_dm", "from_user_id": alice.profile.UserID, "peer_user_id": bob.profile.UserID,
+		"message": DirectMessage{MessageID: "m-forged", FromUserID: alice.profile.UserID, Body: "forged"},
+	})
+	conv := phone.Conversation(bob.profile.UserID)
+	if len(conv) != 2 || conv[1].MessageID != "m-sent" {
+		t.Fatalf("sent message not synced to linked device: %+v", conv)
+	}
+}
+
+func TestBackupExportAndRestore(t *testing.T) {
+	t.Parallel()
+	src := newTestWalletManager(t)
+	src.mu.Lock()
+	wallet := src.profile.Username
+	userID := src.profile.UserID
+	src.friends["u_backupfriend"] = Friend{UserID: "u_backupfriend", CreatedAt: time.Now().UTC()}
+	src.knownUsers["u_backupfriend"] = KnownUser{UserID: "u_backupfriend", BoxPublicKey: src.profile.BoxPublicKey}
+	src.dms["u_backupfriend"] = []DirectMessage{{MessageID: "m1", FromUserID: userID, ToUserID: "u_backupfriend", Body: "backup-history-body", CreatedAt: time.Now().UTC()}}
+	if err := src.saveStateLocked(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	src.mu.Unlock()
+
+	if _, err := src.ExportBackup("wrong", true); err == nil {
+		t.Fatalf("export with wrong passphrase should fail")
+	}
+	data, err := src.ExportBackup("pw", true)
+	if err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	if strings.Contains(string(data), "backup-history-body") {
+		t.Fatalf("backup must not contain plaintext history")
+	}
+
+	dst, err := NewManager(Config{DataDir: t.TempDir(), RPCSocketPath: "/tmp/does-not-exist.sock"})
+	if err != nil {
+		t.Fatalf("new manager: %v", err)
+	}
+	if _, err := dst.ImportBackup(data, "wrong", wallet, true); err == nil {
+		t.Fatalf("import with wrong passphrase should fail")
+	}
+	if _, err := dst.ImportBackup(data, "pw", "0x1111111111111111111111111111111111111111", true); err == nil {
+		t.Fatalf("import with a different wallet should fail")
+	}
+	p, err := dst.ImportBackup(data, "pw", wallet, true)
+	if err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	if p.UserID != userID {
+		t.Fatalf("restored user id = %s, want %s", p.UserID, userID)
+	}
+	dst.mu.RLock()
+	_, hasFriend := dst.friends["u_backupfriend"]
+	history := len(dst.dms["u_backupfriend"])
+	_, askedReset := dst.sessionResets["u_backupfriend"]
+	dst.mu.RUnlock()
+	if !hasFriend || history != 1 {
+		t.Fatalf("friends or history not restored: friend=%v history=%d", hasFriend, history)
+	}
+	if !askedReset {
+		t.Fatalf("restore should ask friends for a fresh handshake")
+	}
+	if _, err := dst.ImportBackup(data, "pw", wallet, true); err == nil {
+		t.Fatalf("import over an existing profile should fail")
+	}
+	if err := dst.Lock(); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+	if err := dst.Unlock("pw"); err != nil {
+		t.Fatalf("unlock restored profile: %v", err)
+	}
+}
+
+func TestKeyRotationUpdatesPeersAndRevokesOldKeys(t *testing.T) {
+	t.Parallel()
+	alice, walletKey := newTestWalletManagerWithKey(t)
+	bob := newTestWalletManager(t)
+	advertisePresence(t, alice, bob)
+	advertisePresence(t, bob, alice)
+	aliceID := alice.profile.UserID
+
+	alice.mu.Lock()
+	oldSign := alice.profile.SignPublicKey
+	stalePresence, _ := alice.signPlainBodyLocked(map[string]any{
+		"user_id":         aliceID,
+		"username":        alice.profile.Username,
+		"sign_public_key": alice.profile.SignPublicKey,
+		"box_public_key":  alice.profile.BoxPublicKey,
+		"ts":              time.Now().UTC().Format(time.RFC3339Nano),
+	})
+	wire, err := alice.buildSecureEnvelopeLocked(inboxTopic(bob.profile.UserID), bob.profile.BoxPublicKey,
+		map[string]any{"type": "dm_message", "message_id": "m-old", "from_user_id": aliceID, "body": "old key"})
+	alice.mu.Unlock()
+	if err != nil {
+		t.Fatalf("build envelope: %v", err)
+	}
+	var oldEnvelope map[string]any
+	_ = json.Unmarshal(wire, &oldEnvelope)
+
+	msg, err := alice.PrepareKeyRotation("compromised")
+	if err != nil {
+		t.Fatalf("prepare rotation: %v", err)
+	}
+	sig, err := crypto.Sign(accounts.TextHash([]byte(msg)), walletKey)
+	if err != nil {
+		t.Fatalf("wallet sign: %v", err)
+	}
+	if _, err := alice.RotateKeys("wrong", "compromised", hexutil.Encode(sig)); err == nil {
+		t.Fatalf("rotation with wrong passphrase should fail")
+	}
+	p, err := alice.RotateKeys("pw", "compromised", hexutil.Encode(sig))
+	if err != nil {
+		t.Fatalf("rotate keys: %v", err)
+	}
+	if p.UserID != aliceID || p.SignPublicKey == oldSign {
+		t.Fatalf("rotation must keep the user id and replace the sign key")
+	}
+
+	advertisePresence(t, alice, bob)
+	bob.mu.RLock()
+	u := bob.knownUsers[aliceID]
+	bob.mu.RUnlock()
+	if u.SignPublicKey != p.SignPublicKey || u.BoxPublicKey != p.BoxPublicKey || u.KeyVersion != 1 || !u.KeyWalletVerified {
+		t.Fatalf("peer did not adopt rotated keys: %+v", u)
+	}
+
+	bob.handlePresence(stalePresence)
+	bob.handleSecure(oldEnvelope)
+	bob.mu.RLock()
+	u = bob.knownUsers[aliceID]
+	oldDelivered := len(bob.dms[aliceID])
+	bob.mu.RUnlock()
+	if u.SignPublicKey != p.SignPublicKey {
+		t.Fatalf("presence with a revoked key must be ignored")
+	}
+	if oldDelivered != 0 {
+		t.Fatalf("envelope signed by a revoked key must be rejected")
+	}
+	deliverSecure(t, alice, bob, map[string]any{"type": "dm_message", "message_id": "m-new", "from_user_id": aliceID, "body": "new key"})
+	bob.mu.RLock()
+	newDelivered := len(bob.dms[aliceID])
+	bob.mu.RUnlock()
+	if newDelivered != 1 {
+		t.Fatalf("expected message under rotated keys, got %d", newDelivered)
+	}
+
+	if err := alice.Lock(); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+	if err := alice.Unlock("pw"); err != nil {
+		t.Fatalf("unlock: %v", err)
+	}
+	if base64.RawStdEncoding.EncodeToString(alice.identity.SignPublicKey) != p.SignPublicKey {
+		t.Fatalf("rotated identity not persisted")
+	}
+}
+
+func TestWalletBindingVerifiesPresence(t *testing.T) {
+	t.Parallel()
+	alice, aliceKey := newTestWalletManagerWithKey(t)
+	bob := newTestWalletManager(t)
+	otherKey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+
+	advertisePresence(t, alice, bob)
+	if bob.knownUsers[alice.profile.UserID].Verified {
+		t.Fatalf("presence without a binding must not be verified")
+	}
+
+	td, err := alice.ProfileBindingRequest()
+	if err != nil {
+		t.Fatalf("binding request: %v", err)
+	}
+	hash, _, err := apitypes.TypedDataAndHash(td)
+	if err != nil {
+		t.Fatalf("hash typed data: %v", err)
+	}
+	issuedAt, _ := strconv.ParseInt(td.Message["issuedAt"].(string), 10, 64)
+	forged, _ := crypto.Sign(hash, otherKey)
+	if _, err := alice.BindWallet(issuedAt, hexutil.Encode(forged)); err == nil {
+		t.Fatalf("binding signed by another wallet should be rejected")
+	}
+	sig, _ := crypto.Sign(hash, aliceKey)
+	if _, err := alice.BindWallet(issuedAt, hexutil.Encode(sig)); err != nil {
+		t.Fatalf("bind wallet: %v", err)
+	}
+
+	advertisePresence(t, alice, bob)
+	bob.mu.RLock()
+	verified := bob.knownUsers[alice.profile.UserID].Verified
+	bob.mu.RUnlock()
+	if !verified {
+		t.Fatalf("expected presence with a valid binding to be verified")
+	}
+
+	// A copied binding does not vouch for someone else's keys.
+	carol := newTestWalletManager(t)
+	carol.mu.Lock()
+	carol.profile.Username = alice.profile.Username
+	carol.profile.WalletBinding = alice.profile.WalletBinding
+	carol.mu.Unlock()
+	advertisePresence(t, carol, bob)
+	bob.mu.RLock()
+	impostor, seen := bob.knownUsers[carol.profile.UserID]
+	bob.mu.RUnlock()
+	if !seen || impostor.Verified {
+		t.Fatalf("binding must not verify a profile with different keys: seen=%v verified=%v", seen, impostor.Verified)
+	}
+}
+
+func TestSignedPresencePinsKeys(t *testing.T) {
+	t.Parallel()
+	alice := newTestWalletManager(t)
+	bob := newTestWalletManager(t)
+	carol := newTestWalletManager(t)
+	advertisePresence(t, alice, bob)
+	aliceID := alice.profile.UserID
+	pinned := bob.knownUsers[aliceID]
+	events, cancel := bob.SubscribeEvents()
+	defer cancel()
+
+	presence := func(signer *Manager, mutate func(map[string]any)) map[string]any {
+		alice.mu.RLock()
+		body := map[string]any{
+			"user_id":         aliceID,
+			"peer_id":         "peer-new",
+			"username":        alice.profile.Username,
+			"sign_public_key": alice.profile.SignPublicKey,
+			"box_public_key":  alice.profile.BoxPublicKey,
+			"ts":              time.Now().UTC().Format(time.RFC3339Nano),
+		}
+		alice.mu.RUnlock()
+		mutate(body)
+		signer.mu.RLock()
+		signed, err := signer.signPlainBodyLocked(body)
+		signer.mu.RUnlock()
+		if err != nil {
+			t.Fatalf("sign presence: %v", err)
+		}
+		return signed
+	}
+
+	tampered := presence(alice, func(map[string]any) {})
+	tampered["peer_id"] = "peer-hijack"
+	bob.handlePresence(tampered)
+	bob.handlePresence(presence(carol, func(b map[string]any) { b["sign_public_key"] = carol.profile.SignPublicKey }))
+	bob.handlePresence(presence(alice, func(b map[string]any) {
+		b["ts"] = time.Now().Add(-time.Hour).UTC().Format(time.RFC3339Nano)
+	}))
+	if got := bob.knownUsers[aliceID]; got.PeerID != pinned.PeerID || got.SignPublicKey != pinned.SignPublicKey {
+		t.Fatalf("tampered, foreign or stale presence must be ignored: %+v", got)
+	}
+
+	_, otherBox, _ := newX25519KeyPair()
+	swapBox := func(b map[string]any) { b["box_public_key"] = base64.RawStdEncoding.EncodeToString(otherBox) }
+	bob.handlePresence(presence(alice, swapBox))
+	bob.handlePresence(presence(alice, swapBox))
+	bob.mu.RLock()
+	got := bob.knownUsers[aliceID]
+	alerts := bob.securityAlertsSnapshotLocked()
+	bob.mu.RUnlock()
+	if got.BoxPublicKey != pinned.BoxPublicKey {
+		t.Fatalf("box key change without rotation must be refused")
+	}
+	if len(alerts) != 1 || alerts[0].UserID != aliceID || alerts[0].Count != 2 {
+		t.Fatalf("expected one key change alert seen twice, got %+v", alerts)
+	}
+	sawAlert := false
+	for len(events) > 0 {
+		if (<-events).Type == "key_change_alert" {
+			sawAlert = true
+		}
+	}
+	if !sawAlert {
+		t.Fatalf("expected a key_change_alert event")
+	}
+	if err := bob.DismissSecurityAlert(alerts[0].AlertID); err != nil {
+		t.Fatalf("dismiss alert: %v", err)
+	}
+
+	bob.handlePresence(presence(alice, func(map[string]any) {}))
+	if got := bob.knownUsers[aliceID]; got.PeerID != "peer-new" {
+		t.Fatalf("valid signed presence should update the peer, got %q", got.PeerID)
+	}
+}
+
+func TestSafetyNumberVerificationAndKeyChange(t *testing.T) {
+	t.Parallel()
+	alice, walletKey := newTestWalletManagerWithKey(t)
+	bob := newTestWalletManager(t)
+	advertisePresence(t, alice, bob)
+	advertisePresence(t, bob, alice)
+	aliceID, bobID := alice.profile.UserID, bob.profile.UserID
+	alice.friends[bobID] = Friend{UserID: bobID, CreatedAt: time.Now().UTC()}
+	bob.friends[aliceID] = Friend{UserID: aliceID, CreatedAt: time.Now().UTC()}
+
+	fromAlice, err := alice.SafetyNumber(bobID)
+	if err != nil {
+		t.Fatalf("alice safety number: %v", err)
+	}
+	fromBob, err := bob.SafetyNumber(aliceID)
+	if err != nil {
+		t.Fatalf("bob safety number: %v", err)
+	}
+	if fromAlice.Number != fromBob.Number || len(strings.ReplaceAll(fromAlice.Number, " ", "")) != 60 {
+		t.Fatalf("both sides must see the same 60 digit number: %q vs %q", fromAlice.Number, fromBob.Number)
+	}
+	if _, err := bob.VerifySafetyPayload(fromBob.QRPayload); err == nil {
+		t.Fatalf("own payload must not verify")
+	}
+	f, err := bob.VerifySafetyPayload(fromAlice.QRPayload)
+	if err != nil || !f.Verified {
+		t.Fatalf("scanning alice's payload should verify her: %v", err)
+	}
+
+	events, cancel := bob.SubscribeEvents()
+	defer cancel()
+	msg, err := alice.PrepareKeyRotation("")
+	if err != nil {
+		t.Fatalf("prepare rotation: %v", err)
+	}
+	sig, err := crypto.Sign(accounts.TextHash([]byte(msg)), walletKey)
+	if err != nil {
+		t.Fatalf("wallet sign: %v", err)
+	}
+	if _, err := alice.RotateKeys("pw", "", hexutil.Encode(sig)); err != nil {
+		t.Fatalf("rotate keys: %v", err)
+	}
+	advertisePresence(t, alice, bob)
+
+	bob.mu.RLock()
+	f2 := bob.friends[aliceID]
+	alerts := bob.securityAlertsSnapshotLocked()
+	bob.mu.RUnlock()
+	if f2.Verified {
+		t.Fatalf("verified mark must be dropped when keys change")
+	}
+	if len(alerts) != 1 || alerts[0].Kind != alertVerifiedKeyChange {
+		t.Fatalf("expected a verified key change alert, got %+v", alerts)
+	}
+	warned := false
+	for len(events) > 0 {
+		if (<-events).Type == "verified_key_change_alert" {
+			warned = true
+		}
+	}
+	if !warned {
+		t.Fatalf("expected a verified_key_change_alert event")
+	}
+	if _, err := bob.VerifySafetyPayload(fromAlice.QRPayload); err == nil {
+		t.Fatalf("payload for the old keys must not verify")
+	}
+}
+
+func TestBlockMuteAndUnfriend(t *testing.T) {
+	t.Parallel()
+	alice := newTestWalletManager(t)
+	bob := newTestWalletManager(t)
+	advertisePresence(t, alice, bob)
+	advertisePresence(t, bob, alice)
+	aliceID, bobID := alice.profile.UserID, bob.profile.UserID
+	alice.friends[bobID] = Friend{UserID: bobID, CreatedAt: time.Now().UTC()}
+	bob.friends[aliceID] = Friend{UserID: aliceID, CreatedAt: time.Now().UTC()}
+	dm := func(id string) map[string]any {
+		return map[string]any{"type": "dm_message", "message_id": id, "from_user_id": bobID, "body": "hi"}
+	}
+
+	deliverSecure(t, bob, alice, dm("m1"))
+	if err := alice.SetMuted(bobID, true); err != nil {
+		t.Fatalf("mute: %v", err)
+	}
+	if got := alice.Snapshot()["unread"].(map[string]int)[bobID]; got != 0 {
+		t.Fatalf("muted peer should not count as unread, got %d", got)
+	}
+	if len(alice.Conversation(bobID)) != 1 {
+		t.Fatalf("muted messages must still be delivered")
+	}
+
+	if err := bob.Unfriend(aliceID); err != nil {
+		t.Fatalf("unfriend: %v", err)
+	}
+	deliverSecure(t, bob, alice, map[string]any{"type": "friend_removed", "from_user_id": bobID})
+	if _, ok := alice.friends[bobID]; ok {
+		t.Fatalf("friend_removed notice should drop the friendship")
+	}
+
+	if err := alice.BlockUser(bobID); err != nil {
+		t.Fatalf("block: %v", err)
+	}
+	before := alice.knownUsers[bobID].PresenceAt
+	advertisePresence(t, bob, alice)
+	deliverSecure(t, bob, alice, dm("m2"))
+	if alice.knownUsers[bobID].PresenceAt != before || len(alice.Conversation(bobID)) != 1 {
+		t.Fatalf("envelopes from a blocked user must be dropped")
+	}
+	if err := alice.SendFriendRequest(bobID, "hi", "discovery", alice.profile.Username, "", ""); err == nil || err.Error() != "user is blocked" {
+		t.Fatalf("expected blocked request to fail, got %v", err)
+	}
+
+	if err := alice.UnblockUser(bobID); err != nil {
+		t.Fatalf("unblock: %v", err)
+	}
+	deliverSecure(t, bob, alice, dm("m3"))
+	if len(alice.Conversation(bobID)) != 2 {
+		t.Fatalf("messages should arrive again after unblocking")
+	}
+}
+
+type fakeRegistry struct {
+	contacts map[string]bool
+}
+
+func (f *fakeRegistry) IsContact(_ context.Context, _, wallet string) (bool, error) {
+	return f.contacts[strings.ToLower(wallet)], nil
+}
+
+func TestPrivacyModesGateStrangers(t *testing.T) {
+	t.Parallel()
+	alice := newTestWalletManager(t)
+	bob := newTestWalletManager(t)
+	advertisePresence(t, alice, bob)
+	advertisePresence(t, bob, alice)
+	aliceID, bobID := alice.profile.UserID, bob.profile.UserID
+	dm := func(id string) map[string]any {
+		return map[string]any{"type": "dm_message", "message_id": id, "from_user_id": bobID, "body": "hi"}
+	}
+
+	if _, err := alice.UpdateProfile("", "", "", Settings{Privacy: PrivacyFriends}); err != nil {
+		t.Fatalf("update privacy: %v", err)
+	}
+	deliverSecure(t, bob, alice, dm("m1"))
+	if len(alice.Conversation(bobID)) != 0 {
+		t.Fatalf("friends-only mode must drop messages from strangers")
+	}
+
+	reg := &fakeRegistry{contacts: map[string]bool{}}
+	alice.mu.Lock()
+	alice.registry = reg
+	alice.profile.Settings = normalizeSettings(Settings{Privacy: PrivacyContacts, ContractAddress: "0x00000000000000000000000000000000000000aa"})
+	u := alice.knownUsers[bobID]
+	u.Verified = true
+	alice.knownUsers[bobID] = u
+	alice.mu.Unlock()
+	deliverSecure(t, bob, alice, dm("m2"))
+	if len(alice.Conversation(bobID)) != 0 {
+		t.Fatalf("contacts mode must drop wallets missing from the registry")
+	}
+	reg.contacts[strings.ToLower(bob.profile.Username)] = true
+	alice.mu.Lock()
+	alice.contactCache = make(map[string]contactCacheEntry)
+	alice.mu.Unlock()
+	deliverSecure(t, bob, alice, dm("m3"))
+	if len(alice.Conversation(bobID)) != 1 {
+		t.Fatalf("contacts mode should accept registry contacts")
+	}
+	// A request only vouches for the wallet its hello is signed by.
+	claimed := "0x00000000000000000000000000000000000000cc"
+	reg.contacts[claimed] = true
+	deliverSecure(t, bob, alice, map[string]any{
+		"type": "friend_request", "request_id": "fr-claimed", "from_user_id": bobID,
+		"wallet_address": claimed, "created_at": time.Now().UTC().Format(time.RFC3339Nano),
+	})
+	if drops, _ := alice.Snapshot()["request_drops"].(RequestDropStats); drops.Privacy != 1 {
+		t.Fatalf("an unproven wallet must not pass as a contact: %+v", drops)
+	}
+
+	// Friends-only presence arrives sealed and is only taken from friends.
+	alice.mu.Lock()
+	sealed, err := alice.signPlainBodyLocked(map[string]any{
+		"user_id":         aliceID,
+		"peer_id":         "peer-sealed",
+		"username":        alice.profile.Username,
+		"sign_public_key": alice.profile.SignPublicKey,
+		"box_public_key":  alice.profile.BoxPublicKey,
+		"ts":              time.Now().UTC().Format(time.RFC3339Nano),
+	})
+	alice.mu.Unlock()
+	if err != nil {
+		t.Fatalf("sign presence: %v", err)
+	}
+	beacon := map[string]any{"type": "presence", "from_user_id": aliceID, "presence": sealed}
+	deliverSecure(t, alice, bob, beacon)
+	if bob.knownUsers[aliceID].PeerID == "peer-sealed" {
+		t.Fatalf("sealed presence from a non-friend must be ignored")
+	}
+	bob.mu.Lock()
+	bob.friends[aliceID] = Friend{UserID: aliceID, CreatedAt: time.Now().UTC()}
+	bob.mu.Unlock()
+	deliverSecure(t, alice, bob, beacon)
+	if bob.knownUsers[aliceID].PeerID != "peer-sealed" {
+		t.Fatalf("sealed presence from a friend should update the peer")
+	}
+}
+
+func TestStrangerRequestLimitsAndProofOfWork(t *testing.T) {
+	t.Parallel()
+	alice, aliceKey := newTestWalletManagerWithKey(t)
+	bob := newTestWalletManager(t)
+	advertisePresence(t, alice, bob)
+	advertisePresence(t, bob, alice)
+	aliceID, bobID := alice.profile.UserID, bob.profile.UserID
+	bob.mu.Lock()
+	bob.profile.Settings = normalizeSettings(Settings{Privacy: PrivacyPublic, RequestPolicy: &RequestPolicy{PerSenderPerHour: 2, PoWBits: 8}})
+	bob.mu.Unlock()
+
+	stamp := func(reqID string) string {
+		s, err := mintRequestStamp(8, requestStampResource(bobID, aliceID, reqID), time.Now())
+		if err != nil {
+			t.Fatalf("mint stamp: %v", err)
+		}
+		return s
+	}
+	if err := verifyRequestStamp(stamp("fr-x"), requestStampResource(bobID, aliceID, "fr-y"), 8, time.Now()); err == nil {
+		t.Fatalf("stamp must be bound to its request")
+	}
+	request := func(reqID, powStamp string) map[string]any {
+		msg, _, err := alice.IssueWalletChallenge("social.example", alice.profile.Username)
+		if err != nil {
+			t.Fatalf("issue challenge: %v", err)
+		}
+		return map[string]any{
+			"type": "friend_request", "request_id": reqID, "from_user_id": aliceID,
+			"wallet_address": alice.profile.Username, "hello_message": msg, "hello_sig": signWalletMessage(t, aliceKey, msg),
+			"pow_stamp": powStamp, "created_at": time.Now().UTC().Format(time.RFC3339Nano),
+		}
+	}
+	// A hello that does not verify is dropped before it is stamped or
+	// counted against the sender.
+	for _, id := range []string{"fr-forged-1", "fr-forged-2"} {
+		forged := request(id, stamp(id))
+		forged["hello_sig"] = signWalletMessage(t, aliceKey, "Hello")
+		deliverSecure(t, alice, bob, forged)
+	}
+	deliverSecure(t, alice, bob, request("fr-1", ""))
+	deliverSecure(t, alice, bob, request("fr-2", stamp("fr-1")))
+	deliverSecure(t, alice, bob, request("fr-3", stamp("fr-3")))
+	deliverSecure(t, alice, bob, request("fr-4", stamp("fr-4")))
+	deliverSecure(t, alice, bob, request("fr-5", stamp("fr-5")))
+	bob.mu.Lock()
+	bob.profile.Settings = normalizeSettings(Settings{Privacy: PrivacyHidden})
+	bob.mu.Unlock()
+	deliverSecure(t, alice, bob, request("fr-6", ""))
+
+	drops, _ := bob.Snapshot()["request_drops"].(RequestDropStats)
+	want := RequestDropStats{Privacy: 1, SenderLimit: 1, ProofOfWork: 2, InvalidHello: 2}
+	if drops != want {
+		t.Fatalf("unexpected drop counters: got %+v want %+v", drops, want)
+	}
+	if got := normalizeRequestPolicy(&RequestPolicy{PoWBits: 99}); got.PoWBits != maxRequestPoWBits || got.PerSenderPerHour != defaultSenderRequestsPerHour {
+		t.Fatalf("policy not normalized: %+v", got)
+	}
+}
+
+func TestFriendRequestLifecycleAndReconcile(t *testing.T) {
+	t.Parallel()
+	alice := newTestWalletManager(t)
+	bob := newTestWalletManager(t)
+	advertisePresence(t, alice, bob)
+	advertisePresence(t, bob, alice)
+	aliceID, bobID := alice.profile.UserID, bob.profile.UserID
+	now := time.Now().UTC()
+	pair := func(id, outStatus, inStatus string, created time.Time) {
+		alice.mu.Lock()
+		alice.requests[id] = FriendRequest{RequestID: id, FromUserID: aliceID, ToUserID: bobID, Status: outStatus, CreatedAt: created, UpdatedAt: created}
+		alice.mu.Unlock()
+		bob.mu.Lock()
+		bob.requests[id] = FriendRequest{RequestID: id, FromUserID: aliceID, ToUserID: bobID, Status: inStatus, CreatedAt: created, UpdatedAt: created}
+		bob.mu.Unlock()
+	}
+	status := func(m *Manager, id string) string {
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+		return m.requests[id].Status
+	}
+
+	pair("fr-cancel", "pending_out", "pending_in", now)
+	if err := alice.CancelFriendRequest("fr-cancel"); err != nil {
+		t.Fatalf("cancel: %v", err)
+	}
+	deliverSecure(t, alice, bob, map[string]any{"type": "friend_request_cancel", "request_id": "fr-cancel", "from_user_id": aliceID})
+	if status(alice, "fr-cancel") != "cancelled" || status(bob, "fr-cancel") != "cancelled" {
+		t.Fatalf("cancel should close the request on both sides")
+	}
+
+	pair("fr-old", "pending_out", "pending_in", now.Add(-friendRequestTTL-time.Hour))
+	alice.mu.Lock()
+	alice.expireRequestsLocked(now)
+	alice.mu.Unlock()
+	if status(alice, "fr-old") != "expired" {
+		t.Fatalf("stale request should expire")
+	}
+	if err := bob.RespondFriendRequest("fr-old", true); err == nil {
+		t.Fatalf("expired request must not be accepted")
+	}
+
+	// Re-sending a pending request keeps a single entry.
+	pair("fr-dup", "pending_out", "pending_in", now)
+	deliverSecure(t, alice, bob, map[string]any{"type": "friend_request", "request_id": "fr-dup", "from_user_id": aliceID, "created_at": now.Format(time.RFC3339Nano)})
+	if status(bob, "fr-dup") != "pending_in" || len(bob.Snapshot()["requests"].([]FriendRequest)) != 3 {
+		t.Fatalf("resend should not duplicate the request")
+	}
+
+	// An acceptance only counts for a request Alice actually sent Bob.
+	for _, id := range []string{"fr-never-sent", "fr-cancel"} {
+		deliverSecure(t, bob, alice, map[string]any{"type": "friend_response", "request_id": id, "status": "accepted", "from_user_id": bobID})
+	}
+	alice.mu.RLock()
+	_, friends := alice.friends[bobID]
+	alice.mu.RUnlock()
+	if friends || status(alice, "fr-cancel") != "cancelled" {
+		t.Fatalf("unsolicited acceptance must not add a friend")
+	}
+
+	// Bob accepted but his friend_response was lost.
+	pair("fr-lost", "pending_out", "accepted", now)
+	bob.mu.Lock()
+	bob.friends[aliceID] = Friend{UserID: aliceID, CreatedAt: now}
+	bob.mu.Unlock()
+	deliverSecure(t, alice, bob, map[string]any{
+		"type": "friend_reconcile", "from_user_id": aliceID, "friend": false, "ack": false,
+		"requests": []any{map[string]any{"request_id": "fr-lost", "status": "pending_out"}},
+	})
+	if _, ok := bob.friends[aliceID]; !ok {
+		t.Fatalf("friendship must survive while the sender still waits on the answer")
+	}
+	deliverSecure(t, bob, alice, map[string]any{
+		"type": "friend_reconcile", "from_user_id": bobID, "friend": true, "ack": true,
+		"requests": []any{map[string]any{"request_id": "fr-lost", "status": "accepted"}},
+	})
+	alice.mu.RLock()
+	_, friends = alice.friends[bobID]
+	alice.mu.RUnlock()
+	if !friends || status(alice, "fr-lost") != "accepted" {
+		t.Fatalf("reconcile should deliver the lost acceptance")
+	}
+
+	// Bob's removal notice was lost.
+	deliverSecure(t, bob, alice, map[string]any{
+		"type": "friend_reconcile", "from_user_id": bobID, "friend": false, "ack": true,
+		"requests": []any{map[string]any{"request_id": "fr-lost", "status": "accepted"}},
+	})
+	alice.mu.RLock()
+	_, friends = alice.friends[bobID]
+	alice.mu.RUnlock()
+	if friends {
+		t.Fatalf("reconcile should drop a friendship the peer no longer has")
+	}
+}
+
+func TestUpdateFriendOrganizesContacts(t *testing.T) {
+	t.Parallel()
+	m := newTestWalletManager(t)
+	now := time.Now().UTC()
+	m.mu.Lock()
+	m.friends["u-a"] = Friend{UserID: "u-a", CreatedAt: now}
+	m.friends["u-b"] = Friend{UserID: "u-b", CreatedAt: now.Add(time.Minute)}
+	m.mu.Unlock()
+	if _, err := m.UpdateFriend("u-x", FriendPatch{}); err == nil {
+		t.Fatalf("non-friends cannot be updated")
+	}
+	alias, note, fav := "  Ann ", "met at devcon", true
+	tags := []string{"Work", " work", "", "family"}
+	f, err := m.UpdateFriend("u-a", FriendPatch{Alias: &alias, Note: &note, Tags: &tags, Favorite: &fav})
+	if err != nil {
+		t.Fatalf("update friend: %v", err)
+	}
+	if f.Alias != "Ann" || f.Note != note || !f.Favorite || strings.Join(f.Tags, ",") != "family,Work" {
+		t.Fatalf("unexpected friend after update: %+v", f)
+	}
+	work := []string{"work"}
+	if _, err := m.UpdateFriend("u-b", FriendPatch{Tags: &work}); err != nil {
+		t.Fatalf("tag friend: %v", err)
+	}
+	// A nil field leaves the old value alone.
+	if f, _ = m.UpdateFriend("u-a", FriendPatch{}); f.Alias != "Ann" {
+		t.Fatalf("empty patch changed the alias")
+	}
+	long := strings.Repeat("x", maxFriendAliasLen+1)
+	if _, err := m.UpdateFriend("u-a", FriendPatch{Alias: &long}); err == nil {
+		t.Fatalf("overlong alias should be refused")
+	}
+
+	snap := m.Snapshot()
+	friends := snap["friends"].([]Friend)
+	if friends[0].UserID != "u-a" {
+		t.Fatalf("favorites should be listed first")
+	}
+	groups := snap["contact_groups"].([]ContactGroup)
+	if len(groups) != 2 || groups[1].Tag != "Work" || strings.Join(groups[1].UserIDs, ",") != "u-a,u-b" {
+		t.Fatalf("unexpected contact groups: %+v", groups)
+	}
+	m.mu.Lock()
+	m.addFriendLocked("u-a", now)
+	m.mu.Unlock()
+	if m.friends["u-a"].Alias != "Ann" {
+		t.Fatalf("re-adding a friend must keep its metadata")
+	}
+}
+
+func TestConversationPagingAndSearch(t *testing.T) {
+	t.Parallel()
+	m := newTestWalletManager(t)
+	base := time.Now().UTC().Add(-time.Hour)
+	m.mu.Lock()
+	for i := 0; i < 250; i++ {
+		body := "note " + strconv.Itoa(i)
+		if i == 42 {
+			body = "Lunch at the Harbour café?"
+		}
+		m.dms["peer-a"] = append(m.dms["peer-a"], DirectMessage{MessageID: "a-" + strconv.Itoa(i), FromUserID: "peer-a", Body: body, CreatedAt: base.Add(time.Duration(i) * time.Second)})
+	}
+	m.dms["peer-b"] = []DirectMessage{{MessageID: "b-0", FromUserID: "peer-b", Body: "harbour tomorrow", CreatedAt: base}}
+	m.mu.Unlock()
+
+	page, err := m.ConversationPage("peer-a", HistoryQuery{})
+	if err != nil || len(page.Messages) != defaultHistoryPage || page.Messages[0].MessageID != "a-50" || !page.HasMoreBefore || page.HasMoreAfter {
+		t.Fatalf("default page should hold the newest messages: %v", err)
+	}
+	page, err = m.ConversationPage("peer-a", HistoryQuery{Before: "a-50", Limit: 20})
+	if err != nil || len(page.Messages) != 20 || page.Messages[0].MessageID != "a-30" || page.Messages[19].MessageID != "a-49" {
+		t.Fatalf("before cursor returned the wrong page: %v", err)
+	}
+	page, _ = m.ConversationPage("peer-a", HistoryQuery{After: "a-10", Limit: 5})
+	if page.Messages[0].MessageID != "a-11" || len(page.Messages) != 5 || !page.HasMoreAfter {
+		t.Fatalf("after cursor should page forward")
+	}
+	page, _ = m.ConversationPage("peer-a", HistoryQuery{AfterTS: base.Add(247 * time.Second)})
+	if len(page.Messages) != 2 || page.HasMoreAfter {
+		t.Fatalf("timestamp bound not applied: %d", len(page.Messages))
+	}
+	if _, err := m.ConversationPage("peer-a", HistoryQuery{Before: "missing"}); err == nil {
+		t.Fatalf("unknown cursor should be an error")
+	}
+
+	hits, err := m.SearchMessages("harb", "", 0)
+	if err != nil || len(hits) != 2 {
+		t.Fatalf("prefix search should find both conversations: %v %d", err, len(hits))
+	}
+	if hits, _ = m.SearchMessages("LUNCH café", "peer-a", 0); len(hits) != 1 || hits[0].Message.MessageID != "a-42" {
+		t.Fatalf("all terms should match case-insensitively")
+	}
+	m.mu.Lock()
+	m.dms["peer-b"] = append(m.dms["peer-b"], DirectMessage{MessageID: "b-1", Body: "lunch then", CreatedAt: base.Add(time.Hour)})
+	m.mu.Unlock()
+	if hits, _ = m.SearchMessages("lunch", "", 0); len(hits) != 2 || hits[0].Message.MessageID != "b-1" {
+		t.Fatalf("index should pick up new messages, newest first")
+	}
+}
+
+func TestDirectMessageEditDeleteAndReact(t *testing.T) {
+	t.Parallel()
+	alice := newTestWalletManager(t)
+	bob := newTestWalletManager(t)
+	advertisePresence(t, alice, bob)
+	advertisePresence(t, bob, alice)
+	aliceID, bobID := alice.profile.UserID, bob.profile.UserID
+	now := time.Now().UTC().Add(-time.Minute)
+	for _, pair := range []struct {
+		m    *Manager
+		peer string
+	}{{alice, bobID}, {bob, aliceID}} {
+		pair.m.mu.Lock()
+		pair.m.friends[pair.peer] = Friend{UserID: pair.peer, CreatedAt: now}
+		pair.m.dms[pair.peer] = []DirectMessage{
+			{MessageID: "m1", FromUserID: aliceID, ToUserID: bobID, Body: "see you at 5", CreatedAt: now},
+			{MessageID: "m2", FromUserID: bobID, ToUserID: aliceID, Body: "ok", CreatedAt: now},
+		}
+		pair.m.mu.Unlock()
+	}
+	msg := func(m *Manager, peer, id string) DirectMessage {
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+		return m.dms[peer][m.dmIndexLocked(peer, id)]
+	}
+
+	if _, err := alice.EditDirectMessage(bobID, "m2", "hijack"); err == nil {
+		t.Fatalf("editing someone else's message must fail")
+	}
+	if _, err := alice.EditDirectMessage(bobID, "m1", "see you at 6"); err != nil {
+		t.Fatalf("edit: %v", err)
+	}
+	deliverSecure(t, alice, bob, map[string]any{"type": "dm_edit", "message_id": "m1", "from_user_id": aliceID, "body": "see you at 6", "edited_at": time.Now().UTC().Format(time.RFC3339Nano)})
+	deliverSecure(t, alice, bob, map[string]any{"type": "dm_edit", "message_id": "m2", "from_user_id": aliceID, "body": "forged", "edited_at": time.Now().UTC().Format(time.RFC3339Nano)})
+	if got := msg(bob, aliceID, "m1"); got.Body != "see you at 6" || len(got.Edits) != 1 || got.Edits[0].Body != "see you at 5" {
+		t.Fatalf("edit not applied with history: %+v", got)
+	}
+	if msg(bob, aliceID, "m2").Body != "ok" {
+		t.Fatalf("peer must not edit our messages")
+	}
+
+	if err := bob.ReactDirectMessage(aliceID, "m1", "👍"); err != nil {
+		t.Fatalf("react: %v", err)
+	}
+	deliverSecure(t, bob, alice, map[string]any{"type": "dm_reaction", "message_id": "m1", "from_user_id": bobID, "emoji": "👍"})
+	if msg(alice, bobID, "m1").Reactions[bobID] != "👍" || msg(bob, aliceID, "m1").Reactions[bobID] != "👍" {
+		t.Fatalf("reaction should show on both sides")
+	}
+
+	if err := bob.DeleteDirectMessage(aliceID, "m1", true); err == nil {
+		t.Fatalf("only the author may delete for everyone")
+	}
+	if err := alice.DeleteDirectMessage(bobID, "m1", true); err != nil {
+		t.Fatalf("delete for everyone: %v", err)
+	}
+	deliverSecure(t, alice, bob, map[string]any{"type": "dm_delete", "message_id": "m1", "from_user_id": aliceID})
+	if got := msg(bob, aliceID, "m1"); got.Deleted != DeletedForEveryone || got.Body != "" || got.Reactions != nil {
+		t.Fatalf("delete should leave a tombstone: %+v", got)
+	}
+	if err := bob.DeleteDirectMessage(aliceID, "m2", false); err != nil {
+		t.Fatalf("delete for me: %v", err)
+	}
+	if msg(bob, aliceID, "m2").Deleted != DeletedForMe || msg(alice, bobID, "m2").Body != "ok" {
+		t.Fatalf("delete for me must stay local")
+	}
+	deliverSecure(t, alice, bob, map[string]any{"type": "dm_message", "message_id": "m1", "from_user_id": aliceID, "body": "see you at 5"})
+	if got := msg(bob, aliceID, "m1"); got.Body != "" || len(bob.Conversation(aliceID)) != 2 {
+		t.Fatalf("a re-delivered message must not resurrect a tombstone")
+	}
+}
+
+func TestRepliesResolveLazily(t *testing.T) {
+	t.Parallel()
+	alice := newTestWalletManager(t)
+	bob := newTestWalletManager(t)
+	advertisePresence(t, alice, bob)
+	advertisePresence(t, bob, alice)
+	aliceID := alice.profile.UserID
+	dm := func(id, body, replyTo string) map[string]any {
+		return map[string]any{"type": "dm_message", "message_id": id, "from_user_id": aliceID, "body": body, "reply_to": replyTo}
+	}
+	bob.mu.Lock()
+	bob.friends[aliceID] = Friend{UserID: aliceID, CreatedAt: time.Now().UTC()}
+	bob.mu.Unlock()
+	get := func(id string) DirectMessage {
+		bob.mu.RLock()
+		defer bob.mu.RUnlock()
+		return bob.dms[aliceID][bob.dmIndexLocked(aliceID, id)]
+	}
+
+	// The second reply and the first arrive before the root they hang off.
+	deliverSecure(t, alice, bob, dm("r2", "me too", "r1"))
+	deliverSecure(t, alice, bob, dm("r1", "agreed", "root"))
+	if got := get("r2"); got.ReplyPending || got.ReplyQuote != "agreed" || got.ThreadRoot != "root" {
+		t.Fatalf("reply should resolve once its parent arrives: %+v", got)
+	}
+	if !get("r1").ReplyPending {
+		t.Fatalf("reply to a missing message should stay pending")
+	}
+	deliverSecure(t, alice, bob, dm("root", "pizza tonight?", ""))
+	if got := get("r1"); got.ReplyPending || got.ReplyQuote != "pizza tonight?" || got.ThreadRoot != "root" {
+		t.Fatalf("root arrival should resolve pending replies: %+v", got)
+	}
+	thread, err := bob.Thread(aliceID, "r2")
+	if err != nil || len(thread) != 3 || thread[0].MessageID != "root" || thread[1].MessageID != "r2" {
+		t.Fatalf("thread should start at its root: %v %+v", err, thread)
+	}
+
+	msg := get("root")
+	tombstoneDM(&msg, DeletedForEveryone, time.Now().UTC())
+	bob.mu.Lock()
+	bob.storeDMUpdateLocked(aliceID, bob.dmIndexLocked(aliceID, "root"), msg)
+	bob.mu.Unlock()
+	if get("r1").ReplyQuote != "" {
+		t.Fatalf("deleting the parent should clear the quote")
+	}
+	if err := bob.SendReply(aliceID, "missing", "hi", "", "", ""); err == nil {
+		t.Fatalf("replying to an unknown message should fail")
+	}
+}
+
+func TestSignalsAreDeliveredWithoutSaving(t *testing.T) {
+	t.Parallel()
+	alice := newTestWalletManager(t)
+	bob := newTestWalletManager(t)
+	advertisePresence(t, alice, bob)
+	advertisePresence(t, bob, alice)
+	aliceID, bobID := alice.profile.UserID, bob.profile.UserID
+	now := time.Now().UTC()
+	alice.mu.Lock()
+	alice.friends[bobID] = Friend{UserID: bobID, CreatedAt: now}
+	u := alice.knownUsers[bobID]
+	u.PeerID = "peer-bob"
+	alice.knownUsers[bobID] = u
+	alice.mu.Unlock()
+	bob.mu.Lock()
+	bob.friends[aliceID] = Friend{UserID: aliceID, CreatedAt: now}
+	bob.mu.Unlock()
+
+	build := func(kind string) []byte {
+		alice.mu.RLock()
+		defer alice.mu.RUnlock()
+		wire, peerID, err := alice.buildSignalLocked(bobID, kind, true)
+		if err != nil || peerID != "peer-bob" {
+			t.Fatalf("build signal: %v %q", err, peerID)
+		}
+		return wire
+	}
+	events, cancelEvents := bob.SubscribeEvents()
+	defer cancelEvents()
+	signals, cancelSignals := bob.SubscribeSignals()
+	defer cancelSignals()
+
+	rec := localrpcclient.MessageRecord{Topic: inboxTopic(bobID), Payload: build(SignalTyping)}
+	if bob.processRecord(rec) {
+		t.Fatalf("signals should not ask for the cursor to be saved")
+	}
+	select {
+	case s := <-signals:
+		if s.Kind != SignalTyping || s.FromUserID != aliceID || !s.Active || !s.ExpiresAt.After(s.At) {
+			t.Fatalf("unexpected signal: %+v", s)
+		}
+	default:
+		t.Fatalf("signal was not delivered")
+	}
+	select {
+	case ev := <-events:
+		t.Fatalf("signal should not emit an event, got %q", ev.Type)
+	default:
+	}
+
+	var env map[string]any
+	_ = json.Unmarshal(build(SignalRecording), &env)
+	env["ts"] = now.Add(-time.Minute).Format(time.RFC3339Nano)
+	stale, _ := json.Marshal(env)
+	bob.processRecord(localrpcclient.MessageRecord{Topic: inboxTopic(bobID), Payload: stale})
+	select {
+	case s := <-signals:
+		t.Fatalf("stale or resigned signal should be dropped: %+v", s)
+	default:
+	}
+	if _, _, err := alice.buildSignalLocked(aliceID, SignalTyping, true); err == nil {
+		t.Fatalf("signals should only go to friends")
+	}
+	if err := alice.SendSignal(bobID, "shouting", true); err == nil {
+		t.Fatalf("unknown signal kinds should be rejected")
+	}
+}
+
+func TestRetentionTimerPurgesMessagesAndMedia(t *testing.T) {
+	t.Parallel()
+	alice := newTestWalletManager(t)
+	bob := newTestWalletManager(t)
+	advertisePresence(t, alice, bob)
+	advertisePresence(t, bob, alice)
+	aliceID, bobID := alice.profile.UserID, bob.profile.UserID
+	now := time.Now().UTC()
+	alice.mu.Lock()
+	alice.friends[bobID] = Friend{UserID: bobID, CreatedAt: now}
+	alice.mu.Unlock()
+	bob.mu.Lock()
+	bob.friends[aliceID] = Friend{UserID: aliceID, CreatedAt: now}
+	bob.mu.Unlock()
+
+	if _, err := alice.SetRetention(bobID, 1); err == nil {
+		t.Fatalf("timers below the minimum should be rejected")
+	}
+	if _, err := alice.SetRetention(bobID, 60); err != nil {
+		t.Fatalf("set retention: %v", err)
+	}
+	deliverSecure(t, alice, bob, map[string]any{"type": "dm_retention", "from_user_id": aliceID, "retention_seconds": 60, "set_at": now.Format(time.RFC3339Nano)})
+	deliverSecure(t, alice, bob, map[string]any{"type": "dm_retention", "from_user_id": aliceID, "retention_seconds": 0, "set_at": now.Add(-time.Hour).Format(time.RFC3339Nano)})
+	deliverSecure(t, alice, bob, map[string]any{"type": "dm_retention", "from_user_id": aliceID, "retention_seconds": 3600, "set_at": "9999-01-01T00:00:00Z"})
+	bob.mu.RLock()
+	got := bob.friends[aliceID].RetentionSeconds
+	bob.mu.RUnlock()
+	if got != 60 {
+		t.Fatalf("newest timer should win and future stamps be refused, got %d", got)
+	}
+
+	dm := func(id, replyTo string, created time.Time) map[string]any {
+		return map[string]any{"type": "dm_message", "message_id": id, "from_user_id": aliceID, "body": "secret " + id,
+			"reply_to": replyTo, "created_at": created.Format(time.RFC3339Nano), "expires_in": 60}
+	}
+	deliverSecure(t, alice, bob, dm("old", "", now.Add(-2*time.Minute)))
+	deliverSecure(t, alice, bob, dm("m1", "", now))
+	deliverSecure(t, alice, bob, dm("m2", "m1", now))
+	bob.mu.Lock()
+	if bob.hasDMLocked(aliceID, "old") {
+		bob.mu.Unlock()
+		t.Fatalf("a message that expired in transit should not be stored")
+	}
+	i := bob.dmIndexLocked(aliceID, "m1")
+	if i < 0 || !bob.dms[aliceID][i].ExpiresAt.Equal(now.Add(time.Minute)) {
+		bob.mu.Unlock()
+		t.Fatalf("received message should expire with the timer")
+	}
+	ref, err := bob.storeMediaLocked([]byte("picture"), "p.png", "image/png")
+	if err != nil {
+		bob.mu.Unlock()
+		t.Fatalf("store media: %v", err)
+	}
+	bob.dms[aliceID][i].MediaDigest = ref.Digest
+	bob.dms[aliceID][i].ExpiresAt = now.Add(-time.Second)
+	bob.mu.Unlock()
+
+	bob.sweepExpiredMessages()
+	bob.mu.RLock()
+	defer bob.mu.RUnlock()
+	if bob.hasDMLocked(aliceID, "m1") || !bob.hasDMLocked(aliceID, "m2") {
+		t.Fatalf("only the expired message should be purged")
+	}
+	if reply := bob.dms[aliceID][bob.dmIndexLocked(aliceID, "m2")]; reply.ReplyQuote != "" {
+		t.Fatalf("reply should not keep quoting a purged message: %q", reply.ReplyQuote)
+	}
+	if _, ok := bob.media[ref.Digest]; ok {
+		t.Fatalf("purged media should be dropped")
+	}
+	if _, err := os.Stat(bob.mediaPath(ref.Digest, true)); !os.IsNotExist(err) {
+		t.Fatalf("purged media blob should be removed from disk: %v", err)
+	}
+	if len(bob.purgeLog) != 1 || bob.purgeLog[0].PeerUserID != aliceID || bob.purgeLog[0].Messages != 1 || bob.purgeLog[0].Media != 1 {
+		t.Fatalf("purge should be audited: %+v", bob.purgeLog)
+	}
+	entries, err := bob.store.Load()
+	if err != nil {
+		t.Fatalf("load store: %v", err)
+	}
+	for _, v := range entries {
+		if strings.Contains(string(v), "secret m1") {
+			t.Fatalf("purged message should be gone from the store")
+		}
+	}
+}
+
+func TestSaveStreamsItemDeltas(t *testing.T) {
+	t.Parallel()
+	alice := newTestWalletManager(t)
+	bob := newTestWalletManager(t)
+	aliceID := alice.profile.UserID
+	events, cancel := bob.SubscribeEvents()
+	defer cancel()
+	drain := func() map[string][]Event {
+		out := make(map[string][]Event)
+		for len(events) > 0 {
+			ev := <-events
+			out[ev.Type] = append(out[ev.Type], ev)
+		}
+		return out
+	}
+
+	advertisePresence(t, alice, bob)
+	got := drain()
+	if len(got[EventUserSeen]) != 1 || !strings.Contains(string(got[EventUserSeen][0].Data), aliceID) {
+		t.Fatalf("presence should stream the one user seen: %v", got)
+	}
+	advertisePresence(t, bob, alice)
+	bob.mu.Lock()
+	bob.friends[aliceID] = Friend{UserID: aliceID, CreatedAt: time.Now().UTC()}
+	bob.mu.Unlock()
+	drain()
+
+	deliverSecure(t, alice, bob, map[string]any{"type": "dm_message", "message_id": "m1", "from_user_id": aliceID, "body": "hi"})
+	got = drain()
+	if len(got[EventMessageAdded]) != 1 || len(got[EventMessageChanged]) != 0 || len(got[EventFriendChanged]) != 1 {
+		t.Fatalf("a new message should stream once, with the friend it came with: %v", got)
+	}
+	var added struct {
+		PeerUserID string        `json:"peer_user_id"`
+		Message    DirectMessage `json:"message"`
+	}
+	if err := json.Unmarshal(got[EventMessageAdded][0].Data, &added); err != nil || added.PeerUserID != aliceID || added.Message.Body != "hi" {
+		t.Fatalf("message_added payload: %v %+v", err, added)
+	}
+	if len(got[EventStatePatch]) != 1 || !strings.Contains(string(got[EventStatePatch][0].Data), `"unread"`) {
+		t.Fatalf("the unread count should be patched: %v", got[EventStatePatch])
+	}
+	if strings.Contains(string(got[EventStatePatch][0].Data), `"me"`) {
+		t.Fatalf("unchanged sections should not be resent: %s", got[EventStatePatch][0].Data)
+	}
+
+	deliverSecure(t, alice, bob, map[string]any{"type": "dm_edit", "message_id": "m1", "from_user_id": aliceID, "body": "hello", "edited_at": time.Now().UTC().Format(time.RFC3339Nano)})
+	if got = drain(); len(got[EventMessageChanged]) != 1 || len(got[EventMessageAdded]) != 0 {
+		t.Fatalf("an edit should stream as a change: %v", got)
+	}
+	bob.mu.Lock()
+	bob.dms[aliceID][0].ExpiresAt = time.Now().Add(-time.Second)
+	bob.mu.Unlock()
+	bob.sweepExpiredMessages()
+	if got = drain(); len(got[EventMessageRemoved]) != 1 || !strings.Contains(string(got[EventMessageRemoved][0].Data), `"m1"`) {
+		t.Fatalf("a purge should stream as a removal: %v", got)
+	}
+
+	first, _ := bob.SnapshotAt()
+	if _, ok := first["conversations"]; !ok {
+		t.Fatalf("snapshot should still carry conversations")
+	}
+	bob.mu.RLock()
+	last := bob.eventSeq
+	bob.mu.RUnlock()
+	if replay, ok := bob.EventsSince(last - 2); !ok || len(replay) != 2 || replay[1].ID != last {
+		t.Fatalf("backlog should replay the missed events: %v %v", ok, replay)
+	}
+}
+
+func TestForgedInnerSenderIsDropped(t *testing.T) {
+	t.Parallel()
+	alice := newTestWalletManager(t)
+	bob := newTestWalletManager(t)
+	mallory := newTestWalletManager(t)
+	advertisePresence(t, alice, bob)
+	advertisePresence(t, bob, alice)
+	advertisePresence(t, mallory, bob)
+	advertisePresence(t, bob, mallory)
+	aliceID, malloryID := alice.profile.UserID, mallory.profile.UserID
+	now := time.Now().UTC()
+	bob.mu.Lock()
+	bob.friends[aliceID] = Friend{UserID: aliceID, CreatedAt: now}
+	bob.friends[malloryID] = Friend{UserID: malloryID, CreatedAt: now}
+	bob.mu.Unlock()
+
+	deliverSecure(t, alice, bob, map[string]any{"type": "dm_message", "message_id": "m1", "from_user_id": aliceID, "body": "see you at noon"})
+	deliverSecure(t, mallory, bob, map[string]any{"type": "dm_edit", "message_id": "m1", "from_user_id": aliceID,
+		"body": "plans changed, send money", "edited_at": now.Add(time.Second).Format(time.RFC3339Nano)})
+	deliverSecure(t, mallory, bob, map[string]any{"type": "friend_removed", "from_user_id": aliceID})
+
+	bob.mu.RLock()
+	defer bob.mu.RUnlock()
+	if msg := bob.dms[aliceID][bob.dmIndexLocked(aliceID, "m1")]; msg.Body != "see you at noon" || !msg.EditedAt.IsZero() {
+		t.Fatalf("a friend must not edit another friend's message: %+v", msg)
+	}
+	if _, ok := bob.friends[aliceID]; !ok {
+		t.Fatalf("a forged friend_removed must not unfriend a third party")
+	}
+}
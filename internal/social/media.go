@@ -0,0 +1,542 @@
+package social
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	maxMediaBytes       = 25 * 1024 * 1024
+	mediaChunkSize      = 256 * 1024
+	mediaChunkOverhead  = 12 + 16
+	mediaChunksPerBatch = 16
+	// mediaStallAfter is how long a transfer may go without a chunk before
+	// another sender of the same content is tried.
+	mediaStallAfter = 2 * time.Minute
+	maxMediaSources = 8
+)
+
+// MediaRef describes an encrypted, content-addressed blob. Digest is the
+// SHA-256 of the plaintext; ChunkHashes cover the encrypted chunks so each
+// one can be verified as it arrives.
+type MediaRef struct {
+	Digest      string   `json:"digest"`
+	Name        string   `json:"name,omitempty"`
+	MIME        string   `json:"mime,omitempty"`
+	Size        int64    `json:"size"`
+	ChunkSize   int      `json:"chunk_size"`
+	ChunkHashes []string `json:"chunk_hashes"`
+	Key         string   `json:"key"`
+}
+
+type mediaBlob struct {
+	MediaRef
+	Complete   bool          `json:"complete"`
+	Missing    []int         `json:"missing,omitempty"`
+	SourceUser string        `json:"source_user,omitempty"`
+	Alternates []mediaSource `json:"alternates,omitempty"`
+	SharedWith []string      `json:"shared_with,omitempty"`
+	UpdatedAt  time.Time     `json:"updated_at"`
+}
+
+// mediaSource is another sender's reference to the same content. Each
+// sender seals its own copy, so the whole reference is kept.
+type mediaSource struct {
+	UserID string   `json:"user_id"`
+	Ref    MediaRef `json:"ref"`
+}
+
+type MediaTransfer struct {
+	Digest   string `json:"digest"`
+	Received int    `json:"received"`
+	Total    int    `json:"total"`
+}
+
+func (m *Manager) mediaDir() string { return filepath.Join(m.cfg.DataDir, "media") }
+
+func (m *Manager) mediaPath(digest string, complete bool) string {
+	if complete {
+		return filepath.Join(m.mediaDir(), digest+".blob")
+	}
+	return filepath.Join(m.mediaDir(), digest+".part")
+}
+
+// decodeMediaData accepts either a data URL or bare base64 as sent by the UI.
+func decodeMediaData(data string) ([]byte, string, error) {
+	mime := ""
+	if strings.HasPrefix(data, "data:") {
+		comma := strings.IndexByte(data, ',')
+		if comma < 0 {
+			return nil, "", errors.New("invalid media data url")
+		}
+		meta := data[len("data:"):comma]
+		mime = strings.TrimSuffix(meta, ";base64")
+		data = data[comma+1:]
+	}
+	raw, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, "", errors.New("invalid media encoding")
+	}
+	return raw, mime, nil
+}
+
+func mediaChunkAAD(digest string, index int) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(index))
+	return append([]byte("social-media-v1:"+digest+":"), b...)
+}
+
+// storeMediaLocked encrypts plain under a fresh key, writes it to the blob
+// store and returns its reference. Identical content is stored once.
+func (m *Manager) storeMediaLocked(plain []byte, name, mime string) (MediaRef, error) {
+	if len(plain) == 0 {
+		return MediaRef{}, errors.New("empty media")
+	}
+	if len(plain) > maxMediaBytes {
+		return MediaRef{}, errors.New("media too large")
+	}
+	sum := sha256.Sum256(plain)
+	digest := hex.EncodeToString(sum[:])
+	if b, ok := m.media[digest]; ok && b.Complete {
+		return b.MediaRef, nil
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return MediaRef{}, err
+	}
+	var out bytes.Buffer
+	hashes := make([]string, 0, len(plain)/mediaChunkSize+1)
+	for i := 0; i*mediaChunkSize < len(plain); i++ {
+		end := min((i+1)*mediaChunkSize, len(plain))
+		nonce, ct, err := sealWithKey(key, plain[i*mediaChunkSize:end], mediaChunkAAD(digest, i))
+		if err != nil {
+			return MediaRef{}, err
+		}
+		chunk := append(nonce, ct...)
+		h := sha256.Sum256(chunk)
+		hashes = append(hashes, hex.EncodeToString(h[:]))
+		out.Write(chunk)
+	}
+	if err := os.MkdirAll(m.mediaDir(), 0o700); err != nil {
+		return MediaRef{}, err
+	}
+	if err := os.WriteFile(m.mediaPath(digest, true), out.Bytes(), 0o600); err != nil {
+		return MediaRef{}, err
+	}
+	ref := MediaRef{
+		Digest:      digest,
+		Name:        name,
+		MIME:        mime,
+		Size:        int64(len(plain)),
+		ChunkSize:   mediaChunkSize,
+		ChunkHashes: hashes,
+		Key:         base64.RawStdEncoding.EncodeToString(key),
+	}
+	m.media[digest] = mediaBlob{MediaRef: ref, Complete: true, UpdatedAt: time.Now().UTC()}
+	return ref, nil
+}
+
+func (m *Manager) shareMediaLocked(digest, userID string) {
+	b, ok := m.media[digest]
+	if !ok || containsString(b.SharedWith, userID) {
+		return
+	}
+	b.SharedWith = append(b.SharedWith, userID)
+	m.media[digest] = b
+}
+
+// OpenMedia returns the decrypted content of a completely downloaded blob.
+func (m *Manager) OpenMedia(digest string) ([]byte, MediaRef, error) {
+	m.mu.RLock()
+	b, ok := m.media[digest]
+	m.mu.RUnlock()
+	if !ok {
+		return nil, MediaRef{}, errors.New("media not found")
+	}
+	if !b.Complete {
+		return nil, MediaRef{}, errors.New("media download incomplete")
+	}
+	enc, err := os.ReadFile(m.mediaPath(digest, true))
+	if err != nil {
+		return nil, MediaRef{}, err
+	}
+	plain, err := decryptMediaBlob(b.MediaRef, enc)
+	if err != nil {
+		return nil, MediaRef{}, err
+	}
+	return plain, b.MediaRef, nil
+}
+
+func decryptMediaBlob(ref MediaRef, enc []byte) ([]byte, error) {
+	key, err := base64.RawStdEncoding.DecodeString(ref.Key)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("invalid media key")
+	}
+	plain := make([]byte, 0, ref.Size)
+	encChunk := ref.ChunkSize + mediaChunkOverhead
+	for i := range ref.ChunkHashes {
+		start := i * encChunk
+		if start >= len(enc) {
+			return nil, errors.New("media blob truncated")
+		}
+		end := min(start+encChunk, len(enc))
+		chunk := enc[start:end]
+		if len(chunk) < mediaChunkOverhead {
+			return nil, errors.New("media chunk truncated")
+		}
+		p, err := openWithKey(key, chunk[:12], chunk[12:], mediaChunkAAD(ref.Digest, i))
+		if err != nil {
+			return nil, errors.New("media chunk corrupted")
+		}
+		plain = append(plain, p...)
+	}
+	sum := sha256.Sum256(plain)
+	if hex.EncodeToString(sum[:]) != ref.Digest || int64(len(plain)) != ref.Size {
+		return nil, errors.New("media digest mismatch")
+	}
+	return plain, nil
+}
+
+func validMediaRef(ref MediaRef) bool {
+	if len(ref.Digest) != 64 || ref.ChunkSize <= 0 || ref.ChunkSize > 4*mediaChunkSize {
+		return false
+	}
+	if ref.Size <= 0 || ref.Size > maxMediaBytes {
+		return false
+	}
+	want := int((ref.Size + int64(ref.ChunkSize) - 1) / int64(ref.ChunkSize))
+	if len(ref.ChunkHashes) != want {
+		return false
+	}
+	if _, err := hex.DecodeString(ref.Digest); err != nil {
+		return false
+	}
+	return !strings.ContainsAny(ref.Digest, "./\\")
+}
+
+// trackMediaDownloadLocked registers an incoming media reference and asks the
+// sender for every chunk that is not on disk yet. A reference to content
+// already on its way is kept as a fallback for when that transfer stalls.
+func (m *Manager) trackMediaDownloadLocked(fromUser string, ref MediaRef) {
+	if existing, ok := m.media[ref.Digest]; ok {
+		if !existing.Complete {
+			addMediaSource(&existing, fromUser, ref)
+			m.replaceStalledSourceLocked(&existing, time.Now().UTC())
+			m.media[ref.Digest] = existing
+			m.requestMissingChunksLocked(ref.Digest)
+		}
+		return
+	}
+	missing := make([]int, len(ref.ChunkHashes))
+	for i := range missing {
+		missing[i] = i
+	}
+	m.media[ref.Digest] = mediaBlob{MediaRef: ref, Missing: missing, SourceUser: fromUser, UpdatedAt: time.Now().UTC()}
+	m.requestMissingChunksLocked(ref.Digest)
+}
+
+func addMediaSource(b *mediaBlob, userID string, ref MediaRef) {
+	if userID == b.SourceUser && ref.Key == b.Key {
+		return
+	}
+	for _, s := range b.Alternates {
+		if s.UserID == userID && s.Ref.Key == ref.Key {
+			return
+		}
+	}
+	if len(b.Alternates) < maxMediaSources {
+		b.Alternates = append(b.Alternates, mediaSource{UserID: userID, Ref: ref})
+	}
+}
+
+// replaceStalledSourceLocked moves a transfer that has not made progress for
+// a while on to the next sender.
+func (m *Manager) replaceStalledSourceLocked(b *mediaBlob, now time.Time) bool {
+	if len(b.Alternates) == 0 || now.Sub(b.UpdatedAt) < mediaStallAfter {
+		return false
+	}
+	m.nextMediaSourceLocked(b, now)
+	return true
+}
+
+// nextMediaSourceLocked drops what was fetched so far, since chunks of one
+// sender's copy are useless with another's, and starts over from the next
+// sender.
+func (m *Manager) nextMediaSourceLocked(b *mediaBlob, now time.Time) {
+	next := b.Alternates[0]
+	b.Alternates = b.Alternates[1:]
+	_ = os.Remove(m.mediaPath(b.Digest, false))
+	b.MediaRef, b.SourceUser = next.Ref, next.UserID
+	b.Missing = make([]int, len(next.Ref.ChunkHashes))
+	for i := range b.Missing {
+		b.Missing[i] = i
+	}
+	b.UpdatedAt = now
+}
+
+func (m *Manager) requestMissingChunksLocked(digest string) {
+	b, ok := m.media[digest]
+	if !ok || b.Complete || b.SourceUser == "" {
+		return
+	}
+	target, ok := m.knownUsers[b.SourceUser]
+	if !ok {
+		return
+	}
+	want := b.Missing
+	if len(want) > mediaChunksPerBatch {
+		want = want[:mediaChunksPerBatch]
+	}
+	payload := map[string]any{
+		"type":         "media_request",
+		"digest":       digest,
+		"chunks":       want,
+		"from_user_id": m.profile.UserID,
+		"created_at":   time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	wire, err := m.buildSecureEnvelopeLocked(inboxTopic(b.SourceUser), target.BoxPublicKey, payload)
+	if err != nil {
+		return
+	}
+	_ = m.sendDirectWireLocked(b.SourceUser, wire)
+}
+
+// resumeMediaDownloadsLocked re-requests missing chunks, optionally only
+// from one peer whose presence just reappeared. It reports whether a
+// stalled transfer moved on to another sender.
+func (m *Manager) resumeMediaDownloadsLocked(fromUser string) bool {
+	now := time.Now().UTC()
+	changed := false
+	for digest, b := range m.media {
+		if b.Complete {
+			continue
+		}
+		if m.replaceStalledSourceLocked(&b, now) {
+			m.media[digest] = b
+			changed = true
+		}
+		if fromUser != "" && b.SourceUser != fromUser {
+			continue
+		}
+		m.requestMissingChunksLocked(digest)
+	}
+	return changed
+}
+
+func (m *Manager) handleMediaRequestLocked(fromUser string, body map[string]any) {
+	digest := asString(body["digest"])
+	b, ok := m.media[digest]
+	if !ok || !b.Complete || !containsString(b.SharedWith, fromUser) {
+		return
+	}
+	enc, err := os.ReadFile(m.mediaPath(digest, true))
+	if err != nil {
+		return
+	}
+	encChunk := b.ChunkSize + mediaChunkOverhead
+	chunks, _ := body["chunks"].([]any)
+	if len(chunks) > mediaChunksPerBatch {
+		chunks = chunks[:mediaChunksPerBatch]
+	}
+	for _, v := range chunks {
+		f, ok := v.(float64)
+		idx := int(f)
+		if !ok || idx < 0 || idx >= len(b.ChunkHashes) {
+			continue
+		}
+		start := idx * encChunk
+		end := min(start+encChunk, len(enc))
+		if start >= end {
+			continue
+		}
+		wire, _ := json.Marshal(map[string]any{
+			"version":    1,
+			"kind":       "media_chunk",
+			"to_user_id": fromUser,
+			"digest":     digest,
+			"index":      idx,
+			"data":       base64.RawStdEncoding.EncodeToString(enc[start:end]),
+		})
+		if err := m.sendDirectWireLocked(fromUser, wire); err != nil {
+			return
+		}
+	}
+}
+
+// handleMediaChunk stores one encrypted chunk. Chunks are not signed; they are
+// accepted only when their hash matches the reference delivered inside an
+// authenticated secure message.
+func (m *Manager) handleMediaChunk(raw map[string]any) {
+	digest := asString(raw["digest"])
+	idxF, _ := raw["index"].(float64)
+	idx := int(idxF)
+	data, err := base64.RawStdEncoding.DecodeString(asString(raw["data"]))
+	if err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.profile == nil || asString(raw["to_user_id"]) != m.profile.UserID {
+		return
+	}
+	b, ok := m.media[digest]
+	if !ok || b.Complete || idx < 0 || idx >= len(b.ChunkHashes) || !containsInt(b.Missing, idx) {
+		return
+	}
+	h := sha256.Sum256(data)
+	if hex.EncodeToString(h[:]) != b.ChunkHashes[idx] {
+		return
+	}
+	if err := os.MkdirAll(m.mediaDir(), 0o700); err != nil {
+		return
+	}
+	f, err := os.OpenFile(m.mediaPath(digest, false), os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return
+	}
+	_, werr := f.WriteAt(data, int64(idx*(b.ChunkSize+mediaChunkOverhead)))
+	cerr := f.Close()
+	if werr != nil || cerr != nil {
+		return
+	}
+	b.Missing = removeInt(b.Missing, idx)
+	b.UpdatedAt = time.Now().UTC()
+	m.media[digest] = b
+	if len(b.Missing) == 0 {
+		m.finishMediaDownloadLocked(&b)
+		m.media[digest] = b
+	} else if (len(b.ChunkHashes)-len(b.Missing))%mediaChunksPerBatch == 0 {
+		m.requestMissingChunksLocked(digest)
+	}
+	_ = m.saveStateLocked()
+}
+
+func (m *Manager) finishMediaDownloadLocked(b *mediaBlob) {
+	part := m.mediaPath(b.Digest, false)
+	enc, err := os.ReadFile(part)
+	if err == nil {
+		_, err = decryptMediaBlob(b.MediaRef, enc)
+	}
+	if err != nil {
+		// Every chunk matched its hash, so the sender's reference itself is
+		// bad; another sender's copy is tried first.
+		if len(b.Alternates) > 0 {
+			m.nextMediaSourceLocked(b, time.Now().UTC())
+			return
+		}
+		// Start over; a corrupted partial file cannot be repaired chunk-wise.
+		_ = os.Remove(part)
+		b.Missing = b.Missing[:0]
+		for i := range b.ChunkHashes {
+			b.Missing = append(b.Missing, i)
+		}
+		return
+	}
+	if err := os.Rename(part, m.mediaPath(b.Digest, true)); err != nil {
+		return
+	}
+	b.Complete = true
+	b.Missing = nil
+}
+
+func (m *Manager) mediaTransfersLocked() []MediaTransfer {
+	out := make([]MediaTransfer, 0)
+	for digest, b := range m.media {
+		if b.Complete {
+			continue
+		}
+		total := len(b.ChunkHashes)
+		out = append(out, MediaTransfer{Digest: digest, Received: total - len(b.Missing), Total: total})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Digest < out[j].Digest })
+	return out
+}
+
+func (m *Manager) resumeMediaDownloads() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.profile == nil || m.identity == nil {
+		return
+	}
+	if m.resumeMediaDownloadsLocked("") {
+		_ = m.saveStateLocked()
+	}
+}
+
+// migrateInlineMediaLocked moves base64 media still embedded in stored DMs
+// into the blob store.
+func (m *Manager) migrateInlineMediaLocked() bool {
+	changed := false
+	for peer, msgs := range m.dms {
+		for i := range msgs {
+			if msgs[i].MediaData == "" {
+				continue
+			}
+			raw, mime, err := decodeMediaData(msgs[i].MediaData)
+			if err != nil {
+				continue
+			}
+			if msgs[i].MediaMIME == "" {
+				msgs[i].MediaMIME = mime
+			}
+			ref, err := m.storeMediaLocked(raw, msgs[i].MediaName, msgs[i].MediaMIME)
+			if err != nil {
+				continue
+			}
+			if msgs[i].FromUserID == m.profileUserIDLocked() {
+				m.shareMediaLocked(ref.Digest, peer)
+			}
+			msgs[i].MediaDigest, msgs[i].MediaSize, msgs[i].MediaData = ref.Digest, ref.Size, ""
+			changed = true
+		}
+	}
+	return changed
+}
+
+func (m *Manager) profileUserIDLocked() string {
+	if m.profile == nil {
+		return ""
+	}
+	return m.profile.UserID
+}
+
+func mediaRefFromBody(v any) (MediaRef, bool) {
+	if v == nil {
+		return MediaRef{}, false
+	}
+	var ref MediaRef
+	if err := remarshal(v, &ref); err != nil || !validMediaRef(ref) {
+		return MediaRef{}, false
+	}
+	return ref, true
+}
+
+func containsInt(list []int, v int) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+func removeInt(list []int, v int) []int {
+	out := list[:0]
+	for _, x := range list {
+		if x != v {
+			out = append(out, x)
+		}
+	}
+	return out
+}
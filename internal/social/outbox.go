@@ -0,0 +1,162 @@
+package social
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"Assembler-Apps/internal/localrpcclient"
+)
+
+const (
+	DeliveryQueued    = "queued"
+	DeliverySent      = "sent"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+
+	outboxMaxAttempts = 30
+	outboxTTL         = 7 * 24 * time.Hour
+	outboxRetryBase   = 5 * time.Second
+	outboxRetryMax    = 10 * time.Minute
+)
+
+// outboxEntry holds a sealed DM envelope until a direct stream to the
+// recipient confirms it. The wire bytes are kept as-is so retries never
+// advance the ratchet and the receiver can dedup on msg_id.
+type outboxEntry struct {
+	MessageID     string    `json:"message_id"`
+	ToUserID      string    `json:"to_user_id"`
+	Wire          []byte    `json:"wire"`
+	Attempts      int       `json:"attempts"`
+	Published     bool      `json:"published"`
+	LastError     string    `json:"last_error,omitempty"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+func (m *Manager) enqueueOutboxLocked(toUserID, msgID string, wire []byte) {
+	now := time.Now().UTC()
+	m.outbox[msgID] = outboxEntry{
+		MessageID:     msgID,
+		ToUserID:      toUserID,
+		Wire:          wire,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+	}
+	m.attemptOutboxLocked(msgID)
+}
+
+// attemptOutboxLocked tries the direct stream first and falls back to the
+// recipient's inbox topic so the node history can carry the envelope while
+// the peer is offline.
+func (m *Manager) attemptOutboxLocked(msgID string) {
+	e, ok := m.outbox[msgID]
+	if !ok {
+		return
+	}
+	now := time.Now().UTC()
+	e.Attempts++
+	err := m.sendDirectWireLocked(e.ToUserID, e.Wire)
+	if err == nil {
+		// The peer's dm_receipt upgrades the message to delivered.
+		delete(m.outbox, msgID)
+		m.setDMStatusLocked(e.ToUserID, msgID, DeliverySent)
+		return
+	}
+	e.LastError = err.Error()
+	if !e.Published {
+		if err := m.publishSecureBytesLocked(inboxTopic(e.ToUserID), e.Wire); err == nil {
+			e.Published = true
+			m.setDMStatusLocked(e.ToUserID, msgID, DeliverySent)
+		}
+	}
+	if e.Attempts >= outboxMaxAttempts || now.Sub(e.CreatedAt) > outboxTTL {
+		delete(m.outbox, msgID)
+		if !e.Published {
+			m.setDMStatusLocked(e.ToUserID, msgID, DeliveryFailed)
+		}
+		return
+	}
+	backoff := outboxRetryBase << min(e.Attempts, 10)
+	if backoff > outboxRetryMax {
+		backoff = outboxRetryMax
+	}
+	e.NextAttemptAt = now.Add(backoff)
+	m.outbox[msgID] = e
+}
+
+func (m *Manager) sendDirectWireLocked(toUserID string, wire []byte) error {
+	target, ok := m.knownUsers[toUserID]
+	if !ok || strings.TrimSpace(target.PeerID) == "" {
+		return errors.New("target peer is offline or peer_id unknown")
+	}
+	rep, err := m.rpc.SendDirect(localrpcclient.SendDirectArgs{
+		AppID:   AppID,
+		PeerID:  target.PeerID,
+		Topic:   inboxTopic(toUserID),
+		Payload: wire,
+	})
+	if err != nil {
+		return err
+	}
+	if rep.Error != "" {
+		return errors.New(rep.Error)
+	}
+	if !rep.Sent {
+		return errors.New("direct stream send failed")
+	}
+	return nil
+}
+
+// flushOutboxLocked retries queued envelopes. With force set every entry for
+// the user is retried immediately, which is what a fresh presence beacon
+// warrants; otherwise only entries whose backoff has elapsed are attempted.
+func (m *Manager) flushOutboxLocked(userID string, force bool) bool {
+	now := time.Now().UTC()
+	due := make([]outboxEntry, 0)
+	for _, e := range m.outbox {
+		if userID != "" && e.ToUserID != userID {
+			continue
+		}
+		if force || !now.Before(e.NextAttemptAt) {
+			due = append(due, e)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].CreatedAt.Before(due[j].CreatedAt) })
+	for _, e := range due {
+		m.attemptOutboxLocked(e.MessageID)
+	}
+	return len(due) > 0
+}
+
+func (m *Manager) retryOutbox() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.profile == nil || m.identity == nil {
+		return
+	}
+	if m.flushOutboxLocked("", false) {
+		_ = m.saveStateLocked()
+	}
+}
+
+func (m *Manager) setDMStatusLocked(peerUserID, msgID, status string) {
+	msgs := m.dms[peerUserID]
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if msgs[i].MessageID == msgID {
+			if status == DeliveryFailed || deliveryRank(status) > deliveryRank(msgs[i].Status) {
+				msgs[i].Status = status
+			}
+			return
+		}
+	}
+}
+
+func (m *Manager) outboxSnapshotLocked() map[string]int {
+	out := make(map[string]int)
+	for _, e := range m.outbox {
+		out[e.ToUserID]++
+	}
+	return out
+}
@@ -0,0 +1,159 @@
+package social
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+)
+
+const (
+	presenceMaxAge    = 10 * time.Minute
+	presenceMaxSkew   = 2 * time.Minute
+	maxSecurityAlerts = 100
+
+	alertKeyChange = "key_change"
+)
+
+// SecurityAlert records a peer advertising keys that differ from the ones
+// pinned for it without a valid rotation, in which case the new keys are not
+// accepted, or a verified friend moving to new keys.
+type SecurityAlert struct {
+	AlertID     string    `json:"alert_id"`
+	Kind        string    `json:"kind"`
+	UserID      string    `json:"user_id"`
+	Username    string    `json:"username,omitempty"`
+	PinnedSign  string    `json:"pinned_sign_public_key"`
+	PinnedBox   string    `json:"pinned_box_public_key"`
+	OfferedSign string    `json:"offered_sign_public_key"`
+	OfferedBox  string    `json:"offered_box_public_key"`
+	PeerID      string    `json:"peer_id,omitempty"`
+	Count       int       `json:"count"`
+	DetectedAt  time.Time `json:"detected_at"`
+	LastSeenAt  time.Time `json:"last_seen_at"`
+}
+
+// signPlainBodyLocked signs body with the identity key. The body goes through
+// a JSON round trip first so the signed bytes are exactly what a receiver
+// re-encodes from the decoded map.
+func (m *Manager) signPlainBodyLocked(body map[string]any) (map[string]any, error) {
+	if m.identity == nil {
+		return nil, errors.New("identity missing")
+	}
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	var norm map[string]any
+	if err := json.Unmarshal(raw, &norm); err != nil {
+		return nil, err
+	}
+	delete(norm, "sig")
+	canon, _ := json.Marshal(norm)
+	norm["sig"] = base64.RawStdEncoding.EncodeToString(ed25519.Sign(m.identity.SignPrivate, canon))
+	return norm, nil
+}
+
+func verifyPlainBody(body map[string]any, signPubB64 string) bool {
+	signPub, err := base64.RawStdEncoding.DecodeString(signPubB64)
+	if err != nil || len(signPub) != ed25519.PublicKeySize {
+		return false
+	}
+	sig, err := base64.RawStdEncoding.DecodeString(asString(body["sig"]))
+	if err != nil {
+		return false
+	}
+	canonMap := make(map[string]any, len(body))
+	for k, v := range body {
+		if k != "sig" {
+			canonMap[k] = v
+		}
+	}
+	canon, _ := json.Marshal(canonMap)
+	return ed25519.Verify(ed25519.PublicKey(signPub), canon, sig)
+}
+
+// presenceFresh bounds how old a signed beacon may be, so a captured one
+// cannot be replayed later to point a user back at a stale peer.
+func presenceFresh(ts time.Time, now time.Time) bool {
+	return !ts.IsZero() && ts.After(now.Add(-presenceMaxAge)) && ts.Before(now.Add(presenceMaxSkew))
+}
+
+// chainRotatesFrom reports whether chain contains a rotation newer than
+// fromSeq that starts at the pinned sign key.
+func chainRotatesFrom(chain []keyRotation, pinnedSign string, fromSeq int) bool {
+	for _, r := range chain {
+		if r.Seq > fromSeq && r.OldSignPub == pinnedSign {
+			return true
+		}
+	}
+	return false
+}
+
+// raiseSecurityAlertLocked records an alert of the given kind and emits
+// "<kind>_alert". Repeats of the same key change only bump the count.
+func (m *Manager) raiseSecurityAlertLocked(kind string, pinned, offered KnownUser) {
+	h := sha256.Sum256([]byte(kind + "|" + pinned.UserID + "|" + offered.SignPublicKey + "|" + offered.BoxPublicKey))
+	id := "al_" + hex.EncodeToString(h[:8])
+	now := time.Now().UTC()
+	if a, ok := m.securityAlerts[id]; ok {
+		a.Count++
+		a.LastSeenAt = now
+		a.PeerID = offered.PeerID
+		m.securityAlerts[id] = a
+		_ = m.saveStateLocked()
+		return
+	}
+	m.securityAlerts[id] = SecurityAlert{
+		AlertID:     id,
+		Kind:        kind,
+		UserID:      pinned.UserID,
+		Username:    pinned.Username,
+		PinnedSign:  pinned.SignPublicKey,
+		PinnedBox:   pinned.BoxPublicKey,
+		OfferedSign: offered.SignPublicKey,
+		OfferedBox:  offered.BoxPublicKey,
+		PeerID:      offered.PeerID,
+		Count:       1,
+		DetectedAt:  now,
+		LastSeenAt:  now,
+	}
+	m.pruneSecurityAlertsLocked()
+	_ = m.saveStateLocked()
+	m.emitEventLocked(kind+"_alert", m.securityAlerts[id])
+}
+
+func (m *Manager) pruneSecurityAlertsLocked() {
+	if len(m.securityAlerts) <= maxSecurityAlerts {
+		return
+	}
+	alerts := m.securityAlertsSnapshotLocked()
+	for _, a := range alerts[maxSecurityAlerts:] {
+		delete(m.securityAlerts, a.AlertID)
+	}
+}
+
+func (m *Manager) securityAlertsSnapshotLocked() []SecurityAlert {
+	out := make([]SecurityAlert, 0, len(m.securityAlerts))
+	for _, a := range m.securityAlerts {
+		out = append(out, a)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].DetectedAt.After(out[j].DetectedAt) })
+	return out
+}
+
+// DismissSecurityAlert removes an alert once the user has looked at it. The
+// pinned keys stay as they are.
+func (m *Manager) DismissSecurityAlert(alertID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.securityAlerts[alertID]; !ok {
+		return errors.New("alert not found")
+	}
+	delete(m.securityAlerts, alertID)
+	return m.saveStateLocked()
+}
@@ -0,0 +1,208 @@
+package social
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Privacy modes decide who sees our presence and which strangers may reach us.
+const (
+	// PrivacyHidden publishes no presence and only talks to friends.
+	PrivacyHidden = "hidden"
+	// PrivacyFriends sends presence to each friend, sealed to their box key.
+	PrivacyFriends = "friends"
+	// PrivacyContacts is discoverable, but only wallets on the
+	// AssemblerRegistry contact list may send requests or messages.
+	PrivacyContacts = "contacts"
+	// PrivacyPublic is discoverable and open to requests from anyone.
+	PrivacyPublic = "public"
+
+	contactCacheTTL     = 10 * time.Minute
+	contactQueryTimeout = 5 * time.Second
+)
+
+func validPrivacy(mode string) bool {
+	switch mode {
+	case PrivacyHidden, PrivacyFriends, PrivacyContacts, PrivacyPublic:
+		return true
+	}
+	return false
+}
+
+// privacyFromFlags maps the flags older clients send onto a mode, or returns
+// "" when the client sent neither. No mode takes requests without presence,
+// so allowing stranger requests wins over not being discoverable.
+func privacyFromFlags(s Settings) string {
+	switch {
+	case !s.flagsSent && !s.Discoverable && !s.AllowStrangerRequests:
+		return ""
+	case s.AllowStrangerRequests:
+		return PrivacyPublic
+	case s.Discoverable:
+		return PrivacyContacts
+	}
+	return PrivacyFriends
+}
+
+func (s *Settings) UnmarshalJSON(b []byte) error {
+	type plain Settings
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, (*plain)(s)); err != nil {
+		return err
+	}
+	_, discoverable := fields["discoverable"]
+	_, allow := fields["allow_stranger_requests"]
+	s.flagsSent = discoverable || allow
+	return nil
+}
+
+// strangerAllowedLocked reports whether a non-friend may send us requests
+// and messages under the current privacy mode.
+func (m *Manager) strangerAllowedLocked(isContact bool) bool {
+	if m.profile == nil {
+		return false
+	}
+	switch m.profile.Settings.Privacy {
+	case PrivacyPublic:
+		return true
+	case PrivacyContacts:
+		return isContact
+	}
+	return false
+}
+
+// senderIsContact resolves the wallet behind a stranger's request or message
+// when the contacts mode or the request stamp policy needs it. A request
+// carries the wallet its hello is signed with; for messages the wallet has to
+// come from a verified profile binding. Must be called without the lock held.
+func (m *Manager) senderIsContact(fromUser string, body map[string]any) bool {
+	m.mu.RLock()
+	mode, powBits := "", 0
+	if m.profile != nil {
+		mode = m.profile.Settings.Privacy
+		powBits = normalizeRequestPolicy(m.profile.Settings.RequestPolicy).PoWBits
+	}
+	_, friend := m.friends[fromUser]
+	u := m.knownUsers[fromUser]
+	m.mu.RUnlock()
+	// Contacts are also spared the request stamp.
+	needed := mode == PrivacyContacts || (powBits > 0 && asString(body["type"]) == "friend_request")
+	if !needed || friend {
+		return false
+	}
+	wallet := ""
+	if asString(body["type"]) == "friend_request" {
+		wallet = strings.TrimSpace(asString(body["wallet_address"]))
+	} else if u.Verified {
+		wallet = u.Username
+	}
+	return wallet != "" && m.isRegistryContact(wallet)
+}
+
+// ContactRegistry answers whether a wallet is on the contact list of an
+// AssemblerRegistry deployment.
+type ContactRegistry interface {
+	IsContact(ctx context.Context, contract, wallet string) (bool, error)
+}
+
+type contactCacheEntry struct {
+	ok bool
+	at time.Time
+}
+
+// isRegistryContact checks wallet against the registry configured in the
+// profile settings. Lookups are cached and fail closed. Must be called
+// without the lock held.
+func (m *Manager) isRegistryContact(wallet string) bool {
+	m.mu.RLock()
+	reg := m.registry
+	contract := ""
+	if m.profile != nil {
+		contract = m.profile.Settings.ContractAddress
+	}
+	key := strings.ToLower(contract + "/" + wallet)
+	cached, hit := m.contactCache[key]
+	m.mu.RUnlock()
+	if reg == nil || !common.IsHexAddress(contract) || !common.IsHexAddress(wallet) {
+		return false
+	}
+	if hit && time.Since(cached.at) < contactCacheTTL {
+		return cached.ok
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), contactQueryTimeout)
+	defer cancel()
+	ok, err := reg.IsContact(ctx, contract, wallet)
+	if err != nil {
+		return false
+	}
+	m.mu.Lock()
+	m.contactCache[key] = contactCacheEntry{ok: ok, at: time.Now()}
+	m.mu.Unlock()
+	return ok
+}
+
+// EthContactRegistry reads isContact(address) over Ethereum JSON-RPC.
+type EthContactRegistry struct {
+	URL    string
+	Client *http.Client
+}
+
+func NewEthContactRegistry(url string) *EthContactRegistry {
+	return &EthContactRegistry{URL: url, Client: &http.Client{Timeout: contactQueryTimeout}}
+}
+
+var isContactSelector = crypto.Keccak256([]byte("isContact(address)"))[:4]
+
+func (r *EthContactRegistry) IsContact(ctx context.Context, contract, wallet string) (bool, error) {
+	data := append(append([]byte(nil), isContactSelector...), common.LeftPadBytes(common.HexToAddress(wallet).Bytes(), 32)...)
+	reqBody, _ := json.Marshal(map[string]any{
+		"jsonrpc": "2.0",
+		"id":      1,
+		"method":  "eth_call",
+		"params": []any{
+			map[string]string{"to": common.HexToAddress(contract).Hex(), "data": hexutil.Encode(data)},
+			"latest",
+		},
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.URL, bytes.NewReader(reqBody))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	var out struct {
+		Result string `json:"result"`
+		Error  *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return false, err
+	}
+	if out.Error != nil {
+		return false, fmt.Errorf("eth_call: %s", out.Error.Message)
+	}
+	raw, err := hexutil.Decode(out.Result)
+	if err != nil || len(raw) != 32 {
+		return false, errors.New("unexpected isContact result")
+	}
+	return new(big.Int).SetBytes(raw).Sign() != 0, nil
+}
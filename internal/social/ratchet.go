@@ -0,0 +1,656 @@
+package social
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	ratchetScheme     = "dr1"
+	maxSkippedKeys    = 256
+	maxPrekeys        = 3
+	prekeyRotateEvery = 7 * 24 * time.Hour
+	// sessionResetEvery limits how often one device is asked to start over.
+	sessionResetEvery = time.Minute
+)
+
+// signedPrekey is the medium-term X25519 key advertised in presence so peers
+// can start a session without an interactive handshake.
+type signedPrekey struct {
+	ID        string    `json:"id"`
+	Private   []byte    `json:"private"`
+	Public    []byte    `json:"public"`
+	Signature []byte    `json:"signature"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type x3dhInit struct {
+	Ephemeral string `json:"ek"`
+	PrekeyID  string `json:"spk_id"`
+	CreatedAt string `json:"ts"`
+}
+
+type ratchetHeader struct {
+	DH string `json:"dh"`
+	PN uint32 `json:"pn"`
+	N  uint32 `json:"n"`
+}
+
+// ratchetSession is the double-ratchet state with one device of a peer.
+type ratchetSession struct {
+	PeerUserID      string            `json:"peer_user_id"`
+	RootKey         []byte            `json:"root_key"`
+	SelfPriv        []byte            `json:"self_priv"`
+	SelfPub         []byte            `json:"self_pub"`
+	RemotePub       []byte            `json:"remote_pub,omitempty"`
+	SendChain       []byte            `json:"send_chain,omitempty"`
+	RecvChain       []byte            `json:"recv_chain,omitempty"`
+	SendN           uint32            `json:"send_n"`
+	RecvN           uint32            `json:"recv_n"`
+	PrevSendN       uint32            `json:"prev_send_n"`
+	Skipped         map[string][]byte `json:"skipped,omitempty"`
+	PendingX3DH     *x3dhInit         `json:"pending_x3dh,omitempty"`
+	RemoteEphemeral string            `json:"remote_ephemeral,omitempty"`
+	LastRecvAt      time.Time         `json:"last_recv_at,omitempty"`
+	CreatedAt       time.Time         `json:"created_at"`
+}
+
+func prekeySigningInput(id string, pub []byte) []byte {
+	return []byte("social-prekey-v1:" + id + ":" + base64.RawStdEncoding.EncodeToString(pub))
+}
+
+// ensurePrekeyLocked issues a fresh signed prekey when none exists or the
+// current one is due for rotation. Older prekeys are kept for a while so late
+// handshakes still complete.
+func (m *Manager) ensurePrekeyLocked() (bool, error) {
+	if m.identity == nil {
+		return false, errors.New("identity missing")
+	}
+	if n := len(m.prekeys); n > 0 && time.Since(m.prekeys[n-1].CreatedAt) < prekeyRotateEvery {
+		return false, nil
+	}
+	priv, pub, err := newX25519KeyPair()
+	if err != nil {
+		return false, err
+	}
+	now := time.Now().UTC()
+	id := fmt.Sprintf("spk-%d", now.UnixNano())
+	pk := signedPrekey{
+		ID:        id,
+		Private:   priv,
+		Public:    pub,
+		Signature: ed25519.Sign(m.identity.SignPrivate, prekeySigningInput(id, pub)),
+		CreatedAt: now,
+	}
+	m.prekeys = append(m.prekeys, pk)
+	if len(m.prekeys) > maxPrekeys {
+		m.prekeys = m.prekeys[len(m.prekeys)-maxPrekeys:]
+	}
+	return true, nil
+}
+
+func (m *Manager) prekeyAdvertLocked() map[string]any {
+	if len(m.prekeys) == 0 {
+		return nil
+	}
+	pk := m.prekeys[len(m.prekeys)-1]
+	return map[string]any{
+		"id":  pk.ID,
+		"pub": base64.RawStdEncoding.EncodeToString(pk.Public),
+		"sig": base64.RawStdEncoding.EncodeToString(pk.Signature),
+	}
+}
+
+func (m *Manager) prekeyByIDLocked(id string) (signedPrekey, bool) {
+	for _, pk := range m.prekeys {
+		if pk.ID == id {
+			return pk, true
+		}
+	}
+	return signedPrekey{}, false
+}
+
+func verifyPrekey(signPubB64, id, pubB64, sigB64 string) bool {
+	signPub, err := base64.RawStdEncoding.DecodeString(signPubB64)
+	if err != nil || len(signPub) != ed25519.PublicKeySize {
+		return false
+	}
+	pub, err := base64.RawStdEncoding.DecodeString(pubB64)
+	if err != nil || len(pub) != 32 {
+		return false
+	}
+	sig, err := base64.RawStdEncoding.DecodeString(sigB64)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(ed25519.PublicKey(signPub), prekeySigningInput(id, pub), sig)
+}
+
+// sessionKey names the session with one device of userID. Sessions with a
+// primary device keep the bare user ID.
+func sessionKey(userID, deviceID string) string {
+	if deviceID == "" {
+		return userID
+	}
+	return userID + "/" + deviceID
+}
+
+// remoteDeviceLocked maps the box key of one of userID's devices to the
+// device part of its session key, empty for the primary. A user whose keys
+// are not known yet is taken to write from the primary.
+func (m *Manager) remoteDeviceLocked(userID, boxPubB64 string) string {
+	primary := m.knownUsers[userID].BoxPublicKey
+	if userID == m.profile.UserID {
+		primary = m.profile.BoxPublicKey
+	}
+	if primary == "" || boxPubB64 == primary {
+		return ""
+	}
+	raw, err := base64.RawStdEncoding.DecodeString(boxPubB64)
+	if err != nil {
+		return ""
+	}
+	return deviceIDFor(raw)
+}
+
+// remotePrekeyLocked returns the prekey last advertised by the device of
+// userID that owns boxPubB64, along with the key it must be signed with.
+func (m *Manager) remotePrekeyLocked(userID, boxPubB64 string) (signPub, id, pub, sig string) {
+	devices := m.ownDevicesLocked()
+	signPub = m.profile.SignPublicKey
+	if userID != m.profile.UserID {
+		u := m.knownUsers[userID]
+		signPub, devices = u.SignPublicKey, u.Devices
+		if boxPubB64 == u.BoxPublicKey {
+			return signPub, u.PrekeyID, u.PrekeyPublic, u.PrekeySignature
+		}
+	}
+	for _, d := range devices {
+		if d.BoxPublicKey == boxPubB64 {
+			return signPub, d.PrekeyID, d.PrekeyPublic, d.PrekeySignature
+		}
+	}
+	return signPub, "", "", ""
+}
+
+// dropSessionsLocked forgets the sessions with every device of userID.
+func (m *Manager) dropSessionsLocked(userID string) {
+	for key, s := range m.sessions {
+		if s.PeerUserID == userID || key == userID {
+			delete(m.sessions, key)
+		}
+	}
+}
+
+// sendSessionLocked returns the ratchet session used to encrypt to the
+// device of toUser holding boxPubB64, starting a new X3DH handshake when
+// that device advertises a prekey. A nil session means the device only
+// speaks the legacy static scheme.
+func (m *Manager) sendSessionLocked(toUser, boxPubB64 string) (*ratchetSession, error) {
+	key := sessionKey(toUser, m.remoteDeviceLocked(toUser, boxPubB64))
+	if s, ok := m.sessions[key]; ok {
+		return s, nil
+	}
+	signPub, prekeyID, prekeyPub, prekeySig := m.remotePrekeyLocked(toUser, boxPubB64)
+	if prekeyID == "" || !verifyPrekey(signPub, prekeyID, prekeyPub, prekeySig) {
+		return nil, nil
+	}
+	peerIdentity, err := decodeKey32(boxPubB64)
+	if err != nil {
+		return nil, err
+	}
+	peerPrekey, err := decodeKey32(prekeyPub)
+	if err != nil {
+		return nil, err
+	}
+	ekPriv, ekPub, err := newX25519KeyPair()
+	if err != nil {
+		return nil, err
+	}
+	dh1, err := curve25519.X25519(m.identity.BoxPrivateKey[:], peerPrekey[:])
+	if err != nil {
+		return nil, err
+	}
+	dh2, err := curve25519.X25519(ekPriv, peerIdentity[:])
+	if err != nil {
+		return nil, err
+	}
+	dh3, err := curve25519.X25519(ekPriv, peerPrekey[:])
+	if err != nil {
+		return nil, err
+	}
+	sk := x3dhSecret(dh1, dh2, dh3)
+	s, err := newInitiatorSession(toUser, sk, peerPrekey[:])
+	if err != nil {
+		return nil, err
+	}
+	s.PendingX3DH = &x3dhInit{
+		Ephemeral: base64.RawStdEncoding.EncodeToString(ekPub),
+		PrekeyID:  prekeyID,
+		CreatedAt: s.CreatedAt.Format(time.RFC3339Nano),
+	}
+	m.sessions[key] = s
+	return s, nil
+}
+
+// openRatchetLocked decrypts a dr1 envelope from the device of fromUser
+// holding senderIdentity. A handshake that loses the simultaneous-initiation
+// tie-break is still decrypted with a throwaway responder session so no
+// message is lost.
+func (m *Manager) openRatchetLocked(fromUser string, senderIdentity [32]byte, raw map[string]any, ad []byte) ([]byte, error) {
+	var hdr ratchetHeader
+	if err := remarshal(raw["header"], &hdr); err != nil {
+		return nil, errors.New("invalid ratchet header")
+	}
+	nonce, err := base64.RawStdEncoding.DecodeString(asString(raw["nonce"]))
+	if err != nil {
+		return nil, err
+	}
+	cipherText, err := base64.RawStdEncoding.DecodeString(asString(raw["ciphertext"]))
+	if err != nil {
+		return nil, err
+	}
+	fromDevice := m.remoteDeviceLocked(fromUser, base64.RawStdEncoding.EncodeToString(senderIdentity[:]))
+	key := sessionKey(fromUser, fromDevice)
+	sess := m.sessions[key]
+	var init *x3dhInit
+	if v, ok := raw["x3dh"]; ok && v != nil {
+		init = &x3dhInit{}
+		if err := remarshal(v, init); err != nil {
+			return nil, errors.New("invalid x3dh header")
+		}
+	}
+	if init == nil || (sess != nil && sess.RemoteEphemeral == init.Ephemeral) {
+		if sess == nil {
+			return nil, errors.New("no ratchet session")
+		}
+		return m.decryptInSessionLocked(key, sess, hdr, nonce, cipherText, ad)
+	}
+
+	inbound, err := m.responderSessionLocked(fromUser, senderIdentity, init)
+	if err != nil {
+		return nil, err
+	}
+	adopt := sess == nil
+	if sess != nil && sess.PendingX3DH != nil {
+		// Devices of one user tie on the user ID, so the device decides.
+		adopt = fromUser+"/"+deviceIDFor(senderIdentity[:]) < m.profile.UserID+"/"+m.deviceIDLocked()
+	} else if sess != nil {
+		adopt = parseTS(init.CreatedAt).After(sess.LastRecvAt)
+	}
+	if !adopt {
+		return inbound.decrypt(hdr, nonce, cipherText, ad)
+	}
+	return m.decryptInSessionLocked(key, inbound, hdr, nonce, cipherText, ad)
+}
+
+func (m *Manager) decryptInSessionLocked(key string, sess *ratchetSession, hdr ratchetHeader, nonce, cipherText, ad []byte) ([]byte, error) {
+	next := sess.clone()
+	plain, err := next.decrypt(hdr, nonce, cipherText, ad)
+	if err != nil {
+		return nil, err
+	}
+	next.PendingX3DH = nil
+	next.LastRecvAt = time.Now().UTC()
+	m.sessions[key] = next
+	return plain, nil
+}
+
+// sessionResetWantedLocked decides whether a ratchet message that could not
+// be opened calls for a reset. A replayed message fails just like a lost one,
+// so a live session only gives way to a handshake newer than itself.
+func (m *Manager) sessionResetWantedLocked(fromUser, senderBoxPubB64 string, raw map[string]any) bool {
+	sess := m.sessions[sessionKey(fromUser, m.remoteDeviceLocked(fromUser, senderBoxPubB64))]
+	if sess == nil {
+		return true
+	}
+	var init x3dhInit
+	if v, ok := raw["x3dh"]; !ok || v == nil || remarshal(v, &init) != nil {
+		return false
+	}
+	at, err := time.Parse(time.RFC3339Nano, init.CreatedAt)
+	return err == nil && init.Ephemeral != sess.RemoteEphemeral && at.After(sess.CreatedAt)
+}
+
+// requestSessionResetLocked asks the sending device for a fresh handshake.
+// Our side of the session is kept: the handshake that answers replaces it.
+func (m *Manager) requestSessionResetLocked(fromUser, senderBoxPubB64 string) {
+	key := sessionKey(fromUser, m.remoteDeviceLocked(fromUser, senderBoxPubB64))
+	now := time.Now().UTC()
+	if last, ok := m.sessionResets[key]; ok && now.Sub(last) < sessionResetEvery {
+		return
+	}
+	m.sessionResets[key] = now
+	wire, err := m.buildSessionResetLocked(fromUser, senderBoxPubB64, now)
+	if err != nil {
+		return
+	}
+	if m.sendDirectWireLocked(fromUser, wire) != nil {
+		_ = m.publishSecureBytesLocked(inboxTopic(fromUser), wire)
+	}
+}
+
+// buildSessionResetLocked addresses a reset request to one device. It
+// carries no secrets, so it is signed but not sealed.
+func (m *Manager) buildSessionResetLocked(toUser, boxPubB64 string, now time.Time) ([]byte, error) {
+	box, err := base64.RawStdEncoding.DecodeString(boxPubB64)
+	if err != nil || len(box) != 32 {
+		return nil, errors.New("invalid recipient key")
+	}
+	env := map[string]any{
+		"version":         1,
+		"kind":            "session_reset",
+		"from_user_id":    m.profile.UserID,
+		"to_user_id":      toUser,
+		"to_device_id":    deviceIDFor(box),
+		"sender_sign_pub": m.profile.SignPublicKey,
+		"sender_box_pub":  base64.RawStdEncoding.EncodeToString(m.identity.BoxPublicKey[:]),
+		"ts":              now.Format(time.RFC3339Nano),
+	}
+	canon, _ := json.Marshal(env)
+	env["sig"] = base64.RawStdEncoding.EncodeToString(ed25519.Sign(m.identity.SignPrivate, canon))
+	return json.Marshal(env)
+}
+
+// handleSessionReset drops the session with the device that asked for a
+// reset, so the next message to it starts a fresh X3DH handshake. Sessions
+// set up after the request was made are kept, which makes replays harmless.
+func (m *Manager) handleSessionReset(raw map[string]any) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.profile == nil || m.identity == nil || asString(raw["to_user_id"]) != m.profile.UserID ||
+		asString(raw["to_device_id"]) != m.deviceIDLocked() {
+		return
+	}
+	from := asString(raw["from_user_id"])
+	signPub := m.knownUsers[from].SignPublicKey
+	if from == m.profile.UserID {
+		signPub = m.profile.SignPublicKey
+	}
+	if signPub == "" || asString(raw["sender_sign_pub"]) != signPub {
+		return
+	}
+	at, err := time.Parse(time.RFC3339Nano, asString(raw["ts"]))
+	if err != nil || time.Until(at) > signalMaxAge {
+		return
+	}
+	pub, _ := base64.RawStdEncoding.DecodeString(signPub)
+	sig, _ := base64.RawStdEncoding.DecodeString(asString(raw["sig"]))
+	canonMap := make(map[string]any, len(raw))
+	for k, v := range raw {
+		if k != "sig" {
+			canonMap[k] = v
+		}
+	}
+	canon, _ := json.Marshal(canonMap)
+	if len(pub) != ed25519.PublicKeySize || !ed25519.Verify(pub, canon, sig) {
+		return
+	}
+	key := sessionKey(from, m.remoteDeviceLocked(from, asString(raw["sender_box_pub"])))
+	if s, ok := m.sessions[key]; ok && s.CreatedAt.Before(at) {
+		delete(m.sessions, key)
+		_ = m.saveStateLocked()
+	}
+}
+
+func (m *Manager) responderSessionLocked(fromUser string, senderIdentity [32]byte, init *x3dhInit) (*ratchetSession, error) {
+	pk, ok := m.prekeyByIDLocked(init.PrekeyID)
+	if !ok {
+		return nil, errors.New("unknown prekey")
+	}
+	ek, err := decodeKey32(init.Ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	dh1, err := curve25519.X25519(pk.Private, senderIdentity[:])
+	if err != nil {
+		return nil, err
+	}
+	dh2, err := curve25519.X25519(m.identity.BoxPrivateKey[:], ek[:])
+	if err != nil {
+		return nil, err
+	}
+	dh3, err := curve25519.X25519(pk.Private, ek[:])
+	if err != nil {
+		return nil, err
+	}
+	return &ratchetSession{
+		PeerUserID:      fromUser,
+		RootKey:         x3dhSecret(dh1, dh2, dh3),
+		SelfPriv:        append([]byte(nil), pk.Private...),
+		SelfPub:         append([]byte(nil), pk.Public...),
+		Skipped:         make(map[string][]byte),
+		RemoteEphemeral: init.Ephemeral,
+		CreatedAt:       time.Now().UTC(),
+	}, nil
+}
+
+func newInitiatorSession(peer string, sk, peerPrekey []byte) (*ratchetSession, error) {
+	priv, pub, err := newX25519KeyPair()
+	if err != nil {
+		return nil, err
+	}
+	shared, err := curve25519.X25519(priv, peerPrekey)
+	if err != nil {
+		return nil, err
+	}
+	rk, cks := kdfRoot(sk, shared)
+	return &ratchetSession{
+		PeerUserID: peer,
+		RootKey:    rk,
+		SelfPriv:   priv,
+		SelfPub:    pub,
+		RemotePub:  append([]byte(nil), peerPrekey...),
+		SendChain:  cks,
+		Skipped:    make(map[string][]byte),
+		CreatedAt:  time.Now().UTC(),
+	}, nil
+}
+
+func (s *ratchetSession) encrypt(plain, ad []byte) (ratchetHeader, []byte, []byte, error) {
+	if s.SendChain == nil {
+		return ratchetHeader{}, nil, nil, errors.New("ratchet cannot send before first reply")
+	}
+	var mk []byte
+	s.SendChain, mk = kdfChain(s.SendChain)
+	hdr := ratchetHeader{DH: base64.RawStdEncoding.EncodeToString(s.SelfPub), PN: s.PrevSendN, N: s.SendN}
+	s.SendN++
+	nonce, ct, err := sealWithKey(mk, plain, ratchetAD(ad, hdr))
+	return hdr, nonce, ct, err
+}
+
+func (s *ratchetSession) decrypt(hdr ratchetHeader, nonce, cipherText, ad []byte) ([]byte, error) {
+	full := ratchetAD(ad, hdr)
+	skipKey := fmt.Sprintf("%s:%d", hdr.DH, hdr.N)
+	if mk, ok := s.Skipped[skipKey]; ok {
+		plain, err := openWithKey(mk, nonce, cipherText, full)
+		if err != nil {
+			return nil, err
+		}
+		delete(s.Skipped, skipKey)
+		return plain, nil
+	}
+	remote, err := base64.RawStdEncoding.DecodeString(hdr.DH)
+	if err != nil || len(remote) != 32 {
+		return nil, errors.New("invalid ratchet key")
+	}
+	if !hmac.Equal(remote, s.RemotePub) {
+		if err := s.skipUntil(hdr.PN); err != nil {
+			return nil, err
+		}
+		if err := s.dhStep(remote); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.skipUntil(hdr.N); err != nil {
+		return nil, err
+	}
+	var mk []byte
+	s.RecvChain, mk = kdfChain(s.RecvChain)
+	s.RecvN++
+	return openWithKey(mk, nonce, cipherText, full)
+}
+
+func (s *ratchetSession) skipUntil(until uint32) error {
+	if s.RecvChain == nil {
+		return nil
+	}
+	if until > s.RecvN+maxSkippedKeys {
+		return errors.New("too many skipped messages")
+	}
+	dh := base64.RawStdEncoding.EncodeToString(s.RemotePub)
+	for s.RecvN < until {
+		var mk []byte
+		s.RecvChain, mk = kdfChain(s.RecvChain)
+		s.Skipped[fmt.Sprintf("%s:%d", dh, s.RecvN)] = mk
+		s.RecvN++
+	}
+	for k := range s.Skipped {
+		if len(s.Skipped) <= maxSkippedKeys {
+			break
+		}
+		delete(s.Skipped, k)
+	}
+	return nil
+}
+
+func (s *ratchetSession) dhStep(remote []byte) error {
+	s.PrevSendN = s.SendN
+	s.SendN = 0
+	s.RecvN = 0
+	s.RemotePub = append([]byte(nil), remote...)
+	shared, err := curve25519.X25519(s.SelfPriv, remote)
+	if err != nil {
+		return err
+	}
+	s.RootKey, s.RecvChain = kdfRoot(s.RootKey, shared)
+	priv, pub, err := newX25519KeyPair()
+	if err != nil {
+		return err
+	}
+	s.SelfPriv, s.SelfPub = priv, pub
+	shared, err = curve25519.X25519(s.SelfPriv, remote)
+	if err != nil {
+		return err
+	}
+	s.RootKey, s.SendChain = kdfRoot(s.RootKey, shared)
+	return nil
+}
+
+func (s *ratchetSession) clone() *ratchetSession {
+	cp := *s
+	cp.Skipped = make(map[string][]byte, len(s.Skipped))
+	for k, v := range s.Skipped {
+		cp.Skipped[k] = v
+	}
+	if s.PendingX3DH != nil {
+		init := *s.PendingX3DH
+		cp.PendingX3DH = &init
+	}
+	return &cp
+}
+
+func x3dhSecret(parts ...[]byte) []byte {
+	var ikm []byte
+	for _, p := range parts {
+		ikm = append(ikm, p...)
+	}
+	out := make([]byte, 32)
+	_, _ = io.ReadFull(hkdf.New(sha256.New, ikm, nil, []byte("social-x3dh-v1")), out)
+	return out
+}
+
+func kdfRoot(rootKey, dhOut []byte) ([]byte, []byte) {
+	out := make([]byte, 64)
+	_, _ = io.ReadFull(hkdf.New(sha256.New, dhOut, rootKey, []byte("social-ratchet-root-v1")), out)
+	return out[:32], out[32:]
+}
+
+func kdfChain(chainKey []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, chainKey)
+	mac.Write([]byte{0x02})
+	next := mac.Sum(nil)
+	mac = hmac.New(sha256.New, chainKey)
+	mac.Write([]byte{0x01})
+	return next, mac.Sum(nil)
+}
+
+func ratchetAD(ad []byte, hdr ratchetHeader) []byte {
+	b, _ := json.Marshal(hdr)
+	return append(append([]byte(nil), ad...), b...)
+}
+
+func sealWithKey(key, plain, ad []byte) ([]byte, []byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	return nonce, aead.Seal(nil, nonce, plain, ad), nil
+}
+
+func openWithKey(key, nonce, cipherText, ad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, nonce, cipherText, ad)
+}
+
+func newX25519KeyPair() ([]byte, []byte, error) {
+	priv := make([]byte, 32)
+	if _, err := rand.Read(priv); err != nil {
+		return nil, nil, err
+	}
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	return priv, pub, nil
+}
+
+func decodeKey32(b64 string) ([32]byte, error) {
+	var out [32]byte
+	raw, err := base64.RawStdEncoding.DecodeString(b64)
+	if err != nil || len(raw) != 32 {
+		return out, errors.New("invalid key")
+	}
+	copy(out[:], raw)
+	return out, nil
+}
+
+func remarshal(in any, out any) error {
+	b, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, out)
+}
+
+func sessionAD(fromUser, toUser string) []byte {
+	return []byte("social-dm-v1|" + fromUser + "|" + toUser + "|")
+}
@@ -0,0 +1,115 @@
+package social
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	DeliveryRead = "read"
+
+	receiptDelivered = "delivered"
+	receiptRead      = "read"
+)
+
+func deliveryRank(status string) int {
+	switch status {
+	case DeliveryQueued:
+		return 1
+	case DeliverySent:
+		return 2
+	case DeliveryDelivered:
+		return 3
+	case DeliveryRead:
+		return 4
+	}
+	return 0
+}
+
+// MarkConversationRead marks every incoming message from peerUserID as read
+// and tells the sender with a read receipt.
+func (m *Manager) MarkConversationRead(peerUserID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.profile == nil || m.identity == nil {
+		return errors.New("not initialized")
+	}
+	now := time.Now().UTC()
+	ids := make([]string, 0)
+	msgs := m.dms[peerUserID]
+	for i := range msgs {
+		if msgs[i].FromUserID != peerUserID || !msgs[i].ReadAt.IsZero() {
+			continue
+		}
+		msgs[i].ReadAt = now
+		ids = append(ids, msgs[i].MessageID)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	m.sendReceiptLocked(peerUserID, receiptRead, ids)
+	return m.saveStateLocked()
+}
+
+func (m *Manager) sendReceiptLocked(toUserID, kind string, messageIDs []string) {
+	target, ok := m.knownUsers[toUserID]
+	if !ok {
+		return
+	}
+	payload := map[string]any{
+		"type":         "dm_receipt",
+		"receipt":      kind,
+		"message_ids":  messageIDs,
+		"from_user_id": m.profile.UserID,
+		"created_at":   time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	wire, err := m.buildSecureEnvelopeLocked(inboxTopic(toUserID), target.BoxPublicKey, payload)
+	if err != nil {
+		return
+	}
+	if err := m.sendDirectWireLocked(toUserID, wire); err != nil {
+		_ = m.publishSecureBytesLocked(inboxTopic(toUserID), wire)
+	}
+	m.fanoutLocked(toUserID, payload)
+}
+
+func (m *Manager) handleReceiptLocked(fromUser string, body map[string]any) {
+	status := DeliveryDelivered
+	if asString(body["receipt"]) == receiptRead {
+		status = DeliveryRead
+	}
+	at := parseTS(asString(body["created_at"]))
+	msgs := m.dms[fromUser]
+	for _, id := range asStringSlice(body["message_ids"]) {
+		for i := range msgs {
+			if msgs[i].MessageID != id || msgs[i].FromUserID != m.profile.UserID {
+				continue
+			}
+			if deliveryRank(status) > deliveryRank(msgs[i].Status) {
+				msgs[i].Status = status
+			}
+			if msgs[i].DeliveredAt.IsZero() {
+				msgs[i].DeliveredAt = at
+			}
+			if status == DeliveryRead && msgs[i].ReadAt.IsZero() {
+				msgs[i].ReadAt = at
+			}
+			delete(m.outbox, id)
+		}
+	}
+}
+
+func (m *Manager) unreadCountsLocked() map[string]int {
+	out := make(map[string]int)
+	for peer, msgs := range m.dms {
+		if m.mutedLocked(peer) {
+			continue
+		}
+		for _, msg := range msgs {
+			if msg.FromUserID == peer && msg.ReadAt.IsZero() && msg.Deleted == "" {
+				out[peer]++
+			}
+		}
+	}
+	return out
+}
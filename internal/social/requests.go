@@ -0,0 +1,322 @@
+package social
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	// friendRequestTTL matches the freshness window of the signed hello a
+	// request carries, which cannot be re-verified after that anyway.
+	friendRequestTTL     = outboxTTL
+	friendReconcileEvery = 10 * time.Minute
+)
+
+func requestExpiry(req FriendRequest) time.Time {
+	if !req.ExpiresAt.IsZero() {
+		return req.ExpiresAt
+	}
+	return req.CreatedAt.Add(friendRequestTTL)
+}
+
+func requestPending(req FriendRequest) bool {
+	return req.Status == "pending_in" || req.Status == "pending_out"
+}
+
+// requestPeerLocked returns the other side of a request.
+func (m *Manager) requestPeerLocked(req FriendRequest) string {
+	if req.FromUserID == m.profile.UserID {
+		return req.ToUserID
+	}
+	return req.FromUserID
+}
+
+// expireRequestsLocked marks pending requests past their expiry as expired.
+func (m *Manager) expireRequestsLocked(now time.Time) bool {
+	changed := false
+	for id, req := range m.requests {
+		if requestPending(req) && now.After(requestExpiry(req)) {
+			req.Status = "expired"
+			req.UpdatedAt = now
+			m.requests[id] = req
+			changed = true
+		}
+	}
+	return changed
+}
+
+// friendRequestPayloadLocked builds the wire form of an outgoing request.
+// Re-sends reuse it so the receiver sees the same request ID and hello.
+func (m *Manager) friendRequestPayloadLocked(req FriendRequest, stamp string) map[string]any {
+	payload := map[string]any{
+		"type":           "friend_request",
+		"request_id":     req.RequestID,
+		"from_user_id":   m.profile.UserID,
+		"from_name":      m.profile.Username,
+		"wallet_address": req.WalletAddress,
+		"hello_message":  req.HelloMessage,
+		"hello_sig":      req.HelloSignature,
+		"message":        req.Message,
+		"method":         req.Method,
+		"created_at":     req.CreatedAt.Format(time.RFC3339Nano),
+		"expires_at":     requestExpiry(req).Format(time.RFC3339Nano),
+	}
+	if m.profile.WalletBinding != nil {
+		payload["wallet_binding"] = m.profile.WalletBinding
+	}
+	if stamp != "" {
+		payload["pow_stamp"] = stamp
+	}
+	return payload
+}
+
+// requestStampFor mints the proof-of-work stamp the target asks for, if
+// any. It can take a while, so it must be called without the lock held.
+func (m *Manager) requestStampFor(targetUserID, requestID string) (string, error) {
+	m.mu.RLock()
+	powBits := m.knownUsers[targetUserID].RequestPoWBits
+	fromUser := ""
+	if m.profile != nil {
+		fromUser = m.profile.UserID
+	}
+	m.mu.RUnlock()
+	if powBits <= 0 || fromUser == "" {
+		return "", nil
+	}
+	return mintRequestStamp(powBits, requestStampResource(targetUserID, fromUser, requestID), time.Now())
+}
+
+// ResendFriendRequest delivers an outgoing request again under the same ID,
+// so the receiver updates it rather than listing it twice. An expired
+// request is reopened for as long as its hello stays fresh.
+func (m *Manager) ResendFriendRequest(requestID string) error {
+	m.mu.RLock()
+	req, ok := m.requests[requestID]
+	m.mu.RUnlock()
+	if !ok {
+		return errors.New("request not found")
+	}
+	stamp, err := m.requestStampFor(req.ToUserID, requestID)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.profile == nil || m.identity == nil {
+		return errors.New("not initialized")
+	}
+	req, ok = m.requests[requestID]
+	if !ok || req.FromUserID != m.profile.UserID {
+		return errors.New("request not found")
+	}
+	if req.Status != "pending_out" && req.Status != "expired" {
+		return errors.New("request already handled")
+	}
+	now := time.Now().UTC()
+	if now.Sub(req.CreatedAt) > friendRequestTTL {
+		return errors.New("request too old to resend")
+	}
+	target, ok := m.knownUsers[req.ToUserID]
+	if !ok {
+		return errors.New("target user not found in discovery")
+	}
+	req.Status = "pending_out"
+	req.ExpiresAt = req.CreatedAt.Add(friendRequestTTL)
+	req.UpdatedAt = now
+	m.requests[requestID] = req
+	if err := m.publishSecureLocked(inboxTopic(req.ToUserID), target.BoxPublicKey, m.friendRequestPayloadLocked(req, stamp)); err != nil {
+		return err
+	}
+	return m.saveStateLocked()
+}
+
+// CancelFriendRequest withdraws an outgoing request and tells the target on
+// a best-effort basis; reconciliation catches a lost notice.
+func (m *Manager) CancelFriendRequest(requestID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.profile == nil || m.identity == nil {
+		return errors.New("not initialized")
+	}
+	req, ok := m.requests[requestID]
+	if !ok || req.FromUserID != m.profile.UserID {
+		return errors.New("request not found")
+	}
+	if req.Status != "pending_out" {
+		return errors.New("request already handled")
+	}
+	req.Status = "cancelled"
+	req.UpdatedAt = time.Now().UTC()
+	m.requests[requestID] = req
+	m.sendRequestControlLocked(req.ToUserID, map[string]any{
+		"type":       "friend_request_cancel",
+		"request_id": requestID,
+	})
+	return m.saveStateLocked()
+}
+
+func (m *Manager) sendRequestControlLocked(toUserID string, payload map[string]any) {
+	target, ok := m.knownUsers[toUserID]
+	if !ok {
+		return
+	}
+	payload["from_user_id"] = m.profile.UserID
+	payload["created_at"] = time.Now().UTC().Format(time.RFC3339Nano)
+	wire, err := m.buildSecureEnvelopeLocked(inboxTopic(toUserID), target.BoxPublicKey, payload)
+	if err != nil {
+		return
+	}
+	if err := m.sendDirectWireLocked(toUserID, wire); err != nil {
+		_ = m.publishSecureBytesLocked(inboxTopic(toUserID), wire)
+	}
+	m.fanoutLocked(toUserID, payload)
+}
+
+// handleRequestResendLocked answers a friend_request whose ID we already
+// hold. A pending request is refreshed or reopened; an answered one gets the
+// answer again in case the first friend_response was lost.
+func (m *Manager) handleRequestResendLocked(fromUser string, req FriendRequest, body map[string]any) {
+	if req.FromUserID != fromUser {
+		return
+	}
+	switch req.Status {
+	case "pending_in", "expired":
+		now := time.Now().UTC()
+		if now.Sub(req.CreatedAt) > friendRequestTTL {
+			return
+		}
+		req.Status = "pending_in"
+		req.ExpiresAt = incomingRequestExpiry(req.CreatedAt, asString(body["expires_at"]))
+		req.UpdatedAt = now
+		m.requests[req.RequestID] = req
+	case "accepted", "rejected":
+		m.sendRequestControlLocked(fromUser, map[string]any{
+			"type":       "friend_response",
+			"request_id": req.RequestID,
+			"status":     req.Status,
+		})
+	}
+}
+
+// incomingRequestExpiry takes the sender's expiry but never lets a request
+// live longer than our own TTL.
+func incomingRequestExpiry(created time.Time, offered string) time.Time {
+	limit := created.Add(friendRequestTTL)
+	if t, err := time.Parse(time.RFC3339Nano, offered); err == nil && t.Before(limit) {
+		return t
+	}
+	return limit
+}
+
+func (m *Manager) handleRequestCancelLocked(fromUser string, body map[string]any) {
+	id := asString(body["request_id"])
+	req, ok := m.requests[id]
+	if !ok || req.FromUserID != fromUser || req.Status != "pending_in" {
+		return
+	}
+	req.Status = "cancelled"
+	req.UpdatedAt = time.Now().UTC()
+	m.requests[id] = req
+}
+
+// sendFriendReconcileLocked tells peer how we see our friendship and the
+// requests between us. ack marks the reply, which is not answered again.
+func (m *Manager) sendFriendReconcileLocked(peer string, ack bool) {
+	_, friend := m.friends[peer]
+	reqs := make([]map[string]any, 0)
+	for _, r := range m.requests {
+		if m.requestPeerLocked(r) == peer {
+			reqs = append(reqs, map[string]any{"request_id": r.RequestID, "status": r.Status})
+		}
+	}
+	m.sendRequestControlLocked(peer, map[string]any{
+		"type":     "friend_reconcile",
+		"friend":   friend,
+		"requests": reqs,
+		"ack":      ack,
+	})
+}
+
+// handleFriendReconcileLocked folds a peer's view into ours. Answers the
+// peer gave to our requests are taken over, withdrawn or expired requests
+// from the peer are closed, and a friendship the peer no longer has is
+// dropped unless the peer is still waiting on our answer. Requests the peer
+// never received are sent again.
+func (m *Manager) handleFriendReconcileLocked(fromUser string, body map[string]any) {
+	_, friend := m.friends[fromUser]
+	related := friend
+	for _, r := range m.requests {
+		related = related || m.requestPeerLocked(r) == fromUser
+	}
+	if !related {
+		return
+	}
+	theirs := make(map[string]string)
+	items, _ := body["requests"].([]any)
+	for _, it := range items {
+		if r, ok := it.(map[string]any); ok {
+			theirs[asString(r["request_id"])] = asString(r["status"])
+		}
+	}
+	now := time.Now().UTC()
+	awaitingUs := false
+	var resend []string
+	for id, req := range m.requests {
+		if m.requestPeerLocked(req) != fromUser {
+			continue
+		}
+		status, known := theirs[id]
+		switch {
+		case req.Status == "pending_out" && !known:
+			resend = append(resend, id)
+		case req.Status == "pending_out" && req.ToUserID == fromUser && (status == "accepted" || status == "rejected" || status == "expired"):
+			req.Status = status
+			req.UpdatedAt = now
+			m.requests[id] = req
+			if status == "accepted" {
+				m.addFriendLocked(fromUser, now)
+				m.syncFriendsLocked()
+				friend = true
+			}
+		case req.Status == "pending_in" && (status == "cancelled" || status == "expired"):
+			req.Status = status
+			req.UpdatedAt = now
+			m.requests[id] = req
+		case status == "pending_out" && (req.Status == "accepted" || req.Status == "rejected"):
+			awaitingUs = true
+		}
+	}
+	peerFriend, _ := body["friend"].(bool)
+	if friend && !peerFriend && !awaitingUs {
+		m.removeFriendLocked(fromUser)
+	}
+	if ack, _ := body["ack"].(bool); !ack {
+		m.sendFriendReconcileLocked(fromUser, true)
+	}
+	for _, id := range resend {
+		go func() { _ = m.ResendFriendRequest(id) }()
+	}
+}
+
+// maintainFriendRequests expires stale requests and, every so often,
+// reconciles with peers we exchanged requests with recently.
+func (m *Manager) maintainFriendRequests() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.profile == nil || m.identity == nil {
+		return
+	}
+	now := time.Now().UTC()
+	changed := m.expireRequestsLocked(now)
+	for _, r := range m.requests {
+		peer := m.requestPeerLocked(r)
+		if now.Sub(r.UpdatedAt) > friendRequestTTL || now.Sub(m.reconciledAt[peer]) < friendReconcileEvery {
+			continue
+		}
+		m.reconciledAt[peer] = now
+		m.sendFriendReconcileLocked(peer, false)
+	}
+	if changed {
+		_ = m.saveStateLocked()
+	}
+}
@@ -0,0 +1,199 @@
+package social
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+)
+
+const (
+	minRetention        = 5 * time.Second
+	maxRetention        = 365 * 24 * time.Hour
+	retentionSweepEvery = 5 * time.Second
+	maxPurgeLog         = 500
+	// retentionMaxSkew bounds how far ahead a remote timer change may be
+	// stamped; a later one would outrank every change made after it.
+	retentionMaxSkew = 2 * time.Minute
+)
+
+// PurgeRecord notes one sweep that removed expired messages from a
+// conversation. Only counts are kept, never content.
+type PurgeRecord struct {
+	PeerUserID string    `json:"peer_user_id"`
+	Messages   int       `json:"messages"`
+	Media      int       `json:"media,omitempty"`
+	At         time.Time `json:"at"`
+}
+
+// validRetention accepts zero, which turns the timer off, or a duration in
+// whole seconds between minRetention and maxRetention.
+func validRetention(seconds int64) bool {
+	d := time.Duration(seconds) * time.Second
+	return seconds == 0 || (d >= minRetention && d <= maxRetention)
+}
+
+// SetRetention sets how long messages exchanged with a friend are kept. The
+// friend adopts the timer too, and the latest change on either side wins.
+// It applies to messages sent from now on.
+func (m *Manager) SetRetention(peerUserID string, seconds int64) (*Friend, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.profile == nil || m.identity == nil {
+		return nil, errors.New("not initialized")
+	}
+	if !validRetention(seconds) {
+		return nil, errors.New("invalid retention")
+	}
+	if _, ok := m.friends[peerUserID]; !ok {
+		return nil, errors.New("target is not a friend")
+	}
+	now := time.Now().UTC()
+	if err := m.queueDMUpdateLocked(peerUserID, map[string]any{
+		"type":              "dm_retention",
+		"retention_seconds": seconds,
+		"set_at":            now.Format(time.RFC3339Nano),
+	}); err != nil {
+		return nil, err
+	}
+	m.applyRetentionLocked(peerUserID, seconds, now)
+	m.syncOwnDevicesLocked("retention", map[string]any{
+		"peer_user_id":      peerUserID,
+		"retention_seconds": seconds,
+		"set_at":            now.Format(time.RFC3339Nano),
+	})
+	if err := m.saveStateLocked(); err != nil {
+		return nil, err
+	}
+	f := m.friends[peerUserID]
+	return &f, nil
+}
+
+func (m *Manager) applyRetentionLocked(peerUserID string, seconds int64, at time.Time) {
+	f, ok := m.friends[peerUserID]
+	// A stamp stored before future ones were refused must not hold forever.
+	stuck := f.RetentionSetAt.After(time.Now().Add(retentionMaxSkew))
+	if !ok || !validRetention(seconds) || (!at.After(f.RetentionSetAt) && !stuck) {
+		return
+	}
+	f.RetentionSeconds, f.RetentionSetAt = seconds, at
+	m.friends[peerUserID] = f
+}
+
+// handleRetentionLocked applies a timer change from the friend or from one
+// of our own devices. Changes stamped in the future are refused.
+func (m *Manager) handleRetentionLocked(peerUserID string, body map[string]any) {
+	seconds, _ := body["retention_seconds"].(float64)
+	at, err := time.Parse(time.RFC3339Nano, asString(body["set_at"]))
+	if err != nil || at.After(time.Now().Add(retentionMaxSkew)) {
+		return
+	}
+	m.applyRetentionLocked(peerUserID, int64(seconds), at)
+}
+
+// messageExpiryLocked returns when a message created at the given time
+// disappears, or zero if it is kept. A shorter timer asked for by the sender
+// is honoured, so a message never outlives what its author expects.
+func (m *Manager) messageExpiryLocked(peerUserID string, createdAt time.Time, requested int64) time.Time {
+	seconds := m.friends[peerUserID].RetentionSeconds
+	if requested > 0 && validRetention(requested) && (seconds == 0 || requested < seconds) {
+		seconds = requested
+	}
+	if seconds == 0 {
+		return time.Time{}
+	}
+	return createdAt.Add(time.Duration(seconds) * time.Second)
+}
+
+func expired(msg DirectMessage, now time.Time) bool {
+	return !msg.ExpiresAt.IsZero() && !msg.ExpiresAt.After(now)
+}
+
+// purgeExpiredLocked drops messages past their expiry along with media no
+// other message refers to, and clears the quotes of replies to them. Each
+// conversation that lost messages gets a purge record.
+func (m *Manager) purgeExpiredLocked(now time.Time) int {
+	total := 0
+	digests := make(map[string]int)
+	for peer, msgs := range m.dms {
+		gone := make(map[string]bool)
+		keep := make([]DirectMessage, 0, len(msgs))
+		for _, msg := range msgs {
+			if !expired(msg, now) {
+				keep = append(keep, msg)
+				continue
+			}
+			gone[msg.MessageID] = true
+			delete(m.outbox, msg.MessageID)
+			if msg.MediaDigest != "" {
+				digests[msg.MediaDigest] = len(m.purgeLog)
+			}
+		}
+		if len(gone) == 0 {
+			continue
+		}
+		for i := range keep {
+			if gone[keep[i].ReplyTo] {
+				keep[i].ReplyQuote, keep[i].ReplyPending = "", false
+			}
+		}
+		m.dms[peer] = keep
+		m.purgeLog = append(m.purgeLog, PurgeRecord{PeerUserID: peer, Messages: len(gone), At: now})
+		total += len(gone)
+	}
+	if total == 0 {
+		return 0
+	}
+	for _, msgs := range m.dms {
+		for _, msg := range msgs {
+			delete(digests, msg.MediaDigest)
+		}
+	}
+	for digest, rec := range digests {
+		if _, ok := m.media[digest]; !ok {
+			continue
+		}
+		delete(m.media, digest)
+		_ = os.Remove(m.mediaPath(digest, true))
+		_ = os.Remove(m.mediaPath(digest, false))
+		m.purgeLog[rec].Media++
+	}
+	if len(m.purgeLog) > maxPurgeLog {
+		m.purgeLog = append([]PurgeRecord(nil), m.purgeLog[len(m.purgeLog)-maxPurgeLog:]...)
+	}
+	m.msgIndex = nil
+	return total
+}
+
+// sweepExpiredMessages purges expired messages and compacts the store, so
+// their plaintext does not linger in older log records either.
+func (m *Manager) sweepExpiredMessages() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.profile == nil || m.store == nil {
+		return
+	}
+	if m.purgeExpiredLocked(time.Now().UTC()) == 0 {
+		return
+	}
+	if m.saveStateLocked() == nil {
+		_ = m.store.Compact()
+	}
+}
+
+func (m *Manager) retentionSweeper(ctx context.Context) {
+	ticker := time.NewTicker(retentionSweepEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.sweepExpiredMessages()
+		}
+	}
+}
+
+func (m *Manager) purgeLogSnapshotLocked() []PurgeRecord {
+	return append([]PurgeRecord{}, m.purgeLog...)
+}
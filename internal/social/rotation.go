@@ -0,0 +1,345 @@
+package social
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"strings"
+	"time"
+)
+
+const (
+	keyRotationPendingTTL = 10 * time.Minute
+
+	rotationReasonRoutine     = "rotated"
+	rotationReasonCompromised = "compromised"
+)
+
+// keyRotation replaces a user's identity keys. It is signed by the key being
+// replaced and by the new key to prove possession. The user ID stays the one
+// derived from the first sign key, so a user's rotations form a chain that
+// starts at that key.
+type keyRotation struct {
+	UserID        string `json:"user_id"`
+	Seq           int    `json:"seq"`
+	OldSignPub    string `json:"old_sign_pub"`
+	OldBoxPub     string `json:"old_box_pub"`
+	NewSignPub    string `json:"new_sign_pub"`
+	NewBoxPub     string `json:"new_box_pub"`
+	Reason        string `json:"reason"`
+	CreatedAt     int64  `json:"created_at"`
+	WalletAddress string `json:"wallet_address,omitempty"`
+	WalletSig     string `json:"wallet_sig,omitempty"`
+	NewSig        string `json:"new_sig"`
+	Sig           string `json:"sig"`
+}
+
+// revokedKey records a sign or box key that was rotated away. Envelopes and
+// presence using it are dropped.
+type revokedKey struct {
+	UserID    string    `json:"user_id"`
+	Reason    string    `json:"reason"`
+	RevokedAt time.Time `json:"revoked_at"`
+}
+
+// pendingRotation holds freshly generated keys while the wallet signs the
+// rotation message.
+type pendingRotation struct {
+	identity  *Identity
+	rotation  keyRotation
+	expiresAt time.Time
+}
+
+func keyRotationSigningInput(r keyRotation) []byte {
+	b, _ := json.Marshal(map[string]any{
+		"domain":         "social-key-rotation-v1",
+		"user_id":        r.UserID,
+		"seq":            r.Seq,
+		"old_sign_pub":   r.OldSignPub,
+		"old_box_pub":    r.OldBoxPub,
+		"new_sign_pub":   r.NewSignPub,
+		"new_box_pub":    r.NewBoxPub,
+		"reason":         r.Reason,
+		"created_at":     r.CreatedAt,
+		"wallet_address": r.WalletAddress,
+	})
+	return b
+}
+
+// keyRotationWalletMessage is the EIP-191 text a wallet signs to vouch for a
+// rotation.
+func keyRotationWalletMessage(r keyRotation) string {
+	return fmt.Sprintf("Rotate social identity keys\nUser: %s\nSequence: %d\nNew sign key: %s\nNew box key: %s\nReason: %s\nIssued at: %d",
+		r.UserID, r.Seq, r.NewSignPub, r.NewBoxPub, r.Reason, r.CreatedAt)
+}
+
+func verifyKeyRotation(r keyRotation) bool {
+	oldPub, err := base64.RawStdEncoding.DecodeString(r.OldSignPub)
+	if err != nil || len(oldPub) != ed25519.PublicKeySize {
+		return false
+	}
+	newPub, err := base64.RawStdEncoding.DecodeString(r.NewSignPub)
+	if err != nil || len(newPub) != ed25519.PublicKeySize {
+		return false
+	}
+	if box, err := base64.RawStdEncoding.DecodeString(r.NewBoxPub); err != nil || len(box) != 32 {
+		return false
+	}
+	sig, err := base64.RawStdEncoding.DecodeString(r.Sig)
+	if err != nil {
+		return false
+	}
+	newSig, err := base64.RawStdEncoding.DecodeString(r.NewSig)
+	if err != nil {
+		return false
+	}
+	input := keyRotationSigningInput(r)
+	if !ed25519.Verify(ed25519.PublicKey(oldPub), input, sig) || !ed25519.Verify(ed25519.PublicKey(newPub), input, newSig) {
+		return false
+	}
+	if r.WalletAddress != "" || r.WalletSig != "" {
+		return verifyWalletSignature(r.WalletAddress, keyRotationWalletMessage(r), r.WalletSig)
+	}
+	return true
+}
+
+// verifyKeyChain checks that chain leads from the key the user ID was
+// derived from to signPubB64. An empty chain means the key was never rotated.
+func verifyKeyChain(userID string, chain []keyRotation, signPubB64 string) bool {
+	if len(chain) == 0 {
+		signPub, err := base64.RawStdEncoding.DecodeString(signPubB64)
+		return err == nil && len(signPub) == ed25519.PublicKeySize && userIDForSignKey(signPub) == userID
+	}
+	for i, r := range chain {
+		if r.UserID != userID || r.Seq != i+1 {
+			return false
+		}
+		if i == 0 {
+			genesis, err := base64.RawStdEncoding.DecodeString(r.OldSignPub)
+			if err != nil || userIDForSignKey(genesis) != userID {
+				return false
+			}
+		} else if r.OldSignPub != chain[i-1].NewSignPub {
+			return false
+		}
+		if !verifyKeyRotation(r) {
+			return false
+		}
+	}
+	return chain[len(chain)-1].NewSignPub == signPubB64
+}
+
+func (m *Manager) keyRevokedLocked(keyB64 string) bool {
+	if keyB64 == "" {
+		return false
+	}
+	_, ok := m.revokedKeys[keyB64]
+	return ok
+}
+
+func (m *Manager) revokeKeyLocked(userID, keyB64, reason string) {
+	if keyB64 == "" || m.keyRevokedLocked(keyB64) {
+		return
+	}
+	m.revokedKeys[keyB64] = revokedKey{UserID: userID, Reason: reason, RevokedAt: time.Now().UTC()}
+}
+
+func normalizeRotationReason(reason string) (string, error) {
+	switch strings.TrimSpace(reason) {
+	case "", rotationReasonRoutine:
+		return rotationReasonRoutine, nil
+	case rotationReasonCompromised:
+		return rotationReasonCompromised, nil
+	}
+	return "", errors.New("invalid rotation reason")
+}
+
+// newKeyRotationLocked generates the next identity keys and the unsigned
+// statement that moves to them.
+func (m *Manager) newKeyRotationLocked(reason string, withWallet bool) (*Identity, keyRotation, error) {
+	next, err := generateIdentity()
+	if err != nil {
+		return nil, keyRotation{}, err
+	}
+	next.UserID = m.identity.UserID
+	r := keyRotation{
+		UserID:     m.identity.UserID,
+		Seq:        len(m.keyRotations) + 1,
+		OldSignPub: m.profile.SignPublicKey,
+		OldBoxPub:  m.profile.BoxPublicKey,
+		NewSignPub: base64.RawStdEncoding.EncodeToString(next.SignPublicKey),
+		NewBoxPub:  base64.RawStdEncoding.EncodeToString(next.BoxPublicKey[:]),
+		Reason:     reason,
+		CreatedAt:  time.Now().UTC().Unix(),
+	}
+	if withWallet {
+		r.WalletAddress = strings.ToLower(m.profile.Username)
+	}
+	return next, r, nil
+}
+
+// PrepareKeyRotation generates new keys and returns the message the wallet
+// has to sign before RotateKeys is called with that signature.
+func (m *Manager) PrepareKeyRotation(reason string) (string, error) {
+	reason, err := normalizeRotationReason(reason)
+	if err != nil {
+		return "", err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.profile == nil || m.identity == nil {
+		return "", errors.New("not initialized")
+	}
+	if !m.isPrimaryDeviceLocked() {
+		return "", errors.New("keys can only be rotated from the primary device")
+	}
+	next, r, err := m.newKeyRotationLocked(reason, true)
+	if err != nil {
+		return "", err
+	}
+	m.pendingRotation = &pendingRotation{identity: next, rotation: r, expiresAt: time.Now().Add(keyRotationPendingTTL)}
+	return keyRotationWalletMessage(r), nil
+}
+
+// RotateKeys replaces the identity sign and box keys and revokes the old
+// ones. With a wallet signature the keys prepared by PrepareKeyRotation are
+// used and the statement is co-signed by the wallet. Linked devices share the
+// old sign key, so they are dropped from the device list and must be linked
+// again.
+func (m *Manager) RotateKeys(passphrase, reason, walletSig string) (*Profile, error) {
+	reason, err := normalizeRotationReason(reason)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.profile == nil || m.identity == nil || m.store == nil {
+		return nil, errors.New("not initialized")
+	}
+	if !m.isPrimaryDeviceLocked() {
+		return nil, errors.New("keys can only be rotated from the primary device")
+	}
+	f, err := readSealedFile(m.identityEncPath())
+	if err != nil {
+		return nil, err
+	}
+	if _, err := openWithPassphrase(f, passphrase); err != nil {
+		return nil, err
+	}
+	var next *Identity
+	var r keyRotation
+	if walletSig = strings.TrimSpace(walletSig); walletSig != "" {
+		p := m.pendingRotation
+		if p == nil || time.Now().After(p.expiresAt) || p.rotation.Seq != len(m.keyRotations)+1 {
+			return nil, errors.New("no pending key rotation")
+		}
+		if p.rotation.Reason != reason {
+			return nil, errors.New("rotation reason does not match prepared rotation")
+		}
+		if !verifyWalletSignature(p.rotation.WalletAddress, keyRotationWalletMessage(p.rotation), walletSig) {
+			return nil, errors.New("invalid wallet signature")
+		}
+		next, r = p.identity, p.rotation
+		r.WalletSig = walletSig
+	} else {
+		next, r, err = m.newKeyRotationLocked(reason, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+	input := keyRotationSigningInput(r)
+	r.Sig = base64.RawStdEncoding.EncodeToString(ed25519.Sign(m.identity.SignPrivate, input))
+	r.NewSig = base64.RawStdEncoding.EncodeToString(ed25519.Sign(next.SignPrivate, input))
+
+	prevIdentity, prevProfile := m.identity, *m.profile
+	prevRotations, prevRevoked := m.keyRotations, maps.Clone(m.revokedKeys)
+	prevSessions, prevPrekeys, prevDevices := m.sessions, m.prekeys, m.deviceList
+
+	now := time.Now().UTC()
+	m.identity = next
+	m.profile.SignPublicKey = r.NewSignPub
+	m.profile.BoxPublicKey = r.NewBoxPub
+	m.profile.LastUpdatedAt = now
+	// The wallet binding covers the old keys and has to be signed again.
+	m.profile.WalletBinding = nil
+	m.keyRotations = append(append([]keyRotation(nil), m.keyRotations...), r)
+	m.revokeKeyLocked(r.UserID, r.OldSignPub, reason)
+	m.revokeKeyLocked(r.UserID, r.OldBoxPub, reason)
+	// Ratchet sessions and prekeys hang off the old keys.
+	m.sessions = make(map[string]*ratchetSession)
+	m.prekeys = nil
+	m.setDeviceListLocked([]Device{{
+		DeviceID:     m.deviceIDLocked(),
+		Name:         "primary",
+		BoxPublicKey: r.NewBoxPub,
+		Primary:      true,
+		AddedAt:      now,
+	}})
+	if err := m.rekeyLocked(passphrase); err != nil {
+		m.identity, *m.profile = prevIdentity, prevProfile
+		m.keyRotations, m.revokedKeys = prevRotations, prevRevoked
+		m.sessions, m.prekeys, m.deviceList = prevSessions, prevPrekeys, prevDevices
+		return nil, err
+	}
+	m.pendingRotation = nil
+	for id := range m.deviceLinks {
+		delete(m.deviceLinks, id)
+	}
+	m.resubscribeLocked()
+	m.publishSectionsLocked()
+	go m.publishPresence()
+	cp := *m.profile
+	return &cp, nil
+}
+
+// acceptPresenceKeysLocked checks the keys a peer advertises. The user ID
+// must derive from the sign key, directly or through the presented rotation
+// chain. Keys are pinned on first use: a known user's keys only change
+// through a newer rotation from the pinned key, anything else is refused and
+// raises an alert. A valid newer rotation revokes the replaced keys and drops
+// the ratchet session built on them. Keys hinted by a group owner are not
+// pinned.
+func (m *Manager) acceptPresenceKeysLocked(u *KnownUser, prev KnownUser, known bool, chain []keyRotation) bool {
+	if known && prev.FromGroup {
+		prev, known = KnownUser{}, false
+	}
+	if m.keyRevokedLocked(u.SignPublicKey) || m.keyRevokedLocked(u.BoxPublicKey) {
+		return false
+	}
+	if !verifyKeyChain(u.UserID, chain, u.SignPublicKey) {
+		return false
+	}
+	if known && prev.SignPublicKey != "" &&
+		(prev.SignPublicKey != u.SignPublicKey || (prev.BoxPublicKey != "" && prev.BoxPublicKey != u.BoxPublicKey)) &&
+		!chainRotatesFrom(chain, prev.SignPublicKey, prev.KeyVersion) {
+		m.raiseSecurityAlertLocked(alertKeyChange, prev, *u)
+		return false
+	}
+	if len(chain) == 0 {
+		return !known || prev.KeyVersion == 0
+	}
+	last := chain[len(chain)-1]
+	if last.Seq < prev.KeyVersion || last.NewBoxPub != u.BoxPublicKey {
+		return false
+	}
+	for _, r := range chain {
+		if r.WalletAddress != "" && !strings.EqualFold(r.WalletAddress, u.Username) {
+			return false
+		}
+	}
+	for _, r := range chain {
+		m.revokeKeyLocked(u.UserID, r.OldSignPub, r.Reason)
+		m.revokeKeyLocked(u.UserID, r.OldBoxPub, r.Reason)
+	}
+	u.KeyVersion = last.Seq
+	u.KeyRotatedAt = time.Unix(last.CreatedAt, 0).UTC()
+	u.KeyWalletVerified = last.WalletSig != ""
+	if known && last.Seq > prev.KeyVersion {
+		m.dropSessionsLocked(u.UserID)
+		m.checkVerifiedKeysLocked(*u)
+	}
+	return true
+}
@@ -0,0 +1,210 @@
+package social
+
+import (
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	safetyNumberVersion    = 1
+	safetyNumberIterations = 5200
+	safetyPayloadPrefix    = "social-safety:"
+
+	alertVerifiedKeyChange = "verified_key_change"
+)
+
+// SafetyNumber is what two friends compare, read aloud or scan as a QR code
+// to confirm they see each other's real keys.
+type SafetyNumber struct {
+	UserID     string    `json:"user_id"`
+	Number     string    `json:"number"`
+	QRPayload  string    `json:"qr_payload"`
+	Verified   bool      `json:"verified"`
+	VerifiedAt time.Time `json:"verified_at,omitempty"`
+}
+
+type safetyPayload struct {
+	V          int    `json:"v"`
+	UserID     string `json:"user_id"`
+	PeerUserID string `json:"peer_user_id"`
+	Local      string `json:"local"`
+	Remote     string `json:"remote"`
+}
+
+// keyFingerprint hashes one party's identity keys the way Signal does:
+// thousands of SHA-512 rounds so a colliding key pair is costly to grind.
+func keyFingerprint(userID, signPubB64, boxPubB64 string) ([]byte, error) {
+	signPub, err := base64.RawStdEncoding.DecodeString(signPubB64)
+	if err != nil || len(signPub) == 0 {
+		return nil, errors.New("invalid sign key")
+	}
+	boxPub, err := base64.RawStdEncoding.DecodeString(boxPubB64)
+	if err != nil || len(boxPub) == 0 {
+		return nil, errors.New("invalid box key")
+	}
+	keys := append(append([]byte(nil), signPub...), boxPub...)
+	h := sha512.New()
+	_ = binary.Write(h, binary.BigEndian, uint16(safetyNumberVersion))
+	h.Write(keys)
+	h.Write([]byte(userID))
+	sum := h.Sum(nil)
+	for i := 0; i < safetyNumberIterations; i++ {
+		h.Reset()
+		h.Write(sum)
+		h.Write(keys)
+		sum = h.Sum(sum[:0])
+	}
+	return sum[:32], nil
+}
+
+// fingerprintDigits renders the first 30 bytes of a fingerprint as six
+// five-digit groups.
+func fingerprintDigits(fp []byte) string {
+	var b strings.Builder
+	for i := 0; i < 30; i += 5 {
+		chunk := uint64(fp[i])<<32 | uint64(fp[i+1])<<24 | uint64(fp[i+2])<<16 | uint64(fp[i+3])<<8 | uint64(fp[i+4])
+		fmt.Fprintf(&b, "%05d", chunk%100000)
+	}
+	return b.String()
+}
+
+// formatSafetyNumber orders the two halves so both friends see the same
+// sixty digits, then splits them into groups of five.
+func formatSafetyNumber(local, remote []byte) string {
+	a, b := fingerprintDigits(local), fingerprintDigits(remote)
+	if b < a {
+		a, b = b, a
+	}
+	digits := a + b
+	groups := make([]string, 0, len(digits)/5)
+	for i := 0; i < len(digits); i += 5 {
+		groups = append(groups, digits[i:i+5])
+	}
+	return strings.Join(groups, " ")
+}
+
+func (m *Manager) safetyFingerprintsLocked(userID string) ([]byte, []byte, error) {
+	if m.profile == nil || m.identity == nil {
+		return nil, nil, errors.New("not initialized")
+	}
+	if _, ok := m.friends[userID]; !ok {
+		return nil, nil, errors.New("not a friend")
+	}
+	u, ok := m.knownUsers[userID]
+	if !ok || u.SignPublicKey == "" || u.BoxPublicKey == "" {
+		return nil, nil, errors.New("friend keys unknown")
+	}
+	local, err := keyFingerprint(m.profile.UserID, m.profile.SignPublicKey, m.profile.BoxPublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	remote, err := keyFingerprint(u.UserID, u.SignPublicKey, u.BoxPublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return local, remote, nil
+}
+
+// SafetyNumber returns the safety number shared with a friend and the
+// payload to show as a QR code for the friend to scan.
+func (m *Manager) SafetyNumber(userID string) (*SafetyNumber, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	local, remote, err := m.safetyFingerprintsLocked(userID)
+	if err != nil {
+		return nil, err
+	}
+	payload, _ := json.Marshal(safetyPayload{
+		V:          safetyNumberVersion,
+		UserID:     m.profile.UserID,
+		PeerUserID: userID,
+		Local:      hex.EncodeToString(local),
+		Remote:     hex.EncodeToString(remote),
+	})
+	f := m.friends[userID]
+	return &SafetyNumber{
+		UserID:     userID,
+		Number:     formatSafetyNumber(local, remote),
+		QRPayload:  safetyPayloadPrefix + base64.RawURLEncoding.EncodeToString(payload),
+		Verified:   f.Verified,
+		VerifiedAt: f.VerifiedAt,
+	}, nil
+}
+
+// VerifySafetyPayload checks a payload scanned from a friend's screen. It
+// must carry the same fingerprints computed here, seen from the other side,
+// and marks the friend verified on a match.
+func (m *Manager) VerifySafetyPayload(raw string) (*Friend, error) {
+	enc, ok := strings.CutPrefix(strings.TrimSpace(raw), safetyPayloadPrefix)
+	if !ok {
+		return nil, errors.New("invalid safety payload")
+	}
+	body, err := base64.RawURLEncoding.DecodeString(enc)
+	if err != nil {
+		return nil, errors.New("invalid safety payload")
+	}
+	var p safetyPayload
+	if err := json.Unmarshal(body, &p); err != nil || p.V != safetyNumberVersion {
+		return nil, errors.New("invalid safety payload")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	local, remote, err := m.safetyFingerprintsLocked(p.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if p.PeerUserID != m.profile.UserID ||
+		subtle.ConstantTimeCompare([]byte(p.Local), []byte(hex.EncodeToString(remote))) != 1 ||
+		subtle.ConstantTimeCompare([]byte(p.Remote), []byte(hex.EncodeToString(local))) != 1 {
+		return nil, errors.New("safety number mismatch")
+	}
+	return m.setFriendVerifiedLocked(p.UserID, true)
+}
+
+// SetFriendVerified records the outcome of comparing safety numbers by hand.
+func (m *Manager) SetFriendVerified(userID string, verified bool) (*Friend, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, _, err := m.safetyFingerprintsLocked(userID); err != nil {
+		return nil, err
+	}
+	return m.setFriendVerifiedLocked(userID, verified)
+}
+
+func (m *Manager) setFriendVerifiedLocked(userID string, verified bool) (*Friend, error) {
+	f := m.friends[userID]
+	f.Verified, f.VerifiedAt, f.VerifiedSignKey, f.VerifiedBoxKey = false, time.Time{}, "", ""
+	if verified {
+		u := m.knownUsers[userID]
+		f.Verified = true
+		f.VerifiedAt = time.Now().UTC()
+		f.VerifiedSignKey, f.VerifiedBoxKey = u.SignPublicKey, u.BoxPublicKey
+	}
+	m.friends[userID] = f
+	if err := m.saveStateLocked(); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// checkVerifiedKeysLocked drops the verified mark when a verified friend
+// moves to keys other than the ones that were compared, and warns about it.
+func (m *Manager) checkVerifiedKeysLocked(u KnownUser) {
+	f, ok := m.friends[u.UserID]
+	if !ok || !f.Verified || (f.VerifiedSignKey == u.SignPublicKey && f.VerifiedBoxKey == u.BoxPublicKey) {
+		return
+	}
+	pinned := u
+	pinned.SignPublicKey, pinned.BoxPublicKey = f.VerifiedSignKey, f.VerifiedBoxKey
+	f.Verified, f.VerifiedAt, f.VerifiedSignKey, f.VerifiedBoxKey = false, time.Time{}, "", ""
+	m.friends[u.UserID] = f
+	m.raiseSecurityAlertLocked(alertVerifiedKeyChange, pinned, u)
+}
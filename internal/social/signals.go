@@ -0,0 +1,200 @@
+package social
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"Assembler-Apps/internal/localrpcclient"
+)
+
+// Signal kinds. Each reaches the browser as its own SSE event type.
+const (
+	SignalTyping       = "typing"
+	SignalRecording    = "recording"
+	SignalChatPresence = "chat_presence"
+
+	// signalTTL is how long an active signal holds without a refresh.
+	signalTTL = 6 * time.Second
+	// signalMaxAge drops signals that were stuck in transit or are replayed
+	// from the node's history after a restart.
+	signalMaxAge = 15 * time.Second
+)
+
+func validSignalKind(kind string) bool {
+	switch kind {
+	case SignalTyping, SignalRecording, SignalChatPresence:
+		return true
+	}
+	return false
+}
+
+// Signal is a short-lived state of a friend. Signals are never stored and
+// never change the snapshot.
+type Signal struct {
+	Kind       string    `json:"kind"`
+	FromUserID string    `json:"from_user_id"`
+	Active     bool      `json:"active"`
+	At         time.Time `json:"at"`
+	ExpiresAt  time.Time `json:"expires_at,omitempty"`
+}
+
+// SubscribeSignals delivers friends' signals as they arrive. Slow readers
+// miss signals rather than hold up the receive loop.
+func (m *Manager) SubscribeSignals() (<-chan Signal, func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := m.nextListenerID
+	m.nextListenerID++
+	ch := make(chan Signal, 64)
+	m.signalListeners[id] = ch
+	cancel := func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if c, ok := m.signalListeners[id]; ok {
+			delete(m.signalListeners, id)
+			close(c)
+		}
+	}
+	return ch, cancel
+}
+
+func (m *Manager) emitSignalLocked(s Signal) {
+	for _, ch := range m.signalListeners {
+		select {
+		case ch <- s:
+		default:
+		}
+	}
+}
+
+// SendSignal tells a friend about a typing, recording or chat presence
+// change over a direct stream. There is no inbox fallback or retry: a
+// signal that cannot go out right away is worthless later.
+func (m *Manager) SendSignal(toUserID, kind string, active bool) error {
+	if !validSignalKind(kind) {
+		return errors.New("invalid signal kind")
+	}
+	m.mu.RLock()
+	wire, peerID, err := m.buildSignalLocked(toUserID, kind, active)
+	m.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	rep, err := m.rpc.SendDirect(localrpcclient.SendDirectArgs{
+		AppID:   AppID,
+		PeerID:  peerID,
+		Topic:   inboxTopic(toUserID),
+		Payload: wire,
+	})
+	if err != nil {
+		return err
+	}
+	if rep.Error != "" {
+		return errors.New(rep.Error)
+	}
+	if !rep.Sent {
+		return errors.New("direct stream send failed")
+	}
+	return nil
+}
+
+// buildSignalLocked seals a signal with the static per-pair key. Using the
+// ratchet would advance session state that then has to be saved.
+func (m *Manager) buildSignalLocked(toUserID, kind string, active bool) ([]byte, string, error) {
+	if m.profile == nil || m.identity == nil {
+		return nil, "", errors.New("not initialized")
+	}
+	if _, ok := m.friends[toUserID]; !ok {
+		return nil, "", errors.New("target is not a friend")
+	}
+	target, ok := m.knownUsers[toUserID]
+	if !ok || target.PeerID == "" {
+		return nil, "", errors.New("target peer is offline or peer_id unknown")
+	}
+	peerPubRaw, err := base64.RawStdEncoding.DecodeString(target.BoxPublicKey)
+	if err != nil || len(peerPubRaw) != 32 {
+		return nil, "", errors.New("invalid recipient key")
+	}
+	var peerPub [32]byte
+	copy(peerPub[:], peerPubRaw)
+	plain, _ := json.Marshal(map[string]any{"signal": kind, "active": active})
+	cipherText, nonce, err := encryptForPeer(m.identity.BoxPrivateKey, peerPub, plain)
+	if err != nil {
+		return nil, "", err
+	}
+	env := map[string]any{
+		"version":         1,
+		"kind":            "signal",
+		"from_user_id":    m.profile.UserID,
+		"to_user_id":      toUserID,
+		"sender_sign_pub": m.profile.SignPublicKey,
+		"ts":              time.Now().UTC().Format(time.RFC3339Nano),
+		"nonce":           base64.RawStdEncoding.EncodeToString(nonce),
+		"ciphertext":      base64.RawStdEncoding.EncodeToString(cipherText),
+	}
+	canon, _ := json.Marshal(env)
+	env["sig"] = base64.RawStdEncoding.EncodeToString(ed25519.Sign(m.identity.SignPrivate, canon))
+	data, _ := json.Marshal(env)
+	return data, target.PeerID, nil
+}
+
+// handleSignal checks a signal against the keys pinned for the friend who
+// sent it and passes it on to subscribers. It only reads state.
+func (m *Manager) handleSignal(raw map[string]any) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.profile == nil || m.identity == nil || asString(raw["to_user_id"]) != m.profile.UserID {
+		return
+	}
+	from := asString(raw["from_user_id"])
+	if _, ok := m.friends[from]; !ok {
+		return
+	}
+	u := m.knownUsers[from]
+	if u.SignPublicKey == "" || asString(raw["sender_sign_pub"]) != u.SignPublicKey {
+		return
+	}
+	at, err := time.Parse(time.RFC3339Nano, asString(raw["ts"]))
+	if err != nil || time.Since(at) > signalMaxAge || time.Until(at) > signalMaxAge {
+		return
+	}
+	signPub, _ := base64.RawStdEncoding.DecodeString(u.SignPublicKey)
+	sig, _ := base64.RawStdEncoding.DecodeString(asString(raw["sig"]))
+	canonMap := make(map[string]any, len(raw))
+	for k, v := range raw {
+		if k != "sig" {
+			canonMap[k] = v
+		}
+	}
+	canon, _ := json.Marshal(canonMap)
+	if len(signPub) != ed25519.PublicKeySize || !ed25519.Verify(signPub, canon, sig) {
+		return
+	}
+	boxPub, err := base64.RawStdEncoding.DecodeString(u.BoxPublicKey)
+	if err != nil || len(boxPub) != 32 {
+		return
+	}
+	var senderPub [32]byte
+	copy(senderPub[:], boxPub)
+	nonce, _ := base64.RawStdEncoding.DecodeString(asString(raw["nonce"]))
+	cipherText, _ := base64.RawStdEncoding.DecodeString(asString(raw["ciphertext"]))
+	plain, err := decryptFromPeer(m.identity.BoxPrivateKey, senderPub, nonce, cipherText)
+	if err != nil {
+		return
+	}
+	var body struct {
+		Signal string `json:"signal"`
+		Active bool   `json:"active"`
+	}
+	if json.Unmarshal(plain, &body) != nil || !validSignalKind(body.Signal) {
+		return
+	}
+	s := Signal{Kind: body.Signal, FromUserID: from, Active: body.Active, At: at}
+	if s.Active {
+		s.ExpiresAt = at.Add(signalTTL)
+	}
+	m.emitSignalLocked(s)
+}
@@ -0,0 +1,462 @@
+package social
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Store is the persistence backend for social state. Keys are flat strings;
+// every Apply call is atomic, so a crash leaves either all or none of its
+// writes on disk.
+type Store interface {
+	Load() (map[string][]byte, error)
+	Apply(puts map[string][]byte, deletes []string) error
+	Compact() error
+	Close() error
+}
+
+const (
+	storeLogName        = "state.log"
+	legacyStateName     = "state.json"
+	storeCompactMin     = 1 << 20
+	storeCompactRatio   = 4
+	storeRecordHeader   = 8
+	storeMaxRecordBytes = 256 << 20
+)
+
+type logRecord struct {
+	Puts    map[string][]byte `json:"p,omitempty"`
+	Deletes []string          `json:"d,omitempty"`
+}
+
+// logStore is an append-only log of atomic batches. Each record is framed as
+// length + CRC32 so a torn write at the tail is detected and truncated on
+// open; the log is rewritten as a single snapshot once it grows well beyond
+// the live data.
+type logStore struct {
+	mu       sync.Mutex
+	path     string
+	f        *os.File
+	live     map[string][]byte
+	liveSize int64
+	logSize  int64
+}
+
+func OpenLogStore(dir string) (Store, error) {
+	s := &logStore{path: filepath.Join(dir, storeLogName), live: make(map[string][]byte)}
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	s.f = f
+	good, err := s.replay()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Truncate(good); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(good, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	s.logSize = good
+	return s, nil
+}
+
+// replay applies every intact record and returns the offset just past the
+// last one.
+func (s *logStore) replay() (int64, error) {
+	if _, err := s.f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	r := bufio.NewReader(s.f)
+	var off int64
+	hdr := make([]byte, storeRecordHeader)
+	for {
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			return off, nil
+		}
+		n := binary.BigEndian.Uint32(hdr[:4])
+		sum := binary.BigEndian.Uint32(hdr[4:])
+		if n == 0 || n > storeMaxRecordBytes {
+			return off, nil
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return off, nil
+		}
+		if crc32.ChecksumIEEE(payload) != sum {
+			return off, nil
+		}
+		var rec logRecord
+		if err := json.Unmarshal(payload, &rec); err != nil {
+			return off, nil
+		}
+		s.applyLive(rec)
+		off += storeRecordHeader + int64(n)
+	}
+}
+
+func (s *logStore) applyLive(rec logRecord) {
+	for _, k := range rec.Deletes {
+		if v, ok := s.live[k]; ok {
+			s.liveSize -= int64(len(k) + len(v))
+			delete(s.live, k)
+		}
+	}
+	for k, v := range rec.Puts {
+		if old, ok := s.live[k]; ok {
+			s.liveSize -= int64(len(k) + len(old))
+		}
+		s.live[k] = v
+		s.liveSize += int64(len(k) + len(v))
+	}
+}
+
+func (s *logStore) Load() (map[string][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string][]byte, len(s.live))
+	for k, v := range s.live {
+		out[k] = v
+	}
+	return out, nil
+}
+
+func (s *logStore) Apply(puts map[string][]byte, deletes []string) error {
+	if len(puts) == 0 && len(deletes) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return errors.New("store closed")
+	}
+	rec := logRecord{Puts: puts, Deletes: deletes}
+	frame, err := encodeLogRecord(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := s.f.Write(frame); err != nil {
+		// Drop the partial tail so the next append starts on a record boundary.
+		_ = s.f.Truncate(s.logSize)
+		_, _ = s.f.Seek(s.logSize, io.SeekStart)
+		return err
+	}
+	if err := s.f.Sync(); err != nil {
+		return err
+	}
+	s.logSize += int64(len(frame))
+	s.applyLive(rec)
+	if s.logSize > storeCompactMin && s.logSize > storeCompactRatio*s.liveSize {
+		return s.compactLocked()
+	}
+	return nil
+}
+
+// compactLocked writes the live set as one record to a temp file and renames
+// it over the log, so the old log stays valid until the swap. The temp file
+// stays open and becomes the log, so nothing has to be reopened after the
+// old one is gone.
+func (s *logStore) compactLocked() error {
+	frame, err := encodeLogRecord(logRecord{Puts: s.live})
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(frame); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	syncDir(filepath.Dir(s.path))
+	s.f.Close()
+	s.f = f
+	s.logSize = int64(len(frame))
+	return nil
+}
+
+func (s *logStore) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return errors.New("store closed")
+	}
+	return s.compactLocked()
+}
+
+func (s *logStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+func encodeLogRecord(rec logRecord) ([]byte, error) {
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	frame := make([]byte, storeRecordHeader+len(payload))
+	binary.BigEndian.PutUint32(frame[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload))
+	copy(frame[storeRecordHeader:], payload)
+	return frame, nil
+}
+
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	_ = d.Sync()
+	d.Close()
+}
+
+// keyedItem is an element of a list that is stored one key per item, so
+// that a new or edited message does not rewrite the rest of its
+// conversation.
+type keyedItem interface {
+	itemKey() string
+}
+
+func (msg DirectMessage) itemKey() string { return msg.MessageID }
+
+func (msg GroupMessage) itemKey() string { return msg.MessageID }
+
+var keyedItemType = reflect.TypeFor[keyedItem]()
+
+func isItemList(t reflect.Type) bool {
+	return t.Kind() == reflect.Slice && t.Elem().Implements(keyedItemType)
+}
+
+// stateEntries flattens persistedState into store keys. Map fields become one
+// key per entry ("<json name>/<map key>") so a changed cursor does not
+// rewrite unrelated state. Lists of messages go one step further: the entry
+// only holds the order of message IDs, and each message has its own key
+// ("<json name>/<map key>/<message id>").
+func stateEntries(ps *persistedState) (map[string][]byte, error) {
+	out := make(map[string][]byte)
+	v := reflect.ValueOf(ps).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := stateFieldName(t.Field(i))
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Map && fv.Type().Key().Kind() == reflect.String {
+			items := isItemList(fv.Type().Elem())
+			iter := fv.MapRange()
+			for iter.Next() {
+				key := name + "/" + iter.Key().String()
+				val := iter.Value()
+				if items {
+					ids := make([]string, val.Len())
+					for j := range ids {
+						item := val.Index(j).Interface()
+						ids[j] = item.(keyedItem).itemKey()
+						b, err := json.Marshal(item)
+						if err != nil {
+							return nil, err
+						}
+						out[key+"/"+ids[j]] = b
+					}
+					b, err := json.Marshal(ids)
+					if err != nil {
+						return nil, err
+					}
+					out[key] = b
+					continue
+				}
+				b, err := json.Marshal(val.Interface())
+				if err != nil {
+					return nil, err
+				}
+				out[key] = b
+			}
+			continue
+		}
+		if fv.IsZero() {
+			continue
+		}
+		b, err := json.Marshal(fv.Interface())
+		if err != nil {
+			return nil, err
+		}
+		out[name] = b
+	}
+	return out, nil
+}
+
+func stateFromEntries(entries map[string][]byte) (*persistedState, error) {
+	ps := &persistedState{}
+	v := reflect.ValueOf(ps).Elem()
+	t := v.Type()
+	fields := make(map[string]int, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		fields[stateFieldName(t.Field(i))] = i
+	}
+	// Message lists are put back together once every item has been read.
+	orders := make(map[int]map[string][]string)
+	items := make(map[int]map[string][]byte)
+	for key, raw := range entries {
+		name, sub, isMapEntry := strings.Cut(key, "/")
+		idx, ok := fields[name]
+		if !ok {
+			continue
+		}
+		fv := v.Field(idx)
+		if isMapEntry && fv.Kind() == reflect.Map && isItemList(fv.Type().Elem()) {
+			if _, _, isItem := strings.Cut(sub, "/"); isItem {
+				if items[idx] == nil {
+					items[idx] = make(map[string][]byte)
+				}
+				items[idx][sub] = raw
+				continue
+			}
+			var ids []string
+			if json.Unmarshal(raw, &ids) == nil {
+				if orders[idx] == nil {
+					orders[idx] = make(map[string][]string)
+				}
+				orders[idx][sub] = ids
+				continue
+			}
+			// Stores written before messages had their own keys hold the
+			// whole list here.
+		}
+		if isMapEntry && fv.Kind() == reflect.Map {
+			if fv.IsNil() {
+				fv.Set(reflect.MakeMap(fv.Type()))
+			}
+			elem := reflect.New(fv.Type().Elem())
+			if err := json.Unmarshal(raw, elem.Interface()); err != nil {
+				return nil, err
+			}
+			fv.SetMapIndex(reflect.ValueOf(sub).Convert(fv.Type().Key()), elem.Elem())
+			continue
+		}
+		if err := json.Unmarshal(raw, fv.Addr().Interface()); err != nil {
+			return nil, err
+		}
+	}
+	for idx, byScope := range orders {
+		fv := v.Field(idx)
+		if fv.IsNil() {
+			fv.Set(reflect.MakeMap(fv.Type()))
+		}
+		for scope, ids := range byScope {
+			list := reflect.MakeSlice(fv.Type().Elem(), 0, len(ids))
+			for _, id := range ids {
+				raw, ok := items[idx][scope+"/"+id]
+				if !ok {
+					continue
+				}
+				elem := reflect.New(fv.Type().Elem().Elem())
+				if err := json.Unmarshal(raw, elem.Interface()); err != nil {
+					return nil, err
+				}
+				list = reflect.Append(list, elem.Elem())
+			}
+			fv.SetMapIndex(reflect.ValueOf(scope).Convert(fv.Type().Key()), list)
+		}
+	}
+	return ps, nil
+}
+
+func stateFieldName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	if name == "" {
+		name = f.Name
+	}
+	return name
+}
+
+// diffEntries returns the puts and deletes needed to move the store from the
+// previously written hashes to next, and the new hash set.
+func diffEntries(prev map[string][32]byte, next map[string][]byte) (map[string][]byte, []string, map[string][32]byte) {
+	puts := make(map[string][]byte)
+	hashes := hashEntries(next)
+	for k, v := range next {
+		if old, ok := prev[k]; !ok || old != hashes[k] {
+			puts[k] = v
+		}
+	}
+	deletes := make([]string, 0)
+	for k := range prev {
+		if _, ok := next[k]; !ok {
+			deletes = append(deletes, k)
+		}
+	}
+	sort.Strings(deletes)
+	return puts, deletes, hashes
+}
+
+func hashEntries(entries map[string][]byte) map[string][32]byte {
+	out := make(map[string][32]byte, len(entries))
+	for k, v := range entries {
+		out[k] = sha256.Sum256(v)
+	}
+	return out
+}
+
+// migrateLegacyState imports a pre-store state.json once and renames it so
+// the import is not repeated.
+func migrateLegacyState(dir string, s Store) error {
+	legacy := filepath.Join(dir, legacyStateName)
+	b, err := os.ReadFile(legacy)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	existing, err := s.Load()
+	if err != nil {
+		return err
+	}
+	if len(existing) == 0 {
+		var ps persistedState
+		if err := json.Unmarshal(b, &ps); err != nil {
+			return err
+		}
+		entries, err := stateEntries(&ps)
+		if err != nil {
+			return err
+		}
+		if err := s.Apply(entries, nil); err != nil {
+			return err
+		}
+	}
+	return os.Rename(legacy, legacy+".migrated")
+}
@@ -0,0 +1,90 @@
+package social
+
+import "errors"
+
+const maxReplyQuoteRunes = 120
+
+// replyQuote is the snippet of a parent shown above a reply.
+func replyQuote(parent DirectMessage) string {
+	if parent.Deleted != "" {
+		return ""
+	}
+	text := parent.Body
+	if text == "" {
+		text = parent.MediaName
+	}
+	if r := []rune(text); len(r) > maxReplyQuoteRunes {
+		return string(r[:maxReplyQuoteRunes]) + "…"
+	}
+	return text
+}
+
+func threadRootOf(msg DirectMessage) string {
+	if msg.ThreadRoot != "" {
+		return msg.ThreadRoot
+	}
+	return msg.MessageID
+}
+
+// attachReplyLocked links msg to the message it answers. A parent we do not
+// hold yet leaves the reply pending, provisionally rooted at the parent,
+// until resolveRepliesLocked sees the parent arrive. Roots are always worked
+// out locally rather than taken from the sender.
+func (m *Manager) attachReplyLocked(peerUserID string, msg *DirectMessage, replyTo string) {
+	msg.ReplyTo, msg.ThreadRoot, msg.ReplyQuote, msg.ReplyPending = replyTo, "", "", false
+	if replyTo == "" || replyTo == msg.MessageID {
+		msg.ReplyTo = ""
+		return
+	}
+	if i := m.dmIndexLocked(peerUserID, replyTo); i >= 0 {
+		parent := m.dms[peerUserID][i]
+		msg.ThreadRoot = threadRootOf(parent)
+		msg.ReplyQuote = replyQuote(parent)
+		return
+	}
+	msg.ThreadRoot = replyTo
+	msg.ReplyPending = true
+}
+
+// resolveRepliesLocked runs after msg was added to the conversation or
+// changed. Replies to it get a fresh quote and stop waiting, and messages
+// rooted at it move to its own root when msg is itself a reply.
+func (m *Manager) resolveRepliesLocked(peerUserID string, msg DirectMessage) {
+	msgs := m.dms[peerUserID]
+	root := threadRootOf(msg)
+	for i := range msgs {
+		if msgs[i].MessageID == msg.MessageID {
+			continue
+		}
+		if msgs[i].ReplyTo == msg.MessageID {
+			msgs[i].ReplyPending = false
+			msgs[i].ReplyQuote = replyQuote(msg)
+		}
+		if msgs[i].ThreadRoot == msg.MessageID && root != msg.MessageID {
+			msgs[i].ThreadRoot = root
+		}
+	}
+}
+
+// Thread returns the thread messageID belongs to: its root first, then
+// every reply in the order they were stored. The root may be missing while
+// it has not synced yet.
+func (m *Manager) Thread(peerUserID, messageID string) ([]DirectMessage, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	msgs := m.dms[peerUserID]
+	i := indexOfDM(msgs, messageID)
+	if i < 0 {
+		return nil, errors.New("message not found")
+	}
+	root := threadRootOf(msgs[i])
+	out := make([]DirectMessage, 0)
+	for _, msg := range msgs {
+		if msg.MessageID == root && msg.Deleted != DeletedForMe {
+			out = append([]DirectMessage{msg}, out...)
+		} else if msg.ThreadRoot == root && msg.Deleted != DeletedForMe {
+			out = append(out, msg)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,470 @@
+package social
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	vaultFileName      = "vault.enc.json"
+	identityFileName   = "identity.enc.json"
+	stagedKeySuffix    = ".next"
+	passphraseIter     = uint32(2)
+	passphraseMemKiB   = uint32(64 * 1024)
+	passphraseParallel = uint8(1)
+)
+
+// The social data dir is encrypted with a random data key. The data key is
+// wrapped with the argon2id passphrase key in vault.enc.json, so changing the
+// passphrase rotates the data key and rewrites the store under it.
+
+func sealWithPassphrase(passphrase string, payload []byte) (encryptedIdentityFile, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return encryptedIdentityFile{}, err
+	}
+	key := argon2.IDKey([]byte(passphrase), salt, passphraseIter, passphraseMemKiB, passphraseParallel, 32)
+	aead, err := newAEAD(key)
+	if err != nil {
+		return encryptedIdentityFile{}, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return encryptedIdentityFile{}, err
+	}
+	ct := aead.Seal(nil, nonce, payload, nil)
+	return encryptedIdentityFile{
+		Version:    1,
+		KDF:        "argon2id",
+		Salt:       base64.RawStdEncoding.EncodeToString(salt),
+		MemoryKiB:  passphraseMemKiB,
+		Iterations: passphraseIter,
+		Parallel:   passphraseParallel,
+		Nonce:      base64.RawStdEncoding.EncodeToString(nonce),
+		Ciphertext: base64.RawStdEncoding.EncodeToString(ct),
+	}, nil
+}
+
+func openWithPassphrase(f encryptedIdentityFile, passphrase string) ([]byte, error) {
+	salt, err := base64.RawStdEncoding.DecodeString(f.Salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := base64.RawStdEncoding.DecodeString(f.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	ct, err := base64.RawStdEncoding.DecodeString(f.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	key := argon2.IDKey([]byte(passphrase), salt, f.Iterations, f.MemoryKiB, f.Parallel, 32)
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, errors.New("invalid nonce")
+	}
+	plain, err := aead.Open(nil, nonce, ct, nil)
+	if err != nil {
+		return nil, errors.New("invalid passphrase")
+	}
+	return plain, nil
+}
+
+func readSealedFile(path string) (encryptedIdentityFile, error) {
+	var f encryptedIdentityFile
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return f, err
+	}
+	err = json.Unmarshal(b, &f)
+	return f, err
+}
+
+func writeSealedFile(path string, f encryptedIdentityFile) error {
+	b, _ := json.MarshalIndent(f, "", "  ")
+	return writeFileAtomic(path, b)
+}
+
+func writeFileAtomic(path string, b []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealedStore encrypts every value with the data key and replaces each key
+// with an HMAC of it, so user IDs and group IDs are not visible on disk. The
+// plaintext key travels inside the ciphertext and is recovered on Load.
+type sealedStore struct {
+	inner  Store
+	aead   cipher.AEAD
+	macKey []byte
+}
+
+func newSealedStore(inner Store, dataKey []byte) (*sealedStore, error) {
+	if len(dataKey) != 32 {
+		return nil, errors.New("invalid data key")
+	}
+	derive := func(info string) []byte {
+		out := make([]byte, 32)
+		_, _ = io.ReadFull(hkdf.New(sha256.New, dataKey, nil, []byte(info)), out)
+		return out
+	}
+	aead, err := newAEAD(derive("social-store-enc-v1"))
+	if err != nil {
+		return nil, err
+	}
+	return &sealedStore{inner: inner, aead: aead, macKey: derive("social-store-index-v1")}, nil
+}
+
+func (s *sealedStore) storedKey(name string) string {
+	mac := hmac.New(sha256.New, s.macKey)
+	mac.Write([]byte(name))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *sealedStore) sealEntries(entries map[string][]byte) (map[string][]byte, error) {
+	out := make(map[string][]byte, len(entries))
+	for name, value := range entries {
+		key := s.storedKey(name)
+		plain := binary.AppendUvarint(nil, uint64(len(name)))
+		plain = append(plain, name...)
+		plain = append(plain, value...)
+		nonce := make([]byte, s.aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		out[key] = s.aead.Seal(nonce, nonce, plain, []byte(key))
+	}
+	return out, nil
+}
+
+func (s *sealedStore) Load() (map[string][]byte, error) {
+	raw, err := s.inner.Load()
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string][]byte, len(raw))
+	ns := s.aead.NonceSize()
+	for key, v := range raw {
+		if len(v) < ns {
+			return nil, errors.New("state decrypt failed")
+		}
+		plain, err := s.aead.Open(nil, v[:ns], v[ns:], []byte(key))
+		if err != nil {
+			return nil, errors.New("state decrypt failed")
+		}
+		n, k := binary.Uvarint(plain)
+		if k <= 0 || uint64(len(plain)-k) < n {
+			return nil, errors.New("state decrypt failed")
+		}
+		out[string(plain[k:k+int(n)])] = plain[k+int(n):]
+	}
+	return out, nil
+}
+
+func (s *sealedStore) Apply(puts map[string][]byte, deletes []string) error {
+	sealed, err := s.sealEntries(puts)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(deletes))
+	for _, name := range deletes {
+		keys = append(keys, s.storedKey(name))
+	}
+	return s.inner.Apply(sealed, keys)
+}
+
+func (s *sealedStore) Compact() error { return s.inner.Compact() }
+
+func (s *sealedStore) Close() error { return s.inner.Close() }
+
+func (m *Manager) vaultPath() string { return filepath.Join(m.cfg.DataDir, vaultFileName) }
+
+func (m *Manager) identityEncPath() string { return filepath.Join(m.cfg.DataDir, identityFileName) }
+
+func (m *Manager) vaultExists() bool {
+	_, err := os.Stat(m.vaultPath())
+	return err == nil
+}
+
+// lockedLocked reports whether encrypted state exists on disk but has not
+// been opened with the passphrase yet.
+func (m *Manager) lockedLocked() bool {
+	return m.store == nil && m.vaultExists()
+}
+
+func (m *Manager) unlockStateLocked(passphrase string) error {
+	m.recoverStagedKeysLocked(passphrase)
+	if err := m.unlock(passphrase); err != nil {
+		return err
+	}
+	if m.store != nil {
+		return nil
+	}
+	if err := m.openVaultLocked(passphrase); err != nil {
+		m.identity = nil
+		return err
+	}
+	return nil
+}
+
+func (m *Manager) openVaultLocked(passphrase string) error {
+	f, err := readSealedFile(m.vaultPath())
+	if errors.Is(err, os.ErrNotExist) {
+		// State written before encryption at rest is still plaintext in the
+		// raw store; it was loaded at startup and is rewritten sealed here.
+		return m.rekeyLocked(passphrase)
+	}
+	if err != nil {
+		return err
+	}
+	dataKey, err := openWithPassphrase(f, passphrase)
+	if err != nil {
+		return err
+	}
+	sealed, err := newSealedStore(m.rawStore, dataKey)
+	if err != nil {
+		return err
+	}
+	m.resetStateLocked()
+	m.store = sealed
+	if err := m.loadState(); err != nil {
+		m.store = nil
+		return err
+	}
+	if m.migrateInlineMediaLocked() {
+		_ = m.saveStateLocked()
+	}
+	return nil
+}
+
+// rekeyLocked re-encrypts the identity and the whole store under a fresh data
+// key wrapped with passphrase. The new key files are staged next to the live
+// ones and promoted only after the store batch is durable, so a crash leaves
+// a key set that matches the store (see recoverStagedKeysLocked).
+func (m *Manager) rekeyLocked(passphrase string) error {
+	if m.identity == nil {
+		return errors.New("identity missing")
+	}
+	if m.rawStore == nil {
+		return errors.New("store not open")
+	}
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return err
+	}
+	vf, err := sealWithPassphrase(passphrase, dataKey)
+	if err != nil {
+		return err
+	}
+	idf, err := sealWithPassphrase(passphrase, identityPlainJSON(m.identity))
+	if err != nil {
+		return err
+	}
+	if err := writeSealedFile(m.identityEncPath()+stagedKeySuffix, idf); err != nil {
+		return err
+	}
+	if err := writeSealedFile(m.vaultPath()+stagedKeySuffix, vf); err != nil {
+		m.discardStagedKeys()
+		return err
+	}
+	next, err := newSealedStore(m.rawStore, dataKey)
+	if err != nil {
+		m.discardStagedKeys()
+		return err
+	}
+	ps := m.persistedStateLocked()
+	entries, err := stateEntries(&ps)
+	if err != nil {
+		m.discardStagedKeys()
+		return err
+	}
+	puts, err := next.sealEntries(entries)
+	if err != nil {
+		m.discardStagedKeys()
+		return err
+	}
+	old, err := m.rawStore.Load()
+	if err != nil {
+		m.discardStagedKeys()
+		return err
+	}
+	deletes := make([]string, 0, len(old))
+	for k := range old {
+		if _, ok := puts[k]; !ok {
+			deletes = append(deletes, k)
+		}
+	}
+	if err := m.rawStore.Apply(puts, deletes); err != nil {
+		m.discardStagedKeys()
+		return err
+	}
+	// Drop superseded records so old ciphertext or legacy plaintext does not
+	// linger in the log.
+	_ = m.rawStore.Compact()
+	if err := m.promoteStagedKeys(); err != nil {
+		return err
+	}
+	m.store = next
+	// Entries are hashed before sealing, so anything changed since the last
+	// save still streams as a change.
+	changed, deleted, hashes := diffEntries(m.storeHashes, entries)
+	m.storeHashes = hashes
+	m.publishChangesLocked(changed, deleted)
+	m.cfg.Passphrase = passphrase
+	_ = os.Remove(m.identityPlainPath())
+	_ = os.Remove(filepath.Join(m.cfg.DataDir, legacyStateName+".migrated"))
+	return nil
+}
+
+// recoverStagedKeysLocked finishes or rolls back a rekey interrupted by a
+// crash. Staged keys are promoted when they decrypt the store, and discarded
+// when they provably do not; a passphrase that cannot open them leaves them
+// alone since it may simply be the old one.
+func (m *Manager) recoverStagedKeysLocked(passphrase string) {
+	if m.rawStore == nil {
+		return
+	}
+	f, err := readSealedFile(m.vaultPath() + stagedKeySuffix)
+	if err != nil {
+		return
+	}
+	dataKey, err := openWithPassphrase(f, passphrase)
+	if err != nil {
+		return
+	}
+	staged, err := newSealedStore(m.rawStore, dataKey)
+	if err != nil {
+		return
+	}
+	if entries, err := staged.Load(); err != nil || len(entries) == 0 {
+		m.discardStagedKeys()
+		return
+	}
+	_ = m.promoteStagedKeys()
+}
+
+func (m *Manager) promoteStagedKeys() error {
+	// Identity first: recovery keys off the staged vault file, so it must be
+	// the last one to move.
+	idStaged := m.identityEncPath() + stagedKeySuffix
+	if _, err := os.Stat(idStaged); err == nil {
+		if err := os.Rename(idStaged, m.identityEncPath()); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(m.vaultPath()+stagedKeySuffix, m.vaultPath()); err != nil {
+		return err
+	}
+	syncDir(m.cfg.DataDir)
+	return nil
+}
+
+func (m *Manager) discardStagedKeys() {
+	_ = os.Remove(m.identityEncPath() + stagedKeySuffix)
+	_ = os.Remove(m.vaultPath() + stagedKeySuffix)
+}
+
+// Lock drops the decrypted state and identity from memory and stops the
+// network loop until Unlock is called again.
+func (m *Manager) Lock() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.vaultExists() {
+		return errors.New("no passphrase set")
+	}
+	if m.cancel != nil {
+		m.cancel()
+		m.cancel = nil
+	}
+	m.subscriptionID = ""
+	m.identity = nil
+	m.store = nil
+	m.storeHashes = nil
+	m.cfg.Passphrase = ""
+	m.resetStateLocked()
+	m.resyncEventsLocked()
+	return nil
+}
+
+// ChangePassphrase verifies the current passphrase and re-encrypts the
+// identity and all stored state under a new data key.
+func (m *Manager) ChangePassphrase(current, next string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.identity == nil || m.store == nil {
+		return errors.New("locked")
+	}
+	if strings.TrimSpace(next) == "" {
+		return errors.New("new passphrase required")
+	}
+	f, err := readSealedFile(m.identityEncPath())
+	if err != nil {
+		return err
+	}
+	if _, err := openWithPassphrase(f, current); err != nil {
+		return err
+	}
+	return m.rekeyLocked(next)
+}
+
+func identityPlainFor(id *Identity) identityPlain {
+	return identityPlain{
+		UserID:      id.UserID,
+		SignPrivB64: base64.RawStdEncoding.EncodeToString(id.SignPrivate),
+		BoxPrivB64:  base64.RawStdEncoding.EncodeToString(id.BoxPrivateKey[:]),
+	}
+}
+
+func identityPlainJSON(id *Identity) []byte {
+	b, _ := json.Marshal(identityPlainFor(id))
+	return b
+}
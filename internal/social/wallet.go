@@ -0,0 +1,185 @@
+package social
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	walletChallengeTTL       = 10 * time.Minute
+	walletChallengeStatement = "Authorize this device to send social friend requests."
+	walletChallengeURIPrefix = "social://user/"
+	walletChallengeResource  = "social:box:"
+	walletChallengeSkew      = 5 * time.Minute
+)
+
+// walletChallenge is an EIP-4361 (Sign-In With Ethereum) message binding a
+// wallet signature to one social user, one box key and one nonce, so a
+// captured hello signature cannot be replayed by anyone else or reused.
+type walletChallenge struct {
+	Domain    string
+	Address   string
+	UserID    string
+	BoxPub    string
+	Nonce     string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
+
+func (c walletChallenge) String() string {
+	return fmt.Sprintf("%s wants you to sign in with your Ethereum account:\n%s\n\n%s\n\nURI: %s%s\nVersion: 1\nChain ID: 1\nNonce: %s\nIssued At: %s\nExpiration Time: %s\nResources:\n- %s%s",
+		c.Domain, c.Address, walletChallengeStatement, walletChallengeURIPrefix, c.UserID, c.Nonce,
+		c.IssuedAt.UTC().Format(time.RFC3339), c.ExpiresAt.UTC().Format(time.RFC3339), walletChallengeResource, c.BoxPub)
+}
+
+func parseWalletChallenge(msg string) (walletChallenge, error) {
+	var c walletChallenge
+	lines := strings.Split(msg, "\n")
+	if len(lines) != 13 {
+		return c, errors.New("invalid wallet challenge")
+	}
+	domain, ok := strings.CutSuffix(lines[0], " wants you to sign in with your Ethereum account:")
+	if !ok || domain == "" || strings.ContainsAny(domain, " \t") {
+		return c, errors.New("invalid wallet challenge domain")
+	}
+	if lines[2] != "" || lines[3] != walletChallengeStatement || lines[4] != "" ||
+		lines[6] != "Version: 1" || lines[7] != "Chain ID: 1" || lines[11] != "Resources:" {
+		return c, errors.New("invalid wallet challenge")
+	}
+	field := func(line, prefix string) (string, bool) {
+		v, ok := strings.CutPrefix(line, prefix)
+		return v, ok && v != ""
+	}
+	var issued, expires string
+	var okURI, okNonce, okIssued, okExpires, okRes bool
+	c.Domain = domain
+	c.Address = lines[1]
+	c.UserID, okURI = field(lines[5], "URI: "+walletChallengeURIPrefix)
+	c.Nonce, okNonce = field(lines[8], "Nonce: ")
+	issued, okIssued = field(lines[9], "Issued At: ")
+	expires, okExpires = field(lines[10], "Expiration Time: ")
+	c.BoxPub, okRes = field(lines[12], "- "+walletChallengeResource)
+	if !okURI || !okNonce || !okIssued || !okExpires || !okRes || !common.IsHexAddress(c.Address) {
+		return c, errors.New("invalid wallet challenge")
+	}
+	var err error
+	if c.IssuedAt, err = time.Parse(time.RFC3339, issued); err != nil {
+		return c, errors.New("invalid wallet challenge issue time")
+	}
+	if c.ExpiresAt, err = time.Parse(time.RFC3339, expires); err != nil {
+		return c, errors.New("invalid wallet challenge expiry")
+	}
+	return c, nil
+}
+
+// IssueWalletChallenge returns a single-use challenge for walletAddr to sign
+// before sending a friend request. domain is the host the user sees, so the
+// wallet can warn about phishing.
+func (m *Manager) IssueWalletChallenge(domain, walletAddr string) (string, time.Time, error) {
+	domain = strings.TrimSpace(domain)
+	if domain == "" || strings.ContainsAny(domain, " \t\n") {
+		return "", time.Time{}, errors.New("invalid domain")
+	}
+	walletAddr = strings.TrimSpace(walletAddr)
+	if !common.IsHexAddress(walletAddr) {
+		return "", time.Time{}, errors.New("wallet address required")
+	}
+	nonceRaw := make([]byte, 16)
+	if _, err := rand.Read(nonceRaw); err != nil {
+		return "", time.Time{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.profile == nil || m.identity == nil {
+		return "", time.Time{}, errors.New("not initialized")
+	}
+	if !strings.EqualFold(walletAddr, m.profile.Username) {
+		return "", time.Time{}, errors.New("wallet address must match profile username")
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	c := walletChallenge{
+		Domain:    domain,
+		Address:   common.HexToAddress(walletAddr).Hex(),
+		UserID:    m.profile.UserID,
+		BoxPub:    base64.RawStdEncoding.EncodeToString(m.identity.BoxPublicKey[:]),
+		Nonce:     hex.EncodeToString(nonceRaw),
+		IssuedAt:  now,
+		ExpiresAt: now.Add(walletChallengeTTL),
+	}
+	for nonce, p := range m.walletChallenges {
+		if now.After(p.ExpiresAt) {
+			delete(m.walletChallenges, nonce)
+		}
+	}
+	m.walletChallenges[c.Nonce] = c
+	return c.String(), c.ExpiresAt, nil
+}
+
+// consumeWalletChallengeLocked checks a signed challenge issued by
+// IssueWalletChallenge and burns its nonce.
+func (m *Manager) consumeWalletChallengeLocked(walletAddr, msg, sigHex string) error {
+	c, err := parseWalletChallenge(msg)
+	if err != nil {
+		return err
+	}
+	issued, ok := m.walletChallenges[c.Nonce]
+	if !ok || issued.String() != msg {
+		return errors.New("unknown wallet challenge")
+	}
+	if time.Now().After(issued.ExpiresAt) {
+		delete(m.walletChallenges, c.Nonce)
+		return errors.New("wallet challenge expired")
+	}
+	if !strings.EqualFold(c.Address, walletAddr) || !verifyWalletSignature(walletAddr, msg, sigHex) {
+		return errors.New("invalid wallet signature")
+	}
+	delete(m.walletChallenges, c.Nonce)
+	return nil
+}
+
+// helloSigned checks that the wallet challenge carried by an incoming friend
+// request is signed by the wallet and names the sending user and the box key
+// the envelope was sealed with. It reads no state, so the wallet can be
+// vouched for before the contact lookup, which runs without the lock.
+func helloSigned(walletAddr, fromUser, senderBoxPub, msg, sigHex string) (walletChallenge, bool) {
+	c, err := parseWalletChallenge(msg)
+	if err != nil {
+		return walletChallenge{}, false
+	}
+	if !strings.EqualFold(c.Address, walletAddr) || c.UserID != fromUser || c.BoxPub != senderBoxPub {
+		return walletChallenge{}, false
+	}
+	if !verifyWalletSignature(walletAddr, msg, sigHex) {
+		return walletChallenge{}, false
+	}
+	return c, true
+}
+
+// acceptHelloLocked checks that a signed hello was valid when the request
+// was created and has not been seen before.
+func (m *Manager) acceptHelloLocked(c walletChallenge, created time.Time) bool {
+	now := time.Now().UTC()
+	if created.Before(c.IssuedAt.Add(-walletChallengeSkew)) || created.After(c.ExpiresAt) ||
+		created.After(now.Add(walletChallengeSkew)) || now.Sub(created) > outboxTTL {
+		return false
+	}
+	key := strings.ToLower(c.Address) + "/" + c.Nonce
+	if _, used := m.usedWalletNonces[key]; used {
+		return false
+	}
+	for k, exp := range m.usedWalletNonces {
+		if now.After(exp) {
+			delete(m.usedWalletNonces, k)
+		}
+	}
+	// Remember the nonce for as long as a request carrying it can arrive.
+	m.usedWalletNonces[key] = c.ExpiresAt.Add(outboxTTL)
+	return true
+}
@@ -4,7 +4,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"Assembler-Apps/internal/social"
 )
@@ -23,13 +25,49 @@ func (s *Server) Register(mux *http.ServeMux) {
 	mux.HandleFunc("/api/social/v1/init", s.handleInit)
 	mux.HandleFunc("/api/social/v1/unlock", s.handleUnlock)
 	mux.HandleFunc("/api/social/v1/wallet-login", s.handleWalletLogin)
+	mux.HandleFunc("/api/social/v1/lock", s.handleLock)
+	mux.HandleFunc("/api/social/v1/passphrase", s.handleChangePassphrase)
+	mux.HandleFunc("/api/social/v1/devices/link", s.handleDeviceLink)
+	mux.HandleFunc("/api/social/v1/devices/join", s.handleDeviceJoin)
+	mux.HandleFunc("/api/social/v1/backup/export", s.handleBackupExport)
+	mux.HandleFunc("/api/social/v1/backup/import", s.handleBackupImport)
+	mux.HandleFunc("/api/social/v1/keys/rotate/prepare", s.handleKeyRotationPrepare)
+	mux.HandleFunc("/api/social/v1/keys/rotate", s.handleKeyRotate)
 	mux.HandleFunc("/api/social/v1/profile", s.handleProfile)
+	mux.HandleFunc("/api/social/v1/wallet/challenge", s.handleWalletChallenge)
+	mux.HandleFunc("/api/social/v1/wallet/binding", s.handleWalletBinding)
+	mux.HandleFunc("/api/social/v1/alerts/dismiss", s.handleDismissAlert)
 	mux.HandleFunc("/api/social/v1/friends/request", s.handleRequest)
 	mux.HandleFunc("/api/social/v1/friends/respond", s.handleRespond)
+	mux.HandleFunc("/api/social/v1/friends/cancel", s.handleCancelRequest)
+	mux.HandleFunc("/api/social/v1/friends/resend", s.handleResendRequest)
 	mux.HandleFunc("/api/social/v1/friends/invite", s.handleInvite)
 	mux.HandleFunc("/api/social/v1/friends/request-by-invite", s.handleRequestByInvite)
+	mux.HandleFunc("/api/social/v1/friends/safety/", s.handleSafetyNumber)
+	mux.HandleFunc("/api/social/v1/friends/verify", s.handleVerifyFriend)
+	mux.HandleFunc("/api/social/v1/friends/contact", s.handleFriendContact)
+	mux.HandleFunc("/api/social/v1/friends/retention", s.handleFriendRetention)
+	mux.HandleFunc("/api/social/v1/friends/remove", s.handleUnfriend)
+	mux.HandleFunc("/api/social/v1/users/block", s.handleBlock)
+	mux.HandleFunc("/api/social/v1/users/mute", s.handleMute)
 	mux.HandleFunc("/api/social/v1/messages/send", s.handleSendMessage)
+	mux.HandleFunc("/api/social/v1/messages/read", s.handleMarkRead)
+	mux.HandleFunc("/api/social/v1/messages/search", s.handleSearchMessages)
+	mux.HandleFunc("/api/social/v1/messages/edit", s.handleEditMessage)
+	mux.HandleFunc("/api/social/v1/messages/delete", s.handleDeleteMessage)
+	mux.HandleFunc("/api/social/v1/messages/react", s.handleReactMessage)
 	mux.HandleFunc("/api/social/v1/messages/", s.handleConversation)
+	mux.HandleFunc("/api/social/v1/signals", s.handleSignal)
+	mux.HandleFunc("/api/social/v1/threads/", s.handleThread)
+	mux.HandleFunc("/api/social/v1/media/", s.handleMedia)
+	mux.HandleFunc("/api/social/v1/groups/create", s.handleGroupCreate)
+	mux.HandleFunc("/api/social/v1/groups/invite", s.handleGroupInvite)
+	mux.HandleFunc("/api/social/v1/groups/remove", s.handleGroupRemove)
+	mux.HandleFunc("/api/social/v1/groups/rotate", s.handleGroupRotate)
+	mux.HandleFunc("/api/social/v1/groups/rename", s.handleGroupRename)
+	mux.HandleFunc("/api/social/v1/groups/leave", s.handleGroupLeave)
+	mux.HandleFunc("/api/social/v1/groups/send", s.handleGroupSend)
+	mux.HandleFunc("/api/social/v1/groups/messages/", s.handleGroupConversation)
 }
 
 func (s *Server) handleStream(w http.ResponseWriter, r *http.Request) {
@@ -42,26 +80,71 @@ func (s *Server) handleStream(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, "streaming not supported")
 		return
 	}
+	// Subscribe before reading the backlog or snapshot so nothing falls in
+	// between; events already covered are skipped by ID below.
 	ch, cancel := s.m.SubscribeEvents()
 	defer cancel()
+	signals, cancelSignals := s.m.SubscribeSignals()
+	defer cancelSignals()
 
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.WriteHeader(http.StatusOK)
-	writeSSEJSON(w, "ready", s.m.Snapshot())
+
+	var lastID uint64
+	var backlog []social.Event
+	resumed := false
+	raw := r.Header.Get("Last-Event-ID")
+	if raw == "" {
+		raw = r.URL.Query().Get("last_event_id")
+	}
+	if id, err := strconv.ParseUint(raw, 10, 64); err == nil {
+		lastID = id
+		backlog, resumed = s.m.EventsSince(id)
+	}
+	if resumed {
+		for _, ev := range backlog {
+			if err := writeSSEEvent(w, ev); err != nil {
+				return
+			}
+			lastID = ev.ID
+		}
+	} else {
+		snap, id := s.m.SnapshotAt()
+		data, err := json.Marshal(snap)
+		if err != nil {
+			return
+		}
+		if err := writeSSEEvent(w, social.Event{ID: id, Type: "ready", Data: data}); err != nil {
+			return
+		}
+		lastID = id
+	}
 	flusher.Flush()
 
 	for {
 		select {
 		case <-r.Context().Done():
 			return
-		case event, ok := <-ch:
+		case ev, ok := <-ch:
+			if !ok {
+				return
+			}
+			if ev.ID <= lastID {
+				continue
+			}
+			if err := writeSSEEvent(w, ev); err != nil {
+				return
+			}
+			lastID = ev.ID
+			flusher.Flush()
+		case sig, ok := <-signals:
 			if !ok {
 				return
 			}
-			if err := writeSSEJSON(w, event, s.m.Snapshot()); err != nil {
+			if err := writeSSEJSON(w, sig.Kind, sig); err != nil {
 				return
 			}
 			flusher.Flush()
@@ -139,13 +222,221 @@ func (s *Server) handleWalletLogin(w http.ResponseWriter, r *http.Request) {
 	}
 	var req struct {
 		WalletAddr string          `json:"wallet_address"`
+		Passphrase string          `json:"passphrase"`
 		Settings   social.Settings `json:"settings"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		writeError(w, http.StatusBadRequest, "invalid json")
 		return
 	}
-	p, err := s.m.LoginWithWallet(req.WalletAddr, req.Settings)
+	p, err := s.m.LoginWithWallet(req.WalletAddr, req.Passphrase, req.Settings)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"me": p})
+}
+
+func (s *Server) handleLock(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		writeNoContent(w)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if err := s.m.Lock(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+}
+
+func (s *Server) handleChangePassphrase(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		writeNoContent(w)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req struct {
+		Current string `json:"current_passphrase"`
+		New     string `json:"new_passphrase"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if err := s.m.ChangePassphrase(req.Current, req.New); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+}
+
+func (s *Server) handleDeviceLink(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		writeNoContent(w)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	token, err := s.m.CreateDeviceLink()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"token": token})
+}
+
+func (s *Server) handleDeviceJoin(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		writeNoContent(w)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req struct {
+		Token      string `json:"token"`
+		Passphrase string `json:"passphrase"`
+		Name       string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if err := s.m.LinkDevice(req.Token, req.Passphrase, req.Name); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+}
+
+func (s *Server) handleKeyRotationPrepare(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		writeNoContent(w)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	msg, err := s.m.PrepareKeyRotation(req.Reason)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"message": msg})
+}
+
+func (s *Server) handleKeyRotate(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		writeNoContent(w)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req struct {
+		Passphrase      string `json:"passphrase"`
+		Reason          string `json:"reason"`
+		WalletSignature string `json:"wallet_signature"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	p, err := s.m.RotateKeys(req.Passphrase, req.Reason, req.WalletSignature)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"me": p})
+}
+
+func (s *Server) handleDismissAlert(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		writeNoContent(w)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req struct {
+		AlertID string `json:"alert_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if err := s.m.DismissSecurityAlert(req.AlertID); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+}
+
+func (s *Server) handleBackupExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		writeNoContent(w)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req struct {
+		Passphrase     string `json:"passphrase"`
+		IncludeHistory bool   `json:"include_history"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	backup, err := s.m.ExportBackup(req.Passphrase, req.IncludeHistory)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"backup": json.RawMessage(backup)})
+}
+
+func (s *Server) handleBackupImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		writeNoContent(w)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req struct {
+		Backup         json.RawMessage `json:"backup"`
+		Passphrase     string          `json:"passphrase"`
+		WalletAddr     string          `json:"wallet_address"`
+		IncludeHistory bool            `json:"include_history"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	p, err := s.m.ImportBackup(req.Backup, req.Passphrase, req.WalletAddr, req.IncludeHistory)
 	if err != nil {
 		writeError(w, http.StatusBadRequest, err.Error())
 		return
@@ -189,13 +480,14 @@ func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
 		TargetUserID string `json:"target_user_id"`
 		Message      string `json:"message"`
 		WalletAddr   string `json:"wallet_address"`
+		HelloMessage string `json:"hello_message"`
 		HelloSig     string `json:"hello_sig"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		writeError(w, http.StatusBadRequest, "invalid json")
 		return
 	}
-	if err := s.m.SendFriendRequest(req.TargetUserID, req.Message, "discover", req.WalletAddr, req.HelloSig); err != nil {
+	if err := s.m.SendFriendRequest(req.TargetUserID, req.Message, "discover", req.WalletAddr, req.HelloMessage, req.HelloSig); err != nil {
 		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
@@ -222,87 +514,745 @@ func (s *Server) handleRespond(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, map[string]any{"ok": true})
 }
 
-func (s *Server) handleInvite(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleCancelRequest(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
-	token, err := s.m.CreateInviteLink()
-	if err != nil {
+	var req struct {
+		RequestID string `json:"request_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if err := s.m.CancelFriendRequest(req.RequestID); err != nil {
 		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	writeJSON(w, http.StatusOK, map[string]any{"token": token})
+	writeJSON(w, http.StatusOK, map[string]any{"ok": true})
 }
 
-func (s *Server) handleRequestByInvite(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleResendRequest(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
 	var req struct {
-		Token      string `json:"token"`
-		Message    string `json:"message"`
-		WalletAddr string `json:"wallet_address"`
-		HelloSig   string `json:"hello_sig"`
+		RequestID string `json:"request_id"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		writeError(w, http.StatusBadRequest, "invalid json")
 		return
 	}
-	if err := s.m.SendFriendRequestByInvite(req.Token, req.Message, req.WalletAddr, req.HelloSig); err != nil {
+	if err := s.m.ResendFriendRequest(req.RequestID); err != nil {
 		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 	writeJSON(w, http.StatusOK, map[string]any{"ok": true})
 }
 
-func (s *Server) handleSendMessage(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleWalletChallenge(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
 	var req struct {
-		ToUserID  string `json:"to_user_id"`
-		Body      string `json:"body"`
-		MediaName string `json:"media_name"`
-		MediaMIME string `json:"media_mime"`
-		MediaData string `json:"media_data"`
+		WalletAddr string `json:"wallet_address"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		writeError(w, http.StatusBadRequest, "invalid json")
 		return
 	}
-	if err := s.m.SendDirectMessage(req.ToUserID, req.Body, req.MediaName, req.MediaMIME, req.MediaData); err != nil {
+	msg, expires, err := s.m.IssueWalletChallenge(r.Host, req.WalletAddr)
+	if err != nil {
 		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+	writeJSON(w, http.StatusOK, map[string]any{"message": msg, "expires_at": expires})
 }
 
-func (s *Server) handleConversation(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
+func (s *Server) handleWalletBinding(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		writeNoContent(w)
+		return
+	}
+	if r.Method == http.MethodGet {
+		td, err := s.m.ProfileBindingRequest()
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"typed_data": td})
+		return
+	}
+	if r.Method != http.MethodPost {
 		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
-	userID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/social/v1/messages/"), "/")
-	if userID == "" {
-		writeError(w, http.StatusBadRequest, "user id required")
+	var req struct {
+		IssuedAt  int64  `json:"issued_at"`
+		Signature string `json:"signature"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	p, err := s.m.BindWallet(req.IssuedAt, req.Signature)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	writeJSON(w, http.StatusOK, map[string]any{"messages": s.m.Conversation(userID)})
+	writeJSON(w, http.StatusOK, map[string]any{"me": p})
 }
 
-func writeJSON(w http.ResponseWriter, status int, payload any) {
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-	w.Header().Set("Access-Control-Allow-Methods", "GET,POST,OPTIONS")
-	w.WriteHeader(status)
-	_ = json.NewEncoder(w).Encode(payload)
+func (s *Server) handleSafetyNumber(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	userID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/social/v1/friends/safety/"), "/")
+	sn, err := s.m.SafetyNumber(userID)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, sn)
 }
 
-func writeError(w http.ResponseWriter, status int, msg string) {
+func (s *Server) handleVerifyFriend(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		writeNoContent(w)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req struct {
+		UserID   string `json:"user_id"`
+		Verified bool   `json:"verified"`
+		Payload  string `json:"payload"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	var (
+		f   *social.Friend
+		err error
+	)
+	if req.Payload != "" {
+		f, err = s.m.VerifySafetyPayload(req.Payload)
+	} else {
+		f, err = s.m.SetFriendVerified(req.UserID, req.Verified)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"friend": f})
+}
+
+func (s *Server) handleFriendContact(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		writeNoContent(w)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req struct {
+		UserID string `json:"user_id"`
+		social.FriendPatch
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	f, err := s.m.UpdateFriend(req.UserID, req.FriendPatch)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"friend": f})
+}
+
+func (s *Server) handleFriendRetention(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		writeNoContent(w)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req struct {
+		UserID  string `json:"user_id"`
+		Seconds int64  `json:"seconds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	f, err := s.m.SetRetention(req.UserID, req.Seconds)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"friend": f})
+}
+
+func (s *Server) handleUnfriend(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		writeNoContent(w)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req struct {
+		UserID string `json:"user_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if err := s.m.Unfriend(req.UserID); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+}
+
+func (s *Server) handleBlock(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		writeNoContent(w)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req struct {
+		UserID  string `json:"user_id"`
+		Blocked bool   `json:"blocked"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	var err error
+	if req.Blocked {
+		err = s.m.BlockUser(req.UserID)
+	} else {
+		err = s.m.UnblockUser(req.UserID)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+}
+
+func (s *Server) handleMute(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		writeNoContent(w)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req struct {
+		UserID string `json:"user_id"`
+		Muted  bool   `json:"muted"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if err := s.m.SetMuted(req.UserID, req.Muted); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+}
+
+func (s *Server) handleInvite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	token, err := s.m.CreateInviteLink()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"token": token})
+}
+
+func (s *Server) handleRequestByInvite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req struct {
+		Token        string `json:"token"`
+		Message      string `json:"message"`
+		WalletAddr   string `json:"wallet_address"`
+		HelloMessage string `json:"hello_message"`
+		HelloSig     string `json:"hello_sig"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if err := s.m.SendFriendRequestByInvite(req.Token, req.Message, req.WalletAddr, req.HelloMessage, req.HelloSig); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+}
+
+func (s *Server) handleSendMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req struct {
+		ToUserID  string `json:"to_user_id"`
+		Body      string `json:"body"`
+		MediaName string `json:"media_name"`
+		MediaMIME string `json:"media_mime"`
+		MediaData string `json:"media_data"`
+		ReplyTo   string `json:"reply_to"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if err := s.m.SendReply(req.ToUserID, req.ReplyTo, req.Body, req.MediaName, req.MediaMIME, req.MediaData); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+}
+
+func (s *Server) handleMarkRead(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req struct {
+		UserID string `json:"user_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if err := s.m.MarkConversationRead(req.UserID); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+}
+
+func (s *Server) handleConversation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	userID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/social/v1/messages/"), "/")
+	if userID == "" {
+		writeError(w, http.StatusBadRequest, "user id required")
+		return
+	}
+	hq, ok := historyQuery(w, r)
+	if !ok {
+		return
+	}
+	page, err := s.m.ConversationPage(userID, hq)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// historyQuery reads the paging parameters shared by the conversation
+// endpoints, answering the request itself when they are invalid.
+func historyQuery(w http.ResponseWriter, r *http.Request) (social.HistoryQuery, bool) {
+	q := r.URL.Query()
+	hq := social.HistoryQuery{Before: q.Get("before"), After: q.Get("after")}
+	var err error
+	if hq.Limit, err = queryInt(q.Get("limit")); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid limit")
+		return hq, false
+	}
+	if hq.BeforeTS, err = queryTime(q.Get("before_ts")); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid before_ts")
+		return hq, false
+	}
+	if hq.AfterTS, err = queryTime(q.Get("after_ts")); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid after_ts")
+		return hq, false
+	}
+	return hq, true
+}
+
+func (s *Server) handleSearchMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	q := r.URL.Query()
+	limit, err := queryInt(q.Get("limit"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid limit")
+		return
+	}
+	hits, err := s.m.SearchMessages(q.Get("q"), q.Get("peer"), limit)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"hits": hits})
+}
+
+func (s *Server) handleEditMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		writeNoContent(w)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req struct {
+		UserID    string `json:"user_id"`
+		MessageID string `json:"message_id"`
+		Body      string `json:"body"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	msg, err := s.m.EditDirectMessage(req.UserID, req.MessageID, req.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"message": msg})
+}
+
+func (s *Server) handleDeleteMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		writeNoContent(w)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req struct {
+		UserID      string `json:"user_id"`
+		MessageID   string `json:"message_id"`
+		ForEveryone bool   `json:"for_everyone"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if err := s.m.DeleteDirectMessage(req.UserID, req.MessageID, req.ForEveryone); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+}
+
+func (s *Server) handleReactMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		writeNoContent(w)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req struct {
+		UserID    string `json:"user_id"`
+		MessageID string `json:"message_id"`
+		Emoji     string `json:"emoji"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if err := s.m.ReactDirectMessage(req.UserID, req.MessageID, req.Emoji); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+}
+
+func (s *Server) handleSignal(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		writeNoContent(w)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req struct {
+		UserID string `json:"user_id"`
+		Kind   string `json:"kind"`
+		Active bool   `json:"active"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if err := s.m.SendSignal(req.UserID, req.Kind, req.Active); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+}
+
+func queryInt(raw string) (int, error) {
+	if raw == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(raw)
+}
+
+func queryTime(raw string) (time.Time, error) {
+	if raw == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, raw)
+}
+
+func (s *Server) handleThread(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/social/v1/threads/"), "/")
+	userID, messageID, _ := strings.Cut(rest, "/")
+	if userID == "" || messageID == "" {
+		writeError(w, http.StatusBadRequest, "user id and message id required")
+		return
+	}
+	msgs, err := s.m.Thread(userID, messageID)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"messages": msgs})
+}
+
+func (s *Server) handleMedia(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	digest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/social/v1/media/"), "/")
+	if digest == "" {
+		writeError(w, http.StatusBadRequest, "media digest required")
+		return
+	}
+	data, ref, err := s.m.OpenMedia(digest)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	mime := ref.MIME
+	if mime == "" {
+		mime = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", mime)
+	w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(data)
+}
+
+func (s *Server) handleGroupCreate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req struct {
+		Name      string   `json:"name"`
+		MemberIDs []string `json:"member_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	g, err := s.m.CreateGroup(req.Name, req.MemberIDs)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"group": g})
+}
+
+func (s *Server) handleGroupInvite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req struct {
+		GroupID string   `json:"group_id"`
+		UserIDs []string `json:"user_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if err := s.m.InviteToGroup(req.GroupID, req.UserIDs); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+}
+
+func (s *Server) handleGroupRemove(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req struct {
+		GroupID string `json:"group_id"`
+		UserID  string `json:"user_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if err := s.m.RemoveFromGroup(req.GroupID, req.UserID); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+}
+
+func (s *Server) handleGroupRotate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req struct {
+		GroupID string `json:"group_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if err := s.m.RotateGroupKey(req.GroupID); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+}
+
+func (s *Server) handleGroupRename(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req struct {
+		GroupID string `json:"group_id"`
+		Name    string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if err := s.m.RenameGroup(req.GroupID, req.Name); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+}
+
+func (s *Server) handleGroupLeave(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req struct {
+		GroupID string `json:"group_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if err := s.m.LeaveGroup(req.GroupID); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+}
+
+func (s *Server) handleGroupSend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req struct {
+		GroupID string `json:"group_id"`
+		Body    string `json:"body"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if err := s.m.SendGroupMessage(req.GroupID, req.Body); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+}
+
+func (s *Server) handleGroupConversation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	groupID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/social/v1/groups/messages/"), "/")
+	if groupID == "" {
+		writeError(w, http.StatusBadRequest, "group id required")
+		return
+	}
+	hq, ok := historyQuery(w, r)
+	if !ok {
+		return
+	}
+	page, err := s.m.GroupConversationPage(groupID, hq)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+func writeJSON(w http.ResponseWriter, status int, payload any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "GET,POST,OPTIONS")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(payload)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
 	writeJSON(w, status, map[string]any{"error": msg})
 }
 
@@ -313,6 +1263,13 @@ func writeNoContent(w http.ResponseWriter) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// writeSSEEvent writes an event with its ID, which the browser sends back as
+// Last-Event-ID when it reconnects.
+func writeSSEEvent(w http.ResponseWriter, ev social.Event) error {
+	_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, ev.Data)
+	return err
+}
+
 func writeSSEJSON(w http.ResponseWriter, event string, payload any) error {
 	b, err := json.Marshal(payload)
 	if err != nil {
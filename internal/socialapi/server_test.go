@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"net/http/httptest"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -50,8 +51,77 @@ func TestSSEStreamWritesStateEvent(t *testing.T) {
 	if !strings.Contains(body, "event: ready") {
 		t.Fatalf("expected ready event, got: %s", body)
 	}
-	if !strings.Contains(body, "event: state") {
-		t.Fatalf("expected state event, got: %s", body)
+	if !strings.Contains(body, "event: state_patch") {
+		t.Fatalf("expected state_patch event, got: %s", body)
+	}
+	if strings.Count(body, `"discovery"`) != 1 {
+		t.Fatalf("only the ready event should carry a full snapshot, got: %s", body)
+	}
+}
+
+func streamOnce(t *testing.T, s *Server, lastEventID string) string {
+	t.Helper()
+	req := httptest.NewRequest("GET", "/api/social/v1/stream", nil)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), 100*time.Millisecond)
+	defer cancel()
+	rec := httptest.NewRecorder()
+	s.handleStream(rec, req.WithContext(ctx))
+	return rec.Body.String()
+}
+
+func TestSSEStreamResumesFromLastEventID(t *testing.T) {
+	t.Parallel()
+	m, err := social.NewManager(social.Config{DataDir: t.TempDir(), RPCSocketPath: "/tmp/does-not-exist.sock"})
+	if err != nil {
+		t.Fatalf("new manager: %v", err)
+	}
+	s := NewServer(m)
+	_, readyID := m.SnapshotAt()
+	if _, err := m.Init("0x1111111111111111111111111111111111111111", "hi", "", "pw", social.Settings{Discoverable: true}); err != nil {
+		t.Fatalf("init social: %v", err)
+	}
+	if _, err := m.UpdateProfile("", "hello again", "", social.Settings{}); err != nil {
+		t.Fatalf("update profile: %v", err)
+	}
+
+	body := streamOnce(t, s, strconv.FormatUint(readyID, 10))
+	if strings.Contains(body, "event: ready") || !strings.Contains(body, "event: state_patch") {
+		t.Fatalf("resume should replay missed events without a snapshot, got: %s", body)
+	}
+	if !strings.Contains(body, "hello again") || !strings.Contains(body, "id: "+strconv.FormatUint(readyID+1, 10)+"\n") {
+		t.Fatalf("resume should start right after the last seen event, got: %s", body)
+	}
+	events, ok := m.EventsSince(readyID)
+	if !ok || len(events) == 0 {
+		t.Fatalf("events since %d: %v %d", readyID, ok, len(events))
+	}
+	if body := streamOnce(t, s, strconv.FormatUint(events[len(events)-1].ID, 10)); body != "" {
+		t.Fatalf("an up-to-date client should get nothing new, got: %s", body)
+	}
+	if body := streamOnce(t, s, "1"); !strings.Contains(body, "event: ready") {
+		t.Fatalf("an unknown event ID should fall back to a snapshot, got: %s", body)
+	}
+}
+
+func TestSSEStreamSnapshotsAfterLock(t *testing.T) {
+	t.Parallel()
+	m, err := social.NewManager(social.Config{DataDir: t.TempDir(), RPCSocketPath: "/tmp/does-not-exist.sock"})
+	if err != nil {
+		t.Fatalf("new manager: %v", err)
+	}
+	s := NewServer(m)
+	if _, err := m.Init("0x1111111111111111111111111111111111111111", "hi", "", "pw", social.Settings{Discoverable: true}); err != nil {
+		t.Fatalf("init social: %v", err)
+	}
+	_, lastID := m.SnapshotAt()
+	if err := m.Lock(); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+	if body := streamOnce(t, s, strconv.FormatUint(lastID, 10)); !strings.Contains(body, "event: ready") {
+		t.Fatalf("a client that was up to date before lock should get a new snapshot, got: %s", body)
 	}
 }
 